@@ -44,14 +44,20 @@ const (
 )
 
 func ReadZipFirmwareBundle(fname string) (*FirmwareBundle, error) {
-	var r *zip.Reader
-
 	zipData, err := ourutil.ReadOrFetchFile(fname)
 	if err != nil {
 		return nil, errors.Trace(err)
 	}
+	return readZipFirmwareBytes(fname, zipData)
+}
+
+// ReadZipFirmwareBytes parses a firmware bundle that is already in memory.
+func ReadZipFirmwareBytes(zipData []byte) (*FirmwareBundle, error) {
+	return readZipFirmwareBytes("firmware", zipData)
+}
 
-	r, err = zip.NewReader(bytes.NewReader(zipData), int64(len(zipData)))
+func readZipFirmwareBytes(fname string, zipData []byte) (*FirmwareBundle, error) {
+	r, err := zip.NewReader(bytes.NewReader(zipData), int64(len(zipData)))
 	if err != nil {
 		return nil, errors.Annotatef(err, "%s: invalid firmware file", fname)
 	}
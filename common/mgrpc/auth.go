@@ -0,0 +1,304 @@
+//
+// Copyright (c) 2014-2019 Cesanta Software Limited
+// All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package mgrpc
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	_ "crypto/sha512" // SHA-384 and SHA-512 for ES384 and ES512.
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/cesanta/errors"
+
+	"github.com/mongoose-os/mos/common/mgrpc/frame"
+)
+
+const (
+	authTypeDigest = "digest"
+
+	// Prefix of the frame key that carries HMAC signature.
+	hmacKeyPrefix = "hmac-sha256:"
+)
+
+// AuthChallenge is sent by the server as the message of a 401 response.
+type AuthChallenge struct {
+	AuthType string `json:"auth_type"`
+	Nonce    int    `json:"nonce"`
+	NC       int    `json:"nc"`
+	Realm    string `json:"realm"`
+}
+
+// Authenticator adds credentials to outgoing requests.
+type Authenticator interface {
+	// Authenticate is invoked with nil challenge before the request is sent.
+	// If the request is rejected with status 401, it is invoked again with the
+	// challenge from the response and, if it returns no error, the request is
+	// sent once more. Otherwise the call fails with the error. Authenticators
+	// that are unable to respond to the challenge should return an error that
+	// satisfies errors.IsNotSupported.
+	Authenticate(ctx context.Context, f *frame.Frame, challenge *AuthChallenge) error
+}
+
+// SecretFunc returns a secret, such as a password or a token. It is only
+// invoked when the secret is actually needed.
+type SecretFunc func() (string, error)
+
+// CredsFunc returns username and password.
+type CredsFunc func() (username, passwd string, err error)
+
+// GetCredsCallback returns digest credentials. It is what MgRPC.Call used to
+// take, it can still be passed as an authenticator that responds to digest
+// challenges.
+//
+// Deprecated: use DigestAuth.
+type GetCredsCallback func() (username, passwd string, err error)
+
+func (f GetCredsCallback) Authenticate(ctx context.Context, fr *frame.Frame, challenge *AuthChallenge) error {
+	if f == nil {
+		if challenge != nil {
+			return errors.NotSupportedf("no credentials")
+		}
+		return nil
+	}
+	return DigestAuth(CredsFunc(f)).Authenticate(ctx, fr, challenge)
+}
+
+type digestAuth struct {
+	getCreds CredsFunc
+}
+
+// DigestAuth returns an authenticator that responds to digest challenges
+// using the username and password returned by getCreds.
+func DigestAuth(getCreds CredsFunc) Authenticator {
+	return &digestAuth{getCreds: getCreds}
+}
+
+func (a *digestAuth) Authenticate(ctx context.Context, f *frame.Frame, challenge *AuthChallenge) error {
+	if challenge == nil {
+		return nil
+	}
+	if challenge.AuthType != authTypeDigest {
+		return errors.NotSupportedf("auth_type %q", challenge.AuthType)
+	}
+	username, passwd, err := a.getCreds()
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	// Generate cnonce
+	cnonceBig, err := rand.Int(rand.Reader, big.NewInt(0xffffffff))
+	if err != nil {
+		return errors.Annotatef(err, "generating cnonce")
+	}
+	cnonce := int(cnonceBig.Int64())
+
+	f.Auth = &frame.FrameAuth{
+		Realm:    challenge.Realm,
+		Nonce:    challenge.Nonce,
+		Username: username,
+		CNonce:   cnonce,
+		Response: mkMd5Resp(
+			"dummy_method", "dummy_uri", username, challenge.Realm, passwd,
+			challenge.Nonce, challenge.NC, cnonce, "auth",
+		),
+	}
+	return nil
+}
+
+func mkMd5Resp(method, uri, username, realm, passwd string, nonce, nc, cnonce int, qop string) string {
+	ha1Arr := md5.Sum([]byte(fmt.Sprintf("%s:%s:%s", username, realm, passwd)))
+	ha1 := hex.EncodeToString(ha1Arr[:])
+
+	ha2Arr := md5.Sum([]byte(fmt.Sprintf("%s:%s", method, uri)))
+	ha2 := hex.EncodeToString(ha2Arr[:])
+
+	respArr := md5.Sum([]byte(fmt.Sprintf(
+		"%s:%d:%d:%d:%s:%s",
+		ha1, nonce, nc, cnonce, "auth", ha2,
+	)))
+	resp := hex.EncodeToString(respArr[:])
+
+	return resp
+}
+
+type bearerAuth struct {
+	getToken SecretFunc
+}
+
+// BearerAuth returns an authenticator that puts a static token into the key
+// field of every request.
+func BearerAuth(getToken SecretFunc) Authenticator {
+	return &bearerAuth{getToken: getToken}
+}
+
+func (a *bearerAuth) Authenticate(ctx context.Context, f *frame.Frame, challenge *AuthChallenge) error {
+	if challenge != nil {
+		return errors.NotSupportedf("token was rejected")
+	}
+	token, err := a.getToken()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	f.Key = token
+	return nil
+}
+
+type hmacAuth struct {
+	getSecret SecretFunc
+}
+
+// HMACAuth returns an authenticator that signs requests with a shared secret,
+// see HMACSignature.
+func HMACAuth(getSecret SecretFunc) Authenticator {
+	return &hmacAuth{getSecret: getSecret}
+}
+
+// HMACSignature computes the key of a frame signed with the secret:
+// "hmac-sha256:" followed by hex-encoded HMAC-SHA256 of the source,
+// destination, ID, method, deadline and parameters of the frame, separated by
+// newlines. Servers can verify requests by comparing the key to this value.
+func HMACSignature(f *frame.Frame, secret string) string {
+	params := f.Params
+	if params == nil {
+		params = f.DeprecatedArgs
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%s\n%s\n%d\n%s\n%d\n%s", f.Src, f.Dst, f.ID, f.Method, f.Deadline, params)
+	return hmacKeyPrefix + hex.EncodeToString(mac.Sum(nil))
+}
+
+func (a *hmacAuth) Authenticate(ctx context.Context, f *frame.Frame, challenge *AuthChallenge) error {
+	if challenge != nil {
+		return errors.NotSupportedf("signature was rejected")
+	}
+	secret, err := a.getSecret()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	f.Key = HMACSignature(f, secret)
+	return nil
+}
+
+type jwtAuth struct {
+	getKey  func() (crypto.Signer, error)
+	subject string
+	ttl     time.Duration
+}
+
+// JWTAuth returns an authenticator that puts a JSON Web Token into the key
+// field of every request. Tokens are signed with the private key returned by
+// getKey, ES256, ES384 or ES512 for ECDSA keys, depending on the curve, and
+// RS256 for RSA keys. Token subject is set to subject, audience - to the
+// destination of the request, expiration time - ttl from now.
+func JWTAuth(getKey func() (crypto.Signer, error), subject string, ttl time.Duration) Authenticator {
+	return &jwtAuth{getKey: getKey, subject: subject, ttl: ttl}
+}
+
+type jwtClaims struct {
+	Subject   string `json:"sub,omitempty"`
+	Audience  string `json:"aud,omitempty"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+func (a *jwtAuth) Authenticate(ctx context.Context, f *frame.Frame, challenge *AuthChallenge) error {
+	if challenge != nil {
+		return errors.NotSupportedf("token was rejected")
+	}
+	key, err := a.getKey()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	now := time.Now()
+	token, err := signJWT(key, &jwtClaims{
+		Subject:   a.subject,
+		Audience:  f.Dst,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(a.ttl).Unix(),
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+	f.Key = token
+	return nil
+}
+
+func signJWT(key crypto.Signer, claims interface{}) (string, error) {
+	alg, hash := "", crypto.SHA256
+	switch pk := key.Public().(type) {
+	case *ecdsa.PublicKey:
+		// Each ES algorithm is defined for one curve, see RFC 7518, 3.4.
+		switch name := pk.Curve.Params().Name; name {
+		case "P-256":
+			alg = "ES256"
+		case "P-384":
+			alg, hash = "ES384", crypto.SHA384
+		case "P-521":
+			alg, hash = "ES512", crypto.SHA512
+		default:
+			return "", errors.Errorf("unsupported ECDSA curve %s, expected P-256, P-384 or P-521", name)
+		}
+	case *rsa.PublicKey:
+		alg = "RS256"
+	default:
+		return "", errors.Errorf("unsupported key type %T", key.Public())
+	}
+	hdr, _ := json.Marshal(map[string]string{"alg": alg, "typ": "JWT"})
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	enc := base64.RawURLEncoding
+	signed := enc.EncodeToString(hdr) + "." + enc.EncodeToString(payload)
+	h := hash.New()
+	h.Write([]byte(signed))
+	sig, err := key.Sign(rand.Reader, h.Sum(nil), hash)
+	if err != nil {
+		return "", errors.Annotatef(err, "failed to sign token")
+	}
+	if ek, ok := key.Public().(*ecdsa.PublicKey); ok {
+		// JWS uses fixed-size concatenation of R and S instead of ASN.1.
+		if sig, err = ecdsaASN1ToRaw(sig, (ek.Curve.Params().BitSize+7)/8); err != nil {
+			return "", errors.Trace(err)
+		}
+	}
+	return signed + "." + enc.EncodeToString(sig), nil
+}
+
+func ecdsaASN1ToRaw(sig []byte, size int) ([]byte, error) {
+	var rs struct{ R, S *big.Int }
+	if _, err := asn1.Unmarshal(sig, &rs); err != nil {
+		return nil, errors.Annotatef(err, "invalid signature")
+	}
+	raw := make([]byte, 2*size)
+	rb, sb := rs.R.Bytes(), rs.S.Bytes()
+	copy(raw[size-len(rb):size], rb)
+	copy(raw[2*size-len(sb):], sb)
+	return raw, nil
+}
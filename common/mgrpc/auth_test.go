@@ -0,0 +1,178 @@
+//
+// Copyright (c) 2014-2019 Cesanta Software Limited
+// All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package mgrpc
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cesanta/errors"
+
+	"github.com/mongoose-os/mos/common/mgrpc/frame"
+)
+
+func unauthorized(f *frame.Frame, msg string) *frame.Frame {
+	return &frame.Frame{ID: f.ID, Error: &frame.Error{Code: 401, Message: msg}}
+}
+
+func TestAuthenticators(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	s := newTestServer(ctx, t)
+	defer s.Close()
+
+	jwtKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const nonce = 123
+	s.AddHandler("Test.Digest", func(_ context.Context, _ MgRPC, f *frame.Frame) *frame.Frame {
+		if f.Auth == nil {
+			return unauthorized(f, fmt.Sprintf(`{"auth_type":"digest","nonce":%d,"nc":1,"realm":"dev"}`, nonce))
+		}
+		want := mkMd5Resp("dummy_method", "dummy_uri", "user", "dev", "pass", nonce, 1, f.Auth.CNonce, "auth")
+		if f.Auth.Username != "user" || f.Auth.Response != want {
+			return unauthorized(f, "")
+		}
+		return echoHandler(nil, nil, f)
+	})
+	s.AddHandler("Test.Bearer", func(_ context.Context, _ MgRPC, f *frame.Frame) *frame.Frame {
+		if f.Key != "token" {
+			return unauthorized(f, `{"auth_type":"digest"}`)
+		}
+		return echoHandler(nil, nil, f)
+	})
+	s.AddHandler("Test.HMAC", func(_ context.Context, _ MgRPC, f *frame.Frame) *frame.Frame {
+		if f.Key != HMACSignature(f, "secret") {
+			return unauthorized(f, "")
+		}
+		return echoHandler(nil, nil, f)
+	})
+	s.AddHandler("Test.JWT", func(_ context.Context, _ MgRPC, f *frame.Frame) *frame.Frame {
+		parts := strings.Split(f.Key, ".")
+		if len(parts) != 3 {
+			return unauthorized(f, "")
+		}
+		sig, _ := base64.RawURLEncoding.DecodeString(parts[2])
+		digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+		if len(sig) != 64 || !ecdsa.Verify(&jwtKey.PublicKey, digest[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])) {
+			return unauthorized(f, "")
+		}
+		var claims jwtClaims
+		payload, _ := base64.RawURLEncoding.DecodeString(parts[1])
+		if json.Unmarshal(payload, &claims) != nil || claims.Subject != "me" || claims.ExpiresAt <= time.Now().Unix() {
+			return unauthorized(f, "")
+		}
+		return echoHandler(nil, nil, f)
+	})
+	rpc := dial(ctx, t, s)
+	defer rpc.Disconnect(ctx)
+
+	creds := func() (string, string, error) { return "user", "pass", nil }
+	secret := func(s string) SecretFunc { return func() (string, error) { return s, nil } }
+	for _, test := range []struct {
+		method string
+		auth   Authenticator
+		status int
+	}{
+		{"Test.Digest", nil, 401},
+		{"Test.Digest", DigestAuth(creds), 0},
+		{"Test.Digest", GetCredsCallback(creds), 0},
+		{"Test.Digest", DigestAuth(func() (string, string, error) { return "user", "wrong", nil }), 401},
+		{"Test.Bearer", BearerAuth(secret("token")), 0},
+		// Bearer token cannot respond to a digest challenge, the call fails.
+		{"Test.Bearer", BearerAuth(secret("wrong")), -1},
+		{"Test.HMAC", HMACAuth(secret("secret")), 0},
+		{"Test.HMAC", HMACAuth(secret("wrong")), 401},
+		{"Test.JWT", JWTAuth(func() (crypto.Signer, error) { return jwtKey, nil }, "me", time.Minute), 0},
+	} {
+		resp, err := rpc.Call(ctx, "", &frame.Command{Cmd: test.method, Args: []byte(`{"a":1}`)}, test.auth)
+		if test.status < 0 {
+			if !errors.IsNotSupported(err) {
+				t.Errorf("%s: expected an error, got %v %v", test.method, resp, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %s", test.method, err)
+		}
+		if resp.Status != test.status {
+			t.Errorf("%s: got status %d, want %d", test.method, resp.Status, test.status)
+		}
+	}
+
+	// Errors getting the credentials are returned to the caller.
+	_, err = rpc.Call(ctx, "", &frame.Command{Cmd: "Test.HMAC"}, HMACAuth(func() (string, error) {
+		return "", errors.Errorf("no secret")
+	}))
+	if err == nil {
+		t.Errorf("expected an error")
+	}
+}
+
+func TestSignJWTCurves(t *testing.T) {
+	for _, c := range []struct {
+		curve elliptic.Curve
+		alg   string
+		hash  crypto.Hash
+	}{
+		{elliptic.P256(), "ES256", crypto.SHA256},
+		{elliptic.P384(), "ES384", crypto.SHA384},
+		{elliptic.P521(), "ES512", crypto.SHA512},
+	} {
+		key, err := ecdsa.GenerateKey(c.curve, rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		token, err := signJWT(key, &jwtClaims{Subject: "me"})
+		if err != nil {
+			t.Fatalf("%s: %s", c.alg, err)
+		}
+		parts := strings.Split(token, ".")
+		var hdr struct{ Alg string }
+		data, _ := base64.RawURLEncoding.DecodeString(parts[0])
+		if json.Unmarshal(data, &hdr) != nil || hdr.Alg != c.alg {
+			t.Errorf("%s: got header %q", c.alg, data)
+		}
+		h := c.hash.New()
+		h.Write([]byte(parts[0] + "." + parts[1]))
+		sig, _ := base64.RawURLEncoding.DecodeString(parts[2])
+		size := (c.curve.Params().BitSize + 7) / 8
+		if len(sig) != 2*size || !ecdsa.Verify(&key.PublicKey, h.Sum(nil), new(big.Int).SetBytes(sig[:size]), new(big.Int).SetBytes(sig[size:])) {
+			t.Errorf("%s: invalid signature", c.alg)
+		}
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P224(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := signJWT(key, &jwtClaims{}); err == nil {
+		t.Errorf("P-224: expected an error")
+	}
+}
@@ -0,0 +1,209 @@
+//
+// Copyright (c) 2014-2019 Cesanta Software Limited
+// All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package codec
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"hash/crc32"
+
+	"github.com/cesanta/errors"
+
+	"github.com/mongoose-os/mos/common/mgrpc/frame"
+)
+
+// Binary frames carry the "data" field of the params or result (which is
+// base64-encoded in regular frames) as raw bytes. They are used for file and
+// firmware transfers over serial, once both sides have agreed to it.
+//
+// On the wire, a binary frame is:
+//
+//	"\n" binFrameMarker escaped(payload) "\n"
+//
+// where payload is:
+//
+//	flags (1 byte): which of the fields the data belongs to (binFrame*)
+//	header length (4 bytes, big endian)
+//	header: JSON frame without the data field
+//	data
+//	CRC32 (IEEE) of all of the above (4 bytes, big endian)
+//
+// Bytes that have special meaning on the stream (frame delimiters, EOF,
+// XON/XOFF) and the escape byte itself are sent as binFrameEscape followed by
+// the byte XOR binFrameEscapeXOR.
+const (
+	binFrameMarker    byte = 0x01
+	binFrameEscape    byte = 0x7d
+	binFrameEscapeXOR byte = 0x20
+
+	binFrameParams byte = 0x01
+	binFrameResult byte = 0x02
+	binFrameArgs   byte = 0x04
+
+	// Data shorter than this is not worth the trouble.
+	minBinaryDataSize = 64
+)
+
+func binFrameNeedsEscape(b byte) bool {
+	switch b {
+	case binFrameEscape, '\n', '\r', '"', eofChar, xonChar, xoffChar:
+		return true
+	}
+	return false
+}
+
+func binFrameEscapeBytes(data []byte) []byte {
+	res := make([]byte, 0, len(data)+len(data)/16)
+	for _, b := range data {
+		if binFrameNeedsEscape(b) {
+			res = append(res, binFrameEscape, b^binFrameEscapeXOR)
+		} else {
+			res = append(res, b)
+		}
+	}
+	return res
+}
+
+func binFrameUnescapeBytes(data []byte) ([]byte, error) {
+	res := make([]byte, 0, len(data))
+	for i := 0; i < len(data); i++ {
+		b := data[i]
+		if b == binFrameEscape {
+			i++
+			if i == len(data) {
+				return nil, errors.Errorf("truncated escape sequence")
+			}
+			b = data[i] ^ binFrameEscapeXOR
+		}
+		res = append(res, b)
+	}
+	return res, nil
+}
+
+// binFrameFields returns the fields of f that may carry data, with their flags.
+func binFrameFields(f *frame.Frame) []struct {
+	flag byte
+	v    *json.RawMessage
+} {
+	return []struct {
+		flag byte
+		v    *json.RawMessage
+	}{
+		{binFrameParams, &f.Params},
+		{binFrameResult, &f.Result},
+		{binFrameArgs, &f.DeprecatedArgs},
+	}
+}
+
+// encodeBinaryFrame returns the escaped binary representation of f (without
+// the delimiters), or nil if f does not carry enough data for a binary frame
+// to make sense.
+func encodeBinaryFrame(f *frame.Frame) ([]byte, error) {
+	hf := *f
+	var flags byte
+	var data []byte
+	for _, fld := range binFrameFields(&hf) {
+		if len(*fld.v) == 0 {
+			continue
+		}
+		var obj map[string]json.RawMessage
+		if json.Unmarshal(*fld.v, &obj) != nil {
+			continue
+		}
+		var dataB64 string
+		if json.Unmarshal(obj["data"], &dataB64) != nil {
+			continue
+		}
+		d, err := base64.StdEncoding.DecodeString(dataB64)
+		if err != nil || len(d) < minBinaryDataSize {
+			continue
+		}
+		delete(obj, "data")
+		v, err := json.Marshal(obj)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		*fld.v = v
+		flags, data = fld.flag, d
+		break
+	}
+	if data == nil {
+		return nil, nil
+	}
+	hdr, err := frame.MarshalJSON(&hf)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	hdr = bytes.TrimSpace(hdr)
+	payload := make([]byte, 1+4, 1+4+len(hdr)+len(data)+4)
+	payload[0] = flags
+	binary.BigEndian.PutUint32(payload[1:5], uint32(len(hdr)))
+	payload = append(payload, hdr...)
+	payload = append(payload, data...)
+	var crc [4]byte
+	binary.BigEndian.PutUint32(crc[:], crc32.ChecksumIEEE(payload))
+	payload = append(payload, crc[:]...)
+	return append([]byte{binFrameMarker}, binFrameEscapeBytes(payload)...), nil
+}
+
+// decodeBinaryFrame parses the frame encoded by encodeBinaryFrame, data is
+// put back into the frame base64-encoded.
+func decodeBinaryFrame(frameData []byte) (*frame.Frame, error) {
+	if len(frameData) == 0 || frameData[0] != binFrameMarker {
+		return nil, errors.Errorf("not a binary frame")
+	}
+	payload, err := binFrameUnescapeBytes(bytes.TrimRight(frameData[1:], "\r"))
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if len(payload) < 1+4+4 {
+		return nil, errors.Errorf("binary frame is too short (%d)", len(payload))
+	}
+	body, crcBytes := payload[:len(payload)-4], payload[len(payload)-4:]
+	expectedCRC := binary.BigEndian.Uint32(crcBytes)
+	if crc := crc32.ChecksumIEEE(body); crc != expectedCRC {
+		return nil, errors.Errorf("CRC mismatch: expected 0x%08x, got 0x%08x", expectedCRC, crc)
+	}
+	flags, hdrLen := body[0], binary.BigEndian.Uint32(body[1:5])
+	if uint64(hdrLen) > uint64(len(body)-5) {
+		return nil, errors.Errorf("invalid header length %d", hdrLen)
+	}
+	hdr, data := body[5:5+hdrLen], body[5+hdrLen:]
+	f := &frame.Frame{SizeHint: len(payload)}
+	if err := json.Unmarshal(hdr, f); err != nil {
+		return nil, errors.Annotatef(err, "invalid binary frame header")
+	}
+	for _, fld := range binFrameFields(f) {
+		if fld.flag != flags {
+			continue
+		}
+		obj := map[string]json.RawMessage{}
+		if len(*fld.v) > 0 {
+			if err := json.Unmarshal(*fld.v, &obj); err != nil {
+				return nil, errors.Annotatef(err, "invalid binary frame header")
+			}
+		}
+		obj["data"], _ = json.Marshal(base64.StdEncoding.EncodeToString(data))
+		if *fld.v, err = json.Marshal(obj); err != nil {
+			return nil, errors.Trace(err)
+		}
+		return f, nil
+	}
+	return nil, errors.Errorf("invalid binary frame flags 0x%02x", flags)
+}
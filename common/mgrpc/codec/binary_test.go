@@ -0,0 +1,117 @@
+//
+// Copyright (c) 2014-2019 Cesanta Software Limited
+// All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package codec
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/mongoose-os/mos/common/mgrpc/frame"
+)
+
+// testData contains all the byte values, including the ones that need escaping.
+func testData() []byte {
+	data := make([]byte, 300)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	return data
+}
+
+func TestBinaryFrameEncoding(t *testing.T) {
+	data := testData()
+	params := `{"data":"` + base64.StdEncoding.EncodeToString(data) + `","filename":"a","offset":0}`
+	f := &frame.Frame{ID: 123, Method: "FS.Put", Params: json.RawMessage(params)}
+
+	enc, err := encodeBinaryFrame(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if enc == nil {
+		t.Fatalf("frame was not encoded")
+	}
+	for _, b := range enc[1:] {
+		if b != binFrameEscape && binFrameNeedsEscape(b) {
+			t.Fatalf("unescaped 0x%02x in %q", b, enc)
+		}
+	}
+	if want := len(data) + len(`{"id":123,"method":"FS.Put","params":{"filename":"a","offset":0}}`); len(enc) >= len(params) || len(enc) < want {
+		t.Errorf("unexpected encoded frame size %d", len(enc))
+	}
+
+	df, err := decodeBinaryFrame(enc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if df.ID != f.ID || df.Method != f.Method || string(df.Params) != params {
+		t.Errorf("got %+v %s, want %+v %s", df, df.Params, f, f.Params)
+	}
+
+	// Corruption is detected.
+	enc[len(enc)/2] ^= 0x40
+	if _, err := decodeBinaryFrame(enc); err == nil {
+		t.Errorf("expected an error")
+	}
+
+	// Frames without data (or with very little of it) are not worth encoding.
+	for _, params := range []string{`{"filename":"a"}`, `{"data":"YQ=="}`, `{"data":1}`, `[1,2]`} {
+		enc, err := encodeBinaryFrame(&frame.Frame{ID: 1, Method: "FS.Put", Params: json.RawMessage(params)})
+		if err != nil || enc != nil {
+			t.Errorf("%s: got %q %v, want nothing", params, enc, err)
+		}
+	}
+}
+
+func TestStreamBinaryFrames(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	p1, p2 := net.Pipe()
+	c1, c2 := SerialDevice("c1", p1), SerialDevice("c2", p2)
+	defer c1.Close()
+	defer c2.Close()
+	if err := c1.SetOptions(&Options{Serial: SerialCodecOptions{BinaryFrames: true}}); err != nil {
+		t.Fatal(err)
+	}
+
+	result := `{"data":"` + base64.StdEncoding.EncodeToString(testData()) + `","left":0}`
+	for _, f := range []*frame.Frame{
+		{ID: 1, Result: json.RawMessage(`{"data":"YQ==","left":0}`)},
+		{ID: 2, Result: json.RawMessage(result)},
+		{ID: 3, Method: "Sys.GetInfo"},
+	} {
+		// Pipe is synchronous, so send and receive at the same time.
+		errCh := make(chan error, 1)
+		go func() {
+			errCh <- c1.Send(ctx, f)
+		}()
+		rf, err := c2.Recv(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := <-errCh; err != nil {
+			t.Fatal(err)
+		}
+		if rf.ID != f.ID || rf.Method != f.Method || !bytes.Equal(rf.Result, f.Result) {
+			t.Errorf("got %+v %s, want %+v %s", rf, rf.Result, f, f.Result)
+		}
+	}
+}
@@ -64,6 +64,8 @@ type ConnectionInfo struct {
 	RemoteAddr string
 	// PeerCertificates is the certificate chain presented by the peer.
 	PeerCertificates []*x509.Certificate
+	// Path is the request path of an inbound WebSocket connection.
+	Path string
 }
 
 // IsEOF returns true when err means "end of file".
@@ -198,12 +198,10 @@ func (c *inboundHttpCodec) CloseNotify() <-chan struct{} {
 	return c.closeNotifier
 }
 
+// MaxNumFrames returns 1: whichever way the request is sent, it is the only
+// frame received and only one response can be sent back.
 func (c *inboundHttpCodec) MaxNumFrames() int {
-	if c.isSingleShot {
-		return 1
-	} else {
-		return -1
-	}
+	return 1
 }
 
 func (c *inboundHttpCodec) Info() ConnectionInfo {
@@ -197,9 +197,7 @@ func (rwc *reconnectWrapperCodec) Send(ctx context.Context, frame *frame.Frame)
 func (rwc *reconnectWrapperCodec) Close() {
 	rwc.closeOnce.Do(func() {
 		close(rwc.closeNotifier)
-		if rwc.conn != nil {
-			rwc.conn.Close()
-		}
+		rwc.closeConn()
 	})
 }
 
@@ -0,0 +1,288 @@
+//
+// Copyright (c) 2014-2019 Cesanta Software Limited
+// All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package codec
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/cesanta/errors"
+	"github.com/golang/glog"
+
+	"github.com/mongoose-os/mos/common/mgrpc/frame"
+)
+
+const (
+	ReplayURLScheme = "replay"
+
+	// Directions of the recorded frames.
+	RecordDirSent     = "tx"
+	RecordDirReceived = "rx"
+
+	// Status code of the error sent by replay codec when there is no matching request in the recording.
+	replayNotFoundStatus = 404
+)
+
+// RecordedFrame is a line of the recording file.
+type RecordedFrame struct {
+	Time      time.Time    `json:"t"`
+	Direction string       `json:"dir"`
+	Frame     *frame.Frame `json:"frame"`
+}
+
+type recordingCodec struct {
+	conn Codec
+
+	lock sync.Mutex
+	w    io.Writer
+	enc  *json.Encoder
+}
+
+// NewRecordingCodec returns a codec that passes frames to and from conn and
+// writes them to w as JSON lines (see RecordedFrame).
+// If w is an io.Closer, it is closed together with the codec.
+func NewRecordingCodec(conn Codec, w io.Writer) Codec {
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	return &recordingCodec{conn: conn, w: w, enc: enc}
+}
+
+func (rc *recordingCodec) String() string {
+	return fmt.Sprintf("[recordingCodec %v]", rc.conn)
+}
+
+func (rc *recordingCodec) record(dir string, f *frame.Frame) {
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+	if err := rc.enc.Encode(&RecordedFrame{Time: time.Now(), Direction: dir, Frame: f}); err != nil {
+		glog.Errorf("failed to record frame: %s", err)
+	}
+}
+
+func (rc *recordingCodec) Recv(ctx context.Context) (*frame.Frame, error) {
+	f, err := rc.conn.Recv(ctx)
+	if err == nil {
+		rc.record(RecordDirReceived, f)
+	}
+	return f, err
+}
+
+func (rc *recordingCodec) Send(ctx context.Context, f *frame.Frame) error {
+	rc.record(RecordDirSent, f)
+	return rc.conn.Send(ctx, f)
+}
+
+func (rc *recordingCodec) Close() {
+	rc.conn.Close()
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+	if c, ok := rc.w.(io.Closer); ok {
+		c.Close()
+	}
+}
+
+func (rc *recordingCodec) CloseNotify() <-chan struct{} {
+	return rc.conn.CloseNotify()
+}
+
+func (rc *recordingCodec) MaxNumFrames() int {
+	return rc.conn.MaxNumFrames()
+}
+
+func (rc *recordingCodec) Info() ConnectionInfo {
+	return rc.conn.Info()
+}
+
+func (rc *recordingCodec) SetOptions(opts *Options) error {
+	return rc.conn.SetOptions(opts)
+}
+
+// replayEntry is a recorded request and the response to it.
+type replayEntry struct {
+	req  *frame.Frame
+	resp *frame.Frame
+	used bool
+}
+
+type replayCodec struct {
+	fileName string
+
+	lock    sync.Mutex
+	entries []*replayEntry
+
+	rxChan        chan *frame.Frame
+	closeNotifier chan struct{}
+	closeOnce     sync.Once
+}
+
+// NewReplayCodec creates a codec that responds to requests with responses
+// from a recording made by the recording codec.
+// Requests are matched by method and parameters, in the order they were
+// recorded. When all the matching requests have been used, the last one is
+// reused. Frame IDs of the responses are rewritten to match the requests.
+func NewReplayCodec(fileName string) (Codec, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer f.Close()
+	rc := &replayCodec{
+		fileName:      fileName,
+		rxChan:        make(chan *frame.Frame, 100),
+		closeNotifier: make(chan struct{}),
+	}
+	reqs := map[int64]*replayEntry{}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 16*1024*1024)
+	for ln := 1; scanner.Scan(); ln++ {
+		var rf RecordedFrame
+		if err := json.Unmarshal(scanner.Bytes(), &rf); err != nil {
+			return nil, errors.Annotatef(err, "%s:%d: invalid record", fileName, ln)
+		}
+		if rf.Frame == nil {
+			continue
+		}
+		switch {
+		case rf.Direction == RecordDirSent && rf.Frame.IsRequest():
+			e := &replayEntry{req: rf.Frame}
+			rc.entries = append(rc.entries, e)
+			reqs[rf.Frame.ID] = e
+		case rf.Direction == RecordDirReceived && !rf.Frame.IsRequest():
+			if e := reqs[rf.Frame.ID]; e != nil && e.resp == nil {
+				e.resp = rf.Frame
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Annotatef(err, "%s: failed to read recording", fileName)
+	}
+	glog.V(1).Infof("%s: %d requests loaded", fileName, len(rc.entries))
+	return rc, nil
+}
+
+func (rc *replayCodec) String() string {
+	return fmt.Sprintf("[replayCodec from %s]", rc.fileName)
+}
+
+// sameParams returns true if the two frames carry semantically equal parameters.
+func sameParams(f1, f2 *frame.Frame) bool {
+	p1, p2 := f1.Params, f2.Params
+	if p1 == nil {
+		p1 = f1.DeprecatedArgs
+	}
+	if p2 == nil {
+		p2 = f2.DeprecatedArgs
+	}
+	if len(p1) == 0 || len(p2) == 0 {
+		return len(p1) == len(p2)
+	}
+	var v1, v2 interface{}
+	if json.Unmarshal(p1, &v1) != nil || json.Unmarshal(p2, &v2) != nil {
+		return false
+	}
+	return reflect.DeepEqual(v1, v2)
+}
+
+func (rc *replayCodec) findResponse(f *frame.Frame) *frame.Frame {
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+	var last *replayEntry
+	for _, e := range rc.entries {
+		if e.resp == nil || e.req.Method != f.Method || !sameParams(e.req, f) {
+			continue
+		}
+		if !e.used {
+			e.used = true
+			return e.resp
+		}
+		last = e
+	}
+	if last != nil {
+		return last.resp
+	}
+	return nil
+}
+
+func (rc *replayCodec) Recv(ctx context.Context) (*frame.Frame, error) {
+	select {
+	case f := <-rc.rxChan:
+		return f, nil
+	case <-rc.closeNotifier:
+		return nil, errors.Trace(io.EOF)
+	case <-ctx.Done():
+		return nil, errors.Trace(ctx.Err())
+	}
+}
+
+func (rc *replayCodec) Send(ctx context.Context, f *frame.Frame) error {
+	if !f.IsRequest() {
+		// Responses to requests from the "device" are not interesting.
+		return nil
+	}
+	var resp frame.Frame
+	if rf := rc.findResponse(f); rf != nil {
+		resp = *rf
+	} else {
+		glog.Errorf("%s: no recorded response to %s %s", rc.fileName, f.Method, f.Params)
+		resp.Error = &frame.Error{
+			Code:    replayNotFoundStatus,
+			Message: fmt.Sprintf("no recorded response to %s", f.Method),
+		}
+	}
+	if f.NoResponse {
+		return nil
+	}
+	resp.ID = f.ID
+	resp.Src, resp.Dst = f.Dst, f.Src
+	select {
+	case rc.rxChan <- &resp:
+		return nil
+	case <-rc.closeNotifier:
+		return errors.Trace(io.EOF)
+	case <-ctx.Done():
+		return errors.Trace(ctx.Err())
+	}
+}
+
+func (rc *replayCodec) Close() {
+	rc.closeOnce.Do(func() {
+		close(rc.closeNotifier)
+	})
+}
+
+func (rc *replayCodec) CloseNotify() <-chan struct{} {
+	return rc.closeNotifier
+}
+
+func (rc *replayCodec) MaxNumFrames() int {
+	return -1
+}
+
+func (rc *replayCodec) Info() ConnectionInfo {
+	return ConnectionInfo{IsConnected: true, RemoteAddr: rc.fileName}
+}
+
+func (rc *replayCodec) SetOptions(opts *Options) error {
+	return nil
+}
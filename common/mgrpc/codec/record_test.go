@@ -0,0 +1,133 @@
+//
+// Copyright (c) 2014-2019 Cesanta Software Limited
+// All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package codec
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mongoose-os/mos/common/mgrpc/frame"
+)
+
+const testRecording = `{"t":"2019-01-01T00:00:00Z","dir":"tx","frame":{"src":"mos","id":1,"method":"Sys.GetInfo"}}
+{"t":"2019-01-01T00:00:01Z","dir":"rx","frame":{"dst":"mos","id":1,"result":{"app":"demo"}}}
+{"t":"2019-01-01T00:00:02Z","dir":"tx","frame":{"src":"mos","id":2,"method":"FS.Get","params":{"filename":"a","offset":0}}}
+{"t":"2019-01-01T00:00:03Z","dir":"tx","frame":{"src":"mos","id":3,"method":"FS.Get","params":{"offset":0,"filename":"b"}}}
+{"t":"2019-01-01T00:00:04Z","dir":"rx","frame":{"dst":"mos","id":3,"result":{"data":"Yg=="}}}
+{"t":"2019-01-01T00:00:05Z","dir":"rx","frame":{"dst":"mos","id":2,"result":{"data":"YQ=="}}}
+`
+
+func newTestReplayCodec(t *testing.T, dir string) Codec {
+	fn := filepath.Join(dir, "rec.jsonl")
+	if err := ioutil.WriteFile(fn, []byte(testRecording), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c, err := NewReplayCodec(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func call(t *testing.T, c Codec, id int64, method, params string) *frame.Frame {
+	ctx := context.Background()
+	f := &frame.Frame{Src: "mos", ID: id, Method: method}
+	if params != "" {
+		f.Params = json.RawMessage(params)
+	}
+	if err := c.Send(ctx, f); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := c.Recv(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.ID != id {
+		t.Errorf("%s: got id %d, want %d", method, resp.ID, id)
+	}
+	return resp
+}
+
+func TestReplayCodec(t *testing.T) {
+	dir, err := ioutil.TempDir("", "replay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	c := newTestReplayCodec(t, dir)
+	defer c.Close()
+
+	for _, test := range []struct {
+		method, params, result string
+		errCode                int
+	}{
+		{method: "FS.Get", params: `{"filename":"b","offset":0}`, result: `{"data":"Yg=="}`},
+		{method: "Sys.GetInfo", result: `{"app":"demo"}`},
+		// Recorded requests are reused once exhausted.
+		{method: "Sys.GetInfo", result: `{"app":"demo"}`},
+		{method: "FS.Get", params: `{"filename":"a","offset":0}`, result: `{"data":"YQ=="}`},
+		{method: "FS.Get", params: `{"filename":"c","offset":0}`, errCode: replayNotFoundStatus},
+		{method: "Sys.Reboot", errCode: replayNotFoundStatus},
+	} {
+		resp := call(t, c, 100, test.method, test.params)
+		if test.errCode != 0 {
+			if resp.Error == nil || resp.Error.Code != test.errCode {
+				t.Errorf("%s %s: got %+v, want error %d", test.method, test.params, resp, test.errCode)
+			}
+			continue
+		}
+		if got := string(resp.Result); resp.Error != nil || got != test.result {
+			t.Errorf("%s %s: got %q %+v, want %q", test.method, test.params, got, resp.Error, test.result)
+		}
+	}
+}
+
+func TestRecordingCodec(t *testing.T) {
+	dir, err := ioutil.TempDir("", "replay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	buf := bytes.NewBuffer(nil)
+	c := NewRecordingCodec(newTestReplayCodec(t, dir), buf)
+	defer c.Close()
+
+	call(t, c, 123, "Sys.GetInfo", "")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 records, got %q", lines)
+	}
+	for i, want := range []struct {
+		dir    string
+		method string
+	}{{RecordDirSent, "Sys.GetInfo"}, {RecordDirReceived, ""}} {
+		var rf RecordedFrame
+		if err := json.Unmarshal([]byte(lines[i]), &rf); err != nil {
+			t.Fatal(err)
+		}
+		if rf.Direction != want.dir || rf.Frame.ID != 123 || rf.Frame.Method != want.method || rf.Time.IsZero() {
+			t.Errorf("record %d: got %+v %+v", i, rf, rf.Frame)
+		}
+	}
+}
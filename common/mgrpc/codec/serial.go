@@ -53,6 +53,9 @@ type SerialCodecOptions struct {
 	JunkHandler          func(junk []byte)
 	SetControlLines      bool
 	InvertedControlLines bool
+	// Send data of FS and OTA transfers in binary frames instead of base64.
+	// Should only be enabled once the other side has agreed to it.
+	BinaryFrames bool
 }
 
 type serialCodec struct {
@@ -0,0 +1,73 @@
+//
+// Copyright (c) 2014-2019 Cesanta Software Limited
+// All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package codec
+
+import (
+	"context"
+	"io"
+	"sync"
+)
+
+type serialDeviceCodec struct {
+	rwc  io.ReadWriteCloser
+	name string
+
+	writeLock sync.Mutex
+}
+
+// SerialDevice creates a codec that plays the device side of a serial
+// connection over rwc: it answers to the handshake sent by the Serial codec
+// and appends checksums to the frames it sends.
+func SerialDevice(name string, rwc io.ReadWriteCloser) Codec {
+	return newStreamConn(&serialDeviceCodec{
+		rwc:  rwc,
+		name: name,
+	}, true /* addChecksum */, nil)
+}
+
+func (c *serialDeviceCodec) Read(b []byte) (n int, err error) {
+	return c.rwc.Read(b)
+}
+
+func (c *serialDeviceCodec) WriteWithContext(ctx context.Context, b []byte) (n int, err error) {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	return c.rwc.Write(b)
+}
+
+func (c *serialDeviceCodec) Close() error {
+	return c.rwc.Close()
+}
+
+func (c *serialDeviceCodec) RemoteAddr() string {
+	return c.name
+}
+
+func (c *serialDeviceCodec) PreprocessFrame(frameData []byte) (bool, error) {
+	if len(frameData) == 1 && frameData[0] == eofChar {
+		// Handshake: respond with a frame consisting of just EOF char.
+		// The other side is ready to receive frames once it sees it.
+		hs := []byte(streamFrameDelimiter1 + string(eofChar) + streamFrameDelimiter1)
+		_, err := c.WriteWithContext(context.TODO(), hs)
+		return true, err
+	}
+	return false, nil
+}
+
+func (c *serialDeviceCodec) SetOptions(opts *Options) error {
+	return nil
+}
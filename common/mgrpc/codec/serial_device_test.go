@@ -0,0 +1,73 @@
+//
+// Copyright (c) 2014-2019 Cesanta Software Limited
+// All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package codec
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/mongoose-os/mos/common/mgrpc/frame"
+)
+
+func TestSerialDevice(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	host, devConn := net.Pipe()
+	defer host.Close()
+	c := SerialDevice("pipe", devConn)
+	defer c.Close()
+
+	recvChan := make(chan *frame.Frame, 1)
+	go func() {
+		f, err := c.Recv(ctx)
+		if err != nil {
+			t.Error(err)
+		}
+		recvChan <- f
+	}()
+
+	hs := []byte(streamFrameDelimiter1 + string(eofChar) + streamFrameDelimiter1)
+	go host.Write(append(hs, []byte("\n\n")...))
+	buf := make([]byte, len(hs))
+	if _, err := io.ReadFull(host, buf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, hs) {
+		t.Errorf("handshake response: got %q, want %q", buf, hs)
+	}
+
+	if _, err := host.Write([]byte("\n\"\"\"{\"id\":1,\"method\":\"Sys.GetInfo\"}\"\"\"\n")); err != nil {
+		t.Fatal(err)
+	}
+	if f := <-recvChan; f == nil || f.ID != 1 || f.Method != "Sys.GetInfo" {
+		t.Fatalf("got %+v", f)
+	}
+
+	go c.Send(ctx, &frame.Frame{ID: 1, Result: []byte(`{}`)})
+	want := "\n\"\"\"{\"id\":1,\"result\":{}}"
+	buf = make([]byte, len(want)+8+4)
+	if _, err := io.ReadFull(host, buf); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(buf[:len(want)]); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
@@ -19,6 +19,7 @@ package codec
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"hash/crc32"
@@ -58,6 +59,12 @@ type streamConn interface {
 	SetOptions(opts *Options) error
 }
 
+// Stream connections that may be secured with TLS implement this interface.
+type tlsStreamConn interface {
+	// TLSConnectionState returns TLS state of the connection or nil if TLS is not used.
+	TLSConnectionState() *tls.ConnectionState
+}
+
 type streamConnectionCodec struct {
 	// Stream connection implementation (see tcp.go and serial.go).
 	conn streamConn
@@ -79,6 +86,11 @@ type streamConnectionCodec struct {
 	// Whether to add a CRC32 checksum after each frame.
 	addChecksum bool
 
+	// Whether to send frames that carry data as binary frames (see binary.go).
+	// Binary frames are always accepted.
+	binaryFrames     bool
+	binaryFramesLock sync.Mutex
+
 	junkHandler func(junk []byte)
 }
 
@@ -126,7 +138,8 @@ func (scc *streamConnectionCodec) frameFromRxBuf() (*frame.Frame, error) {
 	if frameBegin >= 0 {
 		junkLen = frameBegin
 		frameBeginLen := 0
-		// It's a beginning of a frame if it is followed by an opening brace.
+		// It's a beginning of a frame if it is followed by an opening brace
+		// (or a binary frame marker).
 		if frameBegin == frameBegin1 {
 			frameBeginLen = len(streamFrameDelimiter1)
 		} else {
@@ -134,7 +147,7 @@ func (scc *streamConnectionCodec) frameFromRxBuf() (*frame.Frame, error) {
 		}
 		frameDataBegin = frameBeginLen
 		if frameDataBegin < len(remainder) {
-			if remainder[frameDataBegin] != '{' && remainder[frameDataBegin] != eofChar {
+			if c := remainder[frameDataBegin]; c != '{' && c != eofChar && c != binFrameMarker {
 				// It's some random junk or maybe we lost sync, skip the thing.
 				junkLen += frameBeginLen
 				frameBegin = -1
@@ -199,7 +212,13 @@ func (scc *streamConnectionCodec) frameFromRxBuf() (*frame.Frame, error) {
 		copy(scc.rxBuf, remainder)
 	}
 
-	if len(frameData) > 0 {
+	if len(frameData) > 0 && frameData[0] == binFrameMarker {
+		frame, err := decodeBinaryFrame(frameData)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		return frame, nil
+	} else if len(frameData) > 0 {
 		// Check if the frame needs special treatment
 		handled, err := scc.conn.PreprocessFrame(frameData)
 		if err != nil {
@@ -311,21 +330,28 @@ func (scc *streamConnectionCodec) Recv(ctx context.Context) (*frame.Frame, error
 }
 
 func (scc *streamConnectionCodec) Send(ctx context.Context, f *frame.Frame) error {
-	frameData := []byte(streamFrameDelimiter2)
-	frameData = append(frameData, []byte(streamFrameDelimiter1)...)
-	framePayload, err := frame.MarshalJSON(f)
-	if err != nil {
-		return errors.Trace(err)
+	scc.binaryFramesLock.Lock()
+	binaryFrames := scc.binaryFrames
+	scc.binaryFramesLock.Unlock()
+	var frameData []byte
+	if binaryFrames {
+		binFrame, err := encodeBinaryFrame(f)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if binFrame != nil {
+			frameData = []byte(streamFrameDelimiter2)
+			frameData = append(frameData, binFrame...)
+			frameData = append(frameData, []byte(streamFrameDelimiter2)...)
+		}
 	}
-	framePayload = trimWhitespace(framePayload)
-	frameData = append(frameData, framePayload...)
-	if scc.addChecksum {
-		crcHex := fmt.Sprintf("%08x", crc32.ChecksumIEEE(framePayload))
-		frameData = append(frameData, []byte(crcHex)...)
+	if frameData == nil {
+		var err error
+		if frameData, err = textFrame(f, scc.addChecksum); err != nil {
+			return errors.Trace(err)
+		}
 	}
-	frameData = append(frameData, []byte(streamFrameDelimiter1)...)
-	frameData = append(frameData, []byte(streamFrameDelimiter2)...)
-	_, err = scc.conn.WriteWithContext(ctx, frameData)
+	_, err := scc.conn.WriteWithContext(ctx, frameData)
 	if err != nil {
 		scc.Close()
 		return errors.Trace(err)
@@ -339,6 +365,25 @@ func (scc *streamConnectionCodec) Send(ctx context.Context, f *frame.Frame) erro
 	return nil
 }
 
+// textFrame returns the regular, JSON representation of f with delimiters.
+func textFrame(f *frame.Frame, addChecksum bool) ([]byte, error) {
+	frameData := []byte(streamFrameDelimiter2)
+	frameData = append(frameData, []byte(streamFrameDelimiter1)...)
+	framePayload, err := frame.MarshalJSON(f)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	framePayload = trimWhitespace(framePayload)
+	frameData = append(frameData, framePayload...)
+	if addChecksum {
+		crcHex := fmt.Sprintf("%08x", crc32.ChecksumIEEE(framePayload))
+		frameData = append(frameData, []byte(crcHex)...)
+	}
+	frameData = append(frameData, []byte(streamFrameDelimiter1)...)
+	frameData = append(frameData, []byte(streamFrameDelimiter2)...)
+	return frameData, nil
+}
+
 func (scc *streamConnectionCodec) Close() {
 	scc.closeOnce.Do(func() {
 		scc.conn.Close()
@@ -355,9 +400,22 @@ func (scc *streamConnectionCodec) MaxNumFrames() int {
 }
 
 func (scc *streamConnectionCodec) Info() ConnectionInfo {
-	return ConnectionInfo{RemoteAddr: scc.conn.RemoteAddr(), IsConnected: true}
+	ci := ConnectionInfo{RemoteAddr: scc.conn.RemoteAddr(), IsConnected: true}
+	if tc, ok := scc.conn.(tlsStreamConn); ok {
+		if cs := tc.TLSConnectionState(); cs != nil {
+			ci.TLS = true
+			ci.PeerCertificates = cs.PeerCertificates
+		}
+	}
+	return ci
 }
 
 func (scc *streamConnectionCodec) SetOptions(opts *Options) error {
-	return scc.conn.SetOptions(opts)
+	if err := scc.conn.SetOptions(opts); err != nil {
+		return err
+	}
+	scc.binaryFramesLock.Lock()
+	scc.binaryFrames = opts.Serial.BinaryFrames
+	scc.binaryFramesLock.Unlock()
+	return nil
 }
@@ -18,6 +18,7 @@ package codec
 
 import (
 	"context"
+	"crypto/tls"
 	"net"
 
 	"github.com/cesanta/errors"
@@ -50,6 +51,15 @@ func (c *tcpCodec) RemoteAddr() string {
 	return c.conn.RemoteAddr().String()
 }
 
+func (c *tcpCodec) TLSConnectionState() *tls.ConnectionState {
+	tc, ok := c.conn.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+	cs := tc.ConnectionState()
+	return &cs
+}
+
 func (c *tcpCodec) PreprocessFrame(frameData []byte) (bool, error) {
 	return false, nil
 }
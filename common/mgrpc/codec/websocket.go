@@ -119,6 +119,7 @@ func (c *wsCodec) Info() ConnectionInfo {
 			IsConnected: true,
 			TLS:         req.TLS != nil,
 			RemoteAddr:  req.RemoteAddr,
+			Path:        req.URL.Path,
 		}
 		if r.TLS {
 			r.PeerCertificates = c.conn.Request().TLS.PeerCertificates
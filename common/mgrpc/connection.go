@@ -39,9 +39,11 @@ type connectOptions struct {
 	tlsConfig        *tls.Config
 	psk              string
 	enableTracing    bool
+	spanExporter     SpanExporter
 	enableReconnect  bool
 	enableCompatArgs bool
 	codecOptions     codec.Options
+	recordFile       string
 }
 
 // ConnectOption is an optional argument to Instance.Connect which affects the
@@ -109,8 +111,9 @@ func connectTo(connectURL string) ConnectOption {
 		url.Fragment = ""
 		t, a = tWebSocket, url.String()
 		tls = url.Scheme == "wss"
-	case url.Scheme == "tcp":
+	case url.Scheme == "tcp" || url.Scheme == "tcps":
 		t, a = tPlainTCP, url.Host
+		tls = url.Scheme == "tcps"
 	case url.Scheme == "serial":
 		// it might look like "serial:///dev/ttyUSB0" or "serial://COM7", so the
 		// actual payload will be either in url.Host or url.Path.
@@ -123,6 +126,9 @@ func connectTo(connectURL string) ConnectOption {
 		t, a = tWatson, url.String()
 	case url.Scheme == codec.UDPURLScheme:
 		t, a = tUDP, url.Host
+	case url.Scheme == codec.ReplayURLScheme:
+		// "replay:///path/to/file.jsonl" or "replay://file.jsonl"
+		t, a = tReplay, url.Host+url.Path
 	default:
 		return badConnectOption(errors.Errorf("invalid ConnectTo protocol %q", url.Scheme))
 	}
@@ -208,6 +214,16 @@ func Tracing(enable bool) ConnectOption {
 	}
 }
 
+// ExportSpans enables tracing and makes spans of the calls made over
+// the connection and of the requests handled to be sent to e.
+func ExportSpans(e SpanExporter) ConnectOption {
+	return func(c *connectOptions) error {
+		c.enableTracing = true
+		c.spanExporter = e
+		return nil
+	}
+}
+
 func CodecOptions(co codec.Options) ConnectOption {
 	return func(c *connectOptions) error {
 		c.codecOptions = co
@@ -222,6 +238,17 @@ func Reconnect(enable bool) ConnectOption {
 	}
 }
 
+// RecordTo makes the connection record all the frames sent and received to
+// the specified file, which can later be used with the replay:// transport.
+// Frames are appended to the file if it already exists.
+// If file name is empty, this option does nothing.
+func RecordTo(fileName string) ConnectOption {
+	return func(c *connectOptions) error {
+		c.recordFile = fileName
+		return nil
+	}
+}
+
 func CompatArgs(enable bool) ConnectOption {
 	return func(c *connectOptions) error {
 		c.enableCompatArgs = enable
@@ -229,6 +256,27 @@ func CompatArgs(enable bool) ConnectOption {
 	}
 }
 
+// clientTLSConfig returns TLS configuration for connecting to serverName,
+// based on TlsConfig and supplemented with ClientCert and VerifyServerWith settings.
+func (c *connectOptions) clientTLSConfig(serverName string) *tls.Config {
+	var tlsConfig *tls.Config
+	if c.tlsConfig != nil {
+		tlsConfig = c.tlsConfig.Clone()
+	} else {
+		tlsConfig = &tls.Config{}
+	}
+	if c.cert != nil {
+		tlsConfig.Certificates = append(tlsConfig.Certificates, *c.cert)
+	}
+	if c.caPool != nil {
+		tlsConfig.RootCAs = c.caPool
+	}
+	if tlsConfig.ServerName == "" {
+		tlsConfig.ServerName = serverName
+	}
+	return tlsConfig
+}
+
 func badConnectOption(err error) ConnectOption {
 	return func(_ *connectOptions) error {
 		return err
@@ -253,6 +301,11 @@ type ListenerConfig struct {
 	HTTP *HTTPListenerConfig `yaml:"http,omitempty"`
 
 	EnableTracing bool `yaml:"enable_tracing"`
+	// If set, spans of the requests handled are exported to it.
+	SpanExporter SpanExporter `yaml:"-"`
+	// If set, accepted connections are passed to it instead of being served
+	// with the handlers. Connection is closed when it returns.
+	CodecHandler func(c codec.Codec) `yaml:"-"`
 }
 
 // TLSConfig configures the TLS listener wrapper.
@@ -274,7 +327,8 @@ type HTTPListenerConfig struct {
 	// Accept RPC frames in POST requests.
 	EnablePOST bool `yaml:"enable_post,omitempty"`
 	// Allow upgrading to a WebSocket connection.
-	// Note: Currently both POST and WebSocket cannot be used on the same listener.
+	// If both POST and WebSocket are enabled, requests carrying the "Upgrade: websocket"
+	// header are handled as WebSocket connections and the rest are POSTs.
 	EnableWebSocket bool `yaml:"enable_websocket,omitempty"`
 	// Cloud host base. If set, then for REST-like requests destination can be
 	// specified in the Host header, and will be derived by stripping this suffix.
@@ -370,3 +424,20 @@ func ListenerTracing(enable bool) ListenOption {
 		c.EnableTracing = enable
 	}
 }
+
+// ExportListenerSpans enables tracing and makes spans of the requests
+// handled by the listener to be sent to e.
+func ExportListenerSpans(e SpanExporter) ListenOption {
+	return func(c *ListenerConfig) {
+		c.EnableTracing = true
+		c.SpanExporter = e
+	}
+}
+
+// HandleCodecs makes the listener pass accepted connections to h instead of
+// processing requests that arrive on them, e.g. to forward frames elsewhere.
+func HandleCodecs(h func(c codec.Codec)) ListenOption {
+	return func(c *ListenerConfig) {
+		c.CodecHandler = h
+	}
+}
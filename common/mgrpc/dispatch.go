@@ -0,0 +1,213 @@
+//
+// Copyright (c) 2014-2019 Cesanta Software Limited
+// All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package mgrpc
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/mongoose-os/mos/common/mgrpc/codec"
+	"github.com/mongoose-os/mos/common/mgrpc/frame"
+)
+
+const (
+	// Status code of the response sent when request deadline expires before
+	// handler produces a response.
+	statusTimeout = 408
+
+	defaultMaxConcurrency = 1
+)
+
+// Middleware wraps a handler, e.g. to add logging, authentication or metrics.
+// Middleware is applied to all the handlers, including the one that responds
+// to requests for unknown methods.
+type Middleware func(next Handler) Handler
+
+// HandlerOption is an optional argument to AddHandler.
+type HandlerOption func(*handlerOptions)
+
+type handlerOptions struct {
+	maxConcurrency int
+}
+
+// MaxConcurrency limits the number of requests to the method being processed
+// at the same time. Requests in excess of the limit are queued and processed
+// in order of arrival. Values <= 0 mean no limit.
+// By default requests to the same method are processed one at a time.
+func MaxConcurrency(n int) HandlerOption {
+	return func(o *handlerOptions) {
+		o.maxConcurrency = n
+	}
+}
+
+// handlerSpec is a handler together with its options.
+type handlerSpec struct {
+	handler Handler
+	opts    handlerOptions
+}
+
+func newHandlerSpec(handler Handler, opts []HandlerOption) handlerSpec {
+	hs := handlerSpec{
+		handler: handler,
+		opts:    handlerOptions{maxConcurrency: defaultMaxConcurrency},
+	}
+	for _, opt := range opts {
+		opt(&hs.opts)
+	}
+	return hs
+}
+
+// pendingRequest is a request waiting to be handled.
+type pendingRequest struct {
+	ctx     context.Context
+	cancel  context.CancelFunc
+	f       *frame.Frame
+	handler Handler
+	span    *Span
+}
+
+// methodDispatcher runs the handler of a single method, maintaining the
+// concurrency limit and the order of requests.
+type methodDispatcher struct {
+	handlerSpec
+
+	lock    sync.Mutex
+	running int
+	queue   []*pendingRequest
+}
+
+// requestContext returns a context that expires when the request is no longer relevant,
+// according to its deadline and timeout.
+func requestContext(ctx context.Context, f *frame.Frame) (context.Context, context.CancelFunc) {
+	var deadline time.Time
+	if f.Deadline > 0 {
+		deadline = time.Unix(f.Deadline, 0)
+	}
+	if f.Timeout > 0 {
+		td := time.Now().Add(time.Duration(f.Timeout) * time.Second)
+		if deadline.IsZero() || td.Before(deadline) {
+			deadline = td
+		}
+	}
+	if deadline.IsZero() {
+		return context.WithCancel(ctx)
+	}
+	return context.WithDeadline(ctx, deadline)
+}
+
+func applyMiddleware(handler Handler, middleware []Middleware) Handler {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		handler = middleware[i](handler)
+	}
+	return handler
+}
+
+// dispatch schedules f to be processed by the handler of the method, the
+// response is sent over c.
+func (r *mgRPCImpl) dispatch(ctx context.Context, c codec.Codec, f *frame.Frame) {
+	r.handlersLock.Lock()
+	md := r.handlers[f.Method]
+	middleware := r.middleware
+	r.handlersLock.Unlock()
+
+	pr := &pendingRequest{f: f}
+	pr.ctx, pr.cancel = requestContext(ctx, f)
+	if r.opts.enableTracing {
+		pr.span = newSpan(SpanKindServer, f.Trace, f)
+		if r.opts.spanExporter != nil {
+			pr.span.RequestSize = frameSize(f)
+		}
+		pr.ctx = ContextWithSpan(pr.ctx, pr.span.trace())
+	}
+	r.inflight.Add(1)
+
+	if md == nil {
+		pr.handler = applyMiddleware(sendErrorResponse, middleware)
+		go func() {
+			r.handleRequest(ctx, c, pr)
+			r.inflight.Done()
+		}()
+		return
+	}
+
+	pr.handler = applyMiddleware(md.handler, middleware)
+	md.lock.Lock()
+	md.queue = append(md.queue, pr)
+	startWorker := (md.opts.maxConcurrency <= 0 || md.running < md.opts.maxConcurrency)
+	if startWorker {
+		md.running++
+	}
+	md.lock.Unlock()
+	if startWorker {
+		go r.runQueue(ctx, c, md)
+	}
+}
+
+// runQueue processes queued requests until the queue is empty.
+func (r *mgRPCImpl) runQueue(ctx context.Context, c codec.Codec, md *methodDispatcher) {
+	for {
+		md.lock.Lock()
+		if len(md.queue) == 0 {
+			md.running--
+			md.lock.Unlock()
+			return
+		}
+		pr := md.queue[0]
+		md.queue = md.queue[1:]
+		md.lock.Unlock()
+		r.handleRequest(ctx, c, pr)
+		r.inflight.Done()
+	}
+}
+
+// handleRequest invokes the handler and sends the response. If the request
+// expires before the handler returns, a timeout error is sent instead and the
+// eventual response is discarded.
+func (r *mgRPCImpl) handleRequest(ctx context.Context, c codec.Codec, pr *pendingRequest) {
+	defer pr.cancel()
+	f := pr.f
+	var resp *frame.Frame
+	if pr.ctx.Err() == nil {
+		respChan := make(chan *frame.Frame, 1)
+		go func() {
+			respChan <- pr.handler(pr.ctx, r, f)
+		}()
+		select {
+		case resp = <-respChan:
+		case <-pr.ctx.Done():
+			// Wait for the handler to return before taking on the next request.
+			defer func() { <-respChan }()
+		}
+	}
+	if resp == nil && pr.ctx.Err() == context.DeadlineExceeded {
+		glog.V(1).Infof("request %d (%s) has expired", f.ID, f.Method)
+		resp = &frame.Frame{
+			ID:    f.ID,
+			Error: &frame.Error{Code: statusTimeout, Message: fmt.Sprintf("Method [%s] timed out", f.Method)},
+		}
+	}
+	r.finishSpan(pr.span, resp, pr.ctx.Err())
+	if f.NoResponse || resp == nil {
+		return
+	}
+	if err := c.Send(ctx, resp); err != nil {
+		glog.Errorf("failed to send response to %d (%s): %s", f.ID, f.Method, err)
+	}
+}
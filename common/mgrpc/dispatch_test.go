@@ -0,0 +1,243 @@
+//
+// Copyright (c) 2014-2019 Cesanta Software Limited
+// All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package mgrpc
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mongoose-os/mos/common/mgrpc/codec"
+	"github.com/mongoose-os/mos/common/mgrpc/frame"
+)
+
+// newTestServer starts a TCP server. Handlers must be added to it before
+// clients connect, see dial.
+func newTestServer(ctx context.Context, t *testing.T) Server {
+	lc, err := ListenerConfigFromURL("tcp://127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := Listen(ctx, lc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// dial connects a client to the server.
+func dial(ctx context.Context, t *testing.T, s Server) MgRPC {
+	rpc, err := New(ctx, fmt.Sprintf("tcp://%s", s.Addr()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rpc
+}
+
+func TestDispatchSlowHandlerDoesNotBlock(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	s := newTestServer(ctx, t)
+	defer s.Close()
+
+	release := make(chan struct{})
+	s.AddHandler("Test.Slow", func(_ context.Context, _ MgRPC, f *frame.Frame) *frame.Frame {
+		<-release
+		return &frame.Frame{ID: f.ID}
+	})
+	s.AddHandler("Test.Echo", echoHandler)
+	rpc := dial(ctx, t, s)
+	defer rpc.Disconnect(ctx)
+
+	slowDone := make(chan error)
+	go func() {
+		_, err := rpc.Call(ctx, "", &frame.Command{Cmd: "Test.Slow"}, nil)
+		slowDone <- err
+	}()
+	if _, err := rpc.Call(ctx, "", &frame.Command{Cmd: "Test.Echo"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-slowDone:
+		t.Fatalf("slow call finished before being released")
+	default:
+	}
+	close(release)
+	if err := <-slowDone; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDispatchTimeout(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	s := newTestServer(ctx, t)
+	defer s.Close()
+
+	s.AddHandler("Test.Wait", func(ctx context.Context, _ MgRPC, f *frame.Frame) *frame.Frame {
+		<-ctx.Done()
+		return &frame.Frame{ID: f.ID}
+	})
+	rpc := dial(ctx, t, s)
+	defer rpc.Disconnect(ctx)
+
+	resp, err := rpc.Call(ctx, "", &frame.Command{Cmd: "Test.Wait", Timeout: 1}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := resp.Status, statusTimeout; got != want {
+		t.Errorf("got: %d, want: %d", got, want)
+	}
+
+	// Request that has expired before it was received is not handled at all.
+	resp, err = rpc.Call(ctx, "", &frame.Command{Cmd: "Test.Wait", Deadline: time.Now().Add(-time.Minute).Unix()}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := resp.Status, statusTimeout; got != want {
+		t.Errorf("got: %d, want: %d", got, want)
+	}
+}
+
+// chanCodec receives frames from a channel, until it is closed.
+type chanCodec struct {
+	in     chan *frame.Frame
+	closed chan struct{}
+	once   sync.Once
+}
+
+func (c *chanCodec) Recv(ctx context.Context) (*frame.Frame, error) {
+	select {
+	case f, ok := <-c.in:
+		if !ok {
+			return nil, io.EOF
+		}
+		return f, nil
+	case <-c.closed:
+		return nil, io.EOF
+	}
+}
+
+func (c *chanCodec) Send(ctx context.Context, f *frame.Frame) error { return nil }
+func (c *chanCodec) Close()                                         { c.once.Do(func() { close(c.closed) }) }
+func (c *chanCodec) CloseNotify() <-chan struct{}                   { return c.closed }
+func (c *chanCodec) MaxNumFrames() int                              { return -1 }
+func (c *chanCodec) Info() codec.ConnectionInfo                     { return codec.ConnectionInfo{} }
+func (c *chanCodec) SetOptions(opts *codec.Options) error           { return nil }
+
+func TestDispatchCancelOnDisconnect(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	c := &chanCodec{in: make(chan *frame.Frame), closed: make(chan struct{})}
+	started, cancelled := make(chan struct{}), make(chan struct{})
+	serveWithHandlers(ctx, c, &connectOptions{}, map[string]handlerSpec{
+		"Test.Wait": newHandlerSpec(func(ctx context.Context, _ MgRPC, f *frame.Frame) *frame.Frame {
+			close(started)
+			<-ctx.Done()
+			close(cancelled)
+			return nil
+		}, nil),
+	}, nil)
+
+	c.in <- &frame.Frame{ID: 1, Method: "Test.Wait"}
+	<-started
+	// Connection is lost while the request is being handled.
+	close(c.in)
+	select {
+	case <-cancelled:
+	case <-ctx.Done():
+		t.Fatalf("handler was not cancelled after the connection was lost")
+	}
+}
+
+func TestDispatchMaxConcurrency(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	s := newTestServer(ctx, t)
+	defer s.Close()
+
+	var lock sync.Mutex
+	running, maxRunning := 0, 0
+	s.AddHandler("Test.Work", func(_ context.Context, _ MgRPC, f *frame.Frame) *frame.Frame {
+		lock.Lock()
+		running++
+		if running > maxRunning {
+			maxRunning = running
+		}
+		lock.Unlock()
+		time.Sleep(50 * time.Millisecond)
+		lock.Lock()
+		running--
+		lock.Unlock()
+		return &frame.Frame{ID: f.ID}
+	}, MaxConcurrency(2))
+	rpc := dial(ctx, t, s)
+	defer rpc.Disconnect(ctx)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := rpc.Call(ctx, "", &frame.Command{Cmd: "Test.Work"}, nil); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if maxRunning != 2 {
+		t.Errorf("max concurrency: got %d, want 2", maxRunning)
+	}
+}
+
+func TestDispatchMiddleware(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	s := newTestServer(ctx, t)
+	defer s.Close()
+
+	var lock sync.Mutex
+	var seen []string
+	record := func(name string) Middleware {
+		return func(next Handler) Handler {
+			return func(ctx context.Context, r MgRPC, f *frame.Frame) *frame.Frame {
+				lock.Lock()
+				seen = append(seen, name+":"+f.Method)
+				lock.Unlock()
+				return next(ctx, r, f)
+			}
+		}
+	}
+	s.AddMiddleware(record("outer"))
+	s.AddMiddleware(record("inner"))
+	s.AddHandler("Test.Echo", echoHandler)
+	rpc := dial(ctx, t, s)
+	defer rpc.Disconnect(ctx)
+
+	for _, method := range []string{"Test.Echo", "Test.NoSuchMethod"} {
+		if _, err := rpc.Call(ctx, "", &frame.Command{Cmd: method}, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := "[outer:Test.Echo inner:Test.Echo outer:Test.NoSuchMethod inner:Test.NoSuchMethod]"
+	if got := fmt.Sprintf("%v", seen); got != want {
+		t.Errorf("got: %s, want: %s", got, want)
+	}
+}
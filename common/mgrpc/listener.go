@@ -0,0 +1,287 @@
+//
+// Copyright (c) 2014-2019 Cesanta Software Limited
+// All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package mgrpc
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/websocket"
+
+	"github.com/cesanta/errors"
+	"github.com/golang/glog"
+	"github.com/mongoose-os/mos/common/mgrpc/codec"
+)
+
+// Server accepts RPC connections and serves them with a common set of handlers.
+type Server interface {
+	// AddHandler registers a handler for all connections accepted from now on.
+	AddHandler(method string, handler Handler, opts ...HandlerOption)
+	// AddMiddleware appends middleware to the chain used for all connections
+	// accepted from now on.
+	AddMiddleware(mw Middleware)
+	// Addr returns the address the server is listening on.
+	Addr() net.Addr
+	// Close stops accepting new connections and closes existing ones.
+	Close() error
+}
+
+type serverImpl struct {
+	lc  ListenerConfig
+	ctx context.Context
+	l   net.Listener
+	hs  *http.Server
+
+	handlers     map[string]handlerSpec
+	middleware   []Middleware
+	handlersLock sync.Mutex
+
+	conns     map[MgRPC]bool
+	codecs    map[codec.Codec]bool
+	connsLock sync.Mutex
+
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// Listen creates a listener according to lc and starts serving RPC connections
+// that arrive on it, until ctx is done or the server is closed.
+func Listen(ctx context.Context, lc ListenerConfig, opts ...ListenOption) (Server, error) {
+	for _, opt := range opts {
+		opt(&lc)
+	}
+	if lc.TCP != nil && lc.HTTP != nil {
+		return nil, errors.Errorf("%s: only one of tcp and http can be configured", lc.Addr)
+	}
+	if lc.TCP == nil && lc.HTTP == nil {
+		return nil, errors.Errorf("%s: either tcp or http must be configured", lc.Addr)
+	}
+	if lc.HTTP != nil && !lc.HTTP.EnablePOST && !lc.HTTP.EnableWebSocket {
+		return nil, errors.Errorf("%s: neither POST nor WebSocket are enabled", lc.Addr)
+	}
+
+	l, err := net.Listen("tcp", lc.Addr)
+	if err != nil {
+		return nil, errors.Annotatef(err, "failed to listen on %s", lc.Addr)
+	}
+	if lc.TLS != nil {
+		tlsConfig, err := lc.TLS.serverTLSConfig()
+		if err != nil {
+			l.Close()
+			return nil, errors.Annotatef(err, "%s: invalid TLS config", lc.Addr)
+		}
+		l = tls.NewListener(l, tlsConfig)
+	}
+
+	s := &serverImpl{
+		lc:       lc,
+		ctx:      ctx,
+		l:        l,
+		handlers: make(map[string]handlerSpec),
+		conns:    make(map[MgRPC]bool),
+		codecs:   make(map[codec.Codec]bool),
+		closed:   make(chan struct{}),
+	}
+
+	glog.Infof("Listening on %s (tls: %t)", l.Addr(), lc.TLS != nil)
+	if lc.TCP != nil {
+		go s.serveTCP()
+	} else {
+		s.hs = &http.Server{Handler: s}
+		go func() {
+			if err := s.hs.Serve(l); err != nil && err != http.ErrServerClosed {
+				glog.Errorf("%s: HTTP server error: %s", l.Addr(), err)
+			}
+		}()
+	}
+	go func() {
+		select {
+		case <-ctx.Done():
+			s.Close()
+		case <-s.closed:
+		}
+	}()
+	return s, nil
+}
+
+// serverTLSConfig creates server TLS configuration from the listener settings.
+func (tc *TLSConfig) serverTLSConfig() (*tls.Config, error) {
+	cert := tc.Cert
+	if cert == nil {
+		if tc.CertFile == "" {
+			return nil, errors.Errorf("no server certificate provided")
+		}
+		keyFile := tc.KeyFile
+		if keyFile == "" {
+			keyFile = tc.CertFile
+		}
+		c, err := tls.LoadX509KeyPair(tc.CertFile, keyFile)
+		if err != nil {
+			return nil, errors.Annotatef(err, "failed to load server cert")
+		}
+		cert = &c
+	}
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{*cert},
+	}
+	pool := tc.ClientCAPool
+	if tc.ClientCAPoolFile != "" {
+		if pool != nil {
+			return nil, errors.Errorf("only one of client CA pool and client CA pool file can be specified")
+		}
+		pem, err := ioutil.ReadFile(tc.ClientCAPoolFile)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.Errorf("no certificates found in %s", tc.ClientCAPoolFile)
+		}
+	}
+	if pool != nil {
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsConfig, nil
+}
+
+func (s *serverImpl) AddHandler(method string, handler Handler, opts ...HandlerOption) {
+	s.handlersLock.Lock()
+	defer s.handlersLock.Unlock()
+	s.handlers[method] = newHandlerSpec(handler, opts)
+}
+
+func (s *serverImpl) AddMiddleware(mw Middleware) {
+	s.handlersLock.Lock()
+	defer s.handlersLock.Unlock()
+	s.middleware = append(s.middleware, mw)
+}
+
+func (s *serverImpl) Addr() net.Addr {
+	return s.l.Addr()
+}
+
+func (s *serverImpl) Close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		close(s.closed)
+		if s.hs != nil {
+			err = s.hs.Close()
+		} else {
+			err = s.l.Close()
+		}
+		s.connsLock.Lock()
+		for rpc := range s.conns {
+			rpc.Disconnect(context.Background())
+		}
+		for c := range s.codecs {
+			c.Close()
+		}
+		s.connsLock.Unlock()
+	})
+	return errors.Trace(err)
+}
+
+// serveConn serves RPC requests coming from c until it is closed.
+func (s *serverImpl) serveConn(c codec.Codec) {
+	if s.lc.CodecHandler != nil {
+		s.connsLock.Lock()
+		s.codecs[c] = true
+		s.connsLock.Unlock()
+		s.lc.CodecHandler(c)
+		c.Close()
+		s.connsLock.Lock()
+		delete(s.codecs, c)
+		s.connsLock.Unlock()
+		return
+	}
+	s.handlersLock.Lock()
+	opts := &connectOptions{enableTracing: s.lc.EnableTracing, spanExporter: s.lc.SpanExporter}
+	rpc := serveWithHandlers(s.ctx, c, opts, s.handlers, s.middleware)
+	s.handlersLock.Unlock()
+	s.connsLock.Lock()
+	s.conns[rpc] = true
+	s.connsLock.Unlock()
+	<-c.CloseNotify()
+	s.connsLock.Lock()
+	delete(s.conns, rpc)
+	s.connsLock.Unlock()
+}
+
+func (s *serverImpl) serveTCP() {
+	for {
+		conn, err := s.l.Accept()
+		if err != nil {
+			select {
+			case <-s.closed:
+			default:
+				glog.Errorf("%s: accept error: %s", s.l.Addr(), err)
+			}
+			return
+		}
+		glog.V(1).Infof("%s: new connection from %s", s.l.Addr(), conn.RemoteAddr())
+		if tc, ok := conn.(*net.TCPConn); ok {
+			tc.SetKeepAlive(true)
+			tc.SetKeepAlivePeriod(tcpKeepAliveInterval)
+		}
+		go s.serveConn(codec.TCP(conn))
+	}
+}
+
+func isWebSocketUpgrade(req *http.Request) bool {
+	return strings.ToLower(req.Header.Get("Upgrade")) == "websocket"
+}
+
+func (s *serverImpl) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	switch {
+	case isWebSocketUpgrade(req) && s.lc.HTTP.EnableWebSocket:
+		ws := websocket.Server{
+			Handshake: func(config *websocket.Config, req *http.Request) error {
+				// Clients are not required to request a protocol, but if they do, it must be ours.
+				for _, p := range config.Protocol {
+					if p == codec.WSProtocol {
+						config.Protocol = []string{codec.WSProtocol}
+						return nil
+					}
+				}
+				if len(config.Protocol) > 0 {
+					return errors.Errorf("unsupported protocols %q", config.Protocol)
+				}
+				return nil
+			},
+			Handler: func(conn *websocket.Conn) {
+				s.serveConn(codec.WebSocket(conn))
+			},
+		}
+		ws.ServeHTTP(rw, req)
+	case req.Method == http.MethodPost && s.lc.HTTP.EnablePOST:
+		c := codec.InboundHTTP(rw, req, s.lc.HTTP.CloudHost)
+		if c == nil {
+			// Error response has already been sent.
+			return
+		}
+		s.serveConn(c)
+	default:
+		http.Error(rw, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
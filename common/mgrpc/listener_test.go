@@ -0,0 +1,176 @@
+//
+// Copyright (c) 2014-2019 Cesanta Software Limited
+// All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package mgrpc
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/mongoose-os/mos/common/mgrpc/frame"
+)
+
+func echoHandler(_ context.Context, _ MgRPC, f *frame.Frame) *frame.Frame {
+	return &frame.Frame{ID: f.ID, Result: f.Params}
+}
+
+func TestListen(t *testing.T) {
+	for _, scheme := range []string{"tcp", "http", "ws"} {
+		t.Run(scheme, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			lc, err := ListenerConfigFromURL(scheme + "://127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			s, err := Listen(ctx, lc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+			s.AddHandler("Test.Echo", echoHandler)
+
+			rpc, err := New(ctx, fmt.Sprintf("%s://%s", scheme, s.Addr()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer rpc.Disconnect(ctx)
+
+			resp, err := rpc.Call(ctx, "", &frame.Command{Cmd: "Test.Echo", Args: []byte(`{"a":1}`)}, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := string(resp.Response), `{"a":1}`; resp.Status != 0 || got != want {
+				t.Errorf("got: %d %q, want: %q", resp.Status, got, want)
+			}
+
+			resp, err = rpc.Call(ctx, "", &frame.Command{Cmd: "Test.NoSuchMethod"}, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := resp.Status, 404; got != want {
+				t.Errorf("got: %d, want: %d", got, want)
+			}
+		})
+	}
+}
+
+func TestListenConfigErrors(t *testing.T) {
+	ctx := context.Background()
+	for _, lc := range []ListenerConfig{
+		{Addr: "127.0.0.1:0"},
+		{Addr: "127.0.0.1:0", TCP: &TCPListenerConfig{}, HTTP: &HTTPListenerConfig{EnablePOST: true}},
+		{Addr: "127.0.0.1:0", HTTP: &HTTPListenerConfig{}},
+		{Addr: "127.0.0.1:0", TCP: &TCPListenerConfig{}, TLS: &TLSConfig{}},
+	} {
+		if s, err := Listen(ctx, lc); err == nil {
+			s.Close()
+			t.Errorf("%+v: expected an error", lc)
+		}
+	}
+}
+
+// selfSignedCert generates a certificate that can be used by both the server and the client.
+func selfSignedCert(t *testing.T) (*tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	x509Cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(x509Cert)
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: x509Cert}, pool
+}
+
+func TestListenTCPS(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	cert, pool := selfSignedCert(t)
+
+	lc, err := ListenerConfigFromURL("tcps://127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := Listen(ctx, lc, ServerCert(cert), VerifyClientsWith(pool))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.AddHandler("Test.Info", func(_ context.Context, r MgRPC, f *frame.Frame) *frame.Frame {
+		ci := r.(*mgRPCImpl).codec.Info()
+		res, _ := json.Marshal(map[string]interface{}{"tls": ci.TLS, "peer_certs": len(ci.PeerCertificates)})
+		return &frame.Frame{ID: f.ID, Result: res}
+	})
+
+	rpc, err := New(ctx, fmt.Sprintf("tcps://%s", s.Addr()), ClientCert(cert), VerifyServerWith(pool))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rpc.Disconnect(ctx)
+	resp, err := rpc.Call(ctx, "", &frame.Command{Cmd: "Test.Info"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(resp.Response), `{"peer_certs":1,"tls":true}`; got != want {
+		t.Errorf("got: %q, want: %q", got, want)
+	}
+	ci := rpc.(*mgRPCImpl).codec.Info()
+	if !ci.TLS || len(ci.PeerCertificates) != 1 {
+		t.Errorf("client connection info: %+v", ci)
+	}
+
+	// Connection without a client certificate must be rejected.
+	ctx2, cancel2 := context.WithTimeout(ctx, 500*time.Millisecond)
+	defer cancel2()
+	rpc2, err := New(ctx2, fmt.Sprintf("tcps://%s", s.Addr()), VerifyServerWith(pool))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rpc2.Disconnect(ctx)
+	if _, err := rpc2.Call(ctx2, "", &frame.Command{Cmd: "Test.Info"}, nil); err == nil {
+		t.Errorf("expected an error when connecting without a client certificate")
+	}
+}
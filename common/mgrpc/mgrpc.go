@@ -18,15 +18,12 @@ package mgrpc
 
 import (
 	"context"
-	"crypto/md5"
-	"crypto/rand"
 	"crypto/tls"
-	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
-	"math/big"
 	"net"
+	"os"
 	"sync"
 	"time"
 
@@ -38,18 +35,25 @@ import (
 	"github.com/mongoose-os/mos/common/mgrpc/frame"
 )
 
-const (
-	authTypeDigest = "digest"
-)
+// Handler processes an incoming request and returns a response frame, or nil
+// if no response should be sent. Context expires when the request deadline or
+// timeout specified by the caller passes, or when the connection is closed.
+type Handler func(context.Context, MgRPC, *frame.Frame) *frame.Frame
 
-type GetCredsCallback func() (username, passwd string, err error)
-type Handler func(MgRPC, *frame.Frame) *frame.Frame
+// SimpleHandler adapts a handler that does not take a context, as handlers
+// did before, to Handler.
+func SimpleHandler(h func(MgRPC, *frame.Frame) *frame.Frame) Handler {
+	return func(ctx context.Context, r MgRPC, f *frame.Frame) *frame.Frame {
+		return h(r, f)
+	}
+}
 
 type MgRPC interface {
 	Call(
-		ctx context.Context, dst string, cmd *frame.Command, getCreds GetCredsCallback,
+		ctx context.Context, dst string, cmd *frame.Command, auth Authenticator,
 	) (*frame.Response, error)
-	AddHandler(method string, handler Handler)
+	AddHandler(method string, handler Handler, opts ...HandlerOption)
+	AddMiddleware(mw Middleware)
 	Disconnect(ctx context.Context) error
 	IsConnected() bool
 	SetCodecOptions(opts *codec.Options) error
@@ -62,27 +66,25 @@ type mgRPCImpl struct {
 	reqs     map[int64]req
 	reqsLock sync.Mutex
 
-	// Map of handlers, and its lock
-	handlers     map[string]Handler
+	// Map of handlers, middleware chain and their lock
+	handlers     map[string]*methodDispatcher
+	middleware   []Middleware
 	handlersLock sync.Mutex
 
+	// Requests that are being handled.
+	inflight sync.WaitGroup
+
 	opts *connectOptions
 
-	closing bool
+	closing     bool
+	closingLock sync.Mutex
 }
 
 type req struct {
-	respChan chan *frame.Response
+	respChan chan *frame.Frame
 	errChan  chan error
 }
 
-type authErrorMsg struct {
-	AuthType string `json:"auth_type"`
-	Nonce    int    `json:"nonce"`
-	NC       int    `json:"nc"`
-	Realm    string `json:"realm"`
-}
-
 const tcpKeepAliveInterval = 3 * time.Minute
 
 // ErrorResponse is an error type for failed commands. Intended for use by
@@ -104,7 +106,7 @@ func New(ctx context.Context, connectAddr string, opts ...ConnectOption) (MgRPC,
 
 	rpc := mgRPCImpl{
 		reqs:     make(map[int64]req),
-		handlers: make(map[string]Handler),
+		handlers: make(map[string]*methodDispatcher),
 	}
 	if err := rpc.connect(ctx, opts...); err != nil {
 		return nil, errors.Trace(err)
@@ -115,12 +117,33 @@ func New(ctx context.Context, connectAddr string, opts ...ConnectOption) (MgRPC,
 	return &rpc, nil
 }
 
+// Dial connects to connectAddr the same way New does, but returns the
+// underlying codec without processing frames received over it.
+func Dial(ctx context.Context, connectAddr string, opts ...ConnectOption) (codec.Codec, error) {
+	opts = append(opts, connectTo(connectAddr))
+	rpc := mgRPCImpl{}
+	if err := rpc.connect(ctx, opts...); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return rpc.codec, nil
+}
+
 func Serve(ctx context.Context, c codec.Codec) MgRPC {
+	return serveWithHandlers(ctx, c, &connectOptions{}, nil, nil)
+}
+
+// serveWithHandlers is like Serve but uses the given options and installs
+// the handlers and middleware before starting to receive frames.
+func serveWithHandlers(ctx context.Context, c codec.Codec, opts *connectOptions, handlers map[string]handlerSpec, middleware []Middleware) MgRPC {
 	rpc := mgRPCImpl{
-		reqs:     make(map[int64]req),
-		handlers: make(map[string]Handler),
-		codec:    c,
-		opts:     &connectOptions{localID: ""},
+		reqs:       make(map[int64]req),
+		handlers:   make(map[string]*methodDispatcher),
+		middleware: append([]Middleware(nil), middleware...),
+		codec:      c,
+		opts:       opts,
+	}
+	for method, hs := range handlers {
+		rpc.handlers[method] = &methodDispatcher{handlerSpec: hs}
 	}
 	go rpc.recvLoop(ctx, rpc.codec)
 	return &rpc
@@ -172,8 +195,21 @@ func wsDialConfig(config *websocket.Config) (*websocket.Conn, error) {
 	return conn, errors.Trace(err)
 }
 
-func (r *mgRPCImpl) AddHandler(method string, handler Handler) {
-	r.handlers[method] = handler
+// AddHandler registers handler for the method. Requests are handled
+// concurrently with each other and with receiving of responses to outgoing
+// calls, subject to the MaxConcurrency option.
+func (r *mgRPCImpl) AddHandler(method string, handler Handler, opts ...HandlerOption) {
+	r.handlersLock.Lock()
+	defer r.handlersLock.Unlock()
+	r.handlers[method] = &methodDispatcher{handlerSpec: newHandlerSpec(handler, opts)}
+}
+
+// AddMiddleware appends mw to the middleware chain. Middleware added first
+// is the outermost, i.e. it sees requests first.
+func (r *mgRPCImpl) AddMiddleware(mw Middleware) {
+	r.handlersLock.Lock()
+	defer r.handlersLock.Unlock()
+	r.middleware = append(r.middleware, mw)
 }
 
 func (r *mgRPCImpl) mqttConnect(dst string, opts *connectOptions) (codec.Codec, error) {
@@ -204,13 +240,25 @@ func (r *mgRPCImpl) wsConnect(url string, opts *connectOptions) (codec.Codec, er
 }
 
 func (r *mgRPCImpl) tcpConnect(tcpAddress string, opts *connectOptions) (codec.Codec, error) {
-	// TODO(imax): add TLS support.
 	conn, err := net.Dial("tcp", tcpAddress)
 	if err != nil {
 		return nil, errors.Trace(err)
 	}
 	conn.(*net.TCPConn).SetKeepAlive(true)
 	conn.(*net.TCPConn).SetKeepAlivePeriod(tcpKeepAliveInterval)
+	if opts.useTLS {
+		host, _, err := net.SplitHostPort(tcpAddress)
+		if err != nil {
+			host = tcpAddress
+		}
+		tlsConn := tls.Client(conn, opts.clientTLSConfig(host))
+		// Perform handshake now so that errors are reported at connection time.
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, errors.Annotatef(err, "TLS handshake with %s failed", tcpAddress)
+		}
+		conn = tlsConn
+	}
 	return codec.TCP(conn), nil
 }
 
@@ -295,21 +343,46 @@ func (r *mgRPCImpl) connect(ctx context.Context, opts ...ConnectOption) error {
 				c, err := r.watsonConnect(url, r.opts)
 				return c, errors.Trace(err)
 			})
+	case tReplay:
+		if r.codec, err = codec.NewReplayCodec(r.opts.connectAddress); err != nil {
+			return errors.Trace(err)
+		}
 
 	default:
 		return fmt.Errorf("unknown transport %q", r.opts.proto)
 	}
 
+	if r.opts.recordFile != "" {
+		f, err := os.OpenFile(r.opts.recordFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			r.codec.Close()
+			return errors.Annotatef(err, "failed to create record file")
+		}
+		r.codec = codec.NewRecordingCodec(r.codec, f)
+	}
+
 	return nil
 }
 
 func (r *mgRPCImpl) Disconnect(ctx context.Context) error {
-	r.closing = true
+	r.setClosing()
 	r.codec.Close()
 	return nil
 }
 
-func sendErrorResponse(r MgRPC, f *frame.Frame) *frame.Frame {
+func (r *mgRPCImpl) setClosing() {
+	r.closingLock.Lock()
+	defer r.closingLock.Unlock()
+	r.closing = true
+}
+
+func (r *mgRPCImpl) isClosing() bool {
+	r.closingLock.Lock()
+	defer r.closingLock.Unlock()
+	return r.closing
+}
+
+func sendErrorResponse(ctx context.Context, r MgRPC, f *frame.Frame) *frame.Frame {
 	return &frame.Frame{
 		ID:    f.ID,
 		Error: &frame.Error{Code: 404, Message: fmt.Sprintf("Method [%s] not found", f.Method)},
@@ -318,11 +391,14 @@ func sendErrorResponse(r MgRPC, f *frame.Frame) *frame.Frame {
 
 func (r *mgRPCImpl) recvLoop(ctx context.Context, c codec.Codec) {
 	glog.V(2).Infof("Started recv loop, codec: %v", c)
+	// Handlers' contexts are cancelled when the loop exits.
+	handlersCtx, cancelHandlers := context.WithCancel(ctx)
+	defer cancelHandlers()
 	for {
 		glog.V(2).Infof("recv ...")
 		f, err := c.Recv(ctx)
 		glog.V(2).Infof("done, %v", err)
-		if r.closing {
+		if r.isClosing() {
 			glog.Infof("devConn is disconnected, breaking out of the recvLoop (%s)", err)
 			r.reqsLock.Lock()
 			for k, v := range r.reqs {
@@ -339,7 +415,14 @@ func (r *mgRPCImpl) recvLoop(ctx context.Context, c codec.Codec) {
 		}
 		if err != nil {
 			glog.Infof("error returned from codec Recv: %s, keep trying", err)
-			r.closing = true
+			if c.MaxNumFrames() == 1 {
+				// Single-shot codec (e.g. inbound HTTP) is done receiving but can
+				// still deliver the response, let the handler finish.
+				r.waitInflight(c)
+			}
+			// Handlers waiting on their context must not hold up the loop.
+			cancelHandlers()
+			r.setClosing()
 			continue
 		}
 
@@ -352,40 +435,63 @@ func (r *mgRPCImpl) recvLoop(ctx context.Context, c codec.Codec) {
 		}
 
 		if f.Method != "" {
-			callback := sendErrorResponse
-			for k, v := range r.handlers {
-				if k == f.Method {
-					callback = v
-					break
-				}
-			}
-			resp := callback(r, f)
-			if !f.NoResponse && resp != nil {
-				c.Send(ctx, resp)
-			}
+			r.dispatch(handlersCtx, c, f)
 			continue
 		}
 
-		resp := frame.NewResponseFromFrame(f)
 		r.reqsLock.Lock()
-		if req, ok := r.reqs[resp.ID]; ok {
-			req.respChan <- resp
-			delete(r.reqs, resp.ID)
+		if req, ok := r.reqs[f.ID]; ok {
+			req.respChan <- f
+			delete(r.reqs, f.ID)
 		} else {
-			glog.Infof("ignoring unsolicited response: %v", resp)
+			glog.Infof("ignoring unsolicited response: %v", frame.NewResponseFromFrame(f))
 		}
 		r.reqsLock.Unlock()
 	}
 }
 
+// waitInflight waits for the requests that are being handled to finish or
+// for the codec to be closed.
+func (r *mgRPCImpl) waitInflight(c codec.Codec) {
+	done := make(chan struct{})
+	go func() {
+		r.inflight.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-c.CloseNotify():
+	}
+}
+
+// Call sends a request and waits for the response. If auth is not nil, it
+// is used to add credentials to the request and to respond to 401 challenges.
 func (r *mgRPCImpl) Call(
-	ctx context.Context, dst string, cmd *frame.Command, getCreds GetCredsCallback,
+	ctx context.Context, dst string, cmd *frame.Command, auth Authenticator,
+) (*frame.Response, error) {
+	return r.call(ctx, dst, cmd, auth, nil)
+}
+
+type sentNotifierKey struct{}
+
+// ContextWithSentNotifier returns a context that makes Call invoke notify
+// once the request has been passed to the transport, before the response
+// arrives. It allows issuing requests that must reach the other side in
+// order without waiting for the response to each of them.
+// notify may be invoked more than once, e.g. if the request is resent
+// with authentication.
+func ContextWithSentNotifier(ctx context.Context, notify func()) context.Context {
+	return context.WithValue(ctx, sentNotifierKey{}, notify)
+}
+
+func (r *mgRPCImpl) call(
+	ctx context.Context, dst string, cmd *frame.Command, auth Authenticator, challenge *AuthChallenge,
 ) (*frame.Response, error) {
 	if cmd.ID == 0 {
 		cmd.ID = frame.CreateCommandUID()
 	}
 
-	respChan := make(chan *frame.Response)
+	respChan := make(chan *frame.Frame, 1)
 	errChan := make(chan error)
 
 	r.reqsLock.Lock()
@@ -397,63 +503,61 @@ func (r *mgRPCImpl) Call(
 	glog.V(2).Infof("created a request with id %d", cmd.ID)
 
 	f := frame.NewRequestFrame(r.opts.localID, dst, "", cmd, r.opts.enableCompatArgs)
+	if auth != nil {
+		if err := auth.Authenticate(ctx, f, challenge); err != nil {
+			r.reqsLock.Lock()
+			delete(r.reqs, cmd.ID)
+			r.reqsLock.Unlock()
+			return nil, errors.Annotatef(err, "failed to authenticate request")
+		}
+	}
+	var span *Span
+	if r.opts.enableTracing {
+		// Explicitly specified trace takes precedence over the one from the context.
+		parent := cmd.Trace
+		if parent == nil {
+			parent = SpanFromContext(ctx)
+		}
+		span = newSpan(SpanKindClient, parent, f)
+		f.Trace = span.trace()
+		if r.opts.spanExporter != nil {
+			span.RequestSize = frameSize(f)
+		}
+	}
 	if err := r.codec.Send(ctx, f); err != nil {
+		r.finishSpan(span, nil, err)
 		return nil, errors.Trace(err)
 	}
+	if notify, ok := ctx.Value(sentNotifierKey{}).(func()); ok {
+		notify()
+	}
 
 	select {
-	case resp := <-respChan:
+	case respFrame := <-respChan:
+		r.finishSpan(span, respFrame, nil)
+		resp := frame.NewResponseFromFrame(respFrame)
 		glog.V(2).Infof("got response to request %d: [%v] (%v)", cmd.ID, resp, resp.StatusMsg)
-		if resp.Status == 401 && cmd.Auth == nil {
-			var authMsg authErrorMsg
-			if err := json.Unmarshal([]byte(resp.StatusMsg), &authMsg); err == nil {
-				// Succeed in parsing error message, let's check auth type
-				switch authMsg.AuthType {
-				case authTypeDigest:
-					// Get username and password
-					username, passwd, err := getCreds()
-					if err != nil {
-						return nil, errors.Trace(err)
-					}
-
-					// Generate cnonce
-					cnonceBig, err := rand.Int(rand.Reader, big.NewInt(0xffffffff))
-					if err != nil {
-						return nil, errors.Annotatef(err, "generating cnonce")
-					}
-
-					cnonce := int(cnonceBig.Int64())
-
-					// Compute resp
-					resp := mkMd5Resp(
-						"dummy_method", "dummy_uri", username, authMsg.Realm, passwd,
-						authMsg.Nonce, authMsg.NC, cnonce, "auth",
-					)
-
-					cmdWithAuth := *cmd
-					cmdWithAuth.Auth = &frame.FrameAuth{
-						Realm:    authMsg.Realm,
-						Nonce:    authMsg.Nonce,
-						Username: username,
-						CNonce:   cnonce,
-						Response: resp,
-					}
-					glog.V(2).Infof("resending cmd %d with auth added: %v", cmd.ID, cmdWithAuth)
-					return r.Call(ctx, dst, &cmdWithAuth, getCreds)
-
-				default:
-					glog.Warningf("got 401 with an unknown auth_type: %v", authMsg.AuthType)
-				}
-			} else {
+		if resp.Status == 401 && cmd.Auth == nil && challenge == nil && auth != nil {
+			var ch AuthChallenge
+			if err := json.Unmarshal([]byte(resp.StatusMsg), &ch); err != nil {
 				glog.Warningf("got 401 with an invalid message: %v", resp.StatusMsg)
+				return resp, nil
+			}
+			glog.V(2).Infof("resending cmd %d with %s auth", cmd.ID, ch.AuthType)
+			resp2, err := r.call(ctx, dst, cmd, auth, &ch)
+			if err != nil {
+				return nil, errors.Annotatef(err, "%s auth is required", ch.AuthType)
 			}
+			return resp2, nil
 		}
 		return resp, nil
 	case err := <-errChan:
 		glog.V(2).Infof("got err on request %d: [%v]", cmd.ID, err)
+		r.finishSpan(span, nil, err)
 		return nil, errors.Trace(err)
 	case <-ctx.Done():
 		glog.V(2).Infof("context for the request %d is done: %v", cmd.ID, ctx.Err())
+		r.finishSpan(span, nil, ctx.Err())
 		r.reqsLock.Lock()
 		delete(r.reqs, cmd.ID)
 		r.reqsLock.Unlock()
@@ -478,19 +582,3 @@ func (r *mgRPCImpl) IsConnected() bool {
 func (r *mgRPCImpl) SetCodecOptions(opts *codec.Options) error {
 	return r.codec.SetOptions(opts)
 }
-
-func mkMd5Resp(method, uri, username, realm, passwd string, nonce, nc, cnonce int, qop string) string {
-	ha1Arr := md5.Sum([]byte(fmt.Sprintf("%s:%s:%s", username, realm, passwd)))
-	ha1 := hex.EncodeToString(ha1Arr[:])
-
-	ha2Arr := md5.Sum([]byte(fmt.Sprintf("%s:%s", method, uri)))
-	ha2 := hex.EncodeToString(ha2Arr[:])
-
-	respArr := md5.Sum([]byte(fmt.Sprintf(
-		"%s:%d:%d:%d:%s:%s",
-		ha1, nonce, nc, cnonce, "auth", ha2,
-	)))
-	resp := hex.EncodeToString(respArr[:])
-
-	return resp
-}
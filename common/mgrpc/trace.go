@@ -0,0 +1,275 @@
+//
+// Copyright (c) 2014-2019 Cesanta Software Limited
+// All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package mgrpc
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/mongoose-os/mos/common/mgrpc/frame"
+)
+
+// SpanKind tells whether the span was recorded by the caller or by the callee.
+type SpanKind int
+
+const (
+	SpanKindServer SpanKind = 2
+	SpanKindClient SpanKind = 3
+)
+
+// Status of the span of a call that failed without a response, e.g. due to timeout.
+const spanStatusNoResponse = -1
+
+// Span describes a single RPC call as seen by one of the parties.
+type Span struct {
+	TraceID      int64
+	SpanID       int64
+	ParentSpanID int64
+	Kind         SpanKind
+
+	Method string
+	Src    string
+	Dst    string
+
+	Start time.Time
+	End   time.Time
+
+	// Status code of the response, 0 means success. If the call did not get
+	// a response, the status is -1 and the message contains the error.
+	Status    int
+	StatusMsg string
+
+	// Sizes of the JSON-encoded request and response frames.
+	RequestSize  int
+	ResponseSize int
+}
+
+// SpanExporter receives finished spans. Implementations must be safe for concurrent use.
+type SpanExporter interface {
+	ExportSpan(s *Span)
+}
+
+type spanContextKey struct{}
+
+// ContextWithSpan returns a context carrying the given span. Calls made with
+// this context become the children of the span.
+func ContextWithSpan(ctx context.Context, t *frame.Trace) context.Context {
+	return context.WithValue(ctx, spanContextKey{}, t)
+}
+
+// SpanFromContext returns the span carried by the context, if any. Handlers
+// of connections with tracing enabled receive the span of the request.
+func SpanFromContext(ctx context.Context) *frame.Trace {
+	t, _ := ctx.Value(spanContextKey{}).(*frame.Trace)
+	return t
+}
+
+func newSpanID() int64 {
+	for {
+		if id := rand.Int63(); id != 0 {
+			return id
+		}
+	}
+}
+
+// newSpan starts a span which is a child of parent, or the root of a new trace if parent is nil.
+func newSpan(kind SpanKind, parent *frame.Trace, f *frame.Frame) *Span {
+	s := &Span{
+		SpanID: newSpanID(),
+		Kind:   kind,
+		Method: f.Method,
+		Src:    f.Src,
+		Dst:    f.Dst,
+		Start:  time.Now(),
+	}
+	if parent != nil && parent.TraceID != 0 {
+		s.TraceID, s.ParentSpanID = parent.TraceID, parent.SpanID
+	} else {
+		s.TraceID = newSpanID()
+	}
+	return s
+}
+
+func (s *Span) trace() *frame.Trace {
+	return &frame.Trace{TraceID: s.TraceID, SpanID: s.SpanID}
+}
+
+// finish records the outcome of the call, resp may be nil if there was no response.
+func (s *Span) finish(resp *frame.Frame, err error) {
+	s.End = time.Now()
+	switch {
+	case resp != nil && resp.Error != nil:
+		s.Status, s.StatusMsg = resp.Error.Code, resp.Error.Message
+	case resp == nil && err != nil:
+		s.Status, s.StatusMsg = spanStatusNoResponse, err.Error()
+	}
+	if resp != nil {
+		s.ResponseSize = frameSize(resp)
+	}
+}
+
+// finishSpan finishes and exports the span, if it is being recorded.
+func (r *mgRPCImpl) finishSpan(s *Span, resp *frame.Frame, err error) {
+	if s == nil || r.opts.spanExporter == nil {
+		return
+	}
+	s.finish(resp, err)
+	r.opts.spanExporter.ExportSpan(s)
+}
+
+func frameSize(f *frame.Frame) int {
+	if f.SizeHint > 0 {
+		return f.SizeHint
+	}
+	data, _ := frame.MarshalJSON(f)
+	return len(data)
+}
+
+// Types below represent the OTLP/JSON encoding of spans, as produced by the
+// OpenTelemetry file exporter.
+
+type otlpValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	IntValue    *string `json:"intValue,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              SpanKind       `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            otlpStatus     `json:"status"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpTraces struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+// OTLP status codes.
+const (
+	otlpStatusOK    = 1
+	otlpStatusError = 2
+)
+
+func stringAttr(key, value string) otlpKeyValue {
+	return otlpKeyValue{Key: key, Value: otlpValue{StringValue: &value}}
+}
+
+func intAttr(key string, value int64) otlpKeyValue {
+	v := fmt.Sprintf("%d", value)
+	return otlpKeyValue{Key: key, Value: otlpValue{IntValue: &v}}
+}
+
+func (s *Span) toOTLP() otlpSpan {
+	ots := otlpSpan{
+		TraceID:           fmt.Sprintf("%032x", uint64(s.TraceID)),
+		SpanID:            fmt.Sprintf("%016x", uint64(s.SpanID)),
+		Name:              s.Method,
+		Kind:              s.Kind,
+		StartTimeUnixNano: fmt.Sprintf("%d", s.Start.UnixNano()),
+		EndTimeUnixNano:   fmt.Sprintf("%d", s.End.UnixNano()),
+		Attributes: []otlpKeyValue{
+			stringAttr("rpc.system", "mgrpc"),
+			stringAttr("rpc.method", s.Method),
+			stringAttr("mgrpc.src", s.Src),
+			stringAttr("mgrpc.dst", s.Dst),
+			intAttr("mgrpc.status", int64(s.Status)),
+			intAttr("mgrpc.request_size", int64(s.RequestSize)),
+			intAttr("mgrpc.response_size", int64(s.ResponseSize)),
+			intAttr("mgrpc.latency_ms", int64(s.End.Sub(s.Start)/time.Millisecond)),
+		},
+		Status: otlpStatus{Code: otlpStatusOK},
+	}
+	if i := strings.LastIndex(s.Method, "."); i > 0 {
+		ots.Attributes = append(ots.Attributes, stringAttr("rpc.service", s.Method[:i]))
+	}
+	if s.ParentSpanID != 0 {
+		ots.ParentSpanID = fmt.Sprintf("%016x", uint64(s.ParentSpanID))
+	}
+	if s.Status != 0 {
+		ots.Status = otlpStatus{Code: otlpStatusError, Message: s.StatusMsg}
+	}
+	return ots
+}
+
+type jsonSpanExporter struct {
+	serviceName string
+
+	lock sync.Mutex
+	enc  *json.Encoder
+}
+
+// NewJSONSpanExporter returns an exporter that writes spans to w in the
+// OTLP/JSON format, one line per span, like the OpenTelemetry file exporter
+// does. serviceName is reported as the service.name resource attribute.
+func NewJSONSpanExporter(w io.Writer, serviceName string) SpanExporter {
+	return &jsonSpanExporter{serviceName: serviceName, enc: json.NewEncoder(w)}
+}
+
+func (e *jsonSpanExporter) ExportSpan(s *Span) {
+	t := &otlpTraces{ResourceSpans: []otlpResourceSpans{{
+		Resource: otlpResource{Attributes: []otlpKeyValue{stringAttr("service.name", e.serviceName)}},
+		ScopeSpans: []otlpScopeSpans{{
+			Scope: otlpScope{Name: "mgrpc"},
+			Spans: []otlpSpan{s.toOTLP()},
+		}},
+	}}}
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if err := e.enc.Encode(t); err != nil {
+		glog.Errorf("failed to export span: %s", err)
+	}
+}
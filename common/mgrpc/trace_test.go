@@ -0,0 +1,130 @@
+//
+// Copyright (c) 2014-2019 Cesanta Software Limited
+// All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package mgrpc
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mongoose-os/mos/common/mgrpc/frame"
+)
+
+type spanCollector struct {
+	lock  sync.Mutex
+	spans []*Span
+}
+
+func (sc *spanCollector) ExportSpan(s *Span) {
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+	sc.spans = append(sc.spans, s)
+}
+
+func TestTracing(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	serverSpans, clientSpans := &spanCollector{}, &spanCollector{}
+
+	lc, err := ListenerConfigFromURL("tcp://127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := Listen(ctx, lc, ExportListenerSpans(serverSpans))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	handlerSpan := make(chan *frame.Trace, 1)
+	s.AddHandler("Test.Echo", func(ctx context.Context, r MgRPC, f *frame.Frame) *frame.Frame {
+		handlerSpan <- SpanFromContext(ctx)
+		return echoHandler(ctx, r, f)
+	})
+	rpc, err := New(ctx, fmt.Sprintf("tcp://%s", s.Addr()), ExportSpans(clientSpans))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rpc.Disconnect(ctx)
+
+	parent := &frame.Trace{TraceID: 123, SpanID: 456}
+	if _, err := rpc.Call(ContextWithSpan(ctx, parent), "", &frame.Command{Cmd: "Test.Echo", Args: []byte(`{"a":1}`)}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rpc.Call(ctx, "", &frame.Command{Cmd: "Test.NoSuchMethod"}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(clientSpans.spans) != 2 {
+		t.Fatalf("got %d client spans", len(clientSpans.spans))
+	}
+	cs := clientSpans.spans[0]
+	if cs.Kind != SpanKindClient || cs.TraceID != 123 || cs.ParentSpanID != 456 || cs.Method != "Test.Echo" ||
+		cs.Status != 0 || cs.RequestSize == 0 || cs.ResponseSize == 0 || cs.End.Before(cs.Start) {
+		t.Errorf("client span: %+v", cs)
+	}
+	if cs := clientSpans.spans[1]; cs.TraceID == 123 || cs.ParentSpanID != 0 || cs.Status != 404 {
+		t.Errorf("client span: %+v", cs)
+	}
+	if hs := <-handlerSpan; hs == nil || hs.TraceID != 123 || hs.SpanID == cs.SpanID {
+		t.Errorf("handler span: %+v", hs)
+	}
+	// Server span is exported after the response has been sent.
+	for i := 0; i < 100; i++ {
+		serverSpans.lock.Lock()
+		n := len(serverSpans.spans)
+		serverSpans.lock.Unlock()
+		if n == 2 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	serverSpans.lock.Lock()
+	defer serverSpans.lock.Unlock()
+	if len(serverSpans.spans) != 2 {
+		t.Fatalf("got %d server spans", len(serverSpans.spans))
+	}
+	if ss := serverSpans.spans[0]; ss.Kind != SpanKindServer || ss.TraceID != 123 || ss.ParentSpanID != cs.SpanID || ss.Method != "Test.Echo" {
+		t.Errorf("server span: %+v", ss)
+	}
+}
+
+func TestJSONSpanExporter(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	e := NewJSONSpanExporter(buf, "test")
+	start := time.Unix(1, 0)
+	e.ExportSpan(&Span{
+		TraceID: 1, SpanID: 2, ParentSpanID: 3, Kind: SpanKindClient, Method: "Sys.GetInfo",
+		Start: start, End: start.Add(time.Second), Status: 404, StatusMsg: "not found",
+	})
+	var res otlpTraces
+	if err := json.Unmarshal(buf.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	s := res.ResourceSpans[0].ScopeSpans[0].Spans[0]
+	if s.TraceID != "00000000000000000000000000000001" || s.SpanID != "0000000000000002" || s.ParentSpanID != "0000000000000003" ||
+		s.StartTimeUnixNano != "1000000000" || s.EndTimeUnixNano != "2000000000" || s.Kind != SpanKindClient ||
+		s.Status.Code != otlpStatusError || s.Status.Message != "not found" {
+		t.Errorf("got %+v", s)
+	}
+	if got := *res.ResourceSpans[0].Resource.Attributes[0].Value.StringValue; got != "test" {
+		t.Errorf("service name: %q", got)
+	}
+}
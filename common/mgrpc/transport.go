@@ -28,7 +28,8 @@ const (
 	// tWebSocket creates a permanent connection to the destination and
 	// encapsulates Clubby frames into WebSocket frames.
 	tWebSocket
-	// tPlainTCP creates a permanent connection to the destination over plain TCP.
+	// tPlainTCP creates a permanent connection to the destination over TCP,
+	// optionally secured with TLS.
 	tPlainTCP
 	// tSerial creates a permanent connection to the destination over serial port.
 	tSerial
@@ -37,4 +38,6 @@ const (
 	tGCP
 	tWatson
 	tUDP
+	// tReplay responds to requests with responses from a recording.
+	tReplay
 )
@@ -49,11 +49,12 @@ func (m *Pat) Match(s string) (bool, error) {
 		// Unfortunately, filepath.Match can only match the whole string, not part
 		// of it, and ** is not supported, so we have to just manually cut
 		// string if it has more components than the pattern
+		ss := s
 		if len(parts) > len(patParts) {
-			s = strings.Join(parts[:len(patParts)], string(filepath.Separator))
+			ss = strings.Join(parts[:len(patParts)], string(filepath.Separator))
 		}
 
-		matched, err := filepath.Match(item.Pattern, s)
+		matched, err := filepath.Match(item.Pattern, ss)
 		if err != nil {
 			return false, errors.Trace(err)
 		}
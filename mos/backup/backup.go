@@ -0,0 +1,415 @@
+//
+// Copyright (c) 2014-2019 Cesanta Software Limited
+// All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Package backup saves the state of a device, its configuration and
+// filesystem, to an archive and restores it onto the same or another device.
+package backup
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/cesanta/errors"
+	"github.com/golang/glog"
+	flag "github.com/spf13/pflag"
+
+	zip "github.com/mongoose-os/mos/common/ourzip"
+	"github.com/mongoose-os/mos/mos/dev"
+	"github.com/mongoose-os/mos/mos/flags"
+	"github.com/mongoose-os/mos/mos/fs"
+	"github.com/mongoose-os/mos/mos/ourutil"
+)
+
+var (
+	onlyConfigFlag = flag.Bool("only-config", false, "Backup or restore configuration only")
+	onlyFSFlag     = flag.Bool("only-fs", false, "Backup or restore filesystem only")
+)
+
+const (
+	// Level 0 holds the defaults, level 9 is the user level.
+	numConfigLevels = 10
+
+	manifestName   = "manifest.json"
+	configDir      = "config"
+	fsDir          = "fs"
+	manifestFormat = 1
+)
+
+// Options select what to backup or restore.
+type Options struct {
+	OnlyConfig bool
+	OnlyFS     bool
+}
+
+// File is a file of the device filesystem in the backup.
+type File struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// Manifest describes the contents of a backup.
+type Manifest struct {
+	Format  int                `json:"format"`
+	Created time.Time          `json:"created"`
+	Info    *dev.GetInfoResult `json:"info"`
+	// Config levels, configuration of each is stored as config/levelN.json.
+	// Like Config.Get with level, it includes all the levels below.
+	ConfigLevels []int `json:"config_levels,omitempty"`
+	// Files are stored under fs/.
+	Files []File `json:"files,omitempty"`
+}
+
+func configLevelName(level int) string {
+	return fmt.Sprintf("%s/level%d.json", configDir, level)
+}
+
+func addFile(zw *zip.Writer, name string, data []byte) error {
+	w, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate})
+	if err != nil {
+		return errors.Trace(err)
+	}
+	_, err = w.Write(data)
+	return errors.Trace(err)
+}
+
+// Create writes a backup of the device to w.
+func Create(ctx context.Context, devConn dev.DevConn, w io.Writer, opts Options) (*Manifest, error) {
+	m := &Manifest{Format: manifestFormat, Created: time.Now().UTC()}
+	info, err := dev.GetInfo(ctx, devConn)
+	if err != nil {
+		return nil, errors.Annotatef(err, "unable to get device info")
+	}
+	m.Info = info
+	zw := zip.NewWriter(w)
+
+	if !opts.OnlyFS {
+		for level := 0; level < numConfigLevels; level++ {
+			devConf, err := dev.GetConfigLevel(ctx, devConn, level)
+			if err != nil {
+				if level == 0 {
+					return nil, errors.Annotatef(err, "unable to get configuration")
+				}
+				// Older firmware does not support levels.
+				glog.Warningf("unable to get config level %d: %s", level, err)
+				break
+			}
+			data, err := devConf.Get("")
+			if err != nil {
+				return nil, errors.Trace(err)
+			}
+			if err := addFile(zw, configLevelName(level), []byte(data)); err != nil {
+				return nil, errors.Trace(err)
+			}
+			m.ConfigLevels = append(m.ConfigLevels, level)
+		}
+		ourutil.Reportf("Saved %d config levels", len(m.ConfigLevels))
+	}
+
+	if !opts.OnlyConfig {
+		files, err := fs.ListFiles(ctx, devConn, "/")
+		if err != nil {
+			return nil, errors.Annotatef(err, "unable to list files")
+		}
+		for _, f := range files {
+			var buf bytes.Buffer
+			ourutil.Reportf("Reading %s...", *f.Name)
+			if err := fs.GetData(ctx, devConn, *f.Name, &buf); err != nil {
+				return nil, errors.Annotatef(err, "unable to read %s", *f.Name)
+			}
+			if err := addFile(zw, path.Join(fsDir, *f.Name), buf.Bytes()); err != nil {
+				return nil, errors.Trace(err)
+			}
+			sum := sha256.Sum256(buf.Bytes())
+			m.Files = append(m.Files, File{Name: *f.Name, Size: int64(buf.Len()), SHA256: hex.EncodeToString(sum[:])})
+		}
+		ourutil.Reportf("Saved %d files", len(m.Files))
+	}
+
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if err := addFile(zw, manifestName, data); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return m, errors.Trace(zw.Close())
+}
+
+// readArchive returns the manifest and the contents of the backup.
+func readArchive(data []byte) (*Manifest, map[string][]byte, error) {
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, nil, errors.Annotatef(err, "invalid backup archive")
+	}
+	contents := map[string][]byte{}
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		if err != nil {
+			return nil, nil, errors.Annotatef(err, "%s: failed to open", f.Name)
+		}
+		fdata, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return nil, nil, errors.Annotatef(err, "%s: failed to read", f.Name)
+		}
+		contents[f.Name] = fdata
+	}
+	var m Manifest
+	if err := json.Unmarshal(contents[manifestName], &m); err != nil {
+		return nil, nil, errors.Annotatef(err, "invalid or missing %s", manifestName)
+	}
+	if m.Format != manifestFormat {
+		return nil, nil, errors.Errorf("unsupported backup format %d", m.Format)
+	}
+	return &m, contents, nil
+}
+
+// configDelta returns the values of upper that differ from lower.
+func configDelta(upper, lower map[string]interface{}) map[string]interface{} {
+	res := map[string]interface{}{}
+	for k, v := range upper {
+		um, uok := v.(map[string]interface{})
+		lm, lok := lower[k].(map[string]interface{})
+		if uok && lok {
+			if d := configDelta(um, lm); len(d) > 0 {
+				res[k] = d
+			}
+		} else if !reflect.DeepEqual(v, lower[k]) {
+			res[k] = v
+		}
+	}
+	return res
+}
+
+// isConfigFile returns true for the files that hold configuration levels.
+// They are not restored as files: conf0.json holds the defaults of the
+// firmware the device runs, the levels above it are restored via Config.Set.
+func isConfigFile(name string) bool {
+	ok, _ := path.Match("conf*.json", name)
+	return ok
+}
+
+// RestoreData restores the backup in data onto the device. The device must be
+// of the same architecture, unless --force is given.
+func RestoreData(ctx context.Context, devConn dev.DevConn, data []byte, opts Options) error {
+	m, contents, err := readArchive(data)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	info, err := dev.GetInfo(ctx, devConn)
+	if err != nil {
+		return errors.Annotatef(err, "unable to get device info")
+	}
+	if m.Info != nil && m.Info.Arch != nil && info.Arch != nil && !strings.EqualFold(*m.Info.Arch, *info.Arch) {
+		if !*flags.Force {
+			return errors.Errorf("backup was made on %s but the device is %s, use --force to restore anyway", *m.Info.Arch, *info.Arch)
+		}
+		ourutil.Reportf("Warning: backup was made on %s but the device is %s, restoring anyway", *m.Info.Arch, *info.Arch)
+	}
+
+	numFiles := 0
+	if !opts.OnlyConfig {
+		for _, f := range m.Files {
+			if isConfigFile(f.Name) {
+				glog.V(1).Infof("skipping %s", f.Name)
+				continue
+			}
+			fdata, ok := contents[path.Join(fsDir, f.Name)]
+			if !ok {
+				return errors.Errorf("%s is missing from the backup", f.Name)
+			}
+			sum := sha256.Sum256(fdata)
+			if hex.EncodeToString(sum[:]) != f.SHA256 {
+				return errors.Errorf("%s is corrupted in the backup", f.Name)
+			}
+			ourutil.Reportf("Writing %s...", f.Name)
+			if err := fs.PutData(ctx, devConn, bytes.NewReader(fdata), f.Name); err != nil {
+				return errors.Annotatef(err, "unable to write %s", f.Name)
+			}
+			numFiles++
+		}
+		ourutil.Reportf("Restored %d files", numFiles)
+	}
+
+	numLevels := 0
+	if !opts.OnlyFS {
+		if numLevels, err = restoreConfig(ctx, devConn, m, contents); err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	// Restored files and configuration take effect after reboot.
+	if numFiles+numLevels > 0 && !*flags.NoReboot {
+		ourutil.Reportf("Rebooting...")
+		if err := devConn.Call(ctx, "Sys.Reboot", nil, nil); err != nil {
+			return errors.Annotatef(err, "unable to reboot")
+		}
+	}
+	return nil
+}
+
+// getConfigLevel returns the configuration of the device up to the level.
+func getConfigLevel(ctx context.Context, devConn dev.DevConn, level int) (map[string]interface{}, error) {
+	devConf, err := dev.GetConfigLevel(ctx, devConn, level)
+	if err != nil {
+		return nil, errors.Annotatef(err, "unable to get config level %d", level)
+	}
+	v, err := devConf.GetValue("")
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	conf, _ := v.(map[string]interface{})
+	return conf, nil
+}
+
+// mergeConfig merges src into dst.
+func mergeConfig(dst, src map[string]interface{}) {
+	for k, v := range src {
+		sm, sok := v.(map[string]interface{})
+		dm, dok := dst[k].(map[string]interface{})
+		if sok && dok {
+			mergeConfig(dm, sm)
+		} else {
+			dst[k] = v
+		}
+	}
+}
+
+// restoreConfig restores the configuration levels and returns the number of
+// levels that were changed. Level 0 is the firmware defaults, each of the
+// levels above is restored as the difference from the one below.
+// Values set at a level on the device but not on the original one are reset
+// to the value of the level below, this leaves the value set at the level,
+// there is no way to unset it.
+// Firmware that does not support levels returns the same configuration for
+// all of them, such backups are restored with a plain Config.Set of the values
+// that differ from the device defaults.
+func restoreConfig(ctx context.Context, devConn dev.DevConn, m *Manifest, contents map[string][]byte) (int, error) {
+	if len(m.ConfigLevels) == 0 {
+		return 0, nil
+	}
+	levelConf := map[int]map[string]interface{}{}
+	identical := true
+	for _, level := range m.ConfigLevels {
+		var conf map[string]interface{}
+		if err := json.Unmarshal(contents[configLevelName(level)], &conf); err != nil {
+			return 0, errors.Annotatef(err, "invalid config level %d", level)
+		}
+		levelConf[level] = conf
+		if !reflect.DeepEqual(conf, levelConf[m.ConfigLevels[0]]) {
+			identical = false
+		}
+	}
+
+	if identical {
+		defaults, err := getConfigLevel(ctx, devConn, 0)
+		if err != nil {
+			return 0, errors.Trace(err)
+		}
+		delta := configDelta(levelConf[m.ConfigLevels[0]], defaults)
+		if len(delta) == 0 {
+			ourutil.Reportf("Configuration is the same as the defaults")
+			return 0, nil
+		}
+		ourutil.Reportf("Backup has no separate config levels, setting configuration...")
+		if err := devConn.Call(ctx, "Config.Set", &dev.ConfigSetArg{Config: delta, Save: true}, nil); err != nil {
+			return 0, errors.Annotatef(err, "unable to set config")
+		}
+		return 1, nil
+	}
+
+	numLevels := 0
+	for _, level := range m.ConfigLevels {
+		if level == 0 {
+			continue
+		}
+		// Levels below have been restored already.
+		lower, err := getConfigLevel(ctx, devConn, level-1)
+		if err != nil {
+			return 0, errors.Trace(err)
+		}
+		upper, err := getConfigLevel(ctx, devConn, level)
+		if err != nil {
+			return 0, errors.Trace(err)
+		}
+		delta := configDelta(lower, upper)
+		mergeConfig(delta, configDelta(levelConf[level], levelConf[level-1]))
+		if len(configDelta(delta, upper)) == 0 {
+			continue
+		}
+		ourutil.Reportf("Setting config level %d...", level)
+		arg := &dev.ConfigSetArg{Config: delta, Level: level, Save: true}
+		if err := devConn.Call(ctx, "Config.Set", arg, nil); err != nil {
+			return 0, errors.Annotatef(err, "unable to set config level %d", level)
+		}
+		numLevels++
+	}
+	ourutil.Reportf("Restored %d config levels", numLevels)
+	return numLevels, nil
+}
+
+// Backup is the handler of "mos backup out.zip".
+func Backup(ctx context.Context, devConn dev.DevConn) error {
+	args := flag.Args()
+	if len(args) != 2 {
+		return errors.Errorf("output file name is required")
+	}
+	opts := Options{OnlyConfig: *onlyConfigFlag, OnlyFS: *onlyFSFlag}
+	if opts.OnlyConfig && opts.OnlyFS {
+		return errors.Errorf("--only-config and --only-fs are mutually exclusive")
+	}
+	var buf bytes.Buffer
+	if _, err := Create(ctx, devConn, &buf, opts); err != nil {
+		return errors.Trace(err)
+	}
+	if err := ioutil.WriteFile(args[1], buf.Bytes(), 0600); err != nil {
+		return errors.Trace(err)
+	}
+	ourutil.Reportf("Backup saved to %s", args[1])
+	return nil
+}
+
+// Restore is the handler of "mos restore in.zip".
+func Restore(ctx context.Context, devConn dev.DevConn) error {
+	args := flag.Args()
+	if len(args) != 2 {
+		return errors.Errorf("backup file name is required")
+	}
+	opts := Options{OnlyConfig: *onlyConfigFlag, OnlyFS: *onlyFSFlag}
+	if opts.OnlyConfig && opts.OnlyFS {
+		return errors.Errorf("--only-config and --only-fs are mutually exclusive")
+	}
+	data, err := ioutil.ReadFile(args[1])
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if err := RestoreData(ctx, devConn, data, opts); err != nil {
+		return errors.Trace(err)
+	}
+	ourutil.Reportf("Restored from %s", args[1])
+	return nil
+}
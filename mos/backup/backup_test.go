@@ -0,0 +1,151 @@
+//
+// Copyright (c) 2014-2019 Cesanta Software Limited
+// All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package backup_test
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	flag "github.com/spf13/pflag"
+
+	"github.com/mongoose-os/mos/mos/backup"
+	"github.com/mongoose-os/mos/mos/dev"
+	"github.com/mongoose-os/mos/mos/fs"
+	"github.com/mongoose-os/mos/mos/sim"
+)
+
+func getConf(t *testing.T, ctx context.Context, devConn dev.DevConn, path string) string {
+	devConf, err := dev.GetConfigLevel(ctx, devConn, 9)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := devConf.Get(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+func setConf(t *testing.T, ctx context.Context, devConn dev.DevConn, level int, key string, value interface{}) {
+	arg := &dev.ConfigSetArg{Config: map[string]interface{}{key: value}, Level: level, Save: true}
+	if err := devConn.Call(ctx, "Config.Set", arg, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBackupRestore(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	flag.Set("no-reboot", "true")
+	defer flag.Set("no-reboot", "false")
+
+	_, src, closeSrc := sim.NewTestConn(t, ctx, sim.Options{})
+	defer closeSrc()
+	if err := fs.PutData(ctx, src, strings.NewReader("hello"), "hello.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.PutData(ctx, src, strings.NewReader(`{"src": true}`), "conf0.json"); err != nil {
+		t.Fatal(err)
+	}
+	for level, ssid := range map[int]string{5: "vendor", 9: "user"} {
+		setConf(t, ctx, src, level, "wifi", map[string]interface{}{"sta": map[string]interface{}{"ssid": ssid}})
+	}
+	var buf bytes.Buffer
+	m, err := backup.Create(ctx, src, &buf, backup.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.ConfigLevels) != 10 || len(m.Files) != 2 || m.Files[1].Name != "hello.txt" {
+		t.Errorf("unexpected manifest %+v", m)
+	}
+
+	_, dst, closeDst := sim.NewTestConn(t, ctx, sim.Options{})
+	defer closeDst()
+	// Firmware's own config file is kept.
+	if err := fs.PutData(ctx, dst, strings.NewReader(`{"dst": true}`), "conf0.json"); err != nil {
+		t.Fatal(err)
+	}
+	// Values that are not set on the original device are reset.
+	setConf(t, ctx, dst, 9, "debug", map[string]interface{}{"level": 3})
+	if err := backup.RestoreData(ctx, dst, buf.Bytes(), backup.Options{}); err != nil {
+		t.Fatal(err)
+	}
+	var got bytes.Buffer
+	if err := fs.GetData(ctx, dst, "hello.txt", &got); err != nil || got.String() != "hello" {
+		t.Errorf("got %q %v", got.String(), err)
+	}
+	got.Reset()
+	if err := fs.GetData(ctx, dst, "conf0.json", &got); err != nil || got.String() != `{"dst": true}` {
+		t.Errorf("got conf0.json %q %v", got.String(), err)
+	}
+	if got := getConf(t, ctx, dst, "wifi.sta.ssid"); got != "user" {
+		t.Errorf("got ssid %q", got)
+	}
+	if got := getConf(t, ctx, dst, "debug.level"); got != "2" {
+		t.Errorf("got debug.level %q", got)
+	}
+	devConf, err := dev.GetConfigLevel(ctx, dst, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := devConf.Get("wifi.sta.ssid"); got != "vendor" {
+		t.Errorf("got level 8 ssid %q", got)
+	}
+
+	_, cfgOnly, closeCfgOnly := sim.NewTestConn(t, ctx, sim.Options{})
+	defer closeCfgOnly()
+	if err := backup.RestoreData(ctx, cfgOnly, buf.Bytes(), backup.Options{OnlyConfig: true}); err != nil {
+		t.Fatal(err)
+	}
+	if files, err := fs.ListFiles(ctx, cfgOnly, "/"); err != nil || len(files) != 0 {
+		t.Errorf("expected no files, got %v %v", files, err)
+	}
+
+	_, other, closeOther := sim.NewTestConn(t, ctx, sim.Options{Info: sim.Info{Arch: "esp32"}})
+	defer closeOther()
+	if err := backup.RestoreData(ctx, other, buf.Bytes(), backup.Options{}); err == nil || !strings.Contains(err.Error(), "esp32") {
+		t.Errorf("expected arch mismatch error, got %v", err)
+	}
+}
+
+func TestRestoreWithoutLevels(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	flag.Set("no-reboot", "true")
+	defer flag.Set("no-reboot", "false")
+
+	// Firmware returns the same configuration for all levels.
+	_, src, closeSrc := sim.NewTestConn(t, ctx, sim.Options{NoConfigLevels: true})
+	defer closeSrc()
+	setConf(t, ctx, src, 0, "wifi", map[string]interface{}{"sta": map[string]interface{}{"ssid": "user"}})
+	var buf bytes.Buffer
+	if _, err := backup.Create(ctx, src, &buf, backup.Options{OnlyConfig: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	_, dst, closeDst := sim.NewTestConn(t, ctx, sim.Options{})
+	defer closeDst()
+	if err := backup.RestoreData(ctx, dst, buf.Bytes(), backup.Options{}); err != nil {
+		t.Fatal(err)
+	}
+	if got := getConf(t, ctx, dst, "wifi.sta.ssid"); got != "user" {
+		t.Errorf("got ssid %q", got)
+	}
+}
@@ -20,9 +20,11 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 
 	"github.com/mongoose-os/mos/mos/dev"
 	"github.com/mongoose-os/mos/mos/flags"
+	"github.com/mongoose-os/mos/mos/output"
 
 	"github.com/cesanta/errors"
 	flag "github.com/spf13/pflag"
@@ -41,7 +43,10 @@ func isJSON(s string) bool {
 func callDeviceService(
 	ctx context.Context, devConn dev.DevConn, method string, args string,
 ) (string, error) {
-	b, e := devConn.(*dev.MosDevConn).CallB(ctx, method, args)
+	var resp json.RawMessage
+	e := devConn.Call(ctx, method, args, &resp)
+	// Ignoring errors here, cause response could be empty which is a success
+	b, _ := json.MarshalIndent(resp, "", "  ")
 
 	// TODO(dfrank): instead of that, we should probably add a separate function
 	// for rebooting
@@ -74,6 +79,12 @@ func call(ctx context.Context, devConn dev.DevConn) error {
 		return err
 	}
 
-	fmt.Println(result)
-	return nil
+	var v json.RawMessage
+	if result != "" {
+		v = json.RawMessage(result)
+	}
+	return output.Print(ctx, v, func(w io.Writer) error {
+		_, err := fmt.Fprintln(w, result)
+		return err
+	})
 }
@@ -40,8 +40,9 @@ var (
 	AppsDir        = ""
 	modulesDirFlag = ""
 
-	StateFilepath = ""
-	AuthFilepath  = ""
+	StateFilepath   = ""
+	AuthFilepath    = ""
+	DevicesFilepath = ""
 )
 
 func init() {
@@ -53,6 +54,7 @@ func init() {
 
 	flag.StringVar(&StateFilepath, "state-file", "~/.mos/state.json", "Where to store internal mos state")
 	flag.StringVar(&AuthFilepath, "auth-file", "~/.mos/auth.json", "Where to store license server auth key")
+	flag.StringVar(&DevicesFilepath, "devices-file", "~/.mos/devices.yaml", "Device inventory file")
 }
 
 // Init() should be called after all flags are parsed
@@ -95,6 +97,11 @@ func Init() error {
 		return errors.Trace(err)
 	}
 
+	DevicesFilepath, err = NormalizePath(DevicesFilepath, version.GetMosVersion())
+	if err != nil {
+		return errors.Trace(err)
+	}
+
 	if err := os.MkdirAll(TmpDir, 0777); err != nil {
 		return errors.Trace(err)
 	}
@@ -0,0 +1,186 @@
+//
+// Copyright (c) 2014-2019 Cesanta Software Limited
+// All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package config
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/cesanta/errors"
+	"github.com/fatih/color"
+	flag "github.com/spf13/pflag"
+	yaml "gopkg.in/yaml.v2"
+
+	"github.com/mongoose-os/mos/mos/dev"
+	"github.com/mongoose-os/mos/mos/flags"
+	"github.com/mongoose-os/mos/mos/ourutil"
+	"github.com/mongoose-os/mos/mos/output"
+)
+
+// ReadConfigFile reads a configuration document in JSON or, unless the file
+// name ends with .json, YAML.
+func ReadConfigFile(fname string) (map[string]interface{}, error) {
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	var doc map[string]interface{}
+	if strings.ToLower(filepath.Ext(fname)) == ".json" {
+		if err := json.Unmarshal(data, &doc); err != nil {
+			return nil, errors.Annotatef(err, "%s: invalid JSON", fname)
+		}
+		return doc, nil
+	}
+	var ydoc interface{}
+	if err := yaml.Unmarshal(data, &ydoc); err != nil {
+		return nil, errors.Annotatef(err, "%s: invalid YAML", fname)
+	}
+	v, err := fromYAML(ydoc)
+	if err != nil {
+		return nil, errors.Annotatef(err, "%s", fname)
+	}
+	doc, ok := v.(map[string]interface{})
+	if !ok && v != nil {
+		return nil, errors.Errorf("%s: configuration must be an object", fname)
+	}
+	return doc, nil
+}
+
+// fromYAML converts a value decoded from YAML to what it would be if decoded
+// from JSON: maps have string keys and numbers are float64.
+func fromYAML(v interface{}) (interface{}, error) {
+	switch vv := v.(type) {
+	case map[interface{}]interface{}:
+		res := make(map[string]interface{})
+		for k, e := range vv {
+			ks, ok := k.(string)
+			if !ok {
+				return nil, errors.Errorf("invalid key: %v (must be a string)", k)
+			}
+			ev, err := fromYAML(e)
+			if err != nil {
+				return nil, errors.Trace(err)
+			}
+			res[ks] = ev
+		}
+		return res, nil
+	case []interface{}:
+		res := make([]interface{}, len(vv))
+		for i, e := range vv {
+			ev, err := fromYAML(e)
+			if err != nil {
+				return nil, errors.Trace(err)
+			}
+			res[i] = ev
+		}
+		return res, nil
+	case int:
+		return float64(vv), nil
+	case int64:
+		return float64(vv), nil
+	case uint64:
+		return float64(vv), nil
+	}
+	return v, nil
+}
+
+func formatValue(v interface{}) string {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprintf("%v", v)
+	}
+	return string(data)
+}
+
+// PrintDiff prints the changes, old values in red and new ones in green.
+func PrintDiff(w io.Writer, changes []dev.ConfChange) {
+	red, green := color.New(color.FgRed), color.New(color.FgGreen)
+	for _, c := range changes {
+		red.Fprintf(w, "- %s: %s\n", c.Path, formatValue(c.Old))
+		green.Fprintf(w, "+ %s: %s\n", c.Path, formatValue(c.New))
+	}
+}
+
+// Apply merges the configuration document in the file given as the argument
+// into the device configuration at --level and sets it all at once.
+func Apply(ctx context.Context, devConn dev.DevConn) error {
+	args := flag.Args()[1:]
+	if len(args) != 1 {
+		return errors.Errorf("configuration file is required")
+	}
+	doc, err := ReadConfigFile(args[0])
+	if err != nil {
+		return errors.Trace(err)
+	}
+	schema, err := readSchemaFromFlags()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if schema != nil {
+		if err := validationError(schema.Validate(doc)); err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	ourutil.Reportf("Getting configuration...")
+	devConf, err := dev.GetConfigLevel(ctx, devConn, *flags.Level)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if err := devConf.Merge(doc); err != nil {
+		return errors.Trace(err)
+	}
+	res := &ApplyResult{Changes: devConf.Changes()}
+	if res.Changes == nil {
+		res.Changes = []dev.ConfChange{}
+	}
+	switch {
+	case len(res.Changes) == 0:
+		ourutil.Reportf("Configuration is up to date")
+	case flags.IsDryRun():
+		printDiffText(ctx, res.Changes)
+		ourutil.Reportf("Dry run, not applying %d change(s)", len(res.Changes))
+	default:
+		printDiffText(ctx, res.Changes)
+		if err := SetAndSaveLevel(ctx, devConn, devConf, *flags.Level); err != nil {
+			return errors.Trace(err)
+		}
+		res.Applied = true
+	}
+	// In text form the result is the diff, printed before applying it.
+	return output.Print(ctx, res, func(w io.Writer) error { return nil })
+}
+
+// ApplyResult is the result of config-apply.
+type ApplyResult struct {
+	Changes []dev.ConfChange `json:"changes"`
+	// False if the configuration is up to date or it is a dry run.
+	Applied bool `json:"applied"`
+}
+
+// printDiffText prints the changes unless a structured output format is
+// selected, which has them in ApplyResult.
+func printDiffText(ctx context.Context, changes []dev.ConfChange) {
+	if !output.Structured() {
+		PrintDiff(ourutil.Output(ctx), changes)
+	}
+}
@@ -0,0 +1,111 @@
+//
+// Copyright (c) 2014-2019 Cesanta Software Limited
+// All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package config_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mongoose-os/mos/mos/config"
+	"github.com/mongoose-os/mos/mos/dev"
+	"github.com/mongoose-os/mos/mos/sim"
+)
+
+func TestApply(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var defaults map[string]interface{}
+	json.Unmarshal([]byte(`{
+  "debug": {"level": 2},
+  "wifi": {"sta": {"enable": false, "ssid": ""}, "ap": {"enable": true}},
+  "dns": {"servers": ["8.8.8.8"]}
+}`), &defaults)
+	_, devConn, closeDev := sim.NewTestConn(t, ctx, sim.Options{Defaults: defaults})
+	defer closeDev()
+
+	fname := filepath.Join(dir, "conf.yaml")
+	ioutil.WriteFile(fname, []byte(`
+debug:
+  level: 2
+wifi:
+  sta:
+    enable: true
+    ssid: lab
+dns:
+  servers: [1.1.1.1, 8.8.8.8]
+`), 0644)
+	doc, err := config.ReadConfigFile(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	devConf, err := dev.GetConfig(ctx, devConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := devConf.Merge(doc); err != nil {
+		t.Fatal(err)
+	}
+	var diff bytes.Buffer
+	config.PrintDiff(&diff, devConf.Changes())
+	want := `- dns.servers: ["8.8.8.8"]
++ dns.servers: ["1.1.1.1","8.8.8.8"]
+- wifi.sta.enable: false
++ wifi.sta.enable: true
+- wifi.sta.ssid: ""
++ wifi.sta.ssid: "lab"
+`
+	if diff.String() != want {
+		t.Errorf("got diff:\n%s\nwant:\n%s", diff.String(), want)
+	}
+	if _, err := dev.SetConfig(ctx, devConn, devConf, &dev.ConfigSetArg{}); err != nil {
+		t.Fatal(err)
+	}
+	devConf, err = dev.GetConfig(ctx, devConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := devConf.Merge(doc); err != nil {
+		t.Fatal(err)
+	}
+	if changes := devConf.Changes(); len(changes) != 0 {
+		t.Errorf("expected no changes after apply, got %v", changes)
+	}
+
+	for _, bad := range []string{"wifi: {sta: {enable: 1}}", "wifi: {foo: 1}", "wifi: true"} {
+		ioutil.WriteFile(fname, []byte(bad), 0644)
+		doc, err := config.ReadConfigFile(fname)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := devConf.Merge(doc); err == nil || !strings.Contains(err.Error(), "wifi") {
+			t.Errorf("%s: expected an error, got %v", bad, err)
+		}
+	}
+}
@@ -19,6 +19,7 @@ package config
 import (
 	"context"
 	"fmt"
+	"io"
 	"sort"
 	"time"
 
@@ -28,6 +29,7 @@ import (
 	"github.com/mongoose-os/mos/mos/dev"
 	"github.com/mongoose-os/mos/mos/flags"
 	"github.com/mongoose-os/mos/mos/ourutil"
+	"github.com/mongoose-os/mos/mos/output"
 	flag "github.com/spf13/pflag"
 )
 
@@ -62,14 +64,31 @@ func Get(ctx context.Context, devConn dev.DevConn) error {
 	if err != nil {
 		return errors.Trace(err)
 	}
+	v, _ := devConf.GetValue(path)
 
-	fmt.Println(val)
-
-	return nil
+	return output.Print(ctx, v, func(w io.Writer) error {
+		_, err := fmt.Fprintln(w, val)
+		return err
+	})
 }
 
 func Set(ctx context.Context, devConn dev.DevConn) error {
-	return SetWithArgs(ctx, devConn, flag.Args()[1:])
+	args := flag.Args()[1:]
+	if err := SetWithArgs(ctx, devConn, args); err != nil {
+		return errors.Trace(err)
+	}
+	values, err := moscommon.ParseParamValues(args)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	res := &SetResult{Values: values, Saved: !*flags.NoSave}
+	return output.Print(ctx, res, func(w io.Writer) error { return nil })
+}
+
+// SetResult is printed by config-set with a structured output format.
+type SetResult struct {
+	Values map[string]string `json:"values"`
+	Saved  bool              `json:"saved"`
 }
 
 func SetWithArgs(
@@ -79,14 +98,25 @@ func SetWithArgs(
 		return errors.Errorf("at least one path.to.value=value pair should be given")
 	}
 
-	// Get all config from the attached device
-	ourutil.Reportf("Getting configuration...")
-	devConf, err := dev.GetConfigLevel(ctx, devConn, *flags.Level)
+	paramValues, err := moscommon.ParseParamValues(args)
 	if err != nil {
 		return errors.Trace(err)
 	}
 
-	paramValues, err := moscommon.ParseParamValues(args)
+	// Check values against the schema, if given, before talking to the device
+	schema, err := readSchemaFromFlags()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if schema != nil {
+		if err := validationError(schema.ValidateParams(paramValues)); err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	// Get all config from the attached device
+	ourutil.Reportf("Getting configuration...")
+	devConf, err := dev.GetConfigLevel(ctx, devConn, *flags.Level)
 	if err != nil {
 		return errors.Trace(err)
 	}
@@ -131,25 +161,30 @@ func SetAndSaveLevel(ctx context.Context, devConn dev.DevConn, devConf *dev.DevC
 		return nil
 	}
 
-	attempts := saveAttempts
-	for arg.Save {
+	if arg.Save {
 		if !arg.Reboot {
 			ourutil.Reportf("Saving...")
 		} else {
 			ourutil.Reportf("Saving and rebooting...")
 		}
-		ctx2, cancel := context.WithTimeout(ctx, saveTimeout)
-		defer cancel()
-		if err = devConn.Call(ctx2, "Config.Save", map[string]interface{}{
-			"reboot":   arg.Reboot,
-			"try_once": arg.TryOnce,
-		}, nil); err != nil {
-			attempts -= 1
-			if attempts > 0 {
-				glog.Warningf("Error: %s", err)
-				continue
+		// The connection does not retry saving with reboot, as it cannot
+		// tell if the device has rebooted already. Here it is worth the risk
+		// of a second reboot, leaving the configuration unsaved is worse.
+		for attempt := 1; ; attempt++ {
+			ctx2, cancel := context.WithTimeout(dev.WithoutRetries(ctx), saveTimeout)
+			err = devConn.Call(ctx2, "Config.Save", map[string]interface{}{
+				"reboot":   arg.Reboot,
+				"try_once": arg.TryOnce,
+			}, nil)
+			cancel()
+			if err == nil {
+				break
 			}
-			return errors.Trace(err)
+			if attempt >= saveAttempts || !dev.IsRetryable(err) || ctx.Err() != nil {
+				return errors.Trace(err)
+			}
+			glog.Warningf("Error: %s", err)
+			dev.EnsureConnected(ctx, devConn)
 		}
 		if arg.TryOnce {
 			ourutil.Reportf("Note: --try-once is set, config is valid for one reboot only")
@@ -158,7 +193,6 @@ func SetAndSaveLevel(ctx context.Context, devConn dev.DevConn, devConf *dev.DevC
 		if arg.Reboot {
 			time.Sleep(200 * time.Millisecond)
 		}
-		break
 	}
 
 	return nil
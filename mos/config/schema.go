@@ -0,0 +1,342 @@
+//
+// Copyright (c) 2014-2019 Cesanta Software Limited
+// All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package config
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/cesanta/errors"
+	flag "github.com/spf13/pflag"
+	yaml "gopkg.in/yaml.v2"
+
+	"github.com/mongoose-os/mos/common/fwbundle"
+	moscommon "github.com/mongoose-os/mos/mos/common"
+	"github.com/mongoose-os/mos/mos/dev"
+	"github.com/mongoose-os/mos/mos/ourutil"
+	"github.com/mongoose-os/mos/mos/output"
+)
+
+var schemaFlag = flag.String("schema", "", "Config schema to validate configuration against: "+
+	"schema file, build directory or firmware bundle containing mos_conf_schema.yml")
+
+// Config schema value types.
+const (
+	SchemaObject   = "o"
+	SchemaString   = "s"
+	SchemaBool     = "b"
+	SchemaInt      = "i"
+	SchemaUnsigned = "ui"
+	SchemaDouble   = "d"
+	SchemaFloat    = "f"
+)
+
+// SchemaEntry describes a configuration value.
+type SchemaEntry struct {
+	Path    string
+	Type    string
+	Default interface{}
+	// Optional constraints, from the attributes of the schema item.
+	Min  *float64
+	Max  *float64
+	Enum []interface{}
+}
+
+// Schema is a configuration schema, as generated into mos_conf_schema.yml.
+// Each item is a list of the path, type, default value and attributes, e.g.:
+//
+//	- ["foo", "o", {title: "Foo settings"}]
+//	- ["foo.mode", "s", "auto", {enum: ["auto", "manual"]}]
+//	- ["foo.level", "i", 1, {min: 0, max: 5}]
+//	- ["foo.enable", true]
+//
+// Type can be omitted, in which case it is inferred from the default value.
+type Schema struct {
+	entries map[string]*SchemaEntry
+}
+
+func toFloat(v interface{}) (float64, bool) {
+	switch vv := v.(type) {
+	case int:
+		return float64(vv), true
+	case float64:
+		return vv, true
+	}
+	return 0, false
+}
+
+// ParseSchema parses the YAML schema.
+func ParseSchema(data []byte) (*Schema, error) {
+	var items [][]interface{}
+	if err := yaml.Unmarshal(data, &items); err != nil {
+		return nil, errors.Annotatef(err, "invalid schema")
+	}
+	s := &Schema{entries: map[string]*SchemaEntry{}}
+	for i, item := range items {
+		if len(item) < 2 {
+			return nil, errors.Errorf("schema item %d: too short", i+1)
+		}
+		p, ok := item[0].(string)
+		if !ok || p == "" {
+			return nil, errors.Errorf("schema item %d: invalid path %v", i+1, item[0])
+		}
+		e := &SchemaEntry{Path: p}
+		rest := item[1:]
+		if t, ok := rest[0].(string); ok && schemaTypeNames[t] != "" && (len(rest) > 1 || t == SchemaObject) {
+			e.Type, rest = t, rest[1:]
+		}
+		if e.Type != SchemaObject && len(rest) > 0 {
+			e.Default, rest = rest[0], rest[1:]
+			if e.Type == "" {
+				switch d := e.Default.(type) {
+				case string:
+					e.Type = SchemaString
+				case bool:
+					e.Type = SchemaBool
+				case int:
+					e.Type = SchemaInt
+				case float64:
+					e.Type = SchemaDouble
+				default:
+					return nil, errors.Errorf("schema item %d (%s): cannot infer type of %v", i+1, p, d)
+				}
+			}
+		}
+		if len(rest) > 0 {
+			attrs, err := fromYAML(rest[0])
+			if err != nil {
+				return nil, errors.Annotatef(err, "schema item %d (%s)", i+1, p)
+			}
+			if am, ok := attrs.(map[string]interface{}); ok {
+				if v, ok := toFloat(am["min"]); ok {
+					e.Min = &v
+				}
+				if v, ok := toFloat(am["max"]); ok {
+					e.Max = &v
+				}
+				e.Enum, _ = am["enum"].([]interface{})
+			}
+		}
+		s.entries[p] = e
+	}
+	return s, nil
+}
+
+// ReadSchema reads the schema from a file. A build directory or a firmware
+// bundle with a mos_conf_schema.yml part can also be given.
+func ReadSchema(fname string) (*Schema, error) {
+	schemaFileName := filepath.Base(moscommon.GetConfSchemaFilePath(""))
+	if fi, err := os.Stat(fname); err == nil && fi.IsDir() {
+		fname = moscommon.GetConfSchemaFilePath(fname)
+	}
+	if strings.ToLower(filepath.Ext(fname)) == ".zip" {
+		fwb, err := fwbundle.ReadZipFirmwareBundle(fname)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		for _, p := range fwb.Parts {
+			if p.Name == schemaFileName || path.Base(p.Src) == schemaFileName {
+				data, err := p.GetData()
+				if err != nil {
+					return nil, errors.Trace(err)
+				}
+				s, err := ParseSchema(data)
+				return s, errors.Annotatef(err, "%s", fname)
+			}
+		}
+		return nil, errors.Errorf("%s: no %s in the bundle", fname, schemaFileName)
+	}
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	s, err := ParseSchema(data)
+	return s, errors.Annotatef(err, "%s", fname)
+}
+
+// readSchemaFromFlags returns the schema given with --schema, or nil if there is none.
+func readSchemaFromFlags() (*Schema, error) {
+	if *schemaFlag == "" {
+		return nil, nil
+	}
+	return ReadSchema(*schemaFlag)
+}
+
+func (s *Schema) validateValue(p string, v interface{}) []error {
+	e := s.entries[p]
+	if e == nil {
+		return []error{errors.Errorf("%s: unknown config key", p)}
+	}
+	if vm, ok := v.(map[string]interface{}); ok {
+		if e.Type != SchemaObject {
+			return []error{errors.Errorf("%s: expected %s, got an object", p, typeName(e.Type))}
+		}
+		var errs []error
+		for _, k := range sortedKeys(vm) {
+			errs = append(errs, s.validateValue(p+"."+k, vm[k])...)
+		}
+		return errs
+	}
+	ok := true
+	f, isNum := toFloat(v)
+	switch e.Type {
+	case SchemaObject:
+		ok = false
+	case SchemaString:
+		_, ok = v.(string)
+	case SchemaBool:
+		_, ok = v.(bool)
+	case SchemaInt:
+		ok = isNum && f == math.Trunc(f)
+	case SchemaUnsigned:
+		ok = isNum && f == math.Trunc(f) && f >= 0
+	case SchemaDouble, SchemaFloat:
+		ok = isNum
+	}
+	if !ok {
+		return []error{errors.Errorf("%s: expected %s, got %s", p, typeName(e.Type), formatValue(v))}
+	}
+	if e.Min != nil && isNum && f < *e.Min {
+		return []error{errors.Errorf("%s: %s is less than the minimum %v", p, formatValue(v), *e.Min)}
+	}
+	if e.Max != nil && isNum && f > *e.Max {
+		return []error{errors.Errorf("%s: %s is greater than the maximum %v", p, formatValue(v), *e.Max)}
+	}
+	if len(e.Enum) > 0 {
+		for _, ev := range e.Enum {
+			if formatValue(ev) == formatValue(v) {
+				return nil
+			}
+		}
+		return []error{errors.Errorf("%s: %s is not one of %s", p, formatValue(v), formatValue(e.Enum))}
+	}
+	return nil
+}
+
+// Descriptions of the value types, for error messages.
+var schemaTypeNames = map[string]string{
+	SchemaObject:   "an object",
+	SchemaString:   "a string",
+	SchemaBool:     "a boolean",
+	SchemaInt:      "an integer",
+	SchemaUnsigned: "an unsigned integer",
+	SchemaDouble:   "a number",
+	SchemaFloat:    "a number",
+}
+
+func typeName(t string) string {
+	if name, ok := schemaTypeNames[t]; ok {
+		return name
+	}
+	return t
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	var keys []string
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Validate checks the configuration document against the schema and returns
+// all the problems found.
+func (s *Schema) Validate(doc map[string]interface{}) []error {
+	var errs []error
+	for _, k := range sortedKeys(doc) {
+		errs = append(errs, s.validateValue(k, doc[k])...)
+	}
+	return errs
+}
+
+// ValidateParams checks path=value pairs, as given to config-set.
+// Values are converted according to the schema.
+func (s *Schema) ValidateParams(params map[string]string) []error {
+	var errs []error
+	var paths []string
+	for p := range params {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	for _, p := range paths {
+		var v interface{} = params[p]
+		if e := s.entries[p]; e != nil && e.Type != SchemaString {
+			if f, err := strconv.ParseFloat(params[p], 64); err == nil {
+				v = f
+			} else if b, err := strconv.ParseBool(params[p]); err == nil {
+				v = b
+			}
+		}
+		errs = append(errs, s.validateValue(p, v)...)
+	}
+	return errs
+}
+
+// validationError combines the problems into one error.
+func validationError(errs []error) error {
+	if len(errs) == 0 {
+		return nil
+	}
+	var lines []string
+	for _, err := range errs {
+		lines = append(lines, err.Error())
+	}
+	return errors.Errorf("invalid configuration:\n  %s", strings.Join(lines, "\n  "))
+}
+
+// Validate is the handler of config-validate: it checks the configuration
+// file against the schema without talking to the device.
+func Validate(ctx context.Context, devConn dev.DevConn) error {
+	args := flag.Args()[1:]
+	if len(args) != 1 {
+		return errors.Errorf("configuration file is required")
+	}
+	doc, err := ReadConfigFile(args[0])
+	if err != nil {
+		return errors.Trace(err)
+	}
+	schemaFile := *schemaFlag
+	if schemaFile == "" {
+		schemaFile = moscommon.GetConfSchemaFilePath(moscommon.GetBuildDir(""))
+	}
+	schema, err := ReadSchema(schemaFile)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	errs := schema.Validate(doc)
+	if len(errs) > 0 && output.Structured() {
+		return validationError(errs)
+	}
+	w := ourutil.Output(ctx)
+	for _, err := range errs {
+		fmt.Fprintln(w, err)
+	}
+	if len(errs) > 0 {
+		return errors.Errorf("%s: %d problem(s) found", args[0], len(errs))
+	}
+	ourutil.Reportf("%s is valid", args[0])
+	return nil
+}
@@ -0,0 +1,65 @@
+//
+// Copyright (c) 2014-2019 Cesanta Software Limited
+// All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package config_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/mongoose-os/mos/mos/config"
+)
+
+const testSchema = `
+- ["app", "o", {title: "App settings"}]
+- ["app.mode", "s", "auto", {enum: ["auto", "manual"]}]
+- ["app.level", "i", 1, {min: 0, max: 5}]
+- ["app.enable", true]
+- ["app.ratio", 0.5]
+- ["app.name", ""]
+`
+
+func TestSchema(t *testing.T) {
+	schema, err := config.ParseSchema([]byte(testSchema))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		doc  string
+		want string
+	}{
+		{`{"app": {"mode": "manual", "level": 5, "enable": false, "ratio": 2, "name": "x"}}`, "[]"},
+		{`{"app": {"mod": "auto"}}`, "[app.mod: unknown config key]"},
+		{`{"app": {"level": 1.5, "enable": "yes"}}`, "[app.enable: expected a boolean, got \"yes\" app.level: expected an integer, got 1.5]"},
+		{`{"app": {"level": 6, "mode": "off"}}`, "[app.level: 6 is greater than the maximum 5 app.mode: \"off\" is not one of [\"auto\",\"manual\"]]"},
+		{`{"app": true}`, "[app: expected an object, got true]"},
+		{`{"app": {"name": {}}}`, "[app.name: expected a string, got an object]"},
+	} {
+		var doc map[string]interface{}
+		if err := json.Unmarshal([]byte(c.doc), &doc); err != nil {
+			t.Fatal(err)
+		}
+		if got := fmt.Sprint(schema.Validate(doc)); got != c.want {
+			t.Errorf("%s: got %s, want %s", c.doc, got, c.want)
+		}
+	}
+
+	errs := schema.ValidateParams(map[string]string{"app.level": "3", "app.enable": "true", "app.name": "42", "app.levle": "1"})
+	if got, want := fmt.Sprint(errs), "[app.levle: unknown config key]"; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
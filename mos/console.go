@@ -235,7 +235,11 @@ func console(ctx context.Context, devConn dev.DevConn) error {
 		if err = devConn.Call(ctx, "Dash.Console.Subscribe", nil, nil); err != nil {
 			return errors.Trace(err)
 		}
-		devConn.(*dev.MosDevConn).RPC.AddHandler("Dash.Console.Event", func(c mgrpc.MgRPC, f *frame.Frame) *frame.Frame {
+		mdc, ok := dev.AsMosDevConn(devConn)
+		if !ok {
+			return errors.Errorf("%s is not a direct connection", *flags.Port)
+		}
+		mdc.RPC.AddHandler("Dash.Console.Event", func(_ context.Context, c mgrpc.MgRPC, f *frame.Frame) *frame.Frame {
 			var ev struct {
 				DevId string          `json:"id"`
 				Name  string          `json:"name"`
@@ -36,8 +36,14 @@ import (
 )
 
 func CreateFWBundle(ctx context.Context, devConn dev.DevConn) error {
-	if *flags.Output == "" {
-		return errors.Errorf("--output is required")
+	bundleFile := *flags.BundleFile
+	if bundleFile == "" {
+		// Before --bundle-file, the file name was given as --output.
+		// It still is, as long as it is not an output format.
+		if flags.CheckOutputFormat() == nil {
+			return errors.Errorf("--bundle-file is required")
+		}
+		bundleFile = *flags.Output
 	}
 	var err error
 	var fwb *fwbundle.FirmwareBundle
@@ -124,6 +130,6 @@ func CreateFWBundle(ctx context.Context, devConn dev.DevConn) error {
 	if err != nil {
 		return errors.Annotatef(err, "failed to parse --extra-attr")
 	}
-	ourutil.Reportf("Writing %s", *flags.Output)
-	return fwbundle.WriteZipFirmwareBundle(fwb, *flags.Output, *flags.Compress, extraAttrs)
+	ourutil.Reportf("Writing %s", bundleFile)
+	return fwbundle.WriteZipFirmwareBundle(fwb, bundleFile, *flags.Compress, extraAttrs)
 }
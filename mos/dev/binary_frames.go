@@ -0,0 +1,83 @@
+//
+// Copyright (c) 2014-2019 Cesanta Software Limited
+// All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package dev
+
+import (
+	"context"
+
+	"github.com/cesanta/errors"
+	"github.com/golang/glog"
+	flag "github.com/spf13/pflag"
+)
+
+var binaryFramesFlag = flag.Bool("binary-frames", true, "Send file and firmware data over serial in binary frames, if supported by the device")
+
+// EnableBinaryFrames switches the connection to binary frames for the data
+// of file and firmware transfers, if possible. Otherwise data keeps being
+// sent base64-encoded, so the caller does not need to care about the outcome.
+func EnableBinaryFrames(ctx context.Context, devConn DevConn) {
+	dc, ok := AsMosDevConn(devConn)
+	if !ok {
+		return
+	}
+	if err := dc.EnableBinaryFrames(ctx); err != nil {
+		glog.V(1).Infof("not using binary frames: %s", err)
+	}
+}
+
+// EnableBinaryFrames asks the device to accept binary frames and, if it
+// agrees, starts sending them. Only serial connections are supported.
+// The device can also tell how much data it can take in at once, in which
+// case the send chunk size is raised accordingly. If the device refuses,
+// it is not asked again until the connection is re-established.
+func (dc *MosDevConn) EnableBinaryFrames(ctx context.Context) error {
+	if !*binaryFramesFlag {
+		return errors.NotSupportedf("binary frames (disabled)")
+	}
+	if !dc.IsSerial() {
+		return errors.NotSupportedf("binary frames over %s", dc.ConnectAddr)
+	}
+	if dc.codecOpts.Serial.BinaryFrames {
+		return nil
+	}
+	if dc.binaryFramesErr != nil {
+		return dc.binaryFramesErr
+	}
+	var res struct {
+		ChunkSize int `json:"chunk_size"`
+	}
+	if err := dc.Call(ctx, "RPC.EnableBinary", nil, &res); err != nil {
+		err = errors.Annotatef(err, "device does not support binary frames")
+		// The device will not change its mind until it reboots, which
+		// breaks the connection.
+		if RemoteStatus(err) != 0 {
+			dc.binaryFramesErr = err
+		}
+		return err
+	}
+	opts := dc.codecOpts
+	opts.Serial.BinaryFrames = true
+	if opts.Serial.SendChunkSize > 0 && res.ChunkSize > opts.Serial.SendChunkSize {
+		opts.Serial.SendChunkSize = res.ChunkSize
+	}
+	if err := dc.RPC.SetCodecOptions(&opts); err != nil {
+		return errors.Trace(err)
+	}
+	dc.codecOpts = opts
+	glog.Infof("using binary frames, send chunk size %d", opts.Serial.SendChunkSize)
+	return nil
+}
@@ -22,12 +22,16 @@ import (
 	"time"
 
 	"github.com/cesanta/errors"
+
+	"github.com/mongoose-os/mos/common/mgrpc"
 )
 
 type Client struct {
 	Port      string
 	Reconnect bool
 	Timeout   time.Duration
+	// Auth is used to authenticate calls; if nil, credentials are taken from flags.
+	Auth mgrpc.Authenticator
 }
 
 func (c *Client) RegisterFlags(fs *flag.FlagSet) {
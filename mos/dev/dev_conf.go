@@ -18,6 +18,8 @@ package dev
 
 import (
 	"encoding/json"
+	"reflect"
+	"sort"
 	"strconv"
 	"strings"
 
@@ -30,25 +32,30 @@ type DevConf struct {
 	diff map[string]interface{}
 }
 
+// GetValue returns the value at the given path, or the whole config if
+// the path is empty.
+func (c *DevConf) GetValue(path string) (interface{}, error) {
+	if path == "" {
+		// We have to special-case empty path since getMapKey returns map and a
+		// key, since we cannot take address of a map element.
+		return c.data, nil
+	}
+	m, key := getMapKey(path, c.data)
+	if m == nil {
+		return nil, errors.Errorf("no config value at path %q", path)
+	}
+	if dm, dkey := getMapKey(path, c.diff); dm != nil {
+		return dm[dkey], nil
+	}
+	return m[key], nil
+}
+
 // Get takes a path like "wifi.sta.ssid" and tries to get config value at the
 // given path.
 func (c *DevConf) Get(path string) (string, error) {
-	var v interface{}
-	if path != "" {
-		m, key := getMapKey(path, c.data)
-		if m == nil {
-			return "", errors.Errorf("no config value at path %q", path)
-		}
-		dm, dkey := getMapKey(path, c.diff)
-		if dm != nil {
-			v = dm[dkey]
-		} else {
-			v = m[key]
-		}
-	} else {
-		// We have to special-case empty path since getMapKey returns map and a
-		// key, since we cannot take address of a map element.
-		v = c.data
+	v, err := c.GetValue(path)
+	if err != nil {
+		return "", errors.Trace(err)
 	}
 	switch v.(type) {
 	case string:
@@ -119,6 +126,130 @@ func (c *DevConf) Set(path, value string) error {
 	return nil
 }
 
+// Merge deep-merges doc into the configuration: objects are merged key by
+// key, other values, including arrays, replace the existing ones. All the
+// paths must already exist in the configuration. Only values that differ from
+// the current ones are recorded as changed.
+func (c *DevConf) Merge(doc map[string]interface{}) error {
+	if c.diff == nil {
+		c.diff = make(map[string]interface{})
+	}
+	return errors.Trace(mergeMap(c.data, c.diff, doc, ""))
+}
+
+func mergeMap(data, diff, doc map[string]interface{}, prefix string) error {
+	for k, v := range doc {
+		path := prefix + k
+		cur, ok := data[k]
+		if !ok {
+			return errors.Errorf("no config value at path %q", path)
+		}
+		if curMap, ok := cur.(map[string]interface{}); ok {
+			docMap, ok := v.(map[string]interface{})
+			if !ok {
+				return errors.Errorf("path %q refers to an object, got %T", path, v)
+			}
+			sub, _ := diff[k].(map[string]interface{})
+			if sub == nil {
+				sub = make(map[string]interface{})
+			}
+			if err := mergeMap(curMap, sub, docMap, path+"."); err != nil {
+				return errors.Trace(err)
+			}
+			if len(sub) > 0 {
+				diff[k] = sub
+			}
+			continue
+		}
+		if err := checkType(path, cur, v); err != nil {
+			return errors.Trace(err)
+		}
+		if !reflect.DeepEqual(normalizeValue(cur), normalizeValue(v)) {
+			diff[k] = v
+		}
+	}
+	return nil
+}
+
+// checkType returns an error if v cannot replace the current value cur.
+func checkType(path string, cur, v interface{}) error {
+	ok := true
+	switch cur.(type) {
+	case nil:
+	case string:
+		_, ok = v.(string)
+	case float64, json.Number:
+		switch v.(type) {
+		case float64, json.Number:
+		default:
+			ok = false
+		}
+	case bool:
+		_, ok = v.(bool)
+	case []interface{}:
+		_, ok = v.([]interface{})
+	}
+	if !ok {
+		return errors.Errorf("path %q refers to %T, got %T", path, cur, v)
+	}
+	return nil
+}
+
+// normalizeValue converts numbers to float64 so that values can be compared.
+func normalizeValue(v interface{}) interface{} {
+	switch vv := v.(type) {
+	case json.Number:
+		f, err := vv.Float64()
+		if err != nil {
+			return v
+		}
+		return f
+	case []interface{}:
+		res := make([]interface{}, len(vv))
+		for i, e := range vv {
+			res[i] = normalizeValue(e)
+		}
+		return res
+	case map[string]interface{}:
+		res := make(map[string]interface{})
+		for k, e := range vv {
+			res[k] = normalizeValue(e)
+		}
+		return res
+	}
+	return v
+}
+
+// ConfChange is a modification of a configuration value.
+type ConfChange struct {
+	Path string      `json:"path"`
+	Old  interface{} `json:"old"`
+	New  interface{} `json:"new"`
+}
+
+// Changes returns the values modified by Set and Merge, sorted by path.
+func (c *DevConf) Changes() []ConfChange {
+	var changes []ConfChange
+	var walk func(diff map[string]interface{}, prefix string)
+	walk = func(diff map[string]interface{}, prefix string) {
+		for k, v := range diff {
+			path := prefix + k
+			if vm, ok := v.(map[string]interface{}); ok {
+				walk(vm, path+".")
+				continue
+			}
+			var old interface{}
+			if m, key := getMapKey(path, c.data); m != nil {
+				old = m[key]
+			}
+			changes = append(changes, ConfChange{Path: path, Old: old, New: v})
+		}
+	}
+	walk(c.diff, "")
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Path < changes[j].Path })
+	return changes
+}
+
 // getMapKey is a helper function used by both Get and Set; it takes a path and
 // returns a map and a key to which the path corresponds.
 //
@@ -66,7 +66,15 @@ type DevConn interface {
 	Disconnect(context.Context) error
 }
 
-const confOpAttempts = 3
+// EnsureConnected reconnects to the device if the connection has been lost.
+// Only direct connections can be reconnected, for the rest it is a no-op.
+func EnsureConnected(ctx context.Context, dc DevConn) error {
+	mdc, ok := AsMosDevConn(dc)
+	if !ok {
+		return nil
+	}
+	return errors.Trace(mdc.EnsureConnected(ctx))
+}
 
 func SetConfig(ctx context.Context, dc DevConn, devConf *DevConf, setArgTmpl *ConfigSetArg) (bool, error) {
 	var resp ConfigSetResp
@@ -75,48 +83,25 @@ func SetConfig(ctx context.Context, dc DevConn, devConf *DevConf, setArgTmpl *Co
 	}
 	setArg := *setArgTmpl
 	setArg.Config = devConf.diff
-	attempts := confOpAttempts
-	for {
-		ctx2, cancel := context.WithTimeout(ctx, dc.GetTimeout())
-		defer cancel()
-		if err := dc.Call(ctx2, "Config.Set", setArg, &resp); err != nil {
-			attempts -= 1
-			if attempts > 0 {
-				glog.Warningf("Error: %s", err)
-				continue
-			}
-			return false, errors.Trace(err)
-		}
-		glog.Infof("resp: %#v", resp)
-		break
+	if err := dc.Call(ctx, "Config.Set", setArg, &resp); err != nil {
+		return false, errors.Trace(err)
 	}
-
+	glog.Infof("resp: %#v", resp)
 	return resp.Saved, nil
 }
 
 func GetConfigLevel(ctx context.Context, dc DevConn, level int) (*DevConf, error) {
 	var devConf DevConf
-	attempts := confOpAttempts
-	for {
-		ctx2, cancel := context.WithTimeout(ctx, dc.GetTimeout())
-		defer cancel()
-		var err error
-		if level >= 0 {
-			err = dc.Call(ctx2, "Config.Get", struct {
-				Level int `json:"level"`
-			}{Level: level}, &devConf.data)
-		} else {
-			err = dc.Call(ctx2, "Config.Get", nil, &devConf.data)
-		}
-		if err != nil {
-			attempts -= 1
-			if attempts > 0 {
-				glog.Warningf("Error: %s", err)
-				continue
-			}
-			return nil, errors.Trace(err)
-		}
-		break
+	var err error
+	if level >= 0 {
+		err = dc.Call(ctx, "Config.Get", struct {
+			Level int `json:"level"`
+		}{Level: level}, &devConf.data)
+	} else {
+		err = dc.Call(ctx, "Config.Get", nil, &devConf.data)
+	}
+	if err != nil {
+		return nil, errors.Trace(err)
 	}
 	return &devConf, nil
 }
@@ -127,19 +112,8 @@ func GetConfig(ctx context.Context, dc DevConn) (*DevConf, error) {
 
 func GetInfo(ctx context.Context, dc DevConn) (*GetInfoResult, error) {
 	var r GetInfoResult
-	attempts := confOpAttempts
-	for {
-		ctx2, cancel := context.WithTimeout(ctx, dc.GetTimeout())
-		defer cancel()
-		var err error
-		if err = dc.Call(ctx2, "Sys.GetInfo", nil, &r); err == nil {
-			return &r, nil
-		}
-		attempts -= 1
-		if attempts > 0 {
-			glog.Warningf("Error: %s", err)
-			continue
-		}
+	if err := dc.Call(ctx, "Sys.GetInfo", nil, &r); err != nil {
 		return nil, errors.Trace(err)
 	}
+	return &r, nil
 }
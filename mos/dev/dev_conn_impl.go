@@ -20,6 +20,10 @@ import (
 	"context"
 	"crypto/tls"
 	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/cesanta/errors"
@@ -39,15 +43,42 @@ const (
 
 var (
 	mgrpcCompatArgsFlag = flag.Bool("mgrpc-compat-args", false, "Use args field in the RPC frame, for compatibility with older firmware")
+	rpcRecordFlag       = flag.String("rpc-record", "", "Record RPC frames exchanged with the device to this file. It can be replayed later with --port replay:///path/to/file")
+	rpcTraceFlag        = flag.String("rpc-trace", "", "Trace RPC calls and append spans to this file in OpenTelemetry JSON format")
+
+	spanExporter     mgrpc.SpanExporter
+	spanExporterErr  error
+	spanExporterOnce sync.Once
 )
 
+// getSpanExporter returns the exporter of spans to the --rpc-trace file, or nil if tracing is not enabled.
+// The file stays open until exit, it is shared by all the connections.
+func getSpanExporter() (mgrpc.SpanExporter, error) {
+	spanExporterOnce.Do(func() {
+		if *rpcTraceFlag == "" {
+			return
+		}
+		f, err := os.OpenFile(*rpcTraceFlag, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			spanExporterErr = errors.Annotatef(err, "failed to open trace file")
+			return
+		}
+		spanExporter = mgrpc.NewJSONSpanExporter(f, "mos")
+	})
+	return spanExporter, spanExporterErr
+}
+
 type MosDevConn struct {
 	c           *Client
 	ConnectAddr string
 	RPC         mgrpc.MgRPC
 	Dest        string
 	Reconnect   bool
+	tlsConfig   *tls.Config
 	codecOpts   codec.Options
+	// Error the device refused binary frames with on this connection,
+	// see EnableBinaryFrames.
+	binaryFramesErr error
 }
 
 // CreateDevConn creates a direct connection to the device at a given address,
@@ -99,6 +130,24 @@ func (dc *MosDevConn) IsConnected() bool {
 	return dc.RPC != nil && dc.RPC.IsConnected()
 }
 
+// IsSerial returns true if the device is connected over a serial port.
+func (dc *MosDevConn) IsSerial() bool {
+	return strings.HasPrefix(dc.ConnectAddr, "serial://")
+}
+
+// EnsureConnected re-establishes the connection if it has been lost,
+// with the same options it was originally made with.
+func (dc *MosDevConn) EnsureConnected(ctx context.Context) error {
+	if dc.IsConnected() {
+		return nil
+	}
+	if dc.RPC != nil {
+		dc.Disconnect(ctx)
+	}
+	glog.Infof("Reconnecting to %s", dc.ConnectAddr)
+	return errors.Trace(dc.ConnectWithOpts(ctx, dc.Reconnect, nil, nil))
+}
+
 func (dc *MosDevConn) Connect(ctx context.Context, reconnect bool) error {
 	return dc.ConnectWithOpts(ctx, reconnect, nil, nil)
 }
@@ -110,16 +159,31 @@ func (dc *MosDevConn) ConnectWithOpts(ctx context.Context, reconnect bool, tlsCo
 		return nil
 	}
 
+	dc.Reconnect = reconnect
+	if tlsConfig != nil {
+		dc.tlsConfig = tlsConfig
+	}
 	if codecOpts != nil {
 		dc.codecOpts = *codecOpts
 	}
+	// A new connection starts with regular frames, see EnableBinaryFrames.
+	dc.codecOpts.Serial.BinaryFrames = false
+	dc.binaryFramesErr = nil
 
 	opts := []mgrpc.ConnectOption{
 		mgrpc.LocalID("mos"),
 		mgrpc.Reconnect(reconnect),
-		mgrpc.TlsConfig(tlsConfig),
+		mgrpc.TlsConfig(dc.tlsConfig),
 		mgrpc.CompatArgs(*mgrpcCompatArgsFlag),
 		mgrpc.CodecOptions(dc.codecOpts),
+		mgrpc.RecordTo(*rpcRecordFlag),
+	}
+	se, err := getSpanExporter()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if se != nil {
+		opts = append(opts, mgrpc.ExportSpans(se))
 	}
 
 	dc.RPC, err = mgrpc.New(ctx, dc.ConnectAddr, opts...)
@@ -139,6 +203,25 @@ func isJSON(s string) bool {
 	return json.Unmarshal([]byte(s), &js) == nil
 }
 
+// remoteError is the error the device responded to a call with.
+type remoteError mgrpc.ErrorResponse
+
+func (e remoteError) Error() string {
+	return fmt.Sprintf("remote error %d: %s", e.Status, e.Msg)
+}
+
+// RemoteStatus returns the status code of the error the device responded
+// to a call with, or 0 if err did not come from the device.
+func RemoteStatus(err error) int {
+	switch er := errors.Cause(err).(type) {
+	case remoteError:
+		return er.Status
+	case mgrpc.ErrorResponse:
+		return er.Status
+	}
+	return 0
+}
+
 func (dc *MosDevConn) CallRaw(ctx context.Context, method string, args interface{}) (json.RawMessage, error) {
 	argsJSON, ok := args.(string)
 	if !ok {
@@ -162,13 +245,21 @@ func (dc *MosDevConn) CallRaw(ctx context.Context, method string, args interface
 		cmd.Args.UnmarshalJSON([]byte(argsJSON))
 	}
 
-	resp, err := dc.RPC.Call(ctx, dc.Dest, cmd, rpccreds.GetRPCCreds)
+	auth := dc.c.Auth
+	if auth == nil {
+		var err error
+		if auth, err = rpccreds.GetAuthenticator(); err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+
+	resp, err := dc.RPC.Call(ctx, dc.Dest, cmd, auth)
 	if err != nil {
 		return nil, errors.Trace(err)
 	}
 
 	if resp.Status != 0 {
-		return nil, errors.Errorf("remote error %d: %s", resp.Status, resp.StatusMsg)
+		return nil, errors.Trace(remoteError{Status: resp.Status, Msg: resp.StatusMsg})
 	}
 
 	return resp.Response, nil
@@ -189,7 +280,8 @@ func (dc *MosDevConn) Call(ctx context.Context, method string, args interface{},
 	if err != nil {
 		return errors.Trace(err)
 	}
-	if resp != nil {
+	// Methods that return nothing are not an error.
+	if resp != nil && len(respRaw) > 0 {
 		return json.Unmarshal(respRaw, resp)
 	}
 	return nil
@@ -0,0 +1,295 @@
+//
+// Copyright (c) 2014-2019 Cesanta Software Limited
+// All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package dev
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"math"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/cesanta/errors"
+	"github.com/golang/glog"
+	flag "github.com/spf13/pflag"
+)
+
+var (
+	retryAttemptsFlag   = flag.Int("retry-attempts", 3, "Number of times a device call is attempted before giving up")
+	retryBackoffFlag    = flag.Duration("retry-backoff", 250*time.Millisecond, "Delay before the first retry of a failed device call, doubled for each subsequent one")
+	retryMaxBackoffFlag = flag.Duration("retry-max-backoff", 5*time.Second, "Maximum delay between retries of a failed device call")
+	retryJitterFlag     = flag.Float64("retry-jitter", 0.2, "Fraction by which retry delays are randomly varied")
+	fsOpAttemptsFlag    = flag.Int("fs-op-attempts", 3, "Number of times file and firmware data transfers are attempted")
+)
+
+func init() {
+	flag.CommandLine.MarkDeprecated("fs-op-attempts", "please use --retry-attempts")
+}
+
+// RetryPolicy controls retrying of failed calls.
+type RetryPolicy struct {
+	// Attempts is the total number of attempts, 1 means no retries.
+	Attempts int
+	// Backoff is the delay before the first retry, it doubles for each
+	// subsequent one up to MaxBackoff.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// Jitter is the fraction by which delays are randomly varied, 0 to 1.
+	Jitter float64
+	// Reconnect makes the connection re-established after transport errors.
+	Reconnect bool
+}
+
+// RetryPolicyFromFlags returns the retry policy configured by flags.
+func RetryPolicyFromFlags() RetryPolicy {
+	p := RetryPolicy{
+		Attempts:   *retryAttemptsFlag,
+		Backoff:    *retryBackoffFlag,
+		MaxBackoff: *retryMaxBackoffFlag,
+		Jitter:     *retryJitterFlag,
+		Reconnect:  true,
+	}
+	if !flag.CommandLine.Changed("retry-attempts") && flag.CommandLine.Changed("fs-op-attempts") {
+		p.Attempts = *fsOpAttemptsFlag
+	}
+	return p
+}
+
+// Delay returns how long to wait after the given attempt, counting from 1,
+// has failed.
+func (p RetryPolicy) Delay(attempt int) time.Duration {
+	d := float64(p.Backoff) * math.Pow(2, float64(attempt-1))
+	if p.MaxBackoff > 0 && d > float64(p.MaxBackoff) {
+		d = float64(p.MaxBackoff)
+	}
+	if p.Jitter > 0 {
+		d += d * p.Jitter * (2*rand.Float64() - 1)
+	}
+	return time.Duration(d)
+}
+
+// Sleep waits for the delay after the given attempt, or until ctx is done.
+func (p RetryPolicy) Sleep(ctx context.Context, attempt int) error {
+	select {
+	case <-time.After(p.Delay(attempt)):
+		return nil
+	case <-ctx.Done():
+		return errors.Trace(ctx.Err())
+	}
+}
+
+// Device status codes that indicate a temporary condition.
+var retryableStatus = map[int]bool{
+	408: true, // Request timeout
+	429: true, // Too many requests
+	503: true, // Service unavailable
+	504: true, // Gateway timeout
+}
+
+// IsRetryable returns true if the call that failed with err may succeed if
+// attempted again: it timed out, the connection was lost or the device
+// responded with a status that indicates a temporary condition. Other
+// errors, e.g. failure to encode or decode the data, are final.
+func IsRetryable(err error) bool {
+	if status := RemoteStatus(err); status != 0 {
+		return retryableStatus[status]
+	}
+	return isTimeout(err) || isConnectionLost(err)
+}
+
+// isTimeout returns true if the response to the call did not arrive in time.
+// The connection itself may well be fine.
+func isTimeout(err error) bool {
+	cause := errors.Cause(err)
+	if ne, ok := cause.(net.Error); ok {
+		return ne.Timeout()
+	}
+	return cause == context.DeadlineExceeded
+}
+
+// isConnectionLost returns true if err means that the connection to
+// the device is gone.
+func isConnectionLost(err error) bool {
+	switch cause := errors.Cause(err).(type) {
+	case nil:
+		return false
+	case net.Error:
+		return !cause.Timeout()
+	default:
+		return cause == io.EOF || cause == io.ErrUnexpectedEOF
+	}
+}
+
+var (
+	idempotentLock sync.RWMutex
+	// Methods that are safe to call again if it's not known whether
+	// the previous call has reached the device.
+	idempotentMethods = map[string]bool{
+		"Config.Get":       true,
+		"FS.Checksum":      true,
+		"FS.Get":           true,
+		"FS.List":          true,
+		"FS.ListExt":       true,
+		"OTA.Status":       true,
+		"RPC.Describe":     true,
+		"RPC.EnableBinary": true,
+		"RPC.List":         true,
+		"RPC.Ping":         true,
+		"Sys.GetInfo":      true,
+	}
+	// Methods that are safe to retry unless they are asked to reboot the
+	// device: if the response to a call that succeeded is lost, calling
+	// again would reboot it once more.
+	idempotentUnlessReboot = map[string]bool{
+		"Config.Save": true,
+		"Config.Set":  true,
+	}
+)
+
+// SetIdempotent marks the method as safe, or not, to retry.
+// Calls to methods that are not idempotent are never retried.
+func SetIdempotent(method string, idempotent bool) {
+	idempotentLock.Lock()
+	defer idempotentLock.Unlock()
+	idempotentMethods[method] = idempotent
+}
+
+// IsIdempotent returns true if the method is safe to retry.
+func IsIdempotent(method string) bool {
+	idempotentLock.RLock()
+	defer idempotentLock.RUnlock()
+	return idempotentMethods[method]
+}
+
+// isIdempotentCall returns true if the call is safe to retry.
+func isIdempotentCall(method string, args interface{}) bool {
+	if IsIdempotent(method) {
+		return true
+	}
+	return idempotentUnlessReboot[method] && !wantsReboot(args)
+}
+
+// wantsReboot returns true if the arguments ask the device to reboot, or if
+// it cannot be told.
+func wantsReboot(args interface{}) bool {
+	if args == nil {
+		return false
+	}
+	data, ok := args.(string)
+	if !ok {
+		b, err := json.Marshal(args)
+		if err != nil {
+			return true
+		}
+		data = string(b)
+	}
+	if data == "" {
+		return false
+	}
+	var a struct {
+		Reboot bool `json:"reboot"`
+	}
+	if err := json.Unmarshal([]byte(data), &a); err != nil {
+		return true
+	}
+	return a.Reboot
+}
+
+type noRetriesKey struct{}
+
+// WithoutRetries returns a context in which calls are not retried, for
+// callers that handle failures themselves.
+func WithoutRetries(ctx context.Context) context.Context {
+	return context.WithValue(ctx, noRetriesKey{}, true)
+}
+
+// RetryDevConn is a DevConn that retries failed calls of idempotent methods
+// according to the policy, each attempt limited by the connection timeout.
+// Calls of other methods are passed through.
+type RetryDevConn struct {
+	DevConn
+	Policy RetryPolicy
+}
+
+// WithRetries wraps the connection to retry failed calls.
+func WithRetries(dc DevConn, policy RetryPolicy) *RetryDevConn {
+	return &RetryDevConn{DevConn: dc, Policy: policy}
+}
+
+// Unwrap returns the underlying connection.
+func (rc *RetryDevConn) Unwrap() DevConn {
+	return rc.DevConn
+}
+
+func (rc *RetryDevConn) Call(ctx context.Context, method string, args interface{}, resp interface{}) error {
+	if rc.Policy.Attempts <= 1 || !isIdempotentCall(method, args) || ctx.Value(noRetriesKey{}) != nil {
+		return rc.DevConn.Call(ctx, method, args, resp)
+	}
+	for attempt := 1; ; attempt++ {
+		ctx2, cancel := context.WithTimeout(ctx, rc.GetTimeout())
+		err := rc.DevConn.Call(ctx2, method, args, resp)
+		cancel()
+		if err == nil {
+			return nil
+		}
+		if attempt >= rc.Policy.Attempts || !IsRetryable(err) || ctx.Err() != nil {
+			return errors.Trace(err)
+		}
+		glog.Warningf("%s failed (attempt %d of %d), retrying: %s", method, attempt, rc.Policy.Attempts, err)
+		if rc.Policy.Sleep(ctx, attempt) != nil {
+			return errors.Trace(err)
+		}
+		if rc.Policy.Reconnect {
+			rc.reconnect(ctx, err)
+		}
+	}
+}
+
+// reconnect re-establishes the connection if the call failed because it was
+// lost. Calls that merely timed out are retried on the same connection:
+// reopening a serial port resets some boards.
+func (rc *RetryDevConn) reconnect(ctx context.Context, err error) {
+	mdc, ok := AsMosDevConn(rc.DevConn)
+	if !ok || mdc.IsConnected() && !isConnectionLost(err) {
+		return
+	}
+	// The RPC channel may not recover by itself, it is recreated.
+	if mdc.RPC != nil {
+		mdc.Disconnect(ctx)
+	}
+	if err := mdc.EnsureConnected(ctx); err != nil {
+		glog.Warningf("failed to reconnect: %s", err)
+	}
+}
+
+// AsMosDevConn returns the direct connection to the device underlying dc,
+// if there is one.
+func AsMosDevConn(dc DevConn) (*MosDevConn, bool) {
+	for {
+		switch c := dc.(type) {
+		case *MosDevConn:
+			return c, true
+		case interface{ Unwrap() DevConn }:
+			dc = c.Unwrap()
+		default:
+			return nil, false
+		}
+	}
+}
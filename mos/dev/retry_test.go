@@ -0,0 +1,106 @@
+//
+// Copyright (c) 2014-2019 Cesanta Software Limited
+// All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package dev_test
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/cesanta/errors"
+
+	"github.com/mongoose-os/mos/common/mgrpc"
+	"github.com/mongoose-os/mos/mos/dev"
+)
+
+// fakeConn fails the first calls with the given errors.
+type fakeConn struct {
+	errs  []error
+	calls int
+}
+
+func (c *fakeConn) Call(ctx context.Context, method string, args interface{}, resp interface{}) error {
+	c.calls++
+	if len(c.errs) > 0 {
+		err := c.errs[0]
+		c.errs = c.errs[1:]
+		return err
+	}
+	return nil
+}
+
+func (c *fakeConn) GetTimeout() time.Duration            { return time.Second }
+func (c *fakeConn) Connect(context.Context, bool) error  { return nil }
+func (c *fakeConn) Disconnect(ctx context.Context) error { return nil }
+
+func remoteError(status int) error {
+	return errors.Annotatef(mgrpc.ErrorResponse{Status: status, Msg: "fail"}, "remote error")
+}
+
+func TestRetryDevConn(t *testing.T) {
+	ctx := context.Background()
+	policy := dev.RetryPolicy{Attempts: 3, Backoff: time.Millisecond}
+	for _, c := range []struct {
+		method    string
+		args      interface{}
+		errs      []error
+		wantCalls int
+		wantErr   bool
+	}{
+		{"Sys.GetInfo", nil, nil, 1, false},
+		{"Sys.GetInfo", nil, []error{io.EOF, remoteError(503)}, 3, false},
+		{"Sys.GetInfo", nil, []error{io.EOF, io.EOF, io.EOF, io.EOF}, 3, true},
+		{"Sys.GetInfo", nil, []error{context.DeadlineExceeded}, 2, false},
+		{"Sys.GetInfo", nil, []error{errors.Errorf("invalid response")}, 1, true},
+		{"Config.Get", nil, []error{remoteError(404)}, 1, true},
+		{"Config.Set", map[string]interface{}{"save": true}, []error{io.EOF}, 2, false},
+		{"Config.Set", map[string]interface{}{"save": true, "reboot": true}, []error{io.EOF}, 1, true},
+		{"Config.Save", `{"reboot": true}`, []error{io.EOF}, 1, true},
+		{"Sys.Reboot", nil, []error{io.EOF}, 1, true},
+	} {
+		fc := &fakeConn{errs: c.errs}
+		err := dev.WithRetries(fc, policy).Call(ctx, c.method, c.args, nil)
+		if fc.calls != c.wantCalls || (err != nil) != c.wantErr {
+			t.Errorf("%s %v: got %d calls, error %v", c.method, c.errs, fc.calls, err)
+		}
+	}
+
+	fc := &fakeConn{errs: []error{io.EOF}}
+	if err := dev.WithRetries(fc, policy).Call(dev.WithoutRetries(ctx), "Sys.GetInfo", nil, nil); err == nil || fc.calls != 1 {
+		t.Errorf("got %d calls, error %v", fc.calls, err)
+	}
+}
+
+func TestRetryPolicyDelay(t *testing.T) {
+	p := dev.RetryPolicy{Backoff: 100 * time.Millisecond, MaxBackoff: 300 * time.Millisecond}
+	for attempt, want := range []time.Duration{100, 200, 300, 300} {
+		if got := p.Delay(attempt + 1); got != want*time.Millisecond {
+			t.Errorf("attempt %d: got %s, want %s", attempt+1, got, want*time.Millisecond)
+		}
+	}
+}
+
+func TestAsMosDevConn(t *testing.T) {
+	mdc := &dev.MosDevConn{}
+	if got, ok := dev.AsMosDevConn(dev.WithRetries(mdc, dev.RetryPolicy{})); !ok || got != mdc {
+		t.Errorf("got %v %v", got, ok)
+	}
+	if _, ok := dev.AsMosDevConn(&fakeConn{}); ok {
+		t.Errorf("fake connection is not a direct one")
+	}
+}
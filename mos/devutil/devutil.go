@@ -26,35 +26,192 @@ import (
 	"github.com/mongoose-os/mos/common/mgrpc/codec"
 	"github.com/mongoose-os/mos/mos/dev"
 	"github.com/mongoose-os/mos/mos/flags"
+	"github.com/mongoose-os/mos/mos/inventory"
+	"github.com/mongoose-os/mos/mos/ourutil"
+	"github.com/mongoose-os/mos/mos/rpccreds"
 	"github.com/mongoose-os/mos/mos/watson"
 	"github.com/cesanta/errors"
+	flag "github.com/spf13/pflag"
 )
 
 func createDevConnWithJunkHandler(ctx context.Context, junkHandler func(junk []byte)) (dev.DevConn, error) {
-	port, err := GetPort()
+	port, err := getPortOrDiscover(ctx)
 	if err != nil {
 		return nil, errors.Trace(err)
 	}
+	d, err := DeviceFromFlags()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if d == nil {
+		d = &inventory.Device{}
+	}
+	d = withFlags(d)
+	d.Port = port
+	return createDevConnToDevice(ctx, d, junkHandler)
+}
+
+// CreateDevConn connects to the device at port, which is either a serial port
+// or an address, with the rest of the connection settings taken from flags.
+func CreateDevConn(ctx context.Context, port string) (dev.DevConn, error) {
+	return createDevConnToDevice(ctx, withFlags(&inventory.Device{Port: port}), func(junk []byte) {})
+}
+
+// CreateDevConnToDevice connects to the inventory device, settings that
+// the device does not specify or that are given on the command line are
+// taken from flags.
+func CreateDevConnToDevice(ctx context.Context, d *inventory.Device) (dev.DevConn, error) {
+	return createDevConnToDevice(ctx, withFlags(d), func(junk []byte) {})
+}
+
+// DeviceFromFlags returns the inventory device selected by --device or
+// --group, or nil if neither is given. The group must have exactly one member.
+func DeviceFromFlags() (*inventory.Device, error) {
+	if *flags.Device == "" && *flags.Group == "" {
+		return nil, nil
+	}
+	if *flags.Device != "" && *flags.Group != "" {
+		return nil, errors.Errorf("--device and --group are mutually exclusive")
+	}
+	inv, err := inventory.LoadDefault()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if *flags.Device != "" {
+		d, err := inv.Lookup(*flags.Device)
+		return d, errors.Trace(err)
+	}
+	devs, err := inv.Group(*flags.Group)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if len(devs) > 1 {
+		return nil, errors.Errorf("group %q has %d devices, please select one with --device", *flags.Group, len(devs))
+	}
+	return devs[0], nil
+}
+
+// withFlags returns a copy of the device with the settings it does not
+// specify, or that were given explicitly on the command line, taken from flags.
+func withFlags(d *inventory.Device) *inventory.Device {
+	res := *d
+	fromFlag := func(name string, unset bool) bool {
+		return unset || flag.CommandLine.Changed(name)
+	}
+	if fromFlag("cert-file", res.CertFile == "") {
+		res.CertFile = *flags.CertFile
+	}
+	if fromFlag("key-file", res.KeyFile == "") {
+		res.KeyFile = *flags.KeyFile
+	}
+	if fromFlag("ca-cert-file", res.CAFile == "") {
+		res.CAFile = *flags.CAFile
+	}
+	if fromFlag("baud-rate", res.BaudRate == 0) {
+		res.BaudRate = *flags.BaudRate
+	}
+	if fromFlag("hw-flow-control", !res.HWFC) {
+		res.HWFC = *flags.HWFC
+	}
+	// Credentials are either taken from the inventory or from flags, not mixed.
+	if flag.CommandLine.Changed("rpc-auth") || flag.CommandLine.Changed("rpc-creds") {
+		res.RPCAuth, res.RPCCreds = "", ""
+	}
+	return &res
+}
+
+func createDevConnToDevice(ctx context.Context, d *inventory.Device, junkHandler func(junk []byte)) (dev.DevConn, error) {
+	port := d.Port
 	c := dev.Client{Port: port, Timeout: *flags.Timeout, Reconnect: *flags.Reconnect}
+	if d.RPCCreds != "" {
+		method := d.RPCAuth
+		if method == "" {
+			method = rpccreds.AuthDigest
+		}
+		auth, err := rpccreds.NewAuthenticator(method, d.RPCCreds)
+		if err != nil {
+			return nil, errors.Annotatef(err, "%s", d.Name)
+		}
+		c.Auth = auth
+	}
 	prefix := "serial://"
 	if strings.Index(port, "://") > 0 {
 		prefix = ""
 	}
 	addr := prefix + port
 
+	tlsConfig, err := tlsConfig(port, d.CertFile, d.KeyFile, d.CAFile)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	codecOpts := codecOptions(port, d.BaudRate, d.HWFC, junkHandler)
+	mdc, err := c.CreateDevConnWithOpts(ctx, addr, *flags.Reconnect, tlsConfig, codecOpts)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	devConn := dev.WithRetries(mdc, dev.RetryPolicyFromFlags())
+	if d.Platform != "" {
+		if err := checkPlatform(ctx, devConn, d); err != nil {
+			devConn.Disconnect(ctx)
+			return nil, errors.Trace(err)
+		}
+	}
+	return devConn, nil
+}
+
+// checkPlatform verifies that the device reports the platform it is
+// expected to have, unless --force is given.
+func checkPlatform(ctx context.Context, devConn dev.DevConn, d *inventory.Device) error {
+	info, err := dev.GetInfo(ctx, devConn)
+	if err != nil {
+		return errors.Annotatef(err, "failed to get device info")
+	}
+	arch := ""
+	if info.Arch != nil {
+		arch = *info.Arch
+	}
+	if strings.EqualFold(arch, d.Platform) {
+		return nil
+	}
+	if *flags.Force {
+		ourutil.Reportf("Warning: %s is expected to be %s but reports %s, continuing anyway", d.Name, d.Platform, arch)
+		return nil
+	}
+	return errors.Errorf("%s is expected to be %s but reports %q, use --force to connect anyway", d.Name, d.Platform, arch)
+}
+
+func CreateDevConnFromFlags(ctx context.Context) (dev.DevConn, error) {
+	return createDevConnWithJunkHandler(ctx, func(junk []byte) {})
+}
+
+// TLSConfigFromFlags returns TLS config to use for connecting to port, or nil
+// if the connection does not use TLS.
+func TLSConfigFromFlags(port string) (*tls.Config, error) {
+	return tlsConfig(port, *flags.CertFile, *flags.KeyFile, *flags.CAFile)
+}
+
+func tlsConfig(port, certFile, keyFile, caFile string) (*tls.Config, error) {
 	// Init and pass TLS config if --cert-file and --key-file are specified
-	var tlsConfig *tls.Config
-	if *flags.CertFile != "" ||
+	if certFile != "" ||
 		strings.HasPrefix(port, "wss") ||
 		strings.HasPrefix(port, "https") ||
-		strings.HasPrefix(port, "mqtts") {
+		strings.HasPrefix(port, "mqtts") ||
+		strings.HasPrefix(port, "tcps") {
 
-		tlsConfig, err = flags.TLSConfigFromFlags()
-		if err != nil {
-			return nil, errors.Trace(err)
-		}
+		tlsConfig, err := flags.TLSConfig(certFile, keyFile, caFile)
+		return tlsConfig, errors.Trace(err)
 	}
+	return nil, nil
+}
+
+// CodecOptionsFromFlags returns options of the codec used to talk to the device
+// at port, as configured by flags.
+func CodecOptionsFromFlags(port string, junkHandler func(junk []byte)) *codec.Options {
+	return codecOptions(port, *flags.BaudRate, *flags.HWFC, junkHandler)
+}
 
+func codecOptions(port string, baudRate int, hwfc bool, junkHandler func(junk []byte)) *codec.Options {
 	codecOpts := &codec.Options{
 		AzureDM: codec.AzureDMCodecOptions{
 			ConnectionString: *flags.AzureConnectionString,
@@ -64,8 +221,8 @@ func createDevConnWithJunkHandler(ctx context.Context, junkHandler func(junk []b
 		},
 		MQTT: codec.MQTTCodecOptions{},
 		Serial: codec.SerialCodecOptions{
-			BaudRate:             uint(*flags.BaudRate),
-			HardwareFlowControl:  *flags.HWFC,
+			BaudRate:             uint(baudRate),
+			HardwareFlowControl:  hwfc,
 			JunkHandler:          junkHandler,
 			SetControlLines:      *flags.SetControlLines,
 			InvertedControlLines: *flags.InvertedControlLines,
@@ -91,10 +248,5 @@ func createDevConnWithJunkHandler(ctx context.Context, junkHandler func(junk []b
 			codecOpts.Serial.SendChunkSize = 6
 		}
 	}
-	devConn, err := c.CreateDevConnWithOpts(ctx, addr, *flags.Reconnect, tlsConfig, codecOpts)
-	return devConn, errors.Trace(err)
-}
-
-func CreateDevConnFromFlags(ctx context.Context) (dev.DevConn, error) {
-	return createDevConnWithJunkHandler(ctx, func(junk []byte) {})
+	return codecOpts
 }
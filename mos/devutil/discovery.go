@@ -0,0 +1,66 @@
+//
+// Copyright (c) 2014-2019 Cesanta Software Limited
+// All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package devutil
+
+import (
+	"context"
+
+	"github.com/cesanta/errors"
+
+	"github.com/mongoose-os/mos/mos/discovery"
+	"github.com/mongoose-os/mos/mos/flags"
+	"github.com/mongoose-os/mos/mos/ourutil"
+)
+
+// DiscoverDevices searches for devices on the local network, as configured by flags.
+func DiscoverDevices(ctx context.Context) ([]*discovery.Device, error) {
+	devs, err := discovery.Discover(ctx, discovery.Options{
+		Timeout: *flags.DiscoveryTimeout,
+		MDNS:    true,
+		UDP:     true,
+		UDPPort: *flags.DiscoveryUDPPort,
+	})
+	return devs, errors.Trace(err)
+}
+
+// getPortOrDiscover is like GetPort but when --port is "auto", no device is
+// selected from the inventory and there are no serial ports, it uses the
+// first device found on the local network.
+func getPortOrDiscover(ctx context.Context) (string, error) {
+	port, err := GetPort()
+	if err == nil || *flags.Port != "auto" || *flags.Device != "" || *flags.Group != "" {
+		return port, errors.Trace(err)
+	}
+	ourutil.Reportf("No serial ports found, searching the local network...")
+	devs, derr := DiscoverDevices(ctx)
+	if derr != nil || len(devs) == 0 {
+		return "", errors.Errorf("--port not specified and no devices were found")
+	}
+	if len(devs) > 1 {
+		ourutil.Reportf("Found %d devices, use --port to select one", len(devs))
+	}
+	defaultPort = devs[0].Addr
+	ourutil.Reportf("Using %s (%s)", defaultPort, strOrEmpty(devs[0].Info.App))
+	return defaultPort, nil
+}
+
+func strOrEmpty(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
@@ -29,6 +29,13 @@ func GetPort() (string, error) {
 	if *flags.Port != "auto" {
 		return *flags.Port, nil
 	}
+	d, err := DeviceFromFlags()
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	if d != nil {
+		return d.Port, nil
+	}
 	if defaultPort == "" {
 		defaultPort = getDefaultPort()
 		if defaultPort == "" {
@@ -0,0 +1,228 @@
+//
+// Copyright (c) 2014-2019 Cesanta Software Limited
+// All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Package discovery finds devices on the local network.
+//
+// Two methods are used at the same time: DNS-SD queries over mDNS, which
+// find devices running the dns-sd library, and a broadcast of a Sys.GetInfo
+// request over UDP, which finds devices with the UDP RPC channel enabled.
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/cesanta/errors"
+	"github.com/golang/glog"
+
+	"github.com/mongoose-os/mos/common/mgrpc"
+	"github.com/mongoose-os/mos/common/mgrpc/frame"
+	"github.com/mongoose-os/mos/mos/dev"
+)
+
+const (
+	DefaultTimeout = 3 * time.Second
+	DefaultUDPPort = 1234
+
+	// Source ID of the requests sent during discovery.
+	probeSrc = "mos-discovery"
+
+	maxPacketSize = 9000
+)
+
+// Device is a device found on the network.
+type Device struct {
+	// Address that can be used to connect to the device, e.g. "ws://192.168.1.5/rpc".
+	Addr string `json:"addr"`
+	IP   net.IP `json:"ip"`
+	// Device ID, if known.
+	ID   string            `json:"id,omitempty"`
+	Info dev.GetInfoResult `json:"info"`
+}
+
+type Options struct {
+	// How long to wait for responses.
+	Timeout time.Duration
+	// Whether to send DNS-SD queries.
+	MDNS bool
+	// Whether to broadcast UDP probe.
+	UDP bool
+	// Port to send UDP probe to.
+	UDPPort int
+	// Addresses to send UDP probe to, instead of the broadcast addresses.
+	UDPAddrs []string
+}
+
+// Discover searches for devices and returns the ones that responded within
+// the timeout, sorted by address.
+func Discover(ctx context.Context, opts Options) ([]*Device, error) {
+	if opts.Timeout <= 0 {
+		opts.Timeout = DefaultTimeout
+	}
+	if opts.UDPPort <= 0 {
+		opts.UDPPort = DefaultUDPPort
+	}
+	dctx, cancel := context.WithTimeout(ctx, opts.Timeout)
+	defer cancel()
+
+	found := make(chan *Device)
+	var wg sync.WaitGroup
+	var errs []error
+	var errsLock sync.Mutex
+	run := func(name string, f func() error) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := f(); err != nil {
+				glog.Errorf("%s discovery failed: %s", name, err)
+				errsLock.Lock()
+				errs = append(errs, errors.Annotatef(err, "%s", name))
+				errsLock.Unlock()
+			}
+		}()
+	}
+	numMethods := 0
+	if opts.MDNS {
+		run("mDNS", func() error { return discoverMDNS(dctx, found) })
+		numMethods++
+	}
+	if opts.UDP {
+		run("UDP", func() error { return discoverUDP(dctx, opts.UDPPort, opts.UDPAddrs, found) })
+		numMethods++
+	}
+	go func() {
+		wg.Wait()
+		close(found)
+	}()
+
+	// Same device may respond to both methods, possibly more than once.
+	byIP := map[string]*Device{}
+	for d := range found {
+		key := d.IP.String()
+		prev := byIP[key]
+		switch {
+		case prev == nil:
+			byIP[key] = d
+		case strings.HasPrefix(d.Addr, "ws://") && !strings.HasPrefix(prev.Addr, "ws://"):
+			// WebSocket is preferred over UDP, but UDP response carries full info.
+			d.Info = prev.Info
+			if d.ID == "" {
+				d.ID = prev.ID
+			}
+			byIP[key] = d
+		case prev.ID == "":
+			prev.ID = d.ID
+		}
+	}
+	if len(errs) == numMethods && numMethods > 0 {
+		return nil, errs[0]
+	}
+
+	// DNS-SD only carries some of the information, complete it with a Sys.GetInfo call.
+	var res []*Device
+	for _, d := range byIP {
+		if d.Info.Mac == nil {
+			wg.Add(1)
+			go func(d *Device) {
+				defer wg.Done()
+				if err := getInfo(ctx, d, opts.Timeout); err != nil {
+					glog.V(1).Infof("%s: failed to get info: %s", d.Addr, err)
+				}
+			}(d)
+		}
+		res = append(res, d)
+	}
+	wg.Wait()
+	sort.Slice(res, func(i, j int) bool { return res[i].Addr < res[j].Addr })
+	return res, nil
+}
+
+func getInfo(ctx context.Context, d *Device, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	rpc, err := mgrpc.New(ctx, d.Addr)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer rpc.Disconnect(ctx)
+	resp, err := rpc.Call(ctx, "", &frame.Command{Cmd: "Sys.GetInfo"}, nil)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if resp.Status != 0 {
+		return errors.Errorf("error %d: %s", resp.Status, resp.StatusMsg)
+	}
+	var info dev.GetInfoResult
+	if err := json.Unmarshal(resp.Response, &info); err != nil {
+		return errors.Trace(err)
+	}
+	// Keep what we got from DNS-SD if device did not report it.
+	if info.Fw_id == nil {
+		info.Fw_id = d.Info.Fw_id
+	}
+	if info.Arch == nil {
+		info.Arch = d.Info.Arch
+	}
+	d.Info = info
+	return nil
+}
+
+// readPackets reads datagrams from conn and passes them to cb until ctx is done.
+func readPackets(ctx context.Context, conn net.PacketConn, cb func(data []byte, from *net.UDPAddr)) error {
+	go func() {
+		<-ctx.Done()
+		conn.SetReadDeadline(time.Now())
+	}()
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return errors.Trace(err)
+		}
+		if ua, ok := from.(*net.UDPAddr); ok {
+			cb(buf[:n], ua)
+		}
+	}
+}
+
+func strOrDash(s *string) string {
+	if s == nil || *s == "" {
+		return "-"
+	}
+	return *s
+}
+
+// WriteTable writes a human-readable list of devices to w.
+func WriteTable(w io.Writer, devs []*Device) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "ADDRESS\tAPP\tFW_VERSION\tARCH\tMAC\n")
+	for _, d := range devs {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", d.Addr,
+			strOrDash(d.Info.App), strOrDash(d.Info.Fw_version), strOrDash(d.Info.Arch), strOrDash(d.Info.Mac))
+	}
+	return errors.Trace(tw.Flush())
+}
@@ -0,0 +1,128 @@
+//
+// Copyright (c) 2014-2019 Cesanta Software Limited
+// All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package discovery
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/mongoose-os/mos/common/mgrpc/frame"
+)
+
+// mdnsTestResponse builds a response similar to the one sent by dns-sd library.
+func mdnsTestResponse() []byte {
+	msg := make([]byte, dnsHeaderLen)
+	binary.BigEndian.PutUint16(msg[2:], 0x8400)
+	binary.BigEndian.PutUint16(msg[6:], 4)
+	rr := func(name string, rtype uint16, data []byte) {
+		msg = appendDNSName(msg, name)
+		hdr := make([]byte, 10)
+		binary.BigEndian.PutUint16(hdr, rtype)
+		binary.BigEndian.PutUint16(hdr[2:], dnsClassIN)
+		binary.BigEndian.PutUint16(hdr[8:], uint16(len(data)))
+		msg = append(append(msg, hdr...), data...)
+	}
+	// Instance name is a pointer to the first label of the PTR record data.
+	rr(mdnsService, dnsTypePTR, appendDNSName(nil, "esp32_ABCDEF._http._tcp.local"))
+	instance := []byte{0xc0, byte(dnsHeaderLen + len(appendDNSName(nil, mdnsService)) + 10)}
+	msg = append(msg, instance...)
+	hdr := make([]byte, 10)
+	binary.BigEndian.PutUint16(hdr, dnsTypeSRV)
+	srv := append([]byte{0, 0, 0, 0, 0x1f, 0x90}, appendDNSName(nil, "esp32_ABCDEF.local")...)
+	binary.BigEndian.PutUint16(hdr[8:], uint16(len(srv)))
+	msg = append(append(msg, hdr...), srv...)
+	var txt []byte
+	for _, kv := range []string{"id=esp32_ABCDEF", "fw_id=20190101-000000", "arch=esp32"} {
+		txt = append(append(txt, byte(len(kv))), kv...)
+	}
+	rr("esp32_ABCDEF._http._tcp.local", dnsTypeTXT, txt)
+	rr("esp32_ABCDEF.local", dnsTypeA, []byte{192, 168, 1, 5})
+	return msg
+}
+
+func TestMDNSResponse(t *testing.T) {
+	if q := mdnsQuery(mdnsService); len(q) != dnsHeaderLen+len(mdnsService)+2+4 {
+		t.Errorf("unexpected query length %d", len(q))
+	}
+	resp, err := parseMDNSResponse(mdnsTestResponse())
+	if err != nil {
+		t.Fatal(err)
+	}
+	devs := resp.devices(net.IPv4(10, 0, 0, 1))
+	if len(devs) != 1 {
+		t.Fatalf("expected 1 device, got %d", len(devs))
+	}
+	d := devs[0]
+	if got, want := d.Addr, "ws://192.168.1.5:8080/rpc"; got != want {
+		t.Errorf("got: %s, want: %s", got, want)
+	}
+	if d.ID != "esp32_ABCDEF" || d.Info.Arch == nil || *d.Info.Arch != "esp32" || d.Info.Fw_id == nil {
+		t.Errorf("unexpected device: %+v %+v", d, d.Info)
+	}
+
+	if _, err := parseMDNSResponse(mdnsTestResponse()[:40]); err == nil {
+		t.Errorf("expected an error parsing truncated response")
+	}
+}
+
+func TestDiscoverUDP(t *testing.T) {
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	go func() {
+		buf := make([]byte, 1000)
+		for {
+			n, from, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			var f frame.Frame
+			if json.Unmarshal(buf[:n], &f) != nil || f.Method != "Sys.GetInfo" {
+				continue
+			}
+			resp, _ := json.Marshal(&frame.Frame{
+				Src: "dev1", Dst: f.Src, ID: f.ID,
+				Result: json.RawMessage(`{"app":"demo","arch":"esp8266","fw_version":"1.2","mac":"5CCF7F000001"}`),
+			})
+			conn.WriteTo(resp, from)
+		}
+	}()
+
+	devs, err := Discover(context.Background(), Options{
+		Timeout:  500 * time.Millisecond,
+		UDP:      true,
+		UDPAddrs: []string{conn.LocalAddr().String()},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(devs) != 1 {
+		t.Fatalf("expected 1 device, got %d", len(devs))
+	}
+	if got, want := devs[0].Addr, "udp://"+conn.LocalAddr().String(); got != want {
+		t.Errorf("got: %s, want: %s", got, want)
+	}
+	if devs[0].ID != "dev1" || devs[0].Info.App == nil || *devs[0].Info.App != "demo" {
+		t.Errorf("unexpected device: %+v", devs[0])
+	}
+}
@@ -0,0 +1,257 @@
+//
+// Copyright (c) 2014-2019 Cesanta Software Limited
+// All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package discovery
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/cesanta/errors"
+	"github.com/golang/glog"
+)
+
+const (
+	mdnsAddr = "224.0.0.251:5353"
+
+	// DNS-SD service advertised by the dns-sd library of Mongoose OS.
+	mdnsService = "_http._tcp.local"
+
+	dnsTypeA   = 1
+	dnsTypePTR = 12
+	dnsTypeTXT = 16
+	dnsTypeSRV = 33
+
+	dnsClassIN = 1
+	// Top bit of the question class requests a unicast response (RFC 6762, 5.4).
+	dnsClassUnicastResponse = 0x8000
+
+	dnsHeaderLen = 12
+)
+
+// mdnsQuery returns a DNS message with a single PTR question for the service.
+func mdnsQuery(service string) []byte {
+	msg := make([]byte, dnsHeaderLen)
+	binary.BigEndian.PutUint16(msg[4:], 1) // QDCOUNT
+	msg = appendDNSName(msg, service)
+	msg = append(msg, 0, 0, 0, 0)
+	binary.BigEndian.PutUint16(msg[len(msg)-4:], dnsTypePTR)
+	binary.BigEndian.PutUint16(msg[len(msg)-2:], dnsClassIN|dnsClassUnicastResponse)
+	return msg
+}
+
+func appendDNSName(msg []byte, name string) []byte {
+	for _, label := range strings.Split(strings.Trim(name, "."), ".") {
+		msg = append(msg, byte(len(label)))
+		msg = append(msg, label...)
+	}
+	return append(msg, 0)
+}
+
+// readDNSName reads a possibly compressed name at offset, returns the name
+// and the offset right after it.
+func readDNSName(msg []byte, off int) (string, int, error) {
+	var labels []string
+	end := -1
+	for hops := 0; ; hops++ {
+		if off >= len(msg) || hops > 100 {
+			return "", 0, errors.Errorf("invalid name")
+		}
+		l := int(msg[off])
+		switch {
+		case l == 0:
+			if end < 0 {
+				end = off + 1
+			}
+			return strings.Join(labels, "."), end, nil
+		case l&0xc0 == 0xc0:
+			if off+1 >= len(msg) {
+				return "", 0, errors.Errorf("invalid name pointer")
+			}
+			if end < 0 {
+				end = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(msg[off:]) & 0x3fff)
+		default:
+			if off+1+l > len(msg) {
+				return "", 0, errors.Errorf("invalid label")
+			}
+			labels = append(labels, string(msg[off+1:off+1+l]))
+			off += 1 + l
+		}
+	}
+}
+
+// dnsRR is a resource record of a DNS response.
+type dnsRR struct {
+	name  string
+	rtype uint16
+	// Offset and length of the record data within the message.
+	dataOff, dataLen int
+}
+
+// mdnsResponse holds the records of a response that are relevant to discovery.
+type mdnsResponse struct {
+	// Service -> instances.
+	ptr map[string][]string
+	// Instance -> target host and port.
+	srvHost map[string]string
+	srvPort map[string]int
+	// Instance -> TXT key/values.
+	txt map[string]map[string]string
+	// Host -> address.
+	a map[string]net.IP
+}
+
+func parseMDNSResponse(msg []byte) (*mdnsResponse, error) {
+	if len(msg) < dnsHeaderLen {
+		return nil, errors.Errorf("short message")
+	}
+	qdCount := int(binary.BigEndian.Uint16(msg[4:]))
+	rrCount := int(binary.BigEndian.Uint16(msg[6:])) + int(binary.BigEndian.Uint16(msg[8:])) + int(binary.BigEndian.Uint16(msg[10:]))
+	off := dnsHeaderLen
+	for i := 0; i < qdCount; i++ {
+		_, next, err := readDNSName(msg, off)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		off = next + 4
+	}
+	resp := &mdnsResponse{
+		ptr:     map[string][]string{},
+		srvHost: map[string]string{},
+		srvPort: map[string]int{},
+		txt:     map[string]map[string]string{},
+		a:       map[string]net.IP{},
+	}
+	for i := 0; i < rrCount; i++ {
+		name, next, err := readDNSName(msg, off)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		if next+10 > len(msg) {
+			return nil, errors.Errorf("short record")
+		}
+		rr := dnsRR{
+			name:    strings.ToLower(name),
+			rtype:   binary.BigEndian.Uint16(msg[next:]),
+			dataOff: next + 10,
+			dataLen: int(binary.BigEndian.Uint16(msg[next+8:])),
+		}
+		off = rr.dataOff + rr.dataLen
+		if off > len(msg) {
+			return nil, errors.Errorf("short record data")
+		}
+		data := msg[rr.dataOff:off]
+		switch rr.rtype {
+		case dnsTypePTR:
+			instance, _, err := readDNSName(msg, rr.dataOff)
+			if err != nil {
+				return nil, errors.Trace(err)
+			}
+			resp.ptr[rr.name] = append(resp.ptr[rr.name], strings.ToLower(instance))
+		case dnsTypeSRV:
+			if len(data) < 7 {
+				continue
+			}
+			host, _, err := readDNSName(msg, rr.dataOff+6)
+			if err != nil {
+				return nil, errors.Trace(err)
+			}
+			resp.srvPort[rr.name] = int(binary.BigEndian.Uint16(data[4:]))
+			resp.srvHost[rr.name] = strings.ToLower(host)
+		case dnsTypeTXT:
+			kv := map[string]string{}
+			for j := 0; j < len(data); {
+				l := int(data[j])
+				if j+1+l > len(data) {
+					break
+				}
+				parts := strings.SplitN(string(data[j+1:j+1+l]), "=", 2)
+				if len(parts) == 2 {
+					kv[parts[0]] = parts[1]
+				} else {
+					kv[parts[0]] = ""
+				}
+				j += 1 + l
+			}
+			resp.txt[rr.name] = kv
+		case dnsTypeA:
+			if len(data) == 4 {
+				resp.a[rr.name] = net.IP(append([]byte(nil), data...))
+			}
+		}
+	}
+	return resp, nil
+}
+
+// devices returns devices advertised in the response, from is the sender address.
+func (resp *mdnsResponse) devices(from net.IP) []*Device {
+	var devs []*Device
+	for _, instance := range resp.ptr[mdnsService] {
+		txt := resp.txt[instance]
+		// Other devices may advertise the same service, only take ones that look like ours.
+		if _, ok := txt["fw_id"]; !ok {
+			continue
+		}
+		ip := resp.a[resp.srvHost[instance]]
+		if ip == nil {
+			ip = from
+		}
+		host := ip.String()
+		if port := resp.srvPort[instance]; port != 0 && port != 80 {
+			host = net.JoinHostPort(host, strconv.Itoa(port))
+		}
+		d := &Device{Addr: "ws://" + host + "/rpc", IP: ip, ID: txt["id"]}
+		if v := txt["fw_id"]; v != "" {
+			d.Info.Fw_id = &v
+		}
+		if v := txt["arch"]; v != "" {
+			d.Info.Arch = &v
+		}
+		devs = append(devs, d)
+	}
+	return devs
+}
+
+// discoverMDNS sends a DNS-SD query and collects responses until ctx is done.
+func discoverMDNS(ctx context.Context, found chan<- *Device) error {
+	conn, err := net.ListenPacket("udp4", ":0")
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer conn.Close()
+	dst, err := net.ResolveUDPAddr("udp4", mdnsAddr)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if _, err := conn.WriteTo(mdnsQuery(mdnsService), dst); err != nil {
+		return errors.Annotatef(err, "failed to send mDNS query")
+	}
+	return errors.Trace(readPackets(ctx, conn, func(data []byte, from *net.UDPAddr) {
+		resp, err := parseMDNSResponse(data)
+		if err != nil {
+			glog.V(1).Infof("invalid mDNS response from %s: %s", from, err)
+			return
+		}
+		for _, d := range resp.devices(from.IP) {
+			found <- d
+		}
+	}))
+}
@@ -0,0 +1,115 @@
+//
+// Copyright (c) 2014-2019 Cesanta Software Limited
+// All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+
+	"github.com/cesanta/errors"
+	"github.com/golang/glog"
+
+	"github.com/mongoose-os/mos/common/mgrpc/codec"
+	"github.com/mongoose-os/mos/common/mgrpc/frame"
+)
+
+// probeFrameID is the ID of the Sys.GetInfo request broadcast by the UDP probe.
+const probeFrameID = 0x5D1C
+
+// broadcastAddrs returns broadcast addresses of all the IPv4 interfaces that are up,
+// plus the limited broadcast address.
+func broadcastAddrs(port int) []string {
+	ps := strconv.Itoa(port)
+	res := []string{net.JoinHostPort(net.IPv4bcast.String(), ps)}
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		glog.Errorf("failed to list interfaces: %s", err)
+		return res
+	}
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagBroadcast == 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			ipn, ok := addr.(*net.IPNet)
+			if !ok || ipn.IP.To4() == nil || len(ipn.Mask) != net.IPv4len {
+				continue
+			}
+			bcast := make(net.IP, net.IPv4len)
+			for i, b := range ipn.IP.To4() {
+				bcast[i] = b | ^ipn.Mask[i]
+			}
+			res = append(res, net.JoinHostPort(bcast.String(), ps))
+		}
+	}
+	return res
+}
+
+// discoverUDP broadcasts Sys.GetInfo request in the same format as used by
+// the UDP codec and collects responses until ctx is done.
+func discoverUDP(ctx context.Context, port int, targets []string, found chan<- *Device) error {
+	conn, err := net.ListenPacket("udp4", ":0")
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer conn.Close()
+	req, err := json.Marshal(&frame.Frame{Version: 2, Src: probeSrc, ID: probeFrameID, Method: "Sys.GetInfo"})
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if len(targets) == 0 {
+		targets = broadcastAddrs(port)
+	}
+	sent := 0
+	for _, t := range targets {
+		dst, err := net.ResolveUDPAddr("udp4", t)
+		if err != nil {
+			return errors.Annotatef(err, "invalid probe address %q", t)
+		}
+		if _, err := conn.WriteTo(req, dst); err != nil {
+			glog.V(1).Infof("failed to send probe to %s: %s", dst, err)
+			continue
+		}
+		sent++
+	}
+	if sent == 0 {
+		return errors.Errorf("failed to send UDP probe")
+	}
+	return errors.Trace(readPackets(ctx, conn, func(data []byte, from *net.UDPAddr) {
+		var f frame.Frame
+		if err := json.Unmarshal(data, &f); err != nil || f.ID != probeFrameID || f.Error != nil {
+			return
+		}
+		d := &Device{
+			Addr: fmt.Sprintf("%s://%s", codec.UDPURLScheme, from),
+			IP:   from.IP,
+			ID:   f.Src,
+		}
+		if err := json.Unmarshal(f.Result, &d.Info); err != nil {
+			glog.V(1).Infof("invalid GetInfo response from %s: %s", from, err)
+			return
+		}
+		found <- d
+	}))
+}
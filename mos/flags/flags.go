@@ -31,7 +31,8 @@ var (
 	// --arch was deprecated at 2017/08/15 and should eventually be removed.
 	archOld = flag.String("arch", "", "Deprecated, please use --platform instead")
 	Port    = flag.String("port", "auto", "Serial port where the device is connected. "+
-		"If set to 'auto', ports on the system will be enumerated and the first will be used.")
+		"If set to 'auto', ports on the system will be enumerated and the first will be used. "+
+		"If there are none, devices on the local network will be searched for.")
 	BaudRate       = flag.Int("baud-rate", 115200, "Serial port speed")
 	Board          = flag.String("board", "", "Board name.")
 	BuildInfo      = flag.String("build-info", "", "")
@@ -40,13 +41,13 @@ var (
 	Input          = flag.StringP("input", "i", "", "")
 	Manifest       = flag.String("manifest", "", "")
 	Name           = flag.String("name", "", "")
-	Output         = flag.StringP("output", "o", "", "")
+	Output         = flag.StringP("output", "o", "", "Output format: text, json or yaml")
+	BundleFile     = flag.String("bundle-file", "", "create-fw-bundle: file to write the bundle to")
 	platform       = flag.String("platform", "", "Hardware platform")
 	SrcDir         = flag.String("src-dir", "", "")
 	Compress       = flag.Bool("compress", false, "")
 	GHToken        = flag.String("gh-token", "", "")
 	ChunkSize      = flag.Int("chunk-size", 512, "Chunk size for operations")
-	FsOpAttempts   = flag.Int("fs-op-attempts", 3, "Chunk size for operations")
 	PID            = flag.String("pid", "mos", "")
 	UID            = flag.String("uid", "", "")
 	CertFile       = flag.String("cert-file", "", "Certificate file name")
@@ -73,6 +74,9 @@ var (
 	GCPKeyFile        = flag.String("gcp-key-file", "", "Private key file")
 	GCPRPCCreateTopic = flag.Bool("gcp-rpc-create-topic", false, "Create RPC topic plumbing if needed")
 
+	DryRun = flag.Bool("dry-run", true, "Do not apply changes, print what would be done")
+	Force  = flag.Bool("force", false, "Use the force")
+
 	Level    = flag.Int("level", -1, "Config level; default - runtime")
 	NoReboot = flag.Bool("no-reboot", false, "Save config but don't reboot the device.")
 	NoSave   = flag.Bool("no-save", false, "Don't save config and don't reboot the device")
@@ -90,6 +94,13 @@ var (
 	KeepTempFiles = flag.Bool("keep-temp-files", false, "keep temp files after the build is done (by default they are in ~/.mos/tmp)")
 	KeepFS        = flag.Bool("keep-fs", false, "When flashing, skip the filesystem parts")
 
+	Device = flag.String("device", "", "Name or alias of the device from the inventory to connect to, see \"mos devices\"")
+	Group  = flag.String("group", "", "Device group from the inventory")
+
+	Discover         = flag.Bool("discover", false, "Search for devices on the local network")
+	DiscoveryTimeout = flag.Duration("discovery-timeout", 3*time.Second, "How long to wait for devices to respond to discovery")
+	DiscoveryUDPPort = flag.Int("discovery-udp-port", 1234, "UDP port to send Sys.GetInfo probe to during discovery")
+
 	Attr      = flag.StringArray("attr", nil, "manifest attribute, can be used multiple times")
 	ExtraAttr = flag.StringArray("extra-attr", nil, "manifest extra attribute info to be added to ZIP")
 )
@@ -104,18 +115,58 @@ func Platform() string {
 	return *archOld
 }
 
+// Output formats, see OutputFormat.
+const (
+	OutputText = "text"
+	OutputJSON = "json"
+	OutputYAML = "yaml"
+)
+
+// OutputFormat returns the format commands print their results in, as
+// selected by --output. Any other value means text: create-fw-bundle still
+// accepts the bundle file name as --output, which predates --bundle-file.
+func OutputFormat() string {
+	switch *Output {
+	case OutputJSON, OutputYAML:
+		return *Output
+	}
+	return OutputText
+}
+
+// CheckOutputFormat returns an error if --output is not a known format.
+func CheckOutputFormat() error {
+	switch *Output {
+	case "", OutputText, OutputJSON, OutputYAML:
+		return nil
+	}
+	return errors.Errorf("unknown --output format %q, expected text, json or yaml", *Output)
+}
+
+// IsDryRun returns true if --dry-run was given explicitly. It is on by default
+// for commands that make irreversible changes to the hardware, the rest of
+// the commands only do a dry run when asked to.
+func IsDryRun() bool {
+	return flag.CommandLine.Changed("dry-run") && *DryRun
+}
+
 func TLSConfigFromFlags() (*tls.Config, error) {
+	return TLSConfig(*CertFile, *KeyFile, *CAFile)
+}
+
+// TLSConfig returns TLS config using the given client certificate and key,
+// and verifying the server against the CA certificate, if specified.
+func TLSConfig(certFile, keyFile, caFile string) (*tls.Config, error) {
 	tlsConfig := &tls.Config{
 		// TODO(rojer): Ship default CA bundle with mos.
-		InsecureSkipVerify: *CAFile == "",
+		InsecureSkipVerify: caFile == "",
 	}
 
 	// Load client cert / key if specified
-	if *CertFile != "" && *KeyFile == "" {
+	if certFile != "" && keyFile == "" {
 		return nil, errors.Errorf("Please specify --key-file")
 	}
-	if *CertFile != "" {
-		cert, err := tls.LoadX509KeyPair(*CertFile, *KeyFile)
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
 		if err != nil {
 			return nil, errors.Trace(err)
 		}
@@ -123,8 +174,8 @@ func TLSConfigFromFlags() (*tls.Config, error) {
 	}
 
 	// Load CA cert if specified
-	if *CAFile != "" {
-		caCert, err := ioutil.ReadFile(*CAFile)
+	if caFile != "" {
+		caCert, err := ioutil.ReadFile(caFile)
 		if err != nil {
 			return nil, errors.Trace(err)
 		}
@@ -20,6 +20,7 @@ package main
 
 import (
 	"fmt"
+	"io"
 	"os"
 	"runtime"
 	"strings"
@@ -40,6 +41,7 @@ import (
 	"github.com/mongoose-os/mos/mos/flash/rs14100"
 	"github.com/mongoose-os/mos/mos/flash/stm32"
 	"github.com/mongoose-os/mos/mos/ourutil"
+	"github.com/mongoose-os/mos/mos/output"
 	"github.com/mongoose-os/mos/mos/version"
 	flag "github.com/spf13/pflag"
 )
@@ -216,9 +218,19 @@ func flash(ctx context.Context, devConn dev.DevConn) error {
 		err = errors.Errorf("%s: unsupported platform '%s'", *firmware, fw.Platform)
 	}
 
-	if err == nil {
-		ourutil.Reportf("All done!")
+	if err != nil {
+		return errors.Trace(err)
 	}
+	ourutil.Reportf("All done!")
+	res := &flashResult{Name: fw.Name, Platform: fw.Platform, Version: fw.Version, BuildID: fw.BuildID, Port: port}
+	return output.Print(ctx, res, func(w io.Writer) error { return nil })
+}
 
-	return errors.Trace(err)
+// flashResult is printed by flash with a structured output format.
+type flashResult struct {
+	Name     string `json:"name"`
+	Platform string `json:"platform"`
+	Version  string `json:"version"`
+	BuildID  string `json:"build_id"`
+	Port     string `json:"port,omitempty"`
 }
@@ -0,0 +1,147 @@
+//
+// Copyright (c) 2014-2019 Cesanta Software Limited
+// All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Package fleet implements operations on many devices at once.
+package fleet
+
+import (
+	"context"
+	"io/ioutil"
+	"sync"
+
+	"github.com/cesanta/errors"
+	flag "github.com/spf13/pflag"
+	yaml "gopkg.in/yaml.v2"
+
+	"github.com/mongoose-os/mos/mos/dev"
+	"github.com/mongoose-os/mos/mos/devutil"
+	"github.com/mongoose-os/mos/mos/flags"
+	"github.com/mongoose-os/mos/mos/inventory"
+)
+
+var (
+	targetsFlag     = flag.String("targets", "", "YAML file with the list of devices to operate on")
+	parallelismFlag = flag.Int("parallelism", 4, "Number of devices to operate on at the same time")
+)
+
+// Target is a device to operate on.
+type Target struct {
+	// Name used in the output, port if not set.
+	Name string `yaml:"name,omitempty" json:"name,omitempty"`
+	// Serial port or address of the device, as would be given to --port.
+	Port string `yaml:"port" json:"port"`
+	// Inventory entry of the device, if the target comes from the inventory.
+	Device *inventory.Device `yaml:"-" json:"-"`
+}
+
+// ConnectFunc connects to the target.
+type ConnectFunc func(ctx context.Context, t Target) (dev.DevConn, error)
+
+// ReadTargets reads the list of targets from a YAML file, e.g.:
+//
+//	- name: bench-01
+//	  port: /dev/ttyUSB0
+//	- port: ws://192.168.1.10/rpc
+func ReadTargets(fname string) ([]Target, error) {
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	var targets []Target
+	if err := yaml.Unmarshal(data, &targets); err != nil {
+		return nil, errors.Annotatef(err, "%s: invalid targets file", fname)
+	}
+	for i := range targets {
+		t := &targets[i]
+		if t.Port == "" {
+			return nil, errors.Errorf("%s: target %d has no port", fname, i+1)
+		}
+		if t.Name == "" {
+			t.Name = t.Port
+		}
+	}
+	return targets, nil
+}
+
+// targetsFromFlags returns the members of --group from the inventory or the
+// devices listed in --targets, and the function to connect to them.
+func targetsFromFlags() ([]Target, ConnectFunc, error) {
+	if *flags.Group != "" {
+		if *targetsFlag != "" {
+			return nil, nil, errors.Errorf("--group and --targets are mutually exclusive")
+		}
+		inv, err := inventory.LoadDefault()
+		if err != nil {
+			return nil, nil, errors.Trace(err)
+		}
+		devs, err := inv.Group(*flags.Group)
+		if err != nil {
+			return nil, nil, errors.Trace(err)
+		}
+		var targets []Target
+		for _, d := range devs {
+			targets = append(targets, Target{Name: d.Name, Port: d.Port, Device: d})
+		}
+		return targets, connectTarget, nil
+	}
+	if *targetsFlag == "" {
+		return nil, nil, errors.Errorf("--group or --targets is required")
+	}
+	targets, err := ReadTargets(*targetsFlag)
+	if err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+	if len(targets) == 0 {
+		return nil, nil, errors.Errorf("%s: no targets", *targetsFlag)
+	}
+	return targets, connectTarget, nil
+}
+
+// connectTarget connects to the target using the settings of its inventory
+// entry, if any.
+func connectTarget(ctx context.Context, t Target) (dev.DevConn, error) {
+	if t.Device != nil {
+		return devutil.CreateDevConnToDevice(ctx, t.Device)
+	}
+	return devutil.CreateDevConn(ctx, t.Port)
+}
+
+// forEach invokes f for each of the targets, running up to parallelism of
+// them at a time. Targets for which stop returns true before they are
+// started are skipped.
+func forEach(targets []Target, parallelism int, stop func() bool, f func(i int, t Target)) {
+	if parallelism < 1 {
+		parallelism = 1
+	}
+	sem := make(chan struct{}, parallelism)
+	var wg sync.WaitGroup
+	for i, t := range targets {
+		sem <- struct{}{}
+		if stop() {
+			<-sem
+			break
+		}
+		wg.Add(1)
+		go func(i int, t Target) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			f(i, t)
+		}(i, t)
+	}
+	wg.Wait()
+}
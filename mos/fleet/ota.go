@@ -0,0 +1,263 @@
+//
+// Copyright (c) 2014-2019 Cesanta Software Limited
+// All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package fleet
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/cesanta/errors"
+	flag "github.com/spf13/pflag"
+
+	"github.com/mongoose-os/mos/mos/dev"
+	"github.com/mongoose-os/mos/mos/ota"
+	"github.com/mongoose-os/mos/mos/ourutil"
+	"github.com/mongoose-os/mos/mos/output"
+)
+
+var (
+	canaryFlag           = flag.Int("canary", 0, "Number of devices to update first; if any of them fails, the rollout is halted")
+	failureThresholdFlag = flag.Float64("failure-threshold", 0.1, "Halt the rollout when this fraction of devices has failed")
+	reportFlag           = flag.String("report", "", "Write per-device report to this file, CSV if the name ends with .csv, JSON otherwise")
+)
+
+// Outcomes of the update of a device.
+const (
+	StatusUpdated = "updated"
+	StatusFailed  = "failed"
+	StatusSkipped = "skipped"
+)
+
+// OTAOptions control a rollout.
+type OTAOptions struct {
+	Parallelism int
+	// Number of devices updated before the rest; the rollout stops if any of them fail.
+	Canary int
+	// Fraction of the devices that may fail before the rollout is halted.
+	FailureThreshold float64
+}
+
+// OTAResult is the outcome of the update of a device.
+type OTAResult struct {
+	Name         string  `json:"name"`
+	Port         string  `json:"port"`
+	Status       string  `json:"status"`
+	OldFwVersion string  `json:"old_fw_version,omitempty"`
+	OldFwID      string  `json:"old_fw_id,omitempty"`
+	NewFwVersion string  `json:"new_fw_version,omitempty"`
+	NewFwID      string  `json:"new_fw_id,omitempty"`
+	Duration     float64 `json:"duration"`
+	Error        string  `json:"error,omitempty"`
+}
+
+func fwInfo(info *dev.GetInfoResult) (string, string) {
+	version, id := "", ""
+	if info.Fw_version != nil {
+		version = *info.Fw_version
+	}
+	if info.Fw_id != nil {
+		id = *info.Fw_id
+	}
+	return version, id
+}
+
+func updateDevice(ctx context.Context, t Target, fwData []byte, connect ConnectFunc) *OTAResult {
+	res := &OTAResult{Name: t.Name, Port: t.Port, Status: StatusFailed}
+	start := time.Now()
+	err := func() error {
+		devConn, err := connect(ctx, t)
+		if err != nil {
+			return errors.Annotatef(err, "unable to connect")
+		}
+		defer devConn.Disconnect(ctx)
+		info, err := dev.GetInfo(ctx, devConn)
+		if err != nil {
+			return errors.Annotatef(err, "unable to get device info")
+		}
+		res.OldFwVersion, res.OldFwID = fwInfo(info)
+		// Updates run in parallel, tell the devices' progress apart.
+		if err := ota.Update(ourutil.WithReportPrefix(ctx, t.Name+": "), devConn, fwData, ""); err != nil {
+			return errors.Trace(err)
+		}
+		info, err = dev.GetInfo(ctx, devConn)
+		if err != nil {
+			return errors.Annotatef(err, "unable to get device info after update")
+		}
+		res.NewFwVersion, res.NewFwID = fwInfo(info)
+		return nil
+	}()
+	res.Duration = time.Since(start).Seconds()
+	if err != nil {
+		res.Error = errors.Cause(err).Error()
+		ourutil.Reportf("%s: update failed: %s", t.Name, res.Error)
+	} else {
+		res.Status = StatusUpdated
+		ourutil.Reportf("%s: updated %s -> %s", t.Name, res.OldFwVersion, res.NewFwVersion)
+	}
+	return res
+}
+
+// Rollout updates the targets with the firmware, canaries first. Once the
+// failure threshold is exceeded, devices that have not been started are
+// skipped. A result is returned for every target.
+func Rollout(ctx context.Context, targets []Target, fwData []byte, opts OTAOptions, connect ConnectFunc) []*OTAResult {
+	results := make([]*OTAResult, len(targets))
+	for i, t := range targets {
+		results[i] = &OTAResult{Name: t.Name, Port: t.Port, Status: StatusSkipped}
+	}
+	var lock sync.Mutex
+	numFailed, halted := 0, false
+	maxFailed := int(opts.FailureThreshold * float64(len(targets)))
+	stop := func() bool {
+		lock.Lock()
+		defer lock.Unlock()
+		return halted
+	}
+	update := func(offset int) func(i int, t Target) {
+		return func(i int, t Target) {
+			res := updateDevice(ctx, t, fwData, connect)
+			lock.Lock()
+			defer lock.Unlock()
+			results[offset+i] = res
+			if res.Status == StatusFailed {
+				numFailed++
+				if numFailed > maxFailed && !halted {
+					ourutil.Reportf("%d of %d devices failed, halting the rollout", numFailed, len(targets))
+					halted = true
+				}
+			}
+		}
+	}
+
+	canary := opts.Canary
+	if canary > len(targets) {
+		canary = len(targets)
+	}
+	if canary > 0 {
+		ourutil.Reportf("Updating %d canary device(s)...", canary)
+		forEach(targets[:canary], opts.Parallelism, stop, update(0))
+		if numFailed > 0 {
+			ourutil.Reportf("Canary update failed, halting the rollout")
+			return results
+		}
+	}
+	if canary < len(targets) && !halted {
+		ourutil.Reportf("Updating %d device(s)...", len(targets)-canary)
+		forEach(targets[canary:], opts.Parallelism, stop, update(canary))
+	}
+	return results
+}
+
+// WriteReport writes the results as JSON or, if csvFormat is set, as CSV.
+func WriteReport(w io.Writer, results []*OTAResult, csvFormat bool) error {
+	if !csvFormat {
+		data, err := json.MarshalIndent(results, "", "  ")
+		if err != nil {
+			return errors.Trace(err)
+		}
+		_, err = fmt.Fprintf(w, "%s\n", data)
+		return errors.Trace(err)
+	}
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"name", "port", "status", "old_fw_version", "old_fw_id", "new_fw_version", "new_fw_id", "duration", "error"})
+	for _, r := range results {
+		cw.Write([]string{
+			r.Name, r.Port, r.Status, r.OldFwVersion, r.OldFwID, r.NewFwVersion, r.NewFwID,
+			fmt.Sprintf("%.1f", r.Duration), r.Error,
+		})
+	}
+	cw.Flush()
+	return errors.Trace(cw.Error())
+}
+
+// printResults prints the results as a table.
+func printResults(w io.Writer, results []*OTAResult) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "NAME\tSTATUS\tOLD VERSION\tNEW VERSION\tERROR\n")
+	for _, r := range results {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", r.Name, r.Status,
+			strOrDash(r.OldFwVersion), strOrDash(r.NewFwVersion), strOrDash(r.Error))
+	}
+	return tw.Flush()
+}
+
+func strOrDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// OTA is the handler of "mos fleet-ota": it updates all the devices listed
+// in --targets or the members of --group.
+func OTA(ctx context.Context, _ dev.DevConn) error {
+	args := flag.Args()
+	if len(args) != 2 {
+		return errors.Errorf("firmware file is required")
+	}
+	targets, connect, err := targetsFromFlags()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	fwData, err := ourutil.ReadOrFetchFile(args[1])
+	if err != nil {
+		return errors.Trace(err)
+	}
+	opts := OTAOptions{
+		Parallelism:      *parallelismFlag,
+		Canary:           *canaryFlag,
+		FailureThreshold: *failureThresholdFlag,
+	}
+	results := Rollout(ctx, targets, fwData, opts, connect)
+
+	counts := map[string]int{}
+	for _, r := range results {
+		counts[r.Status]++
+	}
+	ourutil.Reportf("Updated: %d, failed: %d, skipped: %d",
+		counts[StatusUpdated], counts[StatusFailed], counts[StatusSkipped])
+	if err := output.Print(ctx, results, func(w io.Writer) error {
+		return errors.Trace(printResults(w, results))
+	}); err != nil {
+		return errors.Trace(err)
+	}
+	if *reportFlag != "" {
+		f, err := os.Create(*reportFlag)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		err = WriteReport(f, results, strings.HasSuffix(strings.ToLower(*reportFlag), ".csv"))
+		if err2 := f.Close(); err == nil {
+			err = err2
+		}
+		if err != nil {
+			return errors.Annotatef(err, "failed to write report")
+		}
+	}
+	if counts[StatusUpdated] != len(results) {
+		return errors.Errorf("%d of %d devices were not updated", len(results)-counts[StatusUpdated], len(results))
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+//
+// Copyright (c) 2014-2019 Cesanta Software Limited
+// All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package fleet_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	flag "github.com/spf13/pflag"
+
+	"github.com/mongoose-os/mos/common/fwbundle"
+	"github.com/mongoose-os/mos/mos/dev"
+	"github.com/mongoose-os/mos/mos/fleet"
+	"github.com/mongoose-os/mos/mos/sim"
+)
+
+func connect(ctx context.Context, t fleet.Target) (dev.DevConn, error) {
+	c := &dev.Client{Timeout: time.Second}
+	return c.CreateDevConn(ctx, t.Port, false)
+}
+
+// newTargets starts a simulated device for each of the archs.
+func newTargets(t *testing.T, ctx context.Context, archs ...string) ([]fleet.Target, func()) {
+	var targets []fleet.Target
+	var closers []func() error
+	for i, arch := range archs {
+		_, ep := sim.NewTestEndpoint(t, ctx, sim.Options{Info: sim.Info{Arch: arch}})
+		closers = append(closers, ep.Close)
+		targets = append(targets, fleet.Target{Name: fmt.Sprintf("dev%d", i), Port: ep.ConnectAddr})
+	}
+	return targets, func() {
+		for _, c := range closers {
+			c()
+		}
+	}
+}
+
+func statuses(results []*fleet.OTAResult) string {
+	var ss []string
+	for _, r := range results {
+		ss = append(ss, r.Status)
+	}
+	return strings.Join(ss, " ")
+}
+
+func TestRollout(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+	flag.Set("commit-timeout", "20s")
+	defer flag.Set("commit-timeout", "300s")
+	fwb := fwbundle.NewBundle()
+	fwb.Name, fwb.Platform, fwb.Version, fwb.BuildID = "app", "sim", "2.0", "20190202-000000"
+	buf := bytes.NewBuffer(nil)
+	if err := fwbundle.WriteZipFirmwareBytes(fwb, buf, false, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Failed canary stops the rollout.
+	targets, closeTargets := newTargets(t, ctx, "esp8266", "sim", "sim")
+	defer closeTargets()
+	results := fleet.Rollout(ctx, targets, buf.Bytes(), fleet.OTAOptions{Parallelism: 2, Canary: 1}, connect)
+	if got, want := statuses(results), "failed skipped skipped"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	// So does exceeding the failure threshold.
+	targets, closeTargets = newTargets(t, ctx, "sim", "esp8266", "sim")
+	defer closeTargets()
+	results = fleet.Rollout(ctx, targets, buf.Bytes(), fleet.OTAOptions{Parallelism: 1, Canary: 1}, connect)
+	if got, want := statuses(results), "updated failed skipped"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if r := results[0]; r.OldFwVersion != "1.0" || r.NewFwVersion != "2.0" || r.NewFwID != "20190202-000000" {
+		t.Errorf("got %+v", r)
+	}
+	if r := results[1]; !strings.Contains(r.Error, "esp8266") {
+		t.Errorf("got error %q", r.Error)
+	}
+
+	var report bytes.Buffer
+	if err := fleet.WriteReport(&report, results, true); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(report.String()), "\n")
+	if len(lines) != 4 || !strings.HasPrefix(lines[1], "dev0,tcp://") || !strings.Contains(lines[1], ",updated,1.0,20190101-000000,2.0,20190202-000000,") {
+		t.Errorf("unexpected report:\n%s", report.String())
+	}
+}
+
+func TestReadTargets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fleet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fname := filepath.Join(dir, "targets.yaml")
+	ioutil.WriteFile(fname, []byte("- name: bench-01\n  port: /dev/ttyUSB0\n- port: ws://192.168.1.10/rpc\n"), 0644)
+	targets, err := fleet.ReadTargets(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "[{bench-01 /dev/ttyUSB0 <nil>} {ws://192.168.1.10/rpc ws://192.168.1.10/rpc <nil>}]"
+	if got := fmt.Sprint(targets); got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+	ioutil.WriteFile(fname, []byte("- name: bench-01\n"), 0644)
+	if _, err := fleet.ReadTargets(fname); err == nil {
+		t.Errorf("expected an error for a target without port")
+	}
+}
@@ -0,0 +1,112 @@
+//
+// Copyright (c) 2014-2019 Cesanta Software Limited
+// All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package fleet
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/cesanta/errors"
+
+	"github.com/mongoose-os/mos/mos/dev"
+	"github.com/mongoose-os/mos/mos/ourutil"
+)
+
+// RunResult is the outcome of running a command on a device.
+type RunResult struct {
+	Name string `json:"name"`
+	Port string `json:"port"`
+	// What the command printed, as is if it's JSON, as a string otherwise.
+	Result   json.RawMessage `json:"result,omitempty"`
+	Error    string          `json:"error,omitempty"`
+	Duration float64         `json:"duration"`
+}
+
+// outputJSON returns the command output as JSON.
+func outputJSON(out []byte) json.RawMessage {
+	out = bytes.TrimSpace(out)
+	if len(out) == 0 {
+		return nil
+	}
+	var v interface{}
+	if json.Unmarshal(out, &v) == nil {
+		return json.RawMessage(out)
+	}
+	data, _ := json.Marshal(string(out))
+	return json.RawMessage(data)
+}
+
+func runDevice(ctx context.Context, t Target, f func(ctx context.Context, devConn dev.DevConn) error, connect ConnectFunc) *RunResult {
+	res := &RunResult{Name: t.Name, Port: t.Port}
+	start := time.Now()
+	var out bytes.Buffer
+	err := func() error {
+		devConn, err := connect(ctx, t)
+		if err != nil {
+			return errors.Annotatef(err, "unable to connect")
+		}
+		defer devConn.Disconnect(ctx)
+		return errors.Trace(f(ourutil.WithOutput(ctx, &out), devConn))
+	}()
+	res.Duration = time.Since(start).Seconds()
+	res.Result = outputJSON(out.Bytes())
+	if err != nil {
+		res.Error = errors.Cause(err).Error()
+	}
+	return res
+}
+
+// Run runs f on the targets, up to parallelism at a time. As each device
+// is done, its result is written to w as a line of JSON.
+func Run(ctx context.Context, targets []Target, parallelism int, f func(ctx context.Context, devConn dev.DevConn) error, connect ConnectFunc, w io.Writer) []*RunResult {
+	results := make([]*RunResult, len(targets))
+	var lock sync.Mutex
+	forEach(targets, parallelism, func() bool { return false }, func(i int, t Target) {
+		res := runDevice(ctx, t, f, connect)
+		data, _ := json.Marshal(res)
+		lock.Lock()
+		defer lock.Unlock()
+		results[i] = res
+		fmt.Fprintf(w, "%s\n", data)
+	})
+	return results
+}
+
+// RunCommand implements "mos fleet run": it runs the command handler
+// f on the members of --group or the devices listed in --targets.
+func RunCommand(ctx context.Context, f func(ctx context.Context, devConn dev.DevConn) error) error {
+	targets, connect, err := targetsFromFlags()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	numFailed := 0
+	for _, r := range Run(ctx, targets, *parallelismFlag, f, connect, os.Stdout) {
+		if r.Error != "" {
+			numFailed++
+		}
+	}
+	if numFailed > 0 {
+		return errors.Errorf("%d of %d devices failed", numFailed, len(targets))
+	}
+	return nil
+}
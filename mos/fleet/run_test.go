@@ -0,0 +1,69 @@
+//
+// Copyright (c) 2014-2019 Cesanta Software Limited
+// All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package fleet_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mongoose-os/mos/mos/dev"
+	"github.com/mongoose-os/mos/mos/fleet"
+	"github.com/mongoose-os/mos/mos/ourutil"
+)
+
+func TestRun(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	targets, closeTargets := newTargets(t, ctx, "sim", "esp32")
+	defer closeTargets()
+	targets = append(targets, fleet.Target{Name: "gone", Port: "tcp://127.0.0.1:1"})
+
+	getArch := func(ctx context.Context, devConn dev.DevConn) error {
+		info, err := dev.GetInfo(ctx, devConn)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(ourutil.Output(ctx), "{\"arch\": %q}\n", *info.Arch)
+		return nil
+	}
+	var out bytes.Buffer
+	results := fleet.Run(ctx, targets, 3, getArch, connect, &out)
+
+	var got []string
+	for _, r := range results {
+		got = append(got, fmt.Sprintf("%s %s %t", r.Name, string(r.Result), r.Error != ""))
+	}
+	if want := []string{`dev0 {"arch": "sim"} false`, `dev1 {"arch": "esp32"} false`, `gone  true`}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != len(targets) {
+		t.Fatalf("expected a line per device, got:\n%s", out.String())
+	}
+	for _, l := range lines {
+		var r fleet.RunResult
+		if err := json.Unmarshal([]byte(l), &r); err != nil || r.Name == "" {
+			t.Errorf("invalid result line %q: %v", l, err)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+//
+// Copyright (c) 2014-2019 Cesanta Software Limited
+// All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package main
+
+import (
+	"context"
+
+	"github.com/cesanta/errors"
+	flag "github.com/spf13/pflag"
+
+	"github.com/mongoose-os/mos/mos/dev"
+	"github.com/mongoose-os/mos/mos/fleet"
+)
+
+// fleetRun is the handler of "mos fleet run [flags] -- COMMAND [ARGS]",
+// it runs the device command on many devices, see fleet.RunCommand.
+func fleetRun(ctx context.Context, _ dev.DevConn) error {
+	args := flag.Args()[1:]
+	if len(args) < 2 || args[0] != "run" {
+		return errors.Errorf("usage: mos fleet run --group GROUP -- COMMAND [ARGS...]")
+	}
+	cmd := getCommand(args[1])
+	if cmd == nil {
+		return errors.Errorf("unknown command %q", args[1])
+	}
+	if cmd.needDevConn != Yes {
+		return errors.Errorf("%s does not operate on a device", cmd.name)
+	}
+	// Handlers take their arguments from the command line, make it look
+	// like the command was invoked directly.
+	if err := flag.CommandLine.Parse(args[1:]); err != nil {
+		return errors.Trace(err)
+	}
+	if err := checkFlags(cmd.required); err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(fleet.RunCommand(ctx, cmd.handler))
+}
@@ -0,0 +1,135 @@
+//
+// Copyright (c) 2014-2019 Cesanta Software Limited
+// All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package fs
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+
+	"github.com/cesanta/errors"
+	"github.com/golang/glog"
+
+	"github.com/mongoose-os/mos/mos/dev"
+	"github.com/mongoose-os/mos/mos/ourutil"
+)
+
+type ChecksumArgs struct {
+	Filename string `json:"filename"`
+	// If set, only this many bytes at the beginning of the file are hashed.
+	Len int64 `json:"len,omitempty"`
+}
+
+type ChecksumResult struct {
+	// Size of the hashed data.
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// deviceChecksum asks the device to compute SHA-256 of the file, or of the
+// first n bytes of it if n > 0. Not all firmware supports it, NotSupported
+// error is returned in that case.
+func deviceChecksum(ctx context.Context, devConn dev.DevConn, devFilename string, n int64) ([]byte, int64, error) {
+	var res ChecksumResult
+	if err := devConn.Call(ctx, "FS.Checksum", &ChecksumArgs{Filename: devFilename, Len: n}, &res); err != nil {
+		if dev.RemoteStatus(err) == 404 {
+			return nil, 0, errors.NotSupportedf("FS.Checksum")
+		}
+		return nil, 0, errors.Trace(err)
+	}
+	sum, err := hex.DecodeString(res.SHA256)
+	if err != nil || len(sum) != sha256.Size {
+		return nil, 0, errors.Errorf("invalid checksum %q", res.SHA256)
+	}
+	return sum, res.Size, nil
+}
+
+// resumeOffset returns the offset to continue uploading data from: the size
+// of the file already on the device, provided that it contains the
+// beginning of data. If the device cannot compute checksums, the size alone
+// is trusted, the final verification will tell if that was wrong.
+func resumeOffset(ctx context.Context, devConn dev.DevConn, devFilename string, data []byte) (int64, error) {
+	size, err := fileSize(ctx, devConn, devFilename)
+	if err != nil {
+		return 0, errors.Annotatef(err, "failed to get size of %s", devFilename)
+	}
+	if size <= 0 || size > int64(len(data)) {
+		return 0, nil
+	}
+	sum, _, err := deviceChecksum(ctx, devConn, devFilename, size)
+	switch {
+	case errors.IsNotSupported(err):
+		return size, nil
+	case err != nil:
+		return 0, errors.Trace(err)
+	}
+	if want := sha256.Sum256(data[:size]); !bytes.Equal(sum, want[:]) {
+		glog.Infof("%s: existing content differs, starting over", devFilename)
+		return 0, nil
+	}
+	return size, nil
+}
+
+// verifyChecksum checks that the file on the device has the expected size
+// and SHA-256. If the device cannot compute checksums, the file is read back
+// if readBack is set, otherwise only the size is checked.
+func verifyChecksum(ctx context.Context, devConn dev.DevConn, devFilename string, size int64, want []byte, readBack bool) error {
+	got, gotSize, err := deviceChecksum(ctx, devConn, devFilename, 0)
+	if errors.IsNotSupported(err) {
+		if !readBack {
+			return errors.Trace(verifySize(ctx, devConn, devFilename, size))
+		}
+		h := sha256.New()
+		st, err2 := getData(ctx, devConn, devFilename, 0, h, sha256.New())
+		if err2 != nil {
+			return errors.Annotatef(err2, "%s: failed to read back", devFilename)
+		}
+		got, gotSize, err = h.Sum(nil), st.Bytes, nil
+	}
+	if err != nil {
+		return errors.Annotatef(err, "%s: failed to verify", devFilename)
+	}
+	if gotSize != size || !bytes.Equal(got, want) {
+		return errors.Errorf("%s: verification failed: expected %d bytes with SHA-256 %x, device has %d bytes with SHA-256 %x",
+			devFilename, size, want, gotSize, got)
+	}
+	glog.V(1).Infof("%s: verified %d bytes, SHA-256 %x", devFilename, size, want)
+	return nil
+}
+
+// verifySize checks only the size of the file, for devices that cannot
+// compute checksums.
+func verifySize(ctx context.Context, devConn dev.DevConn, devFilename string, size int64) error {
+	gotSize, err := fileSize(ctx, devConn, devFilename)
+	if err != nil {
+		return errors.Annotatef(err, "%s: failed to verify", devFilename)
+	}
+	if gotSize != size {
+		return errors.Errorf("%s: verification failed: expected %d bytes, device has %d bytes", devFilename, size, gotSize)
+	}
+	glog.V(1).Infof("%s: verified size only, %d bytes", devFilename, size)
+	sizeOnlyOnce.Do(func() {
+		ourutil.Reportf("Device cannot compute checksums, only file sizes are verified")
+	})
+	return nil
+}
+
+// sizeOnlyOnce makes the user told about size-only verification once, not
+// for every file of fs-sync or backup.
+var sizeOnlyOnce sync.Once
@@ -19,23 +19,29 @@ package fs
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
 	"encoding/base64"
 	"fmt"
+	"hash"
 	"io"
+	"os"
 	"path"
 	"sort"
 	"strings"
 
 	"github.com/cesanta/errors"
-	"github.com/golang/glog"
 	"github.com/mongoose-os/mos/mos/dev"
-	"github.com/mongoose-os/mos/mos/flags"
 	"github.com/mongoose-os/mos/mos/ourutil"
+	"github.com/mongoose-os/mos/mos/output"
+	"github.com/mongoose-os/mos/mos/transfer"
 	flag "github.com/spf13/pflag"
 )
 
 var (
-	longFormat = flag.BoolP("long", "l", false, "Long output format.")
+	longFormat   = flag.BoolP("long", "l", false, "Long output format.")
+	resumeFlag   = flag.Bool("resume", false, "Continue an interrupted put or get instead of starting over")
+	verifyFlag   = flag.Bool("verify", true, "Verify SHA-256 checksum of the file after put or get. If the device cannot compute checksums, see --read-back")
+	readBackFlag = flag.Bool("read-back", true, "If the device cannot compute checksums, verify the file after put by reading it back. If false, or after get, only the size is verified")
 )
 
 type ListArgs struct {
@@ -51,9 +57,9 @@ type ListExtResult struct {
 	Size *int64  `json:"size,omitempty"`
 }
 
-func listFiles(ctx context.Context, devConn dev.DevConn, path string) ([]ListExtResult, error) {
+func listFiles(ctx context.Context, devConn dev.DevConn, path string, long bool) ([]ListExtResult, error) {
 	var res []ListExtResult
-	if *longFormat {
+	if long {
 		if err := devConn.Call(ctx, "FS.ListExt", &ListExtArgs{Path: &path}, &res); err != nil {
 			return nil, errors.Trace(err)
 		}
@@ -71,6 +77,17 @@ func listFiles(ctx context.Context, devConn dev.DevConn, path string) ([]ListExt
 	return res, nil
 }
 
+// ListFiles returns the files in the directory on the device, with sizes,
+// sorted by name.
+func ListFiles(ctx context.Context, devConn dev.DevConn, path string) ([]ListExtResult, error) {
+	files, err := listFiles(ctx, devConn, path, true)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	sort.Sort(byName(files))
+	return files, nil
+}
+
 type byName []ListExtResult
 
 func (a byName) Len() int           { return len(a) }
@@ -83,19 +100,21 @@ func Ls(ctx context.Context, devConn dev.DevConn) error {
 	if len(args) >= 2 {
 		path = args[1]
 	}
-	files, err := listFiles(ctx, devConn, path)
+	files, err := listFiles(ctx, devConn, path, *longFormat)
 	if err != nil {
 		return errors.Trace(err)
 	}
 	sort.Sort(byName(files))
-	for _, file := range files {
-		fmt.Printf("%s", *file.Name)
-		if file.Size != nil {
-			fmt.Printf(" %d", *file.Size)
+	return output.Print(ctx, files, func(w io.Writer) error {
+		for _, file := range files {
+			fmt.Fprintf(w, "%s", *file.Name)
+			if file.Size != nil {
+				fmt.Fprintf(w, " %d", *file.Size)
+			}
+			fmt.Fprintf(w, "\r\n")
 		}
-		fmt.Printf("\r\n")
-	}
-	return nil
+		return nil
+	})
 }
 
 type GetArgs struct {
@@ -110,47 +129,58 @@ type GetResult struct {
 }
 
 func GetFile(ctx context.Context, devConn dev.DevConn, name string) (string, error) {
-	// Get file
-	contents := []byte{}
-	var offset int64
+	var contents bytes.Buffer
+	if err := GetData(ctx, devConn, name, &contents); err != nil {
+		return "", errors.Trace(err)
+	}
+	return contents.String(), nil
+}
 
-	attempts := *flags.FsOpAttempts
-	for {
-		// Get the next chunk of data
-		ctx2, cancel := context.WithTimeout(ctx, devConn.GetTimeout())
-		defer cancel()
-		glog.V(1).Infof("Getting %s %d @ %d (attempts %d)", name, flags.ChunkSize, offset, attempts)
+// GetData retrieves the file from the device, writes it to w and verifies
+// the checksum.
+func GetData(ctx context.Context, devConn dev.DevConn, name string, w io.Writer) error {
+	_, err := getData(ctx, devConn, name, 0, w, sha256.New())
+	return errors.Trace(err)
+}
+
+// getData retrieves the file from the device starting at offset and writes
+// it to w. h must already contain the data before offset, once done, the
+// checksum is verified.
+func getData(ctx context.Context, devConn dev.DevConn, name string, offset int64, w io.Writer, h hash.Hash) (transfer.Stats, error) {
+	stats, err := readData(ctx, devConn, name, offset, io.MultiWriter(w, h))
+	if err != nil {
+		return stats, errors.Trace(err)
+	}
+	if *verifyFlag {
+		err = verifyChecksum(ctx, devConn, name, offset+stats.Bytes, h.Sum(nil), false /* readBack */)
+	}
+	return stats, errors.Trace(err)
+}
+
+// readData retrieves the file from the device starting at offset and writes
+// it to w, without verification.
+func readData(ctx context.Context, devConn dev.DevConn, name string, offset int64, w io.Writer) (transfer.Stats, error) {
+	dev.EnableBinaryFrames(ctx, devConn)
+	t := transfer.NewFromFlags(ctx, devConn)
+	err := t.Read(ctx, offset, w, func(ctx context.Context, offset int64, n int) ([]byte, int64, error) {
 		var chunk GetResult
-		if err := devConn.Call(ctx2, "FS.Get", &GetArgs{
+		if err := devConn.Call(ctx, "FS.Get", &GetArgs{
 			Filename: &name,
 			Offset:   offset,
-			Len:      int64(*flags.ChunkSize),
+			Len:      int64(n),
 		}, &chunk); err != nil {
-			attempts -= 1
-			if attempts > 0 {
-				glog.Warningf("Error: %s", err)
-				continue
-			}
-			// TODO(dfrank): probably handle out of memory error by retrying with a
-			// smaller chunk size
-			return "", errors.Trace(err)
+			return nil, 0, errors.Trace(err)
+		}
+		if chunk.Data == nil || chunk.Left == nil {
+			return nil, 0, errors.Errorf("invalid response to FS.Get")
 		}
-		attempts = *flags.FsOpAttempts
-
 		decoded, err := base64.StdEncoding.DecodeString(*chunk.Data)
 		if err != nil {
-			return "", errors.Trace(err)
+			return nil, 0, errors.Trace(err)
 		}
-
-		contents = append(contents, decoded...)
-		offset += int64(len(decoded))
-
-		// Check if there is some data left
-		if *chunk.Left == 0 {
-			break
-		}
-	}
-	return string(contents), nil
+		return decoded, *chunk.Left, nil
+	})
+	return t.Stats(), errors.Trace(err)
 }
 
 func Get(ctx context.Context, devConn dev.DevConn) error {
@@ -158,16 +188,82 @@ func Get(ctx context.Context, devConn dev.DevConn) error {
 	if len(args) < 2 {
 		return errors.Errorf("filename is required")
 	}
-	if len(args) > 2 {
+	if len(args) > 3 {
 		return errors.Errorf("extra arguments")
 	}
 	filename := args[1]
-	text, err := GetFile(ctx, devConn, filename)
+	if len(args) == 2 {
+		if !output.Structured() {
+			return errors.Trace(GetData(ctx, devConn, filename, ourutil.Output(ctx)))
+		}
+		// Contents go into the result, never as raw bytes.
+		var buf bytes.Buffer
+		if err := GetData(ctx, devConn, filename, &buf); err != nil {
+			return errors.Trace(err)
+		}
+		res := &FileResult{Name: filename, Size: int64(buf.Len()), Data: buf.Bytes()}
+		return output.Print(ctx, res, func(w io.Writer) error { return nil })
+	}
+	if err := GetToFile(ctx, devConn, filename, args[2]); err != nil {
+		return errors.Trace(err)
+	}
+	fi, err := os.Stat(args[2])
 	if err != nil {
 		return errors.Trace(err)
 	}
-	fmt.Print(string(text))
-	return nil
+	res := &FileResult{Name: filename, Size: fi.Size(), File: args[2]}
+	return output.Print(ctx, res, func(w io.Writer) error { return nil })
+}
+
+// FileResult is printed by get and put with a structured output format.
+type FileResult struct {
+	// Name of the file on the device.
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+	// Local file, if any.
+	File string `json:"file,omitempty"`
+	// Contents of the file if no local file is given, base64-encoded.
+	Data []byte `json:"data,omitempty"`
+}
+
+// GetToFile retrieves the file from the device and saves it to hostFilename.
+// With --resume, data already present in the local file is not retrieved again.
+func GetToFile(ctx context.Context, devConn dev.DevConn, devFilename, hostFilename string) error {
+	openFlags := os.O_WRONLY | os.O_CREATE
+	if !*resumeFlag {
+		openFlags |= os.O_TRUNC
+	}
+	f, err := os.OpenFile(hostFilename, openFlags, 0644)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer f.Close()
+	h := sha256.New()
+	var offset int64
+	if *resumeFlag {
+		// Continue where the previous attempt has stopped.
+		rf, err := os.Open(hostFilename)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		offset, err = io.Copy(h, rf)
+		rf.Close()
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if _, err := f.Seek(offset, io.SeekStart); err != nil {
+			return errors.Trace(err)
+		}
+		if offset > 0 {
+			ourutil.Reportf("Resuming at offset %d", offset)
+		}
+	}
+	stats, err := getData(ctx, devConn, devFilename, offset, f, h)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	ourutil.Reportf("Received %s", stats)
+	return errors.Trace(f.Close())
 }
 
 func Put(ctx context.Context, devConn dev.DevConn) error {
@@ -186,71 +282,103 @@ func Put(ctx context.Context, devConn dev.DevConn) error {
 		devFilename = args[2]
 	}
 
-	return PutFile(ctx, devConn, hostFilename, devFilename)
+	size, err := putFile(ctx, devConn, hostFilename, devFilename)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	res := &FileResult{Name: devFilename, Size: size, File: hostFilename}
+	return output.Print(ctx, res, func(w io.Writer) error { return nil })
 }
 
+// PutFile uploads the file to the device and verifies the checksum.
+// With --resume, data that is already on the device is not sent again.
 func PutFile(ctx context.Context, devConn dev.DevConn, hostFilename, devFilename string) error {
+	_, err := putFile(ctx, devConn, hostFilename, devFilename)
+	return errors.Trace(err)
+}
+
+// putFile is PutFile that also returns the size of the file.
+func putFile(ctx context.Context, devConn dev.DevConn, hostFilename, devFilename string) (int64, error) {
 	fileData, err := ourutil.ReadOrFetchFile(hostFilename)
 	if err != nil {
-		return errors.Trace(err)
+		return 0, errors.Trace(err)
 	}
 
-	return PutData(ctx, devConn, bytes.NewBuffer(fileData), devFilename)
+	var offset int64
+	if *resumeFlag {
+		if offset, err = resumeOffset(ctx, devConn, devFilename, fileData); err != nil {
+			return 0, errors.Trace(err)
+		}
+		if offset > 0 {
+			ourutil.Reportf("Resuming at offset %d", offset)
+		}
+	}
+	h := sha256.New()
+	h.Write(fileData[:offset])
+	stats, err := putData(ctx, devConn, bytes.NewBuffer(fileData[offset:]), devFilename, offset, h)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	ourutil.Reportf("Sent %s", stats)
+	return int64(len(fileData)), nil
 }
 
+// PutData uploads data from r to the device and verifies the checksum.
 func PutData(ctx context.Context, devConn dev.DevConn, r io.Reader, devFilename string) error {
-	data := make([]byte, *flags.ChunkSize)
-	appendFlag := false
-
-	offset := 0
-	attempts := *flags.FsOpAttempts
-	for {
-		// Read the next chunk from the file.
-		n, readErr := r.Read(data)
-		if n > 0 {
-			for attempts > 0 {
-				ctx2, cancel := context.WithTimeout(ctx, devConn.GetTimeout())
-				defer cancel()
-				glog.V(1).Infof("Sending %s %d @ %d (attempts %d)", devFilename, n, offset, attempts)
-				putArgs := &struct {
-					Filename string `json:"filename"`
-					Offset   int    `json:"offset"`
-					Append   bool   `json:"append"`
-					Data     string `json:"data"`
-				}{
-					Filename: devFilename,
-					Offset:   offset,
-					Append:   appendFlag,
-					Data:     base64.StdEncoding.EncodeToString(data[:n]),
-				}
-				if err := devConn.Call(ctx2, "FS.Put", putArgs, nil); err != nil {
-					attempts -= 1
-					if attempts > 0 {
-						glog.Warningf("Error: %s", err)
-						continue
-					}
-					return errors.Trace(err)
-				} else {
-					break
-				}
-			}
+	_, err := putData(ctx, devConn, r, devFilename, 0, sha256.New())
+	return errors.Trace(err)
+}
+
+// putData writes data from r to the file starting at offset. h must already
+// contain the data before offset, once done, the checksum is verified.
+func putData(ctx context.Context, devConn dev.DevConn, r io.Reader, devFilename string, offset int64, h hash.Hash) (transfer.Stats, error) {
+	dev.EnableBinaryFrames(ctx, devConn)
+	t := transfer.NewFromFlags(ctx, devConn)
+	err := t.Write(ctx, offset, io.TeeReader(r, h), func(ctx context.Context, offset int64, data []byte) error {
+		putArgs := &struct {
+			Filename string `json:"filename"`
+			Offset   int64  `json:"offset"`
+			Append   bool   `json:"append"`
+			Data     string `json:"data"`
+		}{
+			Filename: devFilename,
+			Offset:   offset,
+			// All subsequent writes to this file will append the chunk.
+			Append: offset > 0,
+			Data:   base64.StdEncoding.EncodeToString(data),
 		}
-		attempts = *flags.FsOpAttempts
-		if readErr != nil {
-			if errors.Cause(readErr) == io.EOF {
-				// Reached EOF, quit the loop normally.
-				break
-			}
-			// Some non-EOF error, return error.
-			return errors.Trace(readErr)
+		return errors.Trace(devConn.Call(ctx, "FS.Put", putArgs, nil))
+	}, func(ctx context.Context) (int64, error) {
+		return fileSize(ctx, devConn, devFilename)
+	})
+	if err != nil {
+		return t.Stats(), errors.Trace(err)
+	}
+	if offset == 0 && t.Stats().Bytes == 0 {
+		// No chunks were sent, create the file or truncate an existing one.
+		if err := devConn.Call(ctx, "FS.Put", map[string]interface{}{"filename": devFilename, "data": ""}, nil); err != nil {
+			return t.Stats(), errors.Trace(err)
 		}
-
-		// All subsequent writes to this file will append the chunk.
-		appendFlag = true
-		offset += n
 	}
+	if *verifyFlag {
+		err = verifyChecksum(ctx, devConn, devFilename, offset+t.Stats().Bytes, h.Sum(nil), *readBackFlag)
+	}
+	return t.Stats(), errors.Trace(err)
+}
 
-	return nil
+// fileSize returns the size of the file on the device.
+func fileSize(ctx context.Context, devConn dev.DevConn, devFilename string) (int64, error) {
+	dir, name := path.Split(devFilename)
+	var files []ListExtResult
+	if err := devConn.Call(ctx, "FS.ListExt", &ListExtArgs{Path: &dir}, &files); err != nil {
+		return 0, errors.Trace(err)
+	}
+	for _, f := range files {
+		if f.Name != nil && *f.Name == name && f.Size != nil {
+			return *f.Size, nil
+		}
+	}
+	return 0, nil
 }
 
 type RemoveArgs struct {
@@ -272,5 +400,12 @@ func Rm(ctx context.Context, devConn dev.DevConn) error {
 		return errors.Errorf("extra arguments")
 	}
 	filename := args[1]
-	return errors.Trace(fsRemoveFile(ctx, devConn, filename))
+	if err := fsRemoveFile(ctx, devConn, filename); err != nil {
+		return errors.Trace(err)
+	}
+	res := &struct {
+		Name    string `json:"name"`
+		Removed bool   `json:"removed"`
+	}{filename, true}
+	return output.Print(ctx, res, func(w io.Writer) error { return nil })
 }
@@ -0,0 +1,277 @@
+//
+// Copyright (c) 2014-2019 Cesanta Software Limited
+// All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package fs_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	flag "github.com/spf13/pflag"
+
+	"github.com/mongoose-os/mos/mos/fs"
+	"github.com/mongoose-os/mos/mos/sim"
+)
+
+func TestResume(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	dir, err := ioutil.TempDir("", "fs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	_, devConn, closeDev := sim.NewTestConn(t, ctx, sim.Options{})
+	defer closeDev()
+	flag.Set("resume", "true")
+	defer flag.Set("resume", "false")
+
+	data := strings.Repeat("0123456789", 1000)
+	hostFile := filepath.Join(dir, "test.txt")
+	if err := ioutil.WriteFile(hostFile, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, prefix := range []string{data[:3000], "garbage", data + "extra"} {
+		if err := fs.PutData(ctx, devConn, strings.NewReader(prefix), "test.txt"); err != nil {
+			t.Fatal(err)
+		}
+		if err := fs.PutFile(ctx, devConn, hostFile, "test.txt"); err != nil {
+			t.Fatal(err)
+		}
+		var got bytes.Buffer
+		if err := fs.GetData(ctx, devConn, "test.txt", &got); err != nil {
+			t.Fatal(err)
+		}
+		if got.String() != data {
+			t.Errorf("%.10q: got %d bytes, want %d", prefix, got.Len(), len(data))
+		}
+	}
+
+	localFile := filepath.Join(dir, "local.txt")
+	for _, prefix := range []string{"", data[:4321]} {
+		if err := ioutil.WriteFile(localFile, []byte(prefix), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := fs.GetToFile(ctx, devConn, "test.txt", localFile); err != nil {
+			t.Fatal(err)
+		}
+		if got, _ := ioutil.ReadFile(localFile); string(got) != data {
+			t.Errorf("%.10q: got %d bytes, want %d", prefix, len(got), len(data))
+		}
+	}
+
+	// Local data that does not match is detected.
+	if err := ioutil.WriteFile(localFile, []byte("garbage"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.GetToFile(ctx, devConn, "test.txt", localFile); err == nil || !strings.Contains(err.Error(), "verification failed") {
+		t.Errorf("expected verification error, got %v", err)
+	}
+
+	// An empty file replaces the existing one.
+	if err := fs.PutData(ctx, devConn, strings.NewReader(""), "test.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := fs.GetFile(ctx, devConn, "test.txt"); err != nil || got != "" {
+		t.Errorf("got %d bytes, %v", len(got), err)
+	}
+}
+
+func TestVerifyWithoutChecksum(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	_, devConn, closeDev := sim.NewTestConn(t, ctx, sim.Options{Disabled: []string{"FS.Checksum"}})
+	defer closeDev()
+
+	data := strings.Repeat("0123456789", 1000)
+	for _, readBack := range []string{"false", "true"} {
+		flag.Set("read-back", readBack)
+		if err := fs.PutData(ctx, devConn, strings.NewReader(data), "test.txt"); err != nil {
+			t.Fatalf("read-back %s: %s", readBack, err)
+		}
+	}
+	flag.Set("read-back", "true")
+	got, err := fs.GetFile(ctx, devConn, "test.txt")
+	if err != nil || got != data {
+		t.Errorf("got %d bytes, %v", len(got), err)
+	}
+}
+
+func TestSync(t *testing.T) {
+	t.Run("flat", func(t *testing.T) { testSync(t, sim.Options{}) })
+	t.Run("dirs", func(t *testing.T) { testSync(t, sim.Options{FSDirs: true}) })
+}
+
+func testSync(t *testing.T, simOpts sim.Options) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	dir, err := ioutil.TempDir("", "fs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	_, devConn, closeDev := sim.NewTestConn(t, ctx, simOpts)
+	defer closeDev()
+
+	localDir := filepath.Join(dir, "local")
+	for name, content := range map[string]string{
+		"index.html":    "<html></html>",
+		"empty.txt":     "",
+		"same.txt":      "same",
+		"size.txt":      "local size",
+		"content.txt":   "local",
+		"www/app.js":    "app",
+		"www/app.js.gz": "gz",
+	} {
+		fn := filepath.Join(localDir, filepath.FromSlash(name))
+		os.MkdirAll(filepath.Dir(fn), 0755)
+		if err := ioutil.WriteFile(fn, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, content := range map[string]string{
+		"same.txt":    "same",
+		"size.txt":    "size",
+		"content.txt": "LOCAL",
+		"extra.txt":   "extra",
+		"old/x.txt":   "x",
+		"empty.txt":   "",
+		"conf0.json":  "{}",
+	} {
+		if err := fs.PutData(ctx, devConn, strings.NewReader(content), name); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	opts := fs.SyncOptions{Delete: true, Exclude: []string{"conf*.json", "www/*.gz"}}
+	plan, err := fs.PlanSync(ctx, devConn, localDir, "/", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, a := range plan {
+		got = append(got, a.Action+" "+a.Name+" "+a.Reason)
+	}
+	want := "[copy content.txt content differs delete extra.txt  copy index.html new delete old/x.txt  copy size.txt size differs copy www/app.js new]"
+	if fmt.Sprint(got) != want {
+		t.Errorf("got plan %s, want %s", got, want)
+	}
+	if err := fs.ApplySync(ctx, devConn, localDir, "/", opts, plan); err != nil {
+		t.Fatal(err)
+	}
+	if plan, err := fs.PlanSync(ctx, devConn, localDir, "/", opts); err != nil || len(plan) != 0 {
+		t.Errorf("expected nothing to do after sync, got %v %v", plan, err)
+	}
+
+	// And back.
+	opts = fs.SyncOptions{FromDevice: true}
+	localDir2 := filepath.Join(dir, "local2")
+	plan, err = fs.PlanSync(ctx, devConn, localDir2, "/", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.ApplySync(ctx, devConn, localDir2, "/", opts, plan); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"conf0.json", "index.html", "www/app.js"} {
+		want, _ := ioutil.ReadFile(filepath.Join(localDir, filepath.FromSlash(name)))
+		if name == "conf0.json" {
+			want = []byte("{}")
+		}
+		if got, err := ioutil.ReadFile(filepath.Join(localDir2, filepath.FromSlash(name))); err != nil || string(got) != string(want) {
+			t.Errorf("%s: got %q %v, want %q", name, got, err, want)
+		}
+	}
+}
+
+func TestSyncWithoutChecksum(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	dir, err := ioutil.TempDir("", "fs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	_, devConn, closeDev := sim.NewTestConn(t, ctx, sim.Options{Disabled: []string{"FS.Checksum"}})
+	defer closeDev()
+
+	for name, content := range map[string][2]string{
+		"same.txt":    {"same", "same"},
+		"content.txt": {"local", "LOCAL"},
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content[0]), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := fs.PutData(ctx, devConn, strings.NewReader(content[1]), name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	plan, err := fs.PlanSync(ctx, devConn, dir, "/", fs.SyncOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan) != 1 || plan[0].Name != "content.txt" || plan[0].Reason != "content differs" {
+		t.Errorf("unexpected plan %v", plan)
+	}
+}
+
+func TestShell(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	_, devConn, closeDev := sim.NewTestConn(t, ctx, sim.Options{})
+	defer closeDev()
+	for name, content := range map[string]string{"a.txt": "aaa", "b.txt": "bb", "c.js": "c"} {
+		if err := fs.PutData(ctx, devConn, strings.NewReader(content), name); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var out bytes.Buffer
+	sh := fs.NewShell(devConn, &out)
+	for _, c := range []struct {
+		line string
+		want string
+	}{
+		{"ls *.txt", "a.txt\nb.txt\n"},
+		{"ls -l c.js", "       1 c.js\n"},
+		{"cat a.txt 'b.txt'", "aaabb"},
+		{"mv a.txt d.txt", ""},
+		{"cat d.txt", "aaa"},
+		{"rm *.txt", ""},
+		{"ls", "c.js\n"},
+	} {
+		out.Reset()
+		if err := sh.Exec(ctx, c.line); err != nil {
+			t.Errorf("%s: %s", c.line, err)
+		} else if out.String() != c.want {
+			t.Errorf("%s: got %q, want %q", c.line, out.String(), c.want)
+		}
+	}
+	out.Reset()
+	if err := sh.Exec(ctx, "df"); err != nil || !strings.Contains(out.String(), "Use%") {
+		t.Errorf("df: got %q %v", out.String(), err)
+	}
+	if err := sh.Exec(ctx, "cat nonexistent*"); err == nil {
+		t.Errorf("expected an error for a glob without matches")
+	}
+}
@@ -0,0 +1,456 @@
+//
+// Copyright (c) 2014-2019 Cesanta Software Limited
+// All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package fs
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/cesanta/errors"
+	"golang.org/x/crypto/ssh/terminal"
+
+	"github.com/mongoose-os/mos/mos/dev"
+)
+
+const shellPrompt = "mos> "
+
+type shellCommand struct {
+	name string
+	args string
+	help string
+	run  func(sh *Shell, ctx context.Context, args []string) error
+}
+
+var shellCommands []shellCommand
+
+func init() {
+	// Initialized here because "help" refers to the list.
+	shellCommands = []shellCommand{
+		{"ls", "[-l] [glob...]", "List files", (*Shell).ls},
+		{"cat", "file...", "Print contents of the files", (*Shell).cat},
+		{"put", "local_file [file]", "Upload a file to the device", (*Shell).put},
+		{"get", "file [local_file]", "Download a file from the device", (*Shell).get},
+		{"rm", "file...", "Delete files", (*Shell).rm},
+		{"mv", "file new_name", "Rename a file", (*Shell).mv},
+		{"df", "", "Show filesystem usage", (*Shell).df},
+		{"edit", "file", "Edit a file with $EDITOR, it is uploaded back if changed", (*Shell).edit},
+		{"help", "", "Show this help", (*Shell).help},
+		{"exit", "", "Exit the shell", nil},
+	}
+}
+
+// Shell is an interactive shell for the device filesystem. It uses the same
+// connection for all the commands.
+type Shell struct {
+	devConn dev.DevConn
+	out     io.Writer
+
+	// Names of the files on the device, for glob expansion and completion.
+	// Reset by commands that change the filesystem.
+	names []string
+}
+
+// NewShell creates a shell that prints output of the commands to out.
+func NewShell(devConn dev.DevConn, out io.Writer) *Shell {
+	return &Shell{devConn: devConn, out: out}
+}
+
+// splitLine splits a command line into words. Single and double quotes can
+// be used for words containing spaces.
+func splitLine(line string) ([]string, error) {
+	var words []string
+	var word bytes.Buffer
+	inWord := false
+	var quote rune
+	for _, c := range line {
+		switch {
+		case quote != 0 && c == quote:
+			quote = 0
+		case quote != 0:
+			word.WriteRune(c)
+		case c == '"' || c == '\'':
+			quote, inWord = c, true
+		case c == ' ' || c == '\t':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(c)
+			inWord = true
+		}
+	}
+	if quote != 0 {
+		return nil, errors.Errorf("unterminated quote")
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
+
+// Exec executes a single command line. io.EOF is returned for "exit".
+func (sh *Shell) Exec(ctx context.Context, line string) error {
+	words, err := splitLine(line)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if len(words) == 0 {
+		return nil
+	}
+	for _, c := range shellCommands {
+		if c.name != words[0] {
+			continue
+		}
+		if c.run == nil {
+			return io.EOF
+		}
+		return errors.Trace(c.run(sh, ctx, words[1:]))
+	}
+	return errors.Errorf("unknown command %q, try \"help\"", words[0])
+}
+
+// Run reads commands from in and executes them until "exit" or end of input.
+// If in is a terminal, line editing and completion are available.
+func (sh *Shell) Run(ctx context.Context, in *os.File) error {
+	if terminal.IsTerminal(int(in.Fd())) {
+		st, err := terminal.MakeRaw(int(in.Fd()))
+		if err != nil {
+			return errors.Trace(err)
+		}
+		defer terminal.Restore(int(in.Fd()), st)
+		t := terminal.NewTerminal(struct {
+			io.Reader
+			io.Writer
+		}{in, os.Stdout}, shellPrompt)
+		t.AutoCompleteCallback = func(line string, pos int, key rune) (string, int, bool) {
+			if key != '\t' {
+				return "", 0, false
+			}
+			return sh.complete(ctx, line, pos)
+		}
+		// Terminal converts line endings for us.
+		sh.out = t
+		return sh.loop(ctx, t.ReadLine)
+	}
+	scanner := bufio.NewScanner(in)
+	return sh.loop(ctx, func() (string, error) {
+		if !scanner.Scan() {
+			if err := scanner.Err(); err != nil {
+				return "", err
+			}
+			return "", io.EOF
+		}
+		return scanner.Text(), nil
+	})
+}
+
+func (sh *Shell) loop(ctx context.Context, readLine func() (string, error)) error {
+	for {
+		line, err := readLine()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return errors.Trace(err)
+		}
+		if err := sh.Exec(ctx, line); err == io.EOF {
+			return nil
+		} else if err != nil {
+			fmt.Fprintf(sh.out, "Error: %s\n", errors.Cause(err))
+		}
+		if ctx.Err() != nil {
+			return errors.Trace(ctx.Err())
+		}
+	}
+}
+
+// remoteNames returns names of the files on the device.
+func (sh *Shell) remoteNames(ctx context.Context) ([]string, error) {
+	if sh.names != nil {
+		return sh.names, nil
+	}
+	files, err := listFiles(ctx, sh.devConn, "/", false)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	names := []string{}
+	for _, f := range files {
+		names = append(names, *f.Name)
+	}
+	sort.Strings(names)
+	sh.names = names
+	return names, nil
+}
+
+// expand replaces globs with the names of the matching remote files.
+func (sh *Shell) expand(ctx context.Context, args []string) ([]string, error) {
+	var res []string
+	for _, arg := range args {
+		if !strings.ContainsAny(arg, "*?[") {
+			res = append(res, arg)
+			continue
+		}
+		names, err := sh.remoteNames(ctx)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		n := len(res)
+		for _, name := range names {
+			if ok, err := path.Match(strings.TrimPrefix(arg, "/"), name); err != nil {
+				return nil, errors.Annotatef(err, "invalid glob %q", arg)
+			} else if ok {
+				res = append(res, name)
+			}
+		}
+		if len(res) == n {
+			return nil, errors.Errorf("no files match %q", arg)
+		}
+	}
+	return res, nil
+}
+
+// complete completes the word before the cursor: command names for the
+// first word, names of the remote files for the rest.
+func (sh *Shell) complete(ctx context.Context, line string, pos int) (string, int, bool) {
+	start := strings.LastIndexAny(line[:pos], " \t") + 1
+	prefix := line[start:pos]
+	var candidates []string
+	if strings.TrimSpace(line[:start]) == "" {
+		for _, c := range shellCommands {
+			candidates = append(candidates, c.name)
+		}
+	} else {
+		names, err := sh.remoteNames(ctx)
+		if err != nil {
+			return "", 0, false
+		}
+		candidates = names
+	}
+	var matches []string
+	for _, c := range candidates {
+		if strings.HasPrefix(c, prefix) {
+			matches = append(matches, c)
+		}
+	}
+	if len(matches) == 0 {
+		return "", 0, false
+	}
+	// Complete up to the longest common prefix.
+	common := matches[0]
+	for _, m := range matches[1:] {
+		for !strings.HasPrefix(m, common) {
+			common = common[:len(common)-1]
+		}
+	}
+	if len(matches) == 1 {
+		common += " "
+	} else if len(common) == len(prefix) {
+		fmt.Fprintf(sh.out, "\n%s\n", strings.Join(matches, "  "))
+	}
+	return line[:start] + common + line[pos:], start + len(common), true
+}
+
+func (sh *Shell) ls(ctx context.Context, args []string) error {
+	long := false
+	if len(args) > 0 && args[0] == "-l" {
+		long, args = true, args[1:]
+	}
+	files, err := listFiles(ctx, sh.devConn, "/", long)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	sort.Sort(byName(files))
+	for _, f := range files {
+		if len(args) > 0 {
+			matched := false
+			for _, arg := range args {
+				if ok, _ := path.Match(strings.TrimPrefix(arg, "/"), *f.Name); ok {
+					matched = true
+				}
+			}
+			if !matched {
+				continue
+			}
+		}
+		if long && f.Size != nil {
+			fmt.Fprintf(sh.out, "%8d %s\n", *f.Size, *f.Name)
+		} else {
+			fmt.Fprintf(sh.out, "%s\n", *f.Name)
+		}
+	}
+	return nil
+}
+
+func (sh *Shell) cat(ctx context.Context, args []string) error {
+	names, err := sh.expand(ctx, args)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if len(names) == 0 {
+		return errors.Errorf("file name is required")
+	}
+	for _, name := range names {
+		if err := GetData(ctx, sh.devConn, name, sh.out); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return nil
+}
+
+func (sh *Shell) put(ctx context.Context, args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return errors.Errorf("usage: put local_file [file]")
+	}
+	devFilename := filepath.Base(args[0])
+	if len(args) == 2 {
+		devFilename = args[1]
+	}
+	sh.names = nil
+	return errors.Trace(PutFile(ctx, sh.devConn, args[0], devFilename))
+}
+
+func (sh *Shell) get(ctx context.Context, args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return errors.Errorf("usage: get file [local_file]")
+	}
+	hostFilename := path.Base(args[0])
+	if len(args) == 2 {
+		hostFilename = args[1]
+	}
+	return errors.Trace(GetToFile(ctx, sh.devConn, args[0], hostFilename))
+}
+
+func (sh *Shell) rm(ctx context.Context, args []string) error {
+	names, err := sh.expand(ctx, args)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if len(names) == 0 {
+		return errors.Errorf("file name is required")
+	}
+	sh.names = nil
+	for _, name := range names {
+		if err := fsRemoveFile(ctx, sh.devConn, name); err != nil {
+			return errors.Annotatef(err, "failed to remove %s", name)
+		}
+	}
+	return nil
+}
+
+// mv uses FS.Rename if the device supports it, otherwise the file is copied.
+func (sh *Shell) mv(ctx context.Context, args []string) error {
+	if len(args) != 2 {
+		return errors.Errorf("usage: mv file new_name")
+	}
+	src, dst := args[0], args[1]
+	sh.names = nil
+	err := sh.devConn.Call(ctx, "FS.Rename", map[string]string{"src": src, "dst": dst}, nil)
+	if err == nil || dev.RemoteStatus(err) != 404 {
+		return errors.Trace(err)
+	}
+	var data bytes.Buffer
+	if err := GetData(ctx, sh.devConn, src, &data); err != nil {
+		return errors.Trace(err)
+	}
+	if err := PutData(ctx, sh.devConn, &data, dst); err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(fsRemoveFile(ctx, sh.devConn, src))
+}
+
+func (sh *Shell) df(ctx context.Context, args []string) error {
+	var info dev.GetInfoResult
+	if err := sh.devConn.Call(ctx, "Sys.GetInfo", nil, &info); err != nil {
+		return errors.Trace(err)
+	}
+	if info.Fs_size == nil || info.Fs_free == nil {
+		return errors.Errorf("device does not report filesystem usage")
+	}
+	size, free := *info.Fs_size, *info.Fs_free
+	used := size - free
+	pct := 0
+	if size > 0 {
+		pct = int(used * 100 / size)
+	}
+	fmt.Fprintf(sh.out, "%10s %10s %10s %4s\n", "Size", "Used", "Free", "Use%")
+	fmt.Fprintf(sh.out, "%10d %10d %10d %3d%%\n", size, used, free, pct)
+	return nil
+}
+
+func (sh *Shell) edit(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return errors.Errorf("usage: edit file")
+	}
+	name := args[0]
+	dir, err := ioutil.TempDir("", "mos-edit-")
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer os.RemoveAll(dir)
+	localFile := filepath.Join(dir, path.Base(name))
+	var data bytes.Buffer
+	if err := GetData(ctx, sh.devConn, name, &data); err != nil {
+		return errors.Trace(err)
+	}
+	if err := ioutil.WriteFile(localFile, data.Bytes(), 0600); err != nil {
+		return errors.Trace(err)
+	}
+	editor := os.Getenv("EDITOR")
+	if editor == "" {
+		editor = "vi"
+	}
+	// $EDITOR may contain arguments.
+	cmdLine := strings.Fields(editor)
+	cmd := exec.Command(cmdLine[0], append(cmdLine[1:], localFile)...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if err := cmd.Run(); err != nil {
+		return errors.Annotatef(err, "editor failed")
+	}
+	newData, err := ioutil.ReadFile(localFile)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if sha256.Sum256(newData) == sha256.Sum256(data.Bytes()) {
+		fmt.Fprintf(sh.out, "%s not changed\n", name)
+		return nil
+	}
+	sh.names = nil
+	return errors.Trace(PutData(ctx, sh.devConn, bytes.NewReader(newData), name))
+}
+
+func (sh *Shell) help(ctx context.Context, args []string) error {
+	for _, c := range shellCommands {
+		fmt.Fprintf(sh.out, "  %-28s %s\n", strings.TrimSpace(c.name+" "+c.args), c.help)
+	}
+	return nil
+}
+
+func FSShell(ctx context.Context, devConn dev.DevConn) error {
+	return errors.Trace(NewShell(devConn, os.Stdout).Run(ctx, os.Stdin))
+}
@@ -0,0 +1,358 @@
+//
+// Copyright (c) 2014-2019 Cesanta Software Limited
+// All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package fs
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/cesanta/errors"
+	"github.com/golang/glog"
+	flag "github.com/spf13/pflag"
+
+	"github.com/mongoose-os/mos/common/ourglob"
+	"github.com/mongoose-os/mos/mos/dev"
+	"github.com/mongoose-os/mos/mos/flags"
+	"github.com/mongoose-os/mos/mos/ourutil"
+	"github.com/mongoose-os/mos/mos/output"
+)
+
+var (
+	fromDeviceFlag = flag.Bool("from-device", false, "fs-sync: copy files from the device to the local directory")
+	deleteFlag     = flag.Bool("delete", false, "fs-sync: delete files that do not exist at the source")
+	includeFlag    = flag.StringSlice("include", nil, "fs-sync: only sync files matching these globs")
+	excludeFlag    = flag.StringSlice("exclude", nil, "fs-sync: do not sync files matching these globs")
+)
+
+// SyncOptions control SyncDir.
+type SyncOptions struct {
+	// Copy files from the device instead of to it.
+	FromDevice bool
+	// Delete files at the destination that do not exist at the source.
+	Delete bool
+	// Globs of the files to sync and to leave alone, matched against paths
+	// relative to the directory being synced. A glob matching a directory
+	// covers everything in it. Exclusions take precedence. If Include is
+	// empty, all files are included.
+	Include []string
+	Exclude []string
+}
+
+// Sync actions.
+const (
+	SyncCopy   = "copy"
+	SyncDelete = "delete"
+)
+
+// SyncAction is a step of the sync plan.
+type SyncAction struct {
+	Action string `json:"action"`
+	Name   string `json:"name"`
+	Size   int64  `json:"size,omitempty"`
+	Reason string `json:"reason,omitempty"`
+}
+
+func (a SyncAction) String() string {
+	if a.Action == SyncDelete {
+		return fmt.Sprintf("%-6s %s", a.Action, a.Name)
+	}
+	return fmt.Sprintf("%-6s %s (%d bytes, %s)", a.Action, a.Name, a.Size, a.Reason)
+}
+
+// syncFile is a file on either side. Names use forward slashes.
+type syncFile struct {
+	name string
+	size int64
+}
+
+func listLocalFiles(dir string) (map[string]syncFile, error) {
+	res := map[string]syncFile{}
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		// Will be created.
+		return res, nil
+	}
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		name := filepath.ToSlash(rel)
+		res[name] = syncFile{name: name, size: info.Size()}
+		return nil
+	})
+	return res, errors.Trace(err)
+}
+
+// listDeviceFiles lists the files in dir on the device, including the ones
+// in subdirectories.
+func listDeviceFiles(ctx context.Context, devConn dev.DevConn, dir string) (map[string]syncFile, error) {
+	var files []ListExtResult
+	if err := devConn.Call(ctx, "FS.ListExt", &ListExtArgs{Path: &dir}, &files); err != nil {
+		return nil, errors.Annotatef(err, "failed to list files")
+	}
+	res := map[string]syncFile{}
+	if err := addDeviceFiles(ctx, devConn, dir, "", files, res); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return res, nil
+}
+
+// addDeviceFiles adds the files listed in the subdirectory rel of dir to res.
+// Filesystems with directories, e.g. LFS, list subdirectories as entries of
+// zero size, these are listed in turn. Listing a file fails, so empty files
+// are told apart. Flat filesystems list all files with full names at once.
+func addDeviceFiles(ctx context.Context, devConn dev.DevConn, dir, rel string, files []ListExtResult, res map[string]syncFile) error {
+	for _, f := range files {
+		if f.Name == nil || f.Size == nil {
+			continue
+		}
+		name := path.Join(rel, *f.Name)
+		if *f.Size == 0 && !strings.Contains(*f.Name, "/") {
+			var sub []ListExtResult
+			subDir := devicePath(dir, name)
+			// A filesystem that ignores the path lists the entry itself again.
+			if err := devConn.Call(ctx, "FS.ListExt", &ListExtArgs{Path: &subDir}, &sub); err == nil && !hasFile(sub, *f.Name) {
+				if err := addDeviceFiles(ctx, devConn, dir, name, sub, res); err != nil {
+					return errors.Trace(err)
+				}
+				continue
+			}
+		}
+		res[name] = syncFile{name: name, size: *f.Size}
+	}
+	return nil
+}
+
+func hasFile(files []ListExtResult, name string) bool {
+	for _, f := range files {
+		if f.Name != nil && *f.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func syncMatcher(opts *SyncOptions) ourglob.PatItems {
+	var items ourglob.PatItems
+	for _, p := range opts.Exclude {
+		items = append(items, ourglob.Item{Pattern: filepath.FromSlash(p), Match: false})
+	}
+	for _, p := range opts.Include {
+		items = append(items, ourglob.Item{Pattern: filepath.FromSlash(p), Match: true})
+	}
+	if len(opts.Include) == 0 {
+		items = append(items, ourglob.Item{Pattern: "*", Match: true})
+	}
+	return items
+}
+
+func devicePath(deviceDir, name string) string {
+	if deviceDir == "" || deviceDir == "/" {
+		return name
+	}
+	return path.Join(deviceDir, name)
+}
+
+// sameContent compares the local file with the one on the device. If the
+// device cannot compute checksums, the file is read from the device to
+// compare, in which case downloaded is set.
+func sameContent(ctx context.Context, devConn dev.DevConn, localFile, devFile string) (same, downloaded bool, err error) {
+	devSum, _, err := deviceChecksum(ctx, devConn, devFile, 0)
+	if errors.IsNotSupported(err) {
+		glog.V(1).Infof("%s: device cannot compute checksums, reading it to compare", devFile)
+		h := sha256.New()
+		if _, err := readData(ctx, devConn, devFile, 0, h); err != nil {
+			return false, true, errors.Trace(err)
+		}
+		devSum, downloaded = h.Sum(nil), true
+	} else if err != nil {
+		return false, false, errors.Trace(err)
+	}
+	f, err := os.Open(localFile)
+	if err != nil {
+		return false, downloaded, errors.Trace(err)
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return false, downloaded, errors.Trace(err)
+	}
+	return bytes.Equal(h.Sum(nil), devSum), downloaded, nil
+}
+
+// PlanSync returns the actions needed to make the files at deviceDir on the
+// device the same as in localDir, or the other way around if
+// opts.FromDevice is set. Files are copied if their size or content differs.
+func PlanSync(ctx context.Context, devConn dev.DevConn, localDir, deviceDir string, opts SyncOptions) ([]SyncAction, error) {
+	localFiles, err := listLocalFiles(localDir)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	deviceFiles, err := listDeviceFiles(ctx, devConn, deviceDir)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	src, dst := localFiles, deviceFiles
+	if opts.FromDevice {
+		src, dst = deviceFiles, localFiles
+	}
+	matcher := syncMatcher(&opts)
+	matches := func(name string) (bool, error) {
+		return matcher.Match(filepath.FromSlash(name))
+	}
+
+	var plan []SyncAction
+	numDownloaded := 0
+	for name, sf := range src {
+		if ok, err := matches(name); err != nil || !ok {
+			if err != nil {
+				return nil, errors.Annotatef(err, "invalid glob")
+			}
+			continue
+		}
+		reason := ""
+		if df, ok := dst[name]; !ok {
+			reason = "new"
+		} else if df.size != sf.size {
+			reason = "size differs"
+		} else {
+			same, downloaded, err := sameContent(ctx, devConn, filepath.Join(localDir, filepath.FromSlash(name)), devicePath(deviceDir, name))
+			if err != nil {
+				return nil, errors.Annotatef(err, "failed to compare %s", name)
+			}
+			if downloaded {
+				numDownloaded++
+			}
+			if same {
+				continue
+			}
+			reason = "content differs"
+		}
+		plan = append(plan, SyncAction{Action: SyncCopy, Name: name, Size: sf.size, Reason: reason})
+	}
+	if opts.Delete {
+		for name := range dst {
+			if _, ok := src[name]; ok {
+				continue
+			}
+			if ok, err := matches(name); err != nil || !ok {
+				continue
+			}
+			plan = append(plan, SyncAction{Action: SyncDelete, Name: name})
+		}
+	}
+	if numDownloaded > 0 {
+		ourutil.Reportf("Device cannot compute checksums, %d files of the same size were read from it to compare content", numDownloaded)
+	}
+	sort.Slice(plan, func(i, j int) bool { return plan[i].Name < plan[j].Name })
+	return plan, nil
+}
+
+// ApplySync performs the actions planned by PlanSync.
+func ApplySync(ctx context.Context, devConn dev.DevConn, localDir, deviceDir string, opts SyncOptions, plan []SyncAction) error {
+	for _, a := range plan {
+		var err error
+		localFile := filepath.Join(localDir, filepath.FromSlash(a.Name))
+		devFile := devicePath(deviceDir, a.Name)
+		switch {
+		case a.Action == SyncCopy && !opts.FromDevice:
+			err = PutFile(ctx, devConn, localFile, devFile)
+		case a.Action == SyncCopy && opts.FromDevice:
+			if err = os.MkdirAll(filepath.Dir(localFile), 0755); err == nil {
+				err = GetToFile(ctx, devConn, devFile, localFile)
+			}
+		case a.Action == SyncDelete && !opts.FromDevice:
+			err = fsRemoveFile(ctx, devConn, devFile)
+		case a.Action == SyncDelete && opts.FromDevice:
+			err = os.Remove(localFile)
+		}
+		if err != nil {
+			return errors.Annotatef(err, "%s %s", a.Action, a.Name)
+		}
+	}
+	return nil
+}
+
+func Sync(ctx context.Context, devConn dev.DevConn) error {
+	args := flag.Args()
+	if len(args) < 2 {
+		return errors.Errorf("local directory is required")
+	}
+	if len(args) > 3 {
+		return errors.Errorf("extra arguments")
+	}
+	localDir, deviceDir := args[1], "/"
+	if len(args) == 3 {
+		deviceDir = args[2]
+	}
+	opts := SyncOptions{
+		FromDevice: *fromDeviceFlag,
+		Delete:     *deleteFlag,
+		Include:    *includeFlag,
+		Exclude:    *excludeFlag,
+	}
+	plan, err := PlanSync(ctx, devConn, localDir, deviceDir, opts)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	res := &SyncResult{Actions: plan}
+	if res.Actions == nil {
+		res.Actions = []SyncAction{}
+	}
+	if len(plan) == 0 {
+		ourutil.Reportf("Everything is up to date")
+		return output.Print(ctx, res, func(w io.Writer) error { return nil })
+	}
+	// In text form the plan is printed before it is carried out.
+	if !output.Structured() {
+		w := ourutil.Output(ctx)
+		for _, a := range plan {
+			fmt.Fprintln(w, a)
+		}
+	}
+	if flags.IsDryRun() {
+		ourutil.Reportf("Dry run, %d actions not performed", len(plan))
+	} else {
+		if err := ApplySync(ctx, devConn, localDir, deviceDir, opts, plan); err != nil {
+			return errors.Trace(err)
+		}
+		ourutil.Reportf("Done, %d actions performed", len(plan))
+		res.Applied = true
+	}
+	return output.Print(ctx, res, func(w io.Writer) error { return nil })
+}
+
+// SyncResult is the result of fs-sync.
+type SyncResult struct {
+	Actions []SyncAction `json:"actions"`
+	// False if everything is up to date or it is a dry run.
+	Applied bool `json:"applied"`
+}
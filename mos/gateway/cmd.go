@@ -0,0 +1,116 @@
+//
+// Copyright (c) 2014-2019 Cesanta Software Limited
+// All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package gateway
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/cesanta/errors"
+	flag "github.com/spf13/pflag"
+
+	"github.com/mongoose-os/mos/common/mgrpc"
+	"github.com/mongoose-os/mos/common/mgrpc/codec"
+	"github.com/mongoose-os/mos/mos/dev"
+	"github.com/mongoose-os/mos/mos/devutil"
+	"github.com/mongoose-os/mos/mos/ourutil"
+)
+
+var (
+	// The gateway does not authenticate clients unless they are required to
+	// present a certificate, so by default it is only reachable locally.
+	listenFlag         = flag.StringSlice("listen", []string{"ws://127.0.0.1:8910"}, "Addresses for the RPC gateway to listen on: ws://, tcp:// or http://, or wss://, tcps:// or https:// with --listen-cert-file. Can be used multiple times. Clients are not authenticated unless --listen-client-ca-file is given, be careful with listening on other than the loopback interface.")
+	listenCertFileFlag = flag.String("listen-cert-file", "", "Certificate for the RPC gateway to present on wss://, tcps:// and https:// addresses")
+	listenKeyFileFlag  = flag.String("listen-key-file", "", "Private key of --listen-cert-file, if it is not in the same file")
+	listenClientCAFlag = flag.String("listen-client-ca-file", "", "CA certificates to verify client certificates with on wss://, tcps:// and https:// addresses. Clients that do not present a valid certificate are rejected")
+	routeFlag          = flag.StringArray("route", nil, `Route requests for a destination to a device: "name=address", e.g. "dev1=serial:///dev/ttyUSB0". Can be used multiple times.`)
+)
+
+// dialFromFlags connects to a device using connection settings from flags.
+func dialFromFlags(ctx context.Context, addr string) (codec.Codec, error) {
+	if strings.Index(addr, "://") < 0 {
+		addr = "serial://" + addr
+	}
+	tlsConfig, err := devutil.TLSConfigFromFlags(addr)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	c, err := mgrpc.Dial(ctx, addr,
+		mgrpc.LocalID(DefaultID),
+		mgrpc.TlsConfig(tlsConfig),
+		mgrpc.CodecOptions(*devutil.CodecOptionsFromFlags(addr, func(junk []byte) {})),
+	)
+	return c, errors.Trace(err)
+}
+
+// RPCGateway runs the gateway until interrupted.
+func RPCGateway(ctx context.Context, devConn dev.DevConn) error {
+	routes := map[string]string{}
+	for _, r := range *routeFlag {
+		name, addr, err := ParseRoute(r)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		routes[name] = addr
+	}
+	g, err := New(ctx, Options{Routes: routes, Dial: dialFromFlags})
+	if err != nil {
+		return errors.Annotatef(err, "please specify --route")
+	}
+	defer g.Close()
+	for name, addr := range routes {
+		ourutil.Reportf("Route: %s -> %s", name, addr)
+	}
+	for _, addr := range *listenFlag {
+		lc, err := mgrpc.ListenerConfigFromURL(addr)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		opts := []mgrpc.ListenOption{mgrpc.HandleCodecs(g.HandleConn)}
+		if lc.TLS != nil {
+			if *listenCertFileFlag == "" {
+				return errors.Errorf("%s: --listen-cert-file is required", addr)
+			}
+			keyFile := *listenKeyFileFlag
+			if keyFile == "" {
+				keyFile = *listenCertFileFlag
+			}
+			opts = append(opts, mgrpc.ServerCertFiles(*listenCertFileFlag, keyFile))
+			if *listenClientCAFlag != "" {
+				opts = append(opts, mgrpc.VerifyClientsWithCAsFromFile(*listenClientCAFlag))
+			}
+		} else if *listenClientCAFlag != "" {
+			return errors.Errorf("%s: client certificates require wss://, tcps:// or https://", addr)
+		}
+		s, err := mgrpc.Listen(ctx, lc, opts...)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		defer s.Close()
+		ourutil.Reportf("Listening on %s", addr)
+	}
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	select {
+	case <-sigs:
+	case <-ctx.Done():
+	}
+	return nil
+}
@@ -0,0 +1,346 @@
+//
+// Copyright (c) 2014-2019 Cesanta Software Limited
+// All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Package gateway implements an RPC gateway that accepts frames on inbound
+// connections and forwards them to devices by destination.
+package gateway
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cesanta/errors"
+	"github.com/golang/glog"
+
+	"github.com/mongoose-os/mos/common/mgrpc/codec"
+	"github.com/mongoose-os/mos/common/mgrpc/frame"
+)
+
+const (
+	// Source ID of the frames sent to devices.
+	DefaultID = "mos-gateway"
+
+	DefaultRequestTimeout = 5 * time.Minute
+
+	statusNoRoute     = 404
+	statusUnavailable = 503
+	statusTimeout     = 504
+)
+
+// DialFunc connects to a device.
+type DialFunc func(ctx context.Context, addr string) (codec.Codec, error)
+
+type Options struct {
+	// Routes map destination names to device addresses.
+	Routes map[string]string
+	// Dial connects to devices.
+	Dial DialFunc
+	// Source ID to set on the frames sent to devices, DefaultID if empty.
+	ID string
+	// How long to wait for device to accept and respond to a request,
+	// DefaultRequestTimeout if 0.
+	RequestTimeout time.Duration
+}
+
+// Gateway forwards requests to devices and relays responses back.
+type Gateway struct {
+	ctx  context.Context
+	opts Options
+
+	lock    sync.Mutex
+	devices map[string]*device
+
+	lastID int64
+}
+
+// pendingRequest is a request forwarded to a device, waiting for response.
+type pendingRequest struct {
+	client   codec.Codec
+	id       int64
+	src      string
+	deadline time.Time
+	// done is closed once the request is resolved, i.e. response has been
+	// relayed to the client or the request has failed.
+	done chan struct{}
+}
+
+// device is a route destination, connected when needed.
+type device struct {
+	name, addr string
+
+	lock    sync.Mutex
+	c       codec.Codec
+	pending map[int64]*pendingRequest
+}
+
+func New(ctx context.Context, opts Options) (*Gateway, error) {
+	if len(opts.Routes) == 0 {
+		return nil, errors.Errorf("no routes")
+	}
+	if opts.Dial == nil {
+		return nil, errors.Errorf("no dial function")
+	}
+	if opts.ID == "" {
+		opts.ID = DefaultID
+	}
+	if opts.RequestTimeout <= 0 {
+		opts.RequestTimeout = DefaultRequestTimeout
+	}
+	g := &Gateway{
+		ctx:     ctx,
+		opts:    opts,
+		devices: map[string]*device{},
+		lastID:  time.Now().UnixNano() & 0xffffffff,
+	}
+	for name, addr := range opts.Routes {
+		g.devices[name] = &device{name: name, addr: addr, pending: map[int64]*pendingRequest{}}
+	}
+	return g, nil
+}
+
+// ParseRoute parses route specification in the form of "name=address".
+func ParseRoute(s string) (name, addr string, err error) {
+	parts := strings.SplitN(s, "=", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", errors.Errorf("invalid route %q, expected name=address", s)
+	}
+	return parts[0], parts[1], nil
+}
+
+func errorResponse(f *frame.Frame, src string, code int, format string, args ...interface{}) *frame.Frame {
+	return &frame.Frame{
+		ID:    f.ID,
+		Src:   src,
+		Dst:   f.Src,
+		Error: &frame.Error{Code: code, Message: fmt.Sprintf(format, args...)},
+	}
+}
+
+// route returns the device the request should be forwarded to.
+// If destination is not specified, the path of the inbound connection is
+// used and if there is just one route, it is the default.
+func (g *Gateway) route(c codec.Codec, f *frame.Frame) *device {
+	dst := f.Dst
+	if dst == "" {
+		dst = strings.Trim(c.Info().Path, "/")
+	}
+	if dst == "" && len(g.devices) == 1 {
+		for _, d := range g.devices {
+			return d
+		}
+	}
+	return g.devices[dst]
+}
+
+// HandleConn processes frames received from the client until the connection is closed.
+func (g *Gateway) HandleConn(c codec.Codec) {
+	info := c.Info()
+	glog.Infof("%s: connected", info.RemoteAddr)
+	defer glog.Infof("%s: disconnected", info.RemoteAddr)
+	// Client that can send only one request, e.g. HTTP POST, is done sending
+	// right after it, but it still has to receive the response.
+	var waitFor []*pendingRequest
+	for {
+		f, err := c.Recv(g.ctx)
+		if err != nil {
+			if !codec.IsEOF(err) {
+				glog.V(1).Infof("%s: %s", info.RemoteAddr, err)
+			}
+			break
+		}
+		if !f.IsRequest() {
+			glog.V(1).Infof("%s: ignoring unsolicited response %d", info.RemoteAddr, f.ID)
+			continue
+		}
+		d := g.route(c, f)
+		if d == nil {
+			g.respond(c, errorResponse(f, g.opts.ID, statusNoRoute, "no route to %q", f.Dst))
+			continue
+		}
+		pr, err := g.forward(d, c, f)
+		if err != nil {
+			glog.Errorf("%s: %s", d.name, err)
+			g.respond(c, errorResponse(f, d.name, statusUnavailable, "%s: %s", d.name, err))
+			continue
+		}
+		if pr != nil && c.MaxNumFrames() == 1 {
+			waitFor = append(waitFor, pr)
+		}
+	}
+	for _, pr := range waitFor {
+		g.wait(c, pr)
+	}
+	g.forgetClient(c)
+}
+
+// wait waits for the request to be resolved, until it times out or the
+// client goes away.
+func (g *Gateway) wait(c codec.Codec, pr *pendingRequest) {
+	t := time.NewTimer(time.Until(pr.deadline))
+	defer t.Stop()
+	select {
+	case <-pr.done:
+	case <-t.C:
+		glog.Infof("%s: request %d timed out", c.Info().RemoteAddr, pr.id)
+		g.respond(c, errorResponse(&frame.Frame{ID: pr.id, Src: pr.src}, g.opts.ID, statusTimeout, "request timed out"))
+	case <-c.CloseNotify():
+	case <-g.ctx.Done():
+	}
+}
+
+func (g *Gateway) respond(c codec.Codec, f *frame.Frame) {
+	if err := c.Send(g.ctx, f); err != nil {
+		glog.V(1).Infof("%s: failed to send response: %s", c.Info().RemoteAddr, err)
+	}
+}
+
+// forward sends request to the device, assigning it a new ID so that
+// requests of different clients do not clash. Unless no response is
+// expected, the request is returned to keep track of.
+func (g *Gateway) forward(d *device, client codec.Codec, f *frame.Frame) (*pendingRequest, error) {
+	dc, err := g.connect(d)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	out := *f
+	out.ID = atomic.AddInt64(&g.lastID, 1)
+	out.Src = g.opts.ID
+	// Destination is meaningful only to the gateway, devices on the other
+	// side either do not care or have it set by the codec.
+	out.Dst = ""
+	var pr *pendingRequest
+	if !f.NoResponse {
+		now := time.Now()
+		d.lock.Lock()
+		for id, pr := range d.pending {
+			if now.After(pr.deadline) {
+				delete(d.pending, id)
+				close(pr.done)
+			}
+		}
+		pr = &pendingRequest{
+			client: client, id: f.ID, src: f.Src, deadline: now.Add(g.opts.RequestTimeout),
+			done: make(chan struct{}),
+		}
+		d.pending[out.ID] = pr
+		d.lock.Unlock()
+	}
+	glog.V(2).Infof("%s: %s %d -> %d", d.name, f.Method, f.ID, out.ID)
+	ctx, cancel := context.WithTimeout(g.ctx, g.opts.RequestTimeout)
+	defer cancel()
+	if err := dc.Send(ctx, &out); err != nil {
+		d.lock.Lock()
+		delete(d.pending, out.ID)
+		d.lock.Unlock()
+		g.disconnect(d, dc)
+		return nil, errors.Annotatef(err, "failed to send request")
+	}
+	return pr, nil
+}
+
+// connect returns connection to the device, establishing it if needed.
+func (g *Gateway) connect(d *device) (codec.Codec, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.c != nil {
+		return d.c, nil
+	}
+	glog.Infof("%s: connecting to %s", d.name, d.addr)
+	c, err := g.opts.Dial(g.ctx, d.addr)
+	if err != nil {
+		return nil, errors.Annotatef(err, "failed to connect to %s", d.addr)
+	}
+	d.c = c
+	go g.recvLoop(d, c)
+	return c, nil
+}
+
+// disconnect closes connection to the device and fails requests pending on it.
+func (g *Gateway) disconnect(d *device, c codec.Codec) {
+	d.lock.Lock()
+	if d.c != c {
+		d.lock.Unlock()
+		return
+	}
+	d.c = nil
+	pending := d.pending
+	d.pending = map[int64]*pendingRequest{}
+	d.lock.Unlock()
+	c.Close()
+	for _, pr := range pending {
+		g.respond(pr.client, errorResponse(&frame.Frame{ID: pr.id, Src: pr.src}, d.name, statusUnavailable, "%s: connection lost", d.name))
+		close(pr.done)
+	}
+}
+
+// recvLoop relays responses from the device to clients that sent the requests.
+func (g *Gateway) recvLoop(d *device, c codec.Codec) {
+	for {
+		f, err := c.Recv(g.ctx)
+		if err != nil {
+			glog.Infof("%s: disconnected: %s", d.name, err)
+			g.disconnect(d, c)
+			return
+		}
+		if f.IsRequest() {
+			glog.V(1).Infof("%s: ignoring request %s from device", d.name, f.Method)
+			continue
+		}
+		d.lock.Lock()
+		pr := d.pending[f.ID]
+		delete(d.pending, f.ID)
+		d.lock.Unlock()
+		if pr == nil {
+			glog.V(1).Infof("%s: ignoring unsolicited response %d", d.name, f.ID)
+			continue
+		}
+		resp := *f
+		resp.ID = pr.id
+		resp.Src = d.name
+		resp.Dst = pr.src
+		g.respond(pr.client, &resp)
+		close(pr.done)
+	}
+}
+
+// forgetClient drops requests of a client that has disconnected.
+func (g *Gateway) forgetClient(c codec.Codec) {
+	for _, d := range g.devices {
+		d.lock.Lock()
+		for id, pr := range d.pending {
+			if pr.client == c {
+				delete(d.pending, id)
+			}
+		}
+		d.lock.Unlock()
+	}
+}
+
+// Close closes connections to the devices.
+func (g *Gateway) Close() {
+	for _, d := range g.devices {
+		d.lock.Lock()
+		c := d.c
+		d.lock.Unlock()
+		if c != nil {
+			g.disconnect(d, c)
+		}
+	}
+}
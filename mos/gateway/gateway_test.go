@@ -0,0 +1,184 @@
+//
+// Copyright (c) 2014-2019 Cesanta Software Limited
+// All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mongoose-os/mos/common/mgrpc"
+	"github.com/mongoose-os/mos/common/mgrpc/codec"
+	"github.com/mongoose-os/mos/common/mgrpc/frame"
+	"github.com/mongoose-os/mos/mos/sim"
+)
+
+func startSim(t *testing.T, ctx context.Context, app string) *sim.Endpoint {
+	_, ep := sim.NewTestEndpoint(t, ctx, sim.Options{Info: sim.Info{App: app}})
+	return ep
+}
+
+func TestGateway(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	ep1, ep2 := startSim(t, ctx, "app1"), startSim(t, ctx, "app2")
+	defer ep1.Close()
+	defer ep2.Close()
+
+	g, err := New(ctx, Options{
+		Routes: map[string]string{"dev1": ep1.ConnectAddr, "dev2": ep2.ConnectAddr},
+		Dial: func(ctx context.Context, addr string) (codec.Codec, error) {
+			return mgrpc.Dial(ctx, addr)
+		},
+		RequestTimeout: 2 * time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+	lc, err := mgrpc.ListenerConfigFromURL("ws://127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := mgrpc.Listen(ctx, lc, mgrpc.HandleCodecs(g.HandleConn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	getApp := func(rpc mgrpc.MgRPC, dst string) (string, int) {
+		resp, err := rpc.Call(ctx, dst, &frame.Command{Cmd: "Sys.GetInfo"}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var info struct {
+			App string `json:"app"`
+		}
+		json.Unmarshal(resp.Response, &info)
+		return info.App, resp.Status
+	}
+
+	rpc, err := mgrpc.New(ctx, fmt.Sprintf("ws://%s/rpc", s.Addr()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rpc.Disconnect(ctx)
+	for _, test := range []struct {
+		dst, app string
+		status   int
+	}{
+		{"dev1", "app1", 0},
+		{"dev2", "app2", 0},
+		{"dev3", "", statusNoRoute},
+		// There is more than one route, destination must be specified.
+		{"", "", statusNoRoute},
+	} {
+		if app, status := getApp(rpc, test.dst); app != test.app || status != test.status {
+			t.Errorf("%q: got %q %d, want %q %d", test.dst, app, status, test.app, test.status)
+		}
+	}
+
+	// Destination can be specified in the path.
+	rpc2, err := mgrpc.New(ctx, fmt.Sprintf("ws://%s/dev2", s.Addr()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rpc2.Disconnect(ctx)
+	if app, _ := getApp(rpc2, ""); app != "app2" {
+		t.Errorf("got %q, want app2", app)
+	}
+
+	// Device that is not reachable results in an error response.
+	ep1.Close()
+	g.Close()
+	if _, status := getApp(rpc, "dev1"); status != statusUnavailable {
+		t.Errorf("got %d, want %d", status, statusUnavailable)
+	}
+}
+
+func TestGatewayHTTP(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	ep := startSim(t, ctx, "app1")
+	defer ep.Close()
+
+	g, err := New(ctx, Options{
+		Routes: map[string]string{"dev1": ep.ConnectAddr},
+		Dial: func(ctx context.Context, addr string) (codec.Codec, error) {
+			return mgrpc.Dial(ctx, addr)
+		},
+		RequestTimeout: 2 * time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+	lc, err := mgrpc.ListenerConfigFromURL("http://127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := mgrpc.Listen(ctx, lc, mgrpc.HandleCodecs(g.HandleConn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	post := func(req string) *frame.Frame {
+		resp, err := http.Post(fmt.Sprintf("http://%s/", s.Addr()), "application/json", strings.NewReader(req))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s: got HTTP status %d", req, resp.StatusCode)
+		}
+		var f frame.Frame
+		if err := json.NewDecoder(resp.Body).Decode(&f); err != nil {
+			t.Fatal(err)
+		}
+		return &f
+	}
+
+	f := post(`{"id": 123, "src": "client", "method": "Sys.GetInfo"}`)
+	var info struct {
+		App string `json:"app"`
+	}
+	json.Unmarshal(f.Result, &info)
+	if f.ID != 123 || f.Error != nil || info.App != "app1" {
+		t.Errorf("got %d %v %q, want 123 <nil> app1", f.ID, f.Error, info.App)
+	}
+
+	f = post(`{"id": 124, "src": "client", "dst": "dev2", "method": "Sys.GetInfo"}`)
+	if f.ID != 124 || f.Error == nil || f.Error.Code != statusNoRoute {
+		t.Errorf("got %d %v, want %d", f.ID, f.Error, statusNoRoute)
+	}
+}
+
+func TestParseRoute(t *testing.T) {
+	if name, addr, err := ParseRoute("dev2=mqtt://broker/dev2"); err != nil || name != "dev2" || addr != "mqtt://broker/dev2" {
+		t.Errorf("got %q %q %v", name, addr, err)
+	}
+	for _, s := range []string{"dev1", "=serial:///dev/ttyUSB0", "dev1="} {
+		if _, _, err := ParseRoute(s); err == nil {
+			t.Errorf("%q: expected an error", s)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+//
+// Copyright (c) 2014-2019 Cesanta Software Limited
+// All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package gen_rpc_client
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/cesanta/errors"
+	flag "github.com/spf13/pflag"
+
+	"github.com/mongoose-os/mos/mos/dev"
+	"github.com/mongoose-os/mos/mos/devutil"
+	"github.com/mongoose-os/mos/mos/ourutil"
+)
+
+const outFileName = "rpc_client.go"
+
+var (
+	outDir   = flag.String("out", "", "Output directory of the generated package")
+	pkgName  = flag.String("package", "", "Name of the generated package, defaults to the name of the output directory")
+	descFile = flag.String("rpc-desc", "", "Read RPC description from this file instead of the device")
+	saveDesc = flag.String("save-rpc-desc", "", "Save RPC description obtained from the device to this file. Devices do not describe results, examples can be added to the description as \"result\" to generate typed results")
+	// Methods that take no arguments and do not change anything.
+	resultFrom = flag.StringSlice("result-from", []string{"Config.Get", "FS.List", "FS.ListExt", "OTA.Status", "RPC.List", "Sys.GetInfo"},
+		"Call these methods without arguments to infer result types from what they return. Results of other methods are json.RawMessage unless the description has an example. Only give read-only methods")
+)
+
+func GenRPCClient(ctx context.Context, devConn dev.DevConn) error {
+	if *outDir == "" {
+		return errors.Errorf("--out is required")
+	}
+	var desc *Description
+	var err error
+	if *descFile != "" {
+		desc, err = ReadDescription(*descFile)
+	} else {
+		if devConn == nil {
+			if devConn, err = devutil.CreateDevConnFromFlags(ctx); err != nil {
+				return errors.Trace(err)
+			}
+		}
+		ourutil.Reportf("Getting RPC description from the device...")
+		desc, err = FetchDescription(ctx, devConn)
+		if err == nil {
+			AddResults(ctx, devConn, desc, *resultFrom)
+		}
+		if err == nil && *saveDesc != "" {
+			err = WriteDescription(*saveDesc, desc)
+		}
+	}
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	name := *pkgName
+	if name == "" {
+		abs, err := filepath.Abs(*outDir)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		name = strings.ToLower(strings.Map(func(r rune) rune {
+			if r == '-' || r == '.' {
+				return '_'
+			}
+			return r
+		}, filepath.Base(abs)))
+	}
+	src, err := Generate(desc, name)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if err := os.MkdirAll(*outDir, 0755); err != nil {
+		return errors.Trace(err)
+	}
+	fn := filepath.Join(*outDir, outFileName)
+	if err := ioutil.WriteFile(fn, src, 0644); err != nil {
+		return errors.Trace(err)
+	}
+	ourutil.Reportf("Wrote client for %d methods to %s", len(desc.Methods), fn)
+	return nil
+}
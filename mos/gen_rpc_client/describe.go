@@ -0,0 +1,114 @@
+//
+// Copyright (c) 2014-2019 Cesanta Software Limited
+// All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package gen_rpc_client
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"sort"
+
+	"github.com/cesanta/errors"
+	"github.com/golang/glog"
+
+	"github.com/mongoose-os/mos/mos/dev"
+)
+
+// Description describes RPC methods of a device.
+// It can be saved to a file and used to generate the client later.
+type Description struct {
+	Methods []*MethodDescription `json:"methods"`
+}
+
+// MethodDescription is a description of a single method.
+type MethodDescription struct {
+	Name string `json:"name"`
+	// Format of the arguments, as returned by RPC.Describe, e.g. "{filename: %Q, offset: %ld}".
+	ArgsFmt string `json:"args_fmt,omitempty"`
+	// Example of the result. Devices do not describe results, but a saved
+	// description can be amended with an example to generate a typed result.
+	Result json.RawMessage `json:"result,omitempty"`
+}
+
+type describeArgs struct {
+	Name string `json:"name"`
+}
+
+// FetchDescription queries the device for the list of methods and their descriptions.
+func FetchDescription(ctx context.Context, devConn dev.DevConn) (*Description, error) {
+	var names []string
+	if err := devConn.Call(ctx, "RPC.List", nil, &names); err != nil {
+		return nil, errors.Annotatef(err, "failed to list methods")
+	}
+	sort.Strings(names)
+	desc := &Description{}
+	for _, name := range names {
+		md := &MethodDescription{}
+		if err := devConn.Call(ctx, "RPC.Describe", &describeArgs{Name: name}, md); err != nil {
+			return nil, errors.Annotatef(err, "failed to describe %s", name)
+		}
+		md.Name = name
+		glog.V(1).Infof("%s: %q", name, md.ArgsFmt)
+		desc.Methods = append(desc.Methods, md)
+	}
+	return desc, nil
+}
+
+// AddResults calls the methods without arguments and adds the results to
+// the description as examples. Only read-only methods should be given.
+// Methods the device does not have or that fail are left without an example.
+func AddResults(ctx context.Context, devConn dev.DevConn, desc *Description, methods []string) {
+	for _, md := range desc.Methods {
+		found := false
+		for _, m := range methods {
+			if m == md.Name {
+				found = true
+			}
+		}
+		if !found || len(md.Result) > 0 {
+			continue
+		}
+		var res json.RawMessage
+		if err := devConn.Call(ctx, md.Name, nil, &res); err != nil {
+			glog.Warningf("%s: %s, result type is unknown", md.Name, err)
+			continue
+		}
+		md.Result = res
+	}
+}
+
+// ReadDescription reads a description saved to a file.
+func ReadDescription(fileName string) (*Description, error) {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	var desc Description
+	if err := json.Unmarshal(data, &desc); err != nil {
+		return nil, errors.Annotatef(err, "%s: invalid description", fileName)
+	}
+	return &desc, nil
+}
+
+// WriteDescription saves a description to a file.
+func WriteDescription(fileName string, desc *Description) error {
+	data, err := json.MarshalIndent(desc, "", "  ")
+	if err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(ioutil.WriteFile(fileName, append(data, '\n'), 0644))
+}
@@ -0,0 +1,167 @@
+//
+// Copyright (c) 2014-2019 Cesanta Software Limited
+// All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package gen_rpc_client
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"go/format"
+	"sort"
+	"strings"
+
+	"github.com/cesanta/errors"
+)
+
+type generator struct {
+	types   bytes.Buffer
+	methods bytes.Buffer
+	// Names of the declared types.
+	names   map[string]bool
+	useJSON bool
+}
+
+// declare returns unused type name based on name.
+func (g *generator) declare(name string) string {
+	res := name
+	for i := 2; g.names[res]; i++ {
+		res = fmt.Sprintf("%s%d", name, i)
+	}
+	g.names[res] = true
+	return res
+}
+
+// typeExpr returns Go type expression for n, declaring struct types as needed.
+func (g *generator) typeExpr(n *typeNode, name string) string {
+	switch {
+	case n.isObject():
+		return g.declareStruct(n, name)
+	case n.elem != nil:
+		return "[]" + g.typeExpr(n.elem, name)
+	}
+	if n.scalar == rawType {
+		g.useJSON = true
+	}
+	return n.scalar
+}
+
+func (g *generator) declareStruct(n *typeNode, name string) string {
+	name = g.declare(name)
+	var keys []string
+	for k := range n.fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var body bytes.Buffer
+	for _, k := range keys {
+		fn := goName(k)
+		ft := g.typeExpr(n.fields[k], name+fn)
+		// Optional values are pointers, so that absent values can be told
+		// from zero values. Slices and raw messages are nil when absent.
+		if !strings.HasPrefix(ft, "[]") && ft != rawType {
+			ft = "*" + ft
+		}
+		fmt.Fprintf(&body, "\t%s %s `json:\"%s,omitempty\"`\n", fn, ft, k)
+	}
+	fmt.Fprintf(&g.types, "type %s struct {\n%s}\n\n", name, body.String())
+	return name
+}
+
+func (g *generator) method(md *MethodDescription) error {
+	name := goName(md.Name)
+	argsParam, argsArg := "", "nil"
+	switch {
+	case md.ArgsFmt != "":
+		argsType, err := parseArgsFmt(md.ArgsFmt)
+		if err != nil {
+			return errors.Annotatef(err, "%s", md.Name)
+		}
+		argsParam = fmt.Sprintf(", args *%s", g.typeExpr(argsType, name+"Args"))
+		argsArg = "args"
+	}
+
+	resType := rawType
+	if len(md.Result) > 0 {
+		var example interface{}
+		dec := json.NewDecoder(bytes.NewReader(md.Result))
+		dec.UseNumber()
+		if err := dec.Decode(&example); err != nil {
+			return errors.Annotatef(err, "%s: invalid result example", md.Name)
+		}
+		resType = g.typeExpr(exampleType(example), name+"Result")
+	} else {
+		g.useJSON = true
+	}
+
+	var resRet, zeroRet string
+	if g.names[resType] {
+		resRet, zeroRet = "&res", "nil"
+		resType = "*" + resType
+	} else {
+		resRet = "res"
+		switch resType {
+		case "string":
+			zeroRet = `""`
+		case "bool":
+			zeroRet = "false"
+		case "int64", "float64":
+			zeroRet = "0"
+		default:
+			zeroRet = "nil"
+		}
+	}
+	fmt.Fprintf(&g.methods, "// %s invokes %s.\n", name, md.Name)
+	fmt.Fprintf(&g.methods, "func (c *Client) %s(ctx context.Context%s) (%s, error) {\n", name, argsParam, resType)
+	fmt.Fprintf(&g.methods, "\tvar res %s\n", strings.TrimPrefix(resType, "*"))
+	fmt.Fprintf(&g.methods, "\tif err := c.DevConn.Call(ctx, %q, %s, &res); err != nil {\n", md.Name, argsArg)
+	fmt.Fprintf(&g.methods, "\t\treturn %s, errors.Trace(err)\n\t}\n", zeroRet)
+	fmt.Fprintf(&g.methods, "\treturn %s, nil\n}\n\n", resRet)
+	return nil
+}
+
+// Generate returns source of a Go package with the client for the described methods.
+func Generate(desc *Description, pkgName string) ([]byte, error) {
+	g := &generator{names: map[string]bool{"Client": true}}
+	methods := append([]*MethodDescription(nil), desc.Methods...)
+	sort.Slice(methods, func(i, j int) bool { return methods[i].Name < methods[j].Name })
+	for _, md := range methods {
+		if err := g.method(md); err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+
+	var src bytes.Buffer
+	fmt.Fprintf(&src, "// Code generated by mos gen-rpc-client. DO NOT EDIT.\n\n")
+	fmt.Fprintf(&src, "// Package %s is the client for RPC methods of a device.\n//\n", pkgName)
+	fmt.Fprintf(&src, "// Devices do not describe the results of their methods, so results are\n")
+	fmt.Fprintf(&src, "// json.RawMessage, unless the description the client was generated from\n")
+	fmt.Fprintf(&src, "// has an example of the result, see --result-from of mos gen-rpc-client.\n")
+	fmt.Fprintf(&src, "package %s\n\nimport (\n\t\"context\"\n", pkgName)
+	if g.useJSON {
+		fmt.Fprintf(&src, "\t\"encoding/json\"\n")
+	}
+	fmt.Fprintf(&src, "\n\t\"github.com/cesanta/errors\"\n\n\t\"github.com/mongoose-os/mos/mos/dev\"\n)\n\n")
+	fmt.Fprintf(&src, "// Client invokes RPC methods of a device.\ntype Client struct {\n\tDevConn dev.DevConn\n}\n\n")
+	fmt.Fprintf(&src, "func NewClient(devConn dev.DevConn) *Client {\n\treturn &Client{DevConn: devConn}\n}\n\n")
+	src.Write(g.types.Bytes())
+	src.Write(g.methods.Bytes())
+	res, err := format.Source(src.Bytes())
+	if err != nil {
+		return nil, errors.Annotatef(err, "generated code is invalid")
+	}
+	return res, nil
+}
@@ -0,0 +1,110 @@
+//
+// Copyright (c) 2014-2019 Cesanta Software Limited
+// All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package gen_rpc_client
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mongoose-os/mos/mos/sim"
+)
+
+func TestParseArgsFmt(t *testing.T) {
+	n, err := parseArgsFmt(`{filename: %Q, "offset": %ld, opts: {append: %B, data: %V}, extra: %M}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, want := range map[string]string{"filename": "string", "offset": "int64", "extra": rawType} {
+		if f := n.fields[k]; f == nil || f.scalar != want {
+			t.Errorf("%s: got %+v, want %s", k, f, want)
+		}
+	}
+	if opts := n.fields["opts"]; opts == nil || opts.fields["append"].scalar != "bool" || opts.fields["data"].scalar != "[]byte" {
+		t.Errorf("opts: got %+v", opts)
+	}
+	for _, s := range []string{`%Q`, `{a: %Q`, `{a %Q}`, `{a: b}`} {
+		if _, err := parseArgsFmt(s); err == nil {
+			t.Errorf("%q: expected an error", s)
+		}
+	}
+}
+
+func TestGoName(t *testing.T) {
+	for in, want := range map[string]string{
+		"FS.Get":      "FSGet",
+		"Sys.GetInfo": "SysGetInfo",
+		"fw_version":  "FwVersion",
+		"id":          "ID",
+		"ram-free":    "RAMFree",
+		"1st":         "X1st",
+	} {
+		if got := goName(in); got != want {
+			t.Errorf("%q: got %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestGenerate(t *testing.T) {
+	desc := &Description{Methods: []*MethodDescription{
+		{Name: "FS.Get", ArgsFmt: "{filename: %Q, offset: %ld, len: %ld}", Result: []byte(`{"data": "", "left": 0}`)},
+		{Name: "FS.List", ArgsFmt: "{path: %Q}", Result: []byte(`["a"]`)},
+		{Name: "FS.ListExt", Result: []byte(`[{"name": "a", "size": 1}]`)},
+		{Name: "Sys.Reboot", ArgsFmt: "{delay_ms: %d}"},
+		{Name: "Sys.GetInfo"},
+	}}
+	src, err := Generate(desc, "client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"// Devices do not describe the results of their methods, so results are\n",
+		"package client\n",
+		"type FSGetArgs struct {\n\tFilename *string `json:\"filename,omitempty\"`\n\tLen      *int64  `json:\"len,omitempty\"`\n",
+		"func (c *Client) FSGet(ctx context.Context, args *FSGetArgs) (*FSGetResult, error) {",
+		"func (c *Client) FSList(ctx context.Context, args *FSListArgs) ([]string, error) {",
+		"type FSListExtResult struct {",
+		"func (c *Client) FSListExt(ctx context.Context) ([]FSListExtResult, error) {",
+		`if err := c.DevConn.Call(ctx, "Sys.Reboot", args, &res); err != nil {`,
+		"func (c *Client) SysGetInfo(ctx context.Context) (json.RawMessage, error) {",
+	} {
+		if !strings.Contains(string(src), want) {
+			t.Errorf("generated code does not contain %q:\n%s", want, src)
+		}
+	}
+}
+
+func TestAddResults(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	_, devConn, closeDev := sim.NewTestConn(t, ctx, sim.Options{})
+	defer closeDev()
+
+	desc := &Description{Methods: []*MethodDescription{{Name: "Sys.GetInfo"}, {Name: "Sys.Reboot"}}}
+	AddResults(ctx, devConn, desc, []string{"Sys.GetInfo"})
+	if len(desc.Methods[0].Result) == 0 || len(desc.Methods[1].Result) != 0 {
+		t.Errorf("got results %s, %s", desc.Methods[0].Result, desc.Methods[1].Result)
+	}
+	src, err := Generate(desc, "client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "func (c *Client) SysGetInfo(ctx context.Context) (*SysGetInfoResult, error) {"; !strings.Contains(string(src), want) {
+		t.Errorf("generated code does not contain %q:\n%s", want, src)
+	}
+}
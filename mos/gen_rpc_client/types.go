@@ -0,0 +1,212 @@
+//
+// Copyright (c) 2014-2019 Cesanta Software Limited
+// All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package gen_rpc_client
+
+import (
+	"bytes"
+	"strings"
+	"unicode"
+
+	"github.com/cesanta/errors"
+)
+
+// typeNode is a type of a value in arguments or result of a method.
+// It is either a scalar Go type or an object with fields.
+type typeNode struct {
+	// Go type of a scalar, e.g. "string" or "json.RawMessage".
+	scalar string
+	// Element type of an array.
+	elem *typeNode
+	// Fields of an object, by JSON name.
+	fields map[string]*typeNode
+}
+
+func (n *typeNode) isObject() bool {
+	return n.fields != nil
+}
+
+const rawType = "json.RawMessage"
+
+// scanfType returns Go type for a json_scanf conversion specifier.
+func scanfType(spec string) string {
+	conv := spec[len(spec)-1]
+	switch conv {
+	case 'Q', 'H', 's':
+		return "string"
+	case 'V':
+		return "[]byte"
+	case 'B':
+		return "bool"
+	case 'd', 'i', 'u', 'x':
+		return "int64"
+	case 'f', 'g', 'e':
+		return "float64"
+	default:
+		// %T and %M hand the raw token to the callback.
+		return rawType
+	}
+}
+
+type fmtLexer struct {
+	s   string
+	pos int
+}
+
+// next returns the next token of a json_scanf format string: a punctuation
+// character, a key or a conversion specifier.
+func (l *fmtLexer) next() (string, error) {
+	for l.pos < len(l.s) && unicode.IsSpace(rune(l.s[l.pos])) {
+		l.pos++
+	}
+	if l.pos >= len(l.s) {
+		return "", nil
+	}
+	start := l.pos
+	switch c := l.s[l.pos]; {
+	case strings.IndexByte("{}[]:,", c) >= 0:
+		l.pos++
+	case c == '"' || c == '\'':
+		end := strings.IndexByte(l.s[l.pos+1:], c)
+		if end < 0 {
+			return "", errors.Errorf("unterminated string at %d", start)
+		}
+		l.pos += end + 2
+		return l.s[start+1 : l.pos-1], nil
+	case c == '%':
+		l.pos++
+		for l.pos < len(l.s) && strings.IndexByte("lhzj0123456789.", l.s[l.pos]) >= 0 {
+			l.pos++
+		}
+		if l.pos >= len(l.s) {
+			return "", errors.Errorf("incomplete specifier at %d", start)
+		}
+		l.pos++
+	default:
+		for l.pos < len(l.s) && strings.IndexByte("{}[]:, \t\r\n\"'", l.s[l.pos]) < 0 {
+			l.pos++
+		}
+	}
+	return l.s[start:l.pos], nil
+}
+
+// parseArgsFmt parses argument format returned by RPC.Describe, e.g.
+// "{filename: %Q, offset: %ld}", into an object type.
+func parseArgsFmt(s string) (*typeNode, error) {
+	l := &fmtLexer{s: s}
+	tok, err := l.next()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if tok != "{" {
+		return nil, errors.Errorf("%q: expected an object", s)
+	}
+	n, err := parseFmtObject(l)
+	if err != nil {
+		return nil, errors.Annotatef(err, "%q", s)
+	}
+	return n, nil
+}
+
+func parseFmtObject(l *fmtLexer) (*typeNode, error) {
+	n := &typeNode{fields: map[string]*typeNode{}}
+	for {
+		key, err := l.next()
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		switch key {
+		case "}":
+			return n, nil
+		case ",":
+			continue
+		case "", "{", "[", "]", ":":
+			return nil, errors.Errorf("unexpected %q at %d", key, l.pos)
+		}
+		if tok, err := l.next(); err != nil || tok != ":" {
+			return nil, errors.Errorf("expected ':' after %q", key)
+		}
+		val, err := l.next()
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		switch {
+		case val == "{":
+			if n.fields[key], err = parseFmtObject(l); err != nil {
+				return nil, errors.Trace(err)
+			}
+		case strings.HasPrefix(val, "%"):
+			n.fields[key] = &typeNode{scalar: scanfType(val)}
+		default:
+			return nil, errors.Errorf("unexpected %q at %d", val, l.pos)
+		}
+	}
+}
+
+// exampleType infers type from an example value decoded with UseNumber.
+func exampleType(v interface{}) *typeNode {
+	switch vv := v.(type) {
+	case string:
+		return &typeNode{scalar: "string"}
+	case bool:
+		return &typeNode{scalar: "bool"}
+	case interface{ Int64() (int64, error) }:
+		if _, err := vv.Int64(); err == nil {
+			return &typeNode{scalar: "int64"}
+		}
+		return &typeNode{scalar: "float64"}
+	case map[string]interface{}:
+		n := &typeNode{fields: map[string]*typeNode{}}
+		for k, fv := range vv {
+			n.fields[k] = exampleType(fv)
+		}
+		return n
+	case []interface{}:
+		if len(vv) == 0 {
+			return &typeNode{elem: &typeNode{scalar: rawType}}
+		}
+		return &typeNode{elem: exampleType(vv[0])}
+	default:
+		return &typeNode{scalar: rawType}
+	}
+}
+
+// Common initialisms that are spelled in upper case.
+var initialisms = map[string]bool{
+	"api": true, "cpu": true, "fs": true, "http": true, "id": true, "ip": true,
+	"json": true, "mac": true, "ota": true, "ram": true, "rpc": true, "ssid": true,
+	"tcp": true, "udp": true, "uid": true, "uri": true, "url": true,
+}
+
+// goName converts a method or JSON field name to an exported Go identifier,
+// e.g. "FS.Get" -> "FSGet", "fw_version" -> "FwVersion".
+func goName(s string) string {
+	var b bytes.Buffer
+	for _, part := range strings.FieldsFunc(s, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}) {
+		if initialisms[strings.ToLower(part)] {
+			b.WriteString(strings.ToUpper(part))
+			continue
+		}
+		b.WriteString(strings.ToUpper(part[:1]) + part[1:])
+	}
+	res := b.String()
+	if res == "" || unicode.IsDigit(rune(res[0])) {
+		res = "X" + res
+	}
+	return res
+}
@@ -0,0 +1,238 @@
+//
+// Copyright (c) 2014-2019 Cesanta Software Limited
+// All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package inventory
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/cesanta/errors"
+	flag "github.com/spf13/pflag"
+	yaml "gopkg.in/yaml.v2"
+
+	"github.com/mongoose-os/mos/mos/common/paths"
+	"github.com/mongoose-os/mos/mos/dev"
+	"github.com/mongoose-os/mos/mos/flags"
+	"github.com/mongoose-os/mos/mos/ourutil"
+	"github.com/mongoose-os/mos/mos/output"
+)
+
+var (
+	aliasFlag = flag.StringSlice("alias", nil, "Device alias for \"mos devices add\", can be used multiple times")
+)
+
+// LoadDefault loads the user's inventory (--devices-file) merged with
+// the project-local one.
+func LoadDefault() (*Inventory, error) {
+	inv, err := Load(paths.DevicesFilepath, LocalFile)
+	return inv, errors.Trace(err)
+}
+
+// Devices is the "mos devices" command handler.
+func Devices(ctx context.Context, devConn dev.DevConn) error {
+	args := flag.Args()[1:]
+	if len(args) < 1 {
+		return errors.Errorf("subcommand is required: list, add, rm or show")
+	}
+	cmd, args := args[0], args[1:]
+	switch cmd {
+	case "list", "ls":
+		return errors.Trace(listDevices(ctx))
+	case "add":
+		if len(args) != 1 {
+			return errors.Errorf("usage: mos devices add NAME --port PORT [--group G1,G2] [--alias A] [--platform P] [connection flags]")
+		}
+		return errors.Trace(addDevice(args[0]))
+	case "rm":
+		if len(args) != 1 {
+			return errors.Errorf("usage: mos devices rm NAME")
+		}
+		return errors.Trace(removeDevice(args[0]))
+	case "show":
+		if len(args) != 1 {
+			return errors.Errorf("usage: mos devices show NAME")
+		}
+		return errors.Trace(showDevice(ctx, args[0]))
+	default:
+		return errors.Errorf("unknown subcommand %q, expected list, add, rm or show", cmd)
+	}
+}
+
+func listDevices(ctx context.Context) error {
+	inv, err := LoadDefault()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	devs := inv.Devices
+	if *flags.Group != "" {
+		if devs, err = inv.Group(*flags.Group); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	rdevs := []*Device{}
+	for _, d := range devs {
+		rdevs = append(rdevs, d.Redacted())
+	}
+	return output.Print(ctx, rdevs, func(w io.Writer) error {
+		tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+		fmt.Fprintf(tw, "NAME\tPORT\tPLATFORM\tGROUPS\tALIASES\n")
+		for _, d := range rdevs {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", d.Name, d.Port,
+				strOrDash(d.Platform), strOrDash(strings.Join(d.Groups, ",")), strOrDash(strings.Join(d.Aliases, ",")))
+		}
+		return tw.Flush()
+	})
+}
+
+func strOrDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// changedFlag returns the value of the flag if it was given on the command line.
+func changedFlag(name string) (string, bool) {
+	if !flag.CommandLine.Changed(name) {
+		return "", false
+	}
+	return flag.CommandLine.Lookup(name).Value.String(), true
+}
+
+// deviceFromFlags creates an inventory entry from the flags given on the command line.
+func deviceFromFlags(name string) (*Device, error) {
+	d := &Device{Name: name, Aliases: *aliasFlag}
+	var ok bool
+	if d.Port, ok = changedFlag("port"); !ok || d.Port == "auto" {
+		return nil, errors.Errorf("--port is required")
+	}
+	if v, ok := changedFlag("group"); ok && v != "" {
+		d.Groups = strings.Split(v, ",")
+	}
+	if _, ok := changedFlag("platform"); ok {
+		d.Platform = flags.Platform()
+	}
+	for _, f := range []struct {
+		name string
+		dst  *string
+	}{
+		{"cert-file", &d.CertFile},
+		{"key-file", &d.KeyFile},
+		{"ca-cert-file", &d.CAFile},
+	} {
+		if v, ok := changedFlag(f.name); ok && v != "" {
+			// The inventory is used from any directory, make the paths absolute.
+			p, err := filepath.Abs(v)
+			if err != nil {
+				return nil, errors.Trace(err)
+			}
+			*f.dst = p
+		}
+	}
+	d.RPCAuth, _ = changedFlag("rpc-auth")
+	if v, ok := changedFlag("rpc-creds"); ok && strings.HasPrefix(v, "@") {
+		p, err := filepath.Abs(v[1:])
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		d.RPCCreds = "@" + p
+	} else {
+		d.RPCCreds = v
+	}
+	if v, ok := changedFlag("baud-rate"); ok {
+		br, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		d.BaudRate = br
+	}
+	if _, ok := changedFlag("hw-flow-control"); ok {
+		d.HWFC = *flags.HWFC
+	}
+	return d, nil
+}
+
+func addDevice(name string) error {
+	d, err := deviceFromFlags(name)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	f, err := ReadFile(paths.DevicesFilepath)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	for _, od := range f.Devices {
+		if od.Name == name {
+			continue
+		}
+		for _, n := range append([]string{d.Name}, d.Aliases...) {
+			if od.HasName(n) {
+				return errors.Errorf("%q is already used by device %q", n, od.Name)
+			}
+		}
+	}
+	if f.Put(d) {
+		ourutil.Reportf("Updated %s in %s", name, paths.DevicesFilepath)
+	} else {
+		ourutil.Reportf("Added %s to %s", name, paths.DevicesFilepath)
+	}
+	return errors.Trace(f.Write(paths.DevicesFilepath))
+}
+
+func removeDevice(name string) error {
+	f, err := ReadFile(paths.DevicesFilepath)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if !f.Remove(name) {
+		if lf, err := ReadFile(LocalFile); err == nil {
+			for _, d := range lf.Devices {
+				if d.HasName(name) {
+					return errors.Errorf("%s is defined in %s, please edit it there", name, LocalFile)
+				}
+			}
+		}
+		return errors.Errorf("no device %q in %s", name, paths.DevicesFilepath)
+	}
+	ourutil.Reportf("Removed %s from %s", name, paths.DevicesFilepath)
+	return errors.Trace(f.Write(paths.DevicesFilepath))
+}
+
+func showDevice(ctx context.Context, name string) error {
+	inv, err := LoadDefault()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	d, err := inv.Lookup(name)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	d = d.Redacted()
+	return output.Print(ctx, d, func(w io.Writer) error {
+		data, err := yaml.Marshal(d)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, "# %s\n%s", d.Source, data)
+		return err
+	})
+}
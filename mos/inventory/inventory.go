@@ -0,0 +1,253 @@
+//
+// Copyright (c) 2014-2019 Cesanta Software Limited
+// All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Package inventory implements the registry of named devices and their
+// connection settings.
+package inventory
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/cesanta/errors"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// LocalFile is the project-local inventory file, looked up in the current
+// directory. Its entries override the ones in the user's inventory.
+const LocalFile = "mos_devices.yaml"
+
+// redactedCreds replaces inline RPC credentials in the output.
+const redactedCreds = "<redacted>"
+
+// Device is an inventory entry. Settings that are not specified are taken
+// from flags.
+type Device struct {
+	Name    string   `yaml:"name" json:"name"`
+	Aliases []string `yaml:"aliases,omitempty" json:"aliases,omitempty"`
+	Groups  []string `yaml:"groups,omitempty" json:"groups,omitempty"`
+	// Serial port or address of the device, as would be given to --port.
+	Port string `yaml:"port" json:"port"`
+	// Platform the device is expected to report, connection fails if it doesn't.
+	Platform string `yaml:"platform,omitempty" json:"platform,omitempty"`
+
+	CertFile string `yaml:"cert_file,omitempty" json:"cert_file,omitempty"`
+	KeyFile  string `yaml:"key_file,omitempty" json:"key_file,omitempty"`
+	CAFile   string `yaml:"ca_cert_file,omitempty" json:"ca_cert_file,omitempty"`
+	RPCAuth  string `yaml:"rpc_auth,omitempty" json:"rpc_auth,omitempty"`
+	RPCCreds string `yaml:"rpc_creds,omitempty" json:"rpc_creds,omitempty"`
+	BaudRate int    `yaml:"baud_rate,omitempty" json:"baud_rate,omitempty"`
+	HWFC     bool   `yaml:"hw_flow_control,omitempty" json:"hw_flow_control,omitempty"`
+
+	// File the device is defined in.
+	Source string `yaml:"-" json:"-"`
+}
+
+// HasName returns true if name is the name or one of the aliases of the device.
+func (d *Device) HasName(name string) bool {
+	if d.Name == name {
+		return true
+	}
+	for _, a := range d.Aliases {
+		if a == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Redacted returns a copy of the device that is safe to display.
+// Credentials given inline are masked, references to a file, an environment
+// variable or the keyring are kept as they do not reveal the secret.
+func (d *Device) Redacted() *Device {
+	rd := *d
+	if rd.RPCCreds != "" && !strings.HasPrefix(rd.RPCCreds, "@") &&
+		!strings.HasPrefix(rd.RPCCreds, "env:") && !strings.HasPrefix(rd.RPCCreds, "keyring:") {
+		rd.RPCCreds = redactedCreds
+	}
+	return &rd
+}
+
+// InGroup returns true if the device is a member of the group.
+func (d *Device) InGroup(group string) bool {
+	for _, g := range d.Groups {
+		if g == group {
+			return true
+		}
+	}
+	return false
+}
+
+// File is the contents of an inventory file, e.g.:
+//
+//	devices:
+//	  - name: bench-01
+//	    aliases: [b1]
+//	    groups: [lab]
+//	    port: /dev/ttyUSB0
+//	    platform: esp32
+//	  - name: gw
+//	    port: mqtts://mqtt.example.com/gw-1
+//	    cert_file: gw.crt
+//	    key_file: gw.key
+type File struct {
+	Devices []*Device `yaml:"devices"`
+}
+
+// ReadFile reads the inventory file. A file that does not exist is
+// not an error, the inventory is just empty.
+func ReadFile(fname string) (*File, error) {
+	f := &File{}
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return f, nil
+		}
+		return nil, errors.Trace(err)
+	}
+	if err := yaml.Unmarshal(data, f); err != nil {
+		return nil, errors.Annotatef(err, "%s: invalid inventory file", fname)
+	}
+	names := map[string]bool{}
+	for i, d := range f.Devices {
+		if d == nil || d.Name == "" {
+			return nil, errors.Errorf("%s: device %d has no name", fname, i+1)
+		}
+		if d.Port == "" {
+			return nil, errors.Errorf("%s: device %q has no port", fname, d.Name)
+		}
+		for _, n := range append([]string{d.Name}, d.Aliases...) {
+			if names[n] {
+				return nil, errors.Errorf("%s: duplicate device name %q", fname, n)
+			}
+			names[n] = true
+		}
+		d.Source = fname
+	}
+	return f, nil
+}
+
+// Write writes the inventory to fname, creating the directory if needed.
+func (f *File) Write(fname string) error {
+	data, err := yaml.Marshal(f)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if err := os.MkdirAll(filepath.Dir(fname), 0755); err != nil {
+		return errors.Trace(err)
+	}
+	// May contain RPC credentials.
+	return errors.Trace(ioutil.WriteFile(fname, data, 0600))
+}
+
+// Put adds the device to the file, replacing the one with the same name.
+// Returns true if the device was replaced.
+func (f *File) Put(d *Device) bool {
+	for i, od := range f.Devices {
+		if od.Name == d.Name {
+			f.Devices[i] = d
+			return true
+		}
+	}
+	f.Devices = append(f.Devices, d)
+	return false
+}
+
+// Remove removes the device with the given name or alias from the file.
+// Returns false if there is no such device.
+func (f *File) Remove(name string) bool {
+	for i, d := range f.Devices {
+		if d.HasName(name) {
+			f.Devices = append(f.Devices[:i], f.Devices[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Inventory is the merged contents of the inventory files.
+type Inventory struct {
+	// Devices sorted by name.
+	Devices []*Device
+}
+
+// Load reads and merges the inventory files, entries in the later files
+// replace the ones with the same name in the earlier ones.
+func Load(fnames ...string) (*Inventory, error) {
+	byName := map[string]*Device{}
+	for _, fname := range fnames {
+		if fname == "" {
+			continue
+		}
+		f, err := ReadFile(fname)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		for _, d := range f.Devices {
+			byName[d.Name] = d
+		}
+	}
+	inv := &Inventory{}
+	for _, d := range byName {
+		inv.Devices = append(inv.Devices, d)
+	}
+	sort.Slice(inv.Devices, func(i, j int) bool { return inv.Devices[i].Name < inv.Devices[j].Name })
+	return inv, nil
+}
+
+// Lookup returns the device with the given name or alias.
+func (inv *Inventory) Lookup(name string) (*Device, error) {
+	for _, d := range inv.Devices {
+		if d.Name == name {
+			return d, nil
+		}
+	}
+	var found []*Device
+	for _, d := range inv.Devices {
+		if d.HasName(name) {
+			found = append(found, d)
+		}
+	}
+	switch len(found) {
+	case 0:
+		return nil, errors.Errorf("no device %q in the inventory", name)
+	case 1:
+		return found[0], nil
+	default:
+		var names []string
+		for _, d := range found {
+			names = append(names, d.Name)
+		}
+		return nil, errors.Errorf("alias %q is ambiguous: %s", name, strings.Join(names, ", "))
+	}
+}
+
+// Group returns the members of the group, sorted by name.
+func (inv *Inventory) Group(group string) ([]*Device, error) {
+	var res []*Device
+	for _, d := range inv.Devices {
+		if d.InGroup(group) {
+			res = append(res, d)
+		}
+	}
+	if len(res) == 0 {
+		return nil, errors.Errorf("no devices in group %q", group)
+	}
+	return res, nil
+}
@@ -0,0 +1,175 @@
+//
+// Copyright (c) 2014-2019 Cesanta Software Limited
+// All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package inventory_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/mongoose-os/mos/mos/inventory"
+)
+
+func writeFile(t *testing.T, fname, data string) {
+	if err := ioutil.WriteFile(fname, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func names(devs []*inventory.Device) []string {
+	var res []string
+	for _, d := range devs {
+		res = append(res, d.Name)
+	}
+	return res
+}
+
+func TestLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "inventory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	global := filepath.Join(dir, "devices.yaml")
+	local := filepath.Join(dir, inventory.LocalFile)
+	writeFile(t, global, `
+devices:
+  - name: b2
+    port: /dev/ttyUSB1
+    groups: [lab]
+  - name: b1
+    aliases: [first]
+    port: /dev/ttyUSB0
+    groups: [lab, esp]
+    platform: esp32
+`)
+	writeFile(t, local, `
+devices:
+  - name: b2
+    port: tcp://192.168.1.2
+    groups: [lab]
+    rpc_creds: admin:secret
+  - name: gw
+    aliases: [first]
+    port: mqtt://broker/gw
+`)
+
+	inv, err := inventory.Load(global, local, filepath.Join(dir, "nonexistent.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := names(inv.Devices), []string{"b1", "b2", "gw"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("devices: got %q, want %q", got, want)
+	}
+
+	d, err := inv.Lookup("b2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := d.Port, "tcp://192.168.1.2"; got != want {
+		t.Errorf("b2 port: got %q, want %q", got, want)
+	}
+	if got, want := d.Source, local; got != want {
+		t.Errorf("b2 source: got %q, want %q", got, want)
+	}
+	if _, err := inv.Lookup("first"); err == nil {
+		t.Errorf("ambiguous alias was resolved")
+	}
+	if _, err := inv.Lookup("b3"); err == nil {
+		t.Errorf("unknown device was resolved")
+	}
+
+	lab, err := inv.Group("lab")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := names(lab), []string{"b1", "b2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("lab: got %q, want %q", got, want)
+	}
+	if _, err := inv.Group("office"); err == nil {
+		t.Errorf("empty group was resolved")
+	}
+}
+
+func TestFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "inventory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fname := filepath.Join(dir, "sub", "devices.yaml")
+
+	f, err := inventory.ReadFile(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.Put(&inventory.Device{Name: "b1", Port: "/dev/ttyUSB0"}) {
+		t.Errorf("new device reported as replaced")
+	}
+	f.Put(&inventory.Device{Name: "b2", Aliases: []string{"two"}, Port: "/dev/ttyUSB1"})
+	if !f.Put(&inventory.Device{Name: "b1", Port: "/dev/ttyUSB2", BaudRate: 921600}) {
+		t.Errorf("existing device not reported as replaced")
+	}
+	if !f.Remove("two") || f.Remove("b3") {
+		t.Errorf("unexpected Remove results")
+	}
+	if err := f.Write(fname); err != nil {
+		t.Fatal(err)
+	}
+
+	f2, err := inventory.ReadFile(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []*inventory.Device{{Name: "b1", Port: "/dev/ttyUSB2", BaudRate: 921600, Source: fname}}
+	if !reflect.DeepEqual(f2.Devices, want) {
+		t.Errorf("got %+v, want %+v", f2.Devices[0], want[0])
+	}
+
+	for _, data := range []string{
+		"devices:\n  - port: /dev/ttyUSB0\n",
+		"devices:\n  - name: b1\n",
+		"devices:\n  - name: b1\n    port: a\n  - name: b2\n    aliases: [b1]\n    port: b\n",
+	} {
+		writeFile(t, fname, data)
+		if _, err := inventory.ReadFile(fname); err == nil {
+			t.Errorf("%q: expected an error", data)
+		}
+	}
+}
+
+func TestRedacted(t *testing.T) {
+	for _, c := range []struct {
+		creds, want string
+	}{
+		{"", ""},
+		{"admin:secret", "<redacted>"},
+		{"@/home/user/creds.txt", "@/home/user/creds.txt"},
+		{"env:MOS_CREDS", "env:MOS_CREDS"},
+		{"keyring:lab", "keyring:lab"},
+	} {
+		d := &inventory.Device{Name: "b1", RPCCreds: c.creds}
+		if got := d.Redacted().RPCCreds; got != c.want {
+			t.Errorf("%q: got %q, want %q", c.creds, got, c.want)
+		}
+		if d.RPCCreds != c.creds {
+			t.Errorf("%q: the original device was modified", c.creds)
+		}
+	}
+}
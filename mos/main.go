@@ -22,6 +22,7 @@ import (
 	cRand "crypto/rand"
 	goflag "flag"
 	"fmt"
+	"io"
 	"log"
 	"math/big"
 	mRand "math/rand"
@@ -36,6 +37,7 @@ import (
 	"github.com/mongoose-os/mos/common/pflagenv"
 	"github.com/mongoose-os/mos/mos/aws"
 	"github.com/mongoose-os/mos/mos/azure"
+	"github.com/mongoose-os/mos/mos/backup"
 	"github.com/mongoose-os/mos/mos/clone"
 	moscommon "github.com/mongoose-os/mos/mos/common"
 	"github.com/mongoose-os/mos/mos/common/paths"
@@ -45,11 +47,20 @@ import (
 	"github.com/mongoose-os/mos/mos/debug_core_dump"
 	"github.com/mongoose-os/mos/mos/dev"
 	"github.com/mongoose-os/mos/mos/devutil"
+	"github.com/mongoose-os/mos/mos/discovery"
+	"github.com/mongoose-os/mos/mos/flags"
+	"github.com/mongoose-os/mos/mos/fleet"
 	"github.com/mongoose-os/mos/mos/fs"
+	"github.com/mongoose-os/mos/mos/gateway"
 	"github.com/mongoose-os/mos/mos/gcp"
+	"github.com/mongoose-os/mos/mos/gen_rpc_client"
+	"github.com/mongoose-os/mos/mos/inventory"
 	license "github.com/mongoose-os/mos/mos/license_cmd"
 	"github.com/mongoose-os/mos/mos/mdash"
 	"github.com/mongoose-os/mos/mos/ota"
+	"github.com/mongoose-os/mos/mos/ourutil"
+	"github.com/mongoose-os/mos/mos/output"
+	"github.com/mongoose-os/mos/mos/sim"
 	"github.com/mongoose-os/mos/mos/update"
 	"github.com/mongoose-os/mos/mos/version"
 	"github.com/mongoose-os/mos/mos/watson"
@@ -71,9 +82,9 @@ var (
 	mosRepo    = flag.String("repo", "", "Path to the mongoose-os repository; if omitted, the mongoose-os repository will be cloned as ./mongoose-os")
 	deviceID   = flag.String("device-id", "", "Device ID")
 	devicePass = flag.String("device-pass", "", "Device pass/key")
-	dryRun     = flag.Bool("dry-run", true, "Do not apply changes, print what would be done")
+	dryRun     = flags.DryRun
 	firmware   = flag.String("firmware", moscommon.GetFirmwareZipFilePath(moscommon.GetBuildDir("")), "Firmware .zip file location (file of HTTP URL)")
-	force      = flag.Bool("force", false, "Use the force")
+	force      = flags.Force
 	verbose    = flag.Bool("verbose", false, "Verbose output")
 	chdir      = flag.StringP("chdir", "C", "", "Change into this directory first")
 	xFlag      = flag.BoolP("enable-extended", "X", false, "Deprecated. Enable extended commands")
@@ -128,11 +139,20 @@ func init() {
 		{"get", fs.Get, `Read file from the local device's filesystem and print to stdout`, nil, []string{"port"}, Yes, false},
 		{"put", fs.Put, `Put file from the host machine to the local device's filesystem`, nil, []string{"port"}, Yes, false},
 		{"rm", fs.Rm, `Delete a file from the device's filesystem`, nil, []string{"port"}, Yes, false},
+		{"fs-sync", fs.Sync, `Synchronize a local directory with the device's filesystem`, nil, []string{"port", "from-device", "delete", "include", "exclude", "dry-run"}, Yes, false},
+		{"fs-shell", fs.FSShell, `Interactive shell for the device's filesystem`, nil, []string{"port"}, Yes, false},
 		{"ota", ota.OTA, `Perform an OTA update on a device`, nil, []string{"port"}, Yes, false},
+		{"fleet-ota", fleet.OTA, `Perform an OTA update on many devices`, nil, []string{"targets", "group", "parallelism", "canary", "failure-threshold", "report", "commit-timeout", "force"}, No, false},
+		{"fleet", fleetRun, `Run a device command on many devices: "mos fleet run --group GROUP -- call Sys.GetInfo"`, nil, []string{"targets", "group", "parallelism"}, No, false},
 		{"config-get", config.Get, `Get config value from the locally attached device`, nil, []string{"port"}, Yes, false},
-		{"config-set", config.Set, `Set config value at the locally attached device`, nil, []string{"port"}, Yes, false},
+		{"config-set", config.Set, `Set config value at the locally attached device`, nil, []string{"port", "schema"}, Yes, false},
+		{"config-apply", config.Apply, `Apply configuration from a YAML or JSON file to the locally attached device`, nil, []string{"port", "level", "dry-run", "no-reboot", "no-save", "try-once", "schema"}, Yes, false},
+		{"config-validate", config.Validate, `Validate configuration file against the config schema`, nil, []string{"schema"}, No, false},
+		{"backup", backup.Backup, `Save device configuration and filesystem to a file`, nil, []string{"port", "only-config", "only-fs"}, Yes, false},
+		{"restore", backup.Restore, `Restore device configuration and filesystem from a backup`, nil, []string{"port", "only-config", "only-fs", "force", "no-reboot"}, Yes, false},
+		{"devices", inventory.Devices, `Manage the device inventory: list, add, rm, show`, nil, []string{"devices-file", "group", "alias", "port", "platform", "baud-rate", "hw-flow-control", "cert-file", "key-file", "ca-cert-file", "rpc-auth", "rpc-creds"}, No, false},
 		{"call", call, `Perform a device API call. "mos call RPC.List" shows available methods`, nil, []string{"port"}, Yes, false},
-		{"create-fw-bundle", create_fw_bundle.CreateFWBundle, `Create or modify a firmware ZIP bundle from disparate parts.`, nil, nil, No, false},
+		{"create-fw-bundle", create_fw_bundle.CreateFWBundle, `Create or modify a firmware ZIP bundle from disparate parts.`, nil, []string{"bundle-file"}, No, false},
 		{"debug-core-dump", debug_core_dump.DebugCoreDump, `Debug a core dump`, nil, nil, No, false},
 		{"aws-iot-setup", aws.AWSIoTSetup, `Provision the device for AWS IoT cloud`, nil, []string{"atca-slot", "aws-region", "port", "use-atca"}, Yes, false},
 		{"azure-iot-setup", azure.AzureIoTSetup, `Provision the device for Azure IoT Hub`, nil, []string{"atca-slot", "azure-auth-file", "port", "use-atca"}, Yes, false},
@@ -161,7 +181,10 @@ func init() {
 		{"esp32-gen-key", esp32GenKey, `Generate and program an encryption key`, nil, nil, No, true},
 		{"eval-manifest-expr", evalManifestExpr, `Evaluate the expression against the final manifest`, nil, nil, No, true},
 		{"get-mos-repo-dir", getMosRepoDir, `Show mongoose-os repo absolute path`, nil, nil, No, true},
-		{"ports", showPorts, `Show serial ports`, nil, nil, No, true},
+		{"ports", showPorts, `Show serial ports`, nil, []string{"discover", "discovery-timeout", "discovery-udp-port"}, No, true},
+		{"gen-rpc-client", gen_rpc_client.GenRPCClient, `Generate Go client for the device RPC methods`, []string{"out"}, []string{"port", "package", "rpc-desc", "save-rpc-desc", "result-from"}, Maybe, true},
+		{"rpc-gateway", gateway.RPCGateway, `Forward RPC requests to devices attached to this machine`, []string{"route"}, []string{"listen", "listen-cert-file", "listen-key-file", "listen-client-ca-file"}, No, true},
+		{"sim", sim.Sim, `Run a simulated device`, nil, []string{"sim-listen", "sim-state-dir"}, No, true},
 	}
 }
 
@@ -171,17 +194,42 @@ func showHelp(ctx context.Context, devConn dev.DevConn) error {
 	return nil
 }
 
+// versionInfo is the structured output of "mos version".
+type versionInfo struct {
+	Version       string `json:"version"`
+	BuildID       string `json:"build_id"`
+	UpdateChannel string `json:"update_channel"`
+}
+
 func showVersion(ctx context.Context, devConn dev.DevConn) error {
-	fmt.Printf(
-		"%s\nVersion: %s\nBuild ID: %s\nUpdate channel: %s\n",
-		"The Mongoose OS command line tool", version.Version, version.BuildId, update.GetUpdateChannel(),
-	)
-	return nil
+	vi := &versionInfo{version.Version, version.BuildId, string(update.GetUpdateChannel())}
+	return output.Print(ctx, vi, func(w io.Writer) error {
+		_, err := fmt.Fprintf(w,
+			"%s\nVersion: %s\nBuild ID: %s\nUpdate channel: %s\n",
+			"The Mongoose OS command line tool", vi.Version, vi.BuildID, vi.UpdateChannel,
+		)
+		return err
+	})
 }
 
 func showPorts(ctx context.Context, devConn dev.DevConn) error {
-	fmt.Printf("%s\n", strings.Join(devutil.EnumerateSerialPorts(), "\n"))
-	return nil
+	if *flags.Discover {
+		devs, err := devutil.DiscoverDevices(ctx)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		return output.Print(ctx, devs, func(w io.Writer) error {
+			return discovery.WriteTable(w, devs)
+		})
+	}
+	ports := devutil.EnumerateSerialPorts()
+	if ports == nil {
+		ports = []string{}
+	}
+	return output.Print(ctx, ports, func(w io.Writer) error {
+		_, err := fmt.Fprintf(w, "%s\n", strings.Join(ports, "\n"))
+		return err
+	})
 }
 
 func run(c *command, ctx context.Context, devConn dev.DevConn) error {
@@ -268,6 +316,8 @@ func main() {
 
 	consoleInit()
 
+	ourutil.JSONReports = output.Structured()
+
 	if len(flag.Args()) == 0 || flag.Arg(0) == "ui" {
 		isUI = true
 		aws.IsUI = true
@@ -284,7 +334,11 @@ func main() {
 		var err error
 		devConn, err = devutil.CreateDevConnFromFlags(ctx)
 		if err != nil {
-			fmt.Println(errors.Trace(err))
+			if output.Structured() {
+				output.PrintError(os.Stdout, err)
+			} else {
+				fmt.Println(errors.Trace(err))
+			}
 			os.Exit(1)
 		}
 	}
@@ -294,13 +348,25 @@ func main() {
 		os.Exit(1)
 	}
 
+	// create-fw-bundle takes the legacy form of --output, the bundle file name.
+	if cmd.name != "create-fw-bundle" {
+		if err := flags.CheckOutputFormat(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+			os.Exit(1)
+		}
+	}
+
 	err := run(cmd, ctx, devConn)
 	if devConn != nil {
 		devConn.Disconnect(context.Background())
 	}
 	if err != nil {
 		glog.Infof("Error: %+v", errors.ErrorStack(err))
-		fmt.Fprintf(os.Stderr, "Error: %s\n", errors.ErrorStack(err))
+		if output.Structured() {
+			output.PrintError(os.Stdout, err)
+		} else {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", errors.ErrorStack(err))
+		}
 		glog.Flush()
 		os.Exit(1)
 	}
@@ -21,12 +21,16 @@ import (
 	"context"
 	"encoding/base64"
 	"encoding/json"
+	"strings"
 	"time"
 
+	"github.com/mongoose-os/mos/common/fwbundle"
 	"github.com/mongoose-os/mos/mos/ourutil"
 	"github.com/mongoose-os/mos/mos/dev"
 	"github.com/mongoose-os/mos/mos/flags"
+	"github.com/mongoose-os/mos/mos/transfer"
 	"github.com/cesanta/errors"
+	"github.com/golang/glog"
 	flag "github.com/spf13/pflag"
 )
 
@@ -37,6 +41,9 @@ var (
 		"Timeout for entire update operation")
 )
 
+// How often a rebooting device is polled after the update.
+const rebootPollInterval = time.Second
+
 func OTA(ctx context.Context, devConn dev.DevConn) error {
 	args := flag.Args()
 	fwFilename := ""
@@ -57,9 +64,24 @@ func OTA(ctx context.Context, devConn dev.DevConn) error {
 	if err != nil {
 		return errors.Trace(err)
 	}
+	return errors.Trace(Update(ctx, devConn, fwFileData, beginArgs))
+}
+
+// Update performs an OTA update of the device. If the firmware is a bundle,
+// its platform is checked against the device beforehand and after the update
+// the device is expected to reboot into the new firmware, which is then
+// committed. Other files are sent as is.
+func Update(ctx context.Context, devConn dev.DevConn, fwFileData []byte, beginArgs string) error {
 	fwFileSize := len(fwFileData)
+	fwb, err := fwbundle.ReadZipFirmwareBytes(fwFileData)
+	if err != nil {
+		glog.Infof("not a firmware bundle, sending as is: %s", err)
+		fwb = nil
+	} else if err := checkPlatform(ctx, devConn, fwb); err != nil {
+		return errors.Trace(err)
+	}
 
-	ourutil.Reportf("Getting current OTA status...")
+	ourutil.CtxReportf(ctx, "Getting current OTA status...")
 	st := struct {
 		State int `json:"state"`
 	}{State: -1}
@@ -83,45 +105,208 @@ func OTA(ctx context.Context, devConn dev.DevConn) error {
 		baJSON, _ := json.Marshal(&ba)
 		beginArgs = string(baJSON)
 	}
-	ourutil.Reportf("Starting an update (args: %s)...", beginArgs)
+	ourutil.CtxReportf(ctx, "Starting an update (args: %s)...", beginArgs)
 	if err = devConn.Call(ctx, "OTA.Begin", beginArgs, nil); err != nil {
 		return errors.Annotatef(err, "unable to start an update")
 	}
 
-	ourutil.Reportf("Writing data...")
-	fwFile := bytes.NewBuffer(fwFileData)
-	data := make([]byte, *flags.ChunkSize)
-	total := int64(0)
+	dev.EnableBinaryFrames(ctx, devConn)
+	ourutil.CtxReportf(ctx, "Writing data...")
 	lastReport := time.Now()
+	topts := transfer.OptionsFromFlags(devConn)
+	topts.Progress = func(total int64) {
+		if time.Since(lastReport) > 5*time.Second {
+			ourutil.CtxReportf(ctx, "  %d of %d (%.2f%%)", total, fwFileSize, float64(total)*100.0/float64(fwFileSize))
+			lastReport = time.Now()
+		}
+	}
+	t := transfer.New(ctx, devConn, topts)
+	// Failed writes are resumed from the offset reported by the device
+	// for as long as the device keeps the update going. Older firmware does
+	// not report it, then chunks are sent one at a time and a failed one is
+	// retried as is.
+	resync := func(ctx context.Context) (int64, error) {
+		return getOffset(ctx, devConn)
+	}
+	if _, err := getOffset(ctx, devConn); errors.IsNotSupported(err) {
+		glog.Infof("device does not report OTA offset, failed writes cannot be resumed")
+		resync = nil
+	}
+	updateCtx, cancel := context.WithTimeout(ctx, *updateTimeoutFlag)
+	defer cancel()
+	var offset int64
 	for {
-		n, err := fwFile.Read(data)
-		if n < 0 {
-			return errors.Annotatef(err, "error reading file data")
-		} else if n == 0 {
+		err = t.Write(updateCtx, offset, bytes.NewReader(fwFileData[offset:]), func(ctx context.Context, offset int64, data []byte) error {
+			sta := struct {
+				Offset int64  `json:"offset"`
+				Data   string `json:"data"`
+			}{Offset: offset, Data: base64.StdEncoding.EncodeToString(data)}
+			return errors.Trace(devConn.Call(ctx, "OTA.Write", &sta, nil))
+		}, resync)
+		if err == nil {
 			break
 		}
-		dataB64 := base64.StdEncoding.EncodeToString(data[:n])
-		sta := struct {
-			Offset int64  `json:"offset"`
-			Data   string `json:"data"`
-		}{Offset: total, Data: dataB64}
-		for i := 0; i < 3; i++ {
-			ctx2, _ := context.WithTimeout(ctx, devConn.GetTimeout())
-			if err = devConn.Call(ctx2, "OTA.Write", &sta, nil); err == nil {
-				break
-			}
-			if i == 2 {
-				devConn.Call(ctx, "OTA.End", nil, nil)
-				return errors.Annotatef(err, "write failed at offset %d", total)
-			}
+		ourutil.CtxReportf(ctx, "Write failed: %s", errors.Cause(err))
+		if offset, err = resumeOffset(updateCtx, devConn); err != nil {
+			devConn.Call(ctx, "OTA.End", nil, nil)
+			return errors.Trace(err)
 		}
-		total += int64(n)
-		if total%65536 == 0 || time.Since(lastReport) > 5*time.Second {
-			ourutil.Reportf("  %d of %d (%.2f%%)", total, fwFileSize, float64(total)*100.0/float64(fwFileSize))
-			lastReport = time.Now()
+		ourutil.CtxReportf(ctx, "Resuming at %d of %d...", offset, fwFileSize)
+	}
+	ourutil.CtxReportf(ctx, "Sent %s", t.Stats())
+
+	ourutil.CtxReportf(ctx, "Finalizing update...")
+	endTime := time.Now()
+	if err := devConn.Call(ctx, "OTA.End", nil, nil); err != nil {
+		return errors.Annotatef(err, "unable to finalize update")
+	}
+	if fwb == nil {
+		return nil
+	}
+	return errors.Trace(verifyAndCommit(ctx, devConn, fwb, endTime))
+}
+
+// getOffset returns the amount of data the device has received so far.
+func getOffset(ctx context.Context, devConn dev.DevConn) (int64, error) {
+	var st struct {
+		Offset *int64 `json:"offset"`
+	}
+	if err := devConn.Call(ctx, "OTA.Status", nil, &st); err != nil {
+		return 0, errors.Trace(err)
+	}
+	if st.Offset == nil {
+		return 0, errors.NotSupportedf("OTA progress reporting")
+	}
+	return *st.Offset, nil
+}
+
+// resumeOffset waits for the device to become reachable again after a failed
+// write and returns the offset to continue the update from.
+func resumeOffset(ctx context.Context, devConn dev.DevConn) (int64, error) {
+	for {
+		select {
+		case <-ctx.Done():
+			return 0, errors.Annotatef(ctx.Err(), "unable to resume update")
+		case <-time.After(rebootPollInterval):
+		}
+		if err := dev.EnsureConnected(ctx, devConn); err != nil {
+			glog.V(1).Infof("failed to reconnect: %s", err)
+			continue
+		}
+		var st struct {
+			State  int    `json:"state"`
+			Msg    string `json:"msg"`
+			Offset *int64 `json:"offset"`
+		}
+		ctx2, cancel := context.WithTimeout(ctx, devConn.GetTimeout())
+		err := devConn.Call(ctx2, "OTA.Status", nil, &st)
+		cancel()
+		if err != nil {
+			// The connection may be stuck, start afresh.
+			glog.V(1).Infof("unable to get OTA status: %s", err)
+			devConn.Disconnect(ctx)
+			continue
+		}
+		if st.State != 1 /* MGOS_OTA_STATE_PROGRESS */ {
+			return 0, errors.Errorf("update is no longer in progress (%d %s)", st.State, st.Msg)
+		}
+		if st.Offset == nil {
+			return 0, errors.NotSupportedf("resuming update (device does not report offset)")
 		}
+		// Binary frames have to be negotiated again on a new connection.
+		dev.EnableBinaryFrames(ctx, devConn)
+		return *st.Offset, nil
 	}
+}
 
-	ourutil.Reportf("Finalizing update...")
-	return devConn.Call(ctx, "OTA.End", nil, nil)
+// checkPlatform makes sure that the bundle is built for the device.
+func checkPlatform(ctx context.Context, devConn dev.DevConn, fwb *fwbundle.FirmwareBundle) error {
+	info, err := dev.GetInfo(ctx, devConn)
+	if err != nil {
+		return errors.Annotatef(err, "unable to get device info")
+	}
+	if info.Arch == nil || fwb.Platform == "" {
+		ourutil.CtxReportf(ctx, "Warning: unable to check firmware platform")
+		return nil
+	}
+	if !strings.EqualFold(*info.Arch, fwb.Platform) {
+		if !*flags.Force {
+			return errors.Errorf("firmware is built for %s but the device is %s, use --force to update anyway", fwb.Platform, *info.Arch)
+		}
+		ourutil.CtxReportf(ctx, "Warning: firmware is built for %s but the device is %s, updating anyway", fwb.Platform, *info.Arch)
+	}
+	if info.Fw_version != nil && info.Fw_id != nil {
+		ourutil.CtxReportf(ctx, "Updating %s (%s) to %s (%s)", *info.Fw_version, *info.Fw_id, fwb.Version, fwb.BuildID)
+	}
+	return nil
+}
+
+// waitForReboot waits for the device to reboot after endTime and returns
+// the info reported by the new firmware.
+func waitForReboot(ctx context.Context, devConn dev.DevConn, endTime time.Time) (*dev.GetInfoResult, error) {
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, errors.Annotatef(ctx.Err(), "device did not come back after reboot")
+		case <-time.After(rebootPollInterval):
+		}
+		if err := dev.EnsureConnected(ctx, devConn); err != nil {
+			glog.V(1).Infof("failed to reconnect: %s", err)
+			continue
+		}
+		var info dev.GetInfoResult
+		ctx2, cancel := context.WithTimeout(ctx, devConn.GetTimeout())
+		err := devConn.Call(ctx2, "Sys.GetInfo", nil, &info)
+		cancel()
+		if err != nil {
+			glog.V(1).Infof("device is not available: %s", err)
+			devConn.Disconnect(ctx)
+			continue
+		}
+		// Until the reboot the old firmware may still be answering.
+		if info.Uptime != nil && time.Duration(*info.Uptime)*time.Second > time.Since(endTime)+time.Second {
+			continue
+		}
+		return &info, nil
+	}
+}
+
+// verifyAndCommit checks that the device is running the firmware from the
+// bundle and commits it. If the check fails, the update is not committed and
+// the device rolls back after the commit timeout.
+func verifyAndCommit(ctx context.Context, devConn dev.DevConn, fwb *fwbundle.FirmwareBundle, endTime time.Time) error {
+	timeout := *commitTimeoutFlag
+	if timeout <= 0 {
+		timeout = *updateTimeoutFlag
+	}
+	ctx, cancel := context.WithDeadline(ctx, endTime.Add(timeout))
+	defer cancel()
+	ourutil.CtxReportf(ctx, "Waiting for the device to reboot...")
+	info, err := waitForReboot(ctx, devConn, endTime)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	fwVersion, fwID := "", ""
+	if info.Fw_version != nil {
+		fwVersion = *info.Fw_version
+	}
+	if info.Fw_id != nil {
+		fwID = *info.Fw_id
+	}
+	if (fwb.Version != "" && fwVersion != fwb.Version) || (fwb.BuildID != "" && fwID != fwb.BuildID) {
+		return errors.Errorf("device is running %s (%s) instead of %s (%s), update failed", fwVersion, fwID, fwb.Version, fwb.BuildID)
+	}
+	ourutil.CtxReportf(ctx, "Device is running %s (%s)", fwVersion, fwID)
+
+	var st struct {
+		IsCommitted bool `json:"is_committed"`
+	}
+	if err := devConn.Call(ctx, "OTA.Status", nil, &st); err != nil {
+		return errors.Annotatef(err, "unable to get OTA status")
+	}
+	if st.IsCommitted {
+		return nil
+	}
+	ourutil.CtxReportf(ctx, "Committing update...")
+	return errors.Annotatef(devConn.Call(ctx, "OTA.Commit", nil, nil), "unable to commit update")
 }
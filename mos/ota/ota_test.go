@@ -0,0 +1,161 @@
+//
+// Copyright (c) 2014-2019 Cesanta Software Limited
+// All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package ota_test
+
+import (
+	"bytes"
+	"context"
+	"math/rand"
+	"strings"
+	"testing"
+	"time"
+
+	flag "github.com/spf13/pflag"
+
+	"github.com/mongoose-os/mos/common/fwbundle"
+	"github.com/mongoose-os/mos/mos/dev"
+	"github.com/mongoose-os/mos/mos/ota"
+	"github.com/mongoose-os/mos/mos/sim"
+)
+
+func bundle(t *testing.T, platform, version, buildID string, size int) []byte {
+	fwb := fwbundle.NewBundle()
+	fwb.Name, fwb.Platform, fwb.Version, fwb.BuildID = "app", platform, version, buildID
+	if size > 0 {
+		data := make([]byte, size)
+		rand.Read(data)
+		p := &fwbundle.FirmwarePart{Name: "app", Src: "app.bin"}
+		p.SetData(data)
+		fwb.AddPart(p)
+	}
+	buf := bytes.NewBuffer(nil)
+	if err := fwbundle.WriteZipFirmwareBytes(fwb, buf, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestUpdate(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	d, devConn, closeDev := sim.NewTestConn(t, ctx, sim.Options{})
+	defer closeDev()
+
+	var err error
+
+	err = ota.Update(ctx, devConn, bundle(t, "esp8266", "2.0", "20190202-000000", 0), "")
+	if err == nil || !strings.Contains(err.Error(), "--force") {
+		t.Errorf("expected platform mismatch error, got %v", err)
+	}
+	if got := d.Info().FwVersion; got != "1.0" {
+		t.Errorf("got version %s after a refused update", got)
+	}
+
+	flag.Set("commit-timeout", "20s")
+	defer flag.Set("commit-timeout", "300s")
+	if err := ota.Update(ctx, devConn, bundle(t, "sim", "2.0", "20190202-000000", 0), ""); err != nil {
+		t.Fatal(err)
+	}
+	var st sim.OTAStatus
+	if err := devConn.Call(ctx, "OTA.Status", nil, &st); err != nil || !st.IsCommitted {
+		t.Errorf("expected committed update, got %+v %v", st, err)
+	}
+	// Committed firmware survives reboot.
+	d.Reboot()
+	if info := d.Info(); info.FwVersion != "2.0" || info.FwID != "20190202-000000" {
+		t.Errorf("got %s (%s) after reboot", info.FwVersion, info.FwID)
+	}
+}
+
+func TestResumeUpdate(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+	opts := sim.Options{Faults: sim.Faults{SlowRate: 1, SlowDelay: 50 * time.Millisecond}}
+	d, devConn, closeDev := sim.NewTestConn(t, ctx, opts)
+	defer closeDev()
+	flag.Set("commit-timeout", "20s")
+	defer flag.Set("commit-timeout", "300s")
+
+	// Drop the connection once the update is under way.
+	dropped := make(chan int64, 1)
+	go func() {
+		c := &dev.Client{Timeout: 2 * time.Second}
+		monConn, err := c.CreateDevConn(ctx, devConn.ConnectAddr, false)
+		if err != nil {
+			dropped <- -1
+			return
+		}
+		defer monConn.Disconnect(ctx)
+		for ctx.Err() == nil {
+			var st sim.OTAStatus
+			if err := monConn.Call(ctx, "OTA.Status", nil, &st); err == nil && st.Offset > 0 {
+				d.DropConnections()
+				dropped <- st.Offset
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+	if err := ota.Update(ctx, devConn, bundle(t, "sim", "2.0", "20190202-000000", 64*1024), ""); err != nil {
+		t.Fatal(err)
+	}
+	if offset := <-dropped; offset <= 0 {
+		t.Errorf("connection was not dropped during the update")
+	}
+	if info := d.Info(); info.FwVersion != "2.0" {
+		t.Errorf("got version %s", info.FwVersion)
+	}
+}
+
+// flakyConn fails the first OTA.Write as if it had timed out.
+type flakyConn struct {
+	dev.DevConn
+	failed bool
+}
+
+func (c *flakyConn) Unwrap() dev.DevConn {
+	return c.DevConn
+}
+
+func (c *flakyConn) Call(ctx context.Context, method string, args interface{}, resp interface{}) error {
+	if method == "OTA.Write" && !c.failed {
+		c.failed = true
+		return context.DeadlineExceeded
+	}
+	return c.DevConn.Call(ctx, method, args, resp)
+}
+
+func TestUpdateWithoutOffset(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	d, devConn, closeDev := sim.NewTestConn(t, ctx, sim.Options{NoOTAOffset: true})
+	defer closeDev()
+	flag.Set("commit-timeout", "20s")
+	defer flag.Set("commit-timeout", "300s")
+
+	// The failed chunk is sent again, the update is not aborted.
+	fc := &flakyConn{DevConn: devConn}
+	if err := ota.Update(ctx, fc, bundle(t, "sim", "2.0", "20190202-000000", 16*1024), ""); err != nil {
+		t.Fatal(err)
+	}
+	if !fc.failed {
+		t.Errorf("no write has failed")
+	}
+	if info := d.Info(); info.FwVersion != "2.0" {
+		t.Errorf("got version %s", info.FwVersion)
+	}
+}
@@ -18,25 +18,78 @@ package ourutil
 
 import (
 	"bufio"
+	"context"
+	"encoding/json"
 	"fmt"
 	"io"
 	"os"
 	"regexp"
 	"strings"
+	"time"
 
 	"github.com/golang/glog"
 )
 
+// JSONReports makes Reportf print messages as JSON lines, see ProgressEvent.
+var JSONReports = false
+
+// ProgressEvent is a line Reportf prints to stderr when JSONReports is set.
+type ProgressEvent struct {
+	// Always "progress".
+	Type    string    `json:"type"`
+	Time    time.Time `json:"time"`
+	Message string    `json:"message"`
+}
+
 func Reportf(f string, args ...interface{}) {
-	fmt.Fprintf(os.Stderr, f+"\n", args...)
+	if JSONReports {
+		data, _ := json.Marshal(&ProgressEvent{Type: "progress", Time: time.Now(), Message: fmt.Sprintf(f, args...)})
+		fmt.Fprintf(os.Stderr, "%s\n", data)
+	} else {
+		fmt.Fprintf(os.Stderr, f+"\n", args...)
+	}
 	glog.Infof(f, args...)
 }
 
+type reportPrefixKey struct{}
+
+// WithReportPrefix returns a context in which messages reported with
+// CtxReportf start with prefix, e.g. the name of the device when several
+// are handled at once.
+func WithReportPrefix(ctx context.Context, prefix string) context.Context {
+	return context.WithValue(ctx, reportPrefixKey{}, prefix)
+}
+
+// CtxReportf is Reportf with the prefix set by WithReportPrefix.
+func CtxReportf(ctx context.Context, f string, args ...interface{}) {
+	if prefix, ok := ctx.Value(reportPrefixKey{}).(string); ok {
+		f = strings.Replace(prefix, "%", "%%", -1) + f
+	}
+	Reportf(f, args...)
+}
+
 func Freportf(logFile io.Writer, f string, args ...interface{}) {
 	fmt.Fprintf(logFile, f+"\n", args...)
 	glog.Infof(f, args...)
 }
 
+type outputKey struct{}
+
+// WithOutput returns a context in which commands print their results to w
+// instead of stdout.
+func WithOutput(ctx context.Context, w io.Writer) context.Context {
+	return context.WithValue(ctx, outputKey{}, w)
+}
+
+// Output returns the writer to print command results to, stdout unless
+// overridden with WithOutput. Progress messages go to stderr, see Reportf.
+func Output(ctx context.Context) io.Writer {
+	if w, ok := ctx.Value(outputKey{}).(io.Writer); ok {
+		return w
+	}
+	return os.Stdout
+}
+
 func Prompt(text string) string {
 	fmt.Fprintf(os.Stderr, "%s ", text)
 	ans, _ := bufio.NewReader(os.Stdin).ReadString('\n')
@@ -0,0 +1,99 @@
+//
+// Copyright (c) 2014-2019 Cesanta Software Limited
+// All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Package output prints command results in the format selected by --output.
+//
+// With --output=json, the result of a command is printed to stdout as
+// a JSON document. Commands that operate on many devices, like "fleet run",
+// print a line per device instead. Progress messages go to stderr as JSON
+// lines, see ourutil.ProgressEvent:
+//
+//	{"type":"progress","time":"2019-01-01T00:00:00Z","message":"Connecting..."}
+//
+// If the command fails, the error is printed to stdout instead of the result:
+//
+//	{"error":{"message":"call failed: remote error 404: No handler","code":404}}
+//
+// The code is the status returned by the device, if the error came from it.
+// With --output=yaml, results and errors are printed as YAML, progress
+// messages are the same as for json.
+package output
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/cesanta/errors"
+	yaml "gopkg.in/yaml.v2"
+
+	"github.com/mongoose-os/mos/mos/dev"
+	"github.com/mongoose-os/mos/mos/flags"
+	"github.com/mongoose-os/mos/mos/ourutil"
+)
+
+// Error is printed when a command fails.
+type Error struct {
+	Message string `json:"message"`
+	// Status code returned by the device, if the error came from it.
+	Code int `json:"code,omitempty"`
+}
+
+// Structured returns true if a format other than text is selected.
+func Structured() bool {
+	return flags.OutputFormat() != flags.OutputText
+}
+
+// Print prints the result of a command to ourutil.Output(ctx): v is
+// serialized if a structured format is selected, otherwise text is called to
+// print it in human-readable form.
+func Print(ctx context.Context, v interface{}, text func(w io.Writer) error) error {
+	w := ourutil.Output(ctx)
+	if !Structured() {
+		return errors.Trace(text(w))
+	}
+	return errors.Trace(write(w, v))
+}
+
+// PrintError prints the error in the selected structured format.
+func PrintError(w io.Writer, err error) error {
+	e := struct {
+		Error Error `json:"error"`
+	}{Error{Message: err.Error(), Code: dev.RemoteStatus(err)}}
+	return errors.Trace(write(w, e))
+}
+
+func write(w io.Writer, v interface{}) error {
+	// JSON tags define the structure, YAML is produced from JSON.
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if flags.OutputFormat() == flags.OutputYAML {
+		var yv interface{}
+		if err := yaml.Unmarshal(data, &yv); err != nil {
+			return errors.Trace(err)
+		}
+		if data, err = yaml.Marshal(yv); err != nil {
+			return errors.Trace(err)
+		}
+		_, err = w.Write(data)
+		return errors.Trace(err)
+	}
+	_, err = fmt.Fprintf(w, "%s\n", data)
+	return errors.Trace(err)
+}
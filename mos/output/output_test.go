@@ -0,0 +1,71 @@
+//
+// Copyright (c) 2014-2019 Cesanta Software Limited
+// All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package output_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+
+	"github.com/cesanta/errors"
+	flag "github.com/spf13/pflag"
+
+	"github.com/mongoose-os/mos/common/mgrpc"
+	"github.com/mongoose-os/mos/mos/ourutil"
+	"github.com/mongoose-os/mos/mos/output"
+)
+
+func TestPrint(t *testing.T) {
+	defer flag.Set("output", "")
+	v := []struct {
+		Name string `json:"name"`
+		Size int    `json:"size"`
+	}{{"init.js", 10}}
+	text := func(w io.Writer) error {
+		_, err := io.WriteString(w, "init.js 10\n")
+		return err
+	}
+	for _, c := range []struct {
+		format, want string
+	}{
+		{"", "init.js 10\n"},
+		{"fw.zip", "init.js 10\n"},
+		{"json", "[\n  {\n    \"name\": \"init.js\",\n    \"size\": 10\n  }\n]\n"},
+		{"yaml", "- name: init.js\n  size: 10\n"},
+	} {
+		flag.Set("output", c.format)
+		var buf bytes.Buffer
+		if err := output.Print(ourutil.WithOutput(context.Background(), &buf), v, text); err != nil {
+			t.Fatal(err)
+		}
+		if got := buf.String(); got != c.want {
+			t.Errorf("%q: got %q, want %q", c.format, got, c.want)
+		}
+	}
+
+	flag.Set("output", "json")
+	var buf bytes.Buffer
+	err := errors.Annotatef(mgrpc.ErrorResponse{Status: 404, Msg: "not found"}, "remote error")
+	if err := output.PrintError(&buf, errors.Annotatef(err, "call failed")); err != nil {
+		t.Fatal(err)
+	}
+	want := "{\n  \"error\": {\n    \"message\": \"call failed: remote error: (404) not found\",\n    \"code\": 404\n  }\n}\n"
+	if got := buf.String(); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,53 @@
+//
+// Copyright (c) 2014-2019 Cesanta Software Limited
+// All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package rpccreds
+
+import (
+	"bytes"
+	"os/exec"
+	"runtime"
+	"strings"
+
+	"github.com/cesanta/errors"
+)
+
+// Service name under which credentials are looked up in the keyring.
+const keyringService = "mos"
+
+// readKeyring reads a secret stored in the OS keyring using the platform's
+// command-line tool: "security" on macOS, "secret-tool" (libsecret) on Linux.
+func readKeyring(name string) (string, error) {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		cmd = exec.Command("security", "find-generic-password", "-s", keyringService, "-a", name, "-w")
+	case "linux", "freebsd", "openbsd":
+		cmd = exec.Command("secret-tool", "lookup", "service", keyringService, "account", name)
+	default:
+		return "", errors.NotSupportedf("keyring on %s", runtime.GOOS)
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", errors.Annotatef(err, "%s: %s", strings.Join(cmd.Args, " "), strings.TrimSpace(stderr.String()))
+	}
+	if len(out) == 0 {
+		return "", errors.NotFoundf("%s/%s", keyringService, name)
+	}
+	return string(out), nil
+}
@@ -17,29 +17,107 @@
 package rpccreds
 
 import (
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
 	"io/ioutil"
+	"os"
 	"strings"
+	"time"
 
 	"github.com/cesanta/errors"
 	flag "github.com/spf13/pflag"
+
+	"github.com/mongoose-os/mos/common/mgrpc"
+)
+
+const (
+	AuthDigest = "digest"
+	AuthBearer = "bearer"
+	AuthHMAC   = "hmac"
+	AuthJWT    = "jwt"
+
+	envPrefix     = "env:"
+	keyringPrefix = "keyring:"
 )
 
 var (
-	rpcCreds = flag.String("rpc-creds", "", `Either "username:passwd" or "@filename" which contains username:passwd`)
+	rpcCreds = flag.String("rpc-creds", "", `RPC credentials: "username:passwd" or a token, key or secret, depending on --rpc-auth. `+
+		`Can also be "@filename", "env:VAR" or "keyring:name" to read credentials from a file, an environment variable or the OS keyring`)
+	rpcAuth       = flag.String("rpc-auth", AuthDigest, `RPC authentication method: digest, bearer, hmac or jwt`)
+	rpcJWTSubject = flag.String("rpc-jwt-subject", "", "Subject of the JWT tokens used with --rpc-auth=jwt")
+	rpcJWTTTL     = flag.Duration("rpc-jwt-ttl", 10*time.Minute, "Lifetime of the JWT tokens used with --rpc-auth=jwt")
 )
 
-func GetRPCCreds() (username, passwd string, err error) {
-	if len(*rpcCreds) > 0 && (*rpcCreds)[0] == '@' {
-		filename := (*rpcCreds)[1:]
+// GetAuthenticator returns an authenticator configured by flags.
+// Credentials are not read until they are needed.
+func GetAuthenticator() (mgrpc.Authenticator, error) {
+	return NewAuthenticator(*rpcAuth, *rpcCreds)
+}
+
+// NewAuthenticator returns an authenticator using the given method and
+// credentials spec, which has the same format as --rpc-creds.
+// JWT settings are taken from flags.
+func NewAuthenticator(method, spec string) (mgrpc.Authenticator, error) {
+	c := creds(spec)
+	switch method {
+	case AuthDigest:
+		return mgrpc.DigestAuth(c.userPass), nil
+	case AuthBearer:
+		return mgrpc.BearerAuth(c.secret), nil
+	case AuthHMAC:
+		return mgrpc.HMACAuth(c.secret), nil
+	case AuthJWT:
+		return mgrpc.JWTAuth(c.privateKey, *rpcJWTSubject, *rpcJWTTTL), nil
+	default:
+		return nil, errors.Errorf("unknown --rpc-auth method %q", method)
+	}
+}
+
+// creds is a credentials spec, see --rpc-creds.
+type creds string
+
+func (c creds) secret() (string, error) {
+	spec := string(c)
+	switch {
+	case strings.HasPrefix(spec, "@"):
+		filename := spec[1:]
 		data, err := ioutil.ReadFile(filename)
 		if err != nil {
-			return "", "", errors.Annotatef(err, "reading RPC creds file %s", filename)
+			return "", errors.Annotatef(err, "reading RPC creds file %s", filename)
+		}
+		return strings.TrimSpace(string(data)), nil
+	case strings.HasPrefix(spec, envPrefix):
+		name := spec[len(envPrefix):]
+		v, ok := os.LookupEnv(name)
+		if !ok {
+			return "", errors.Errorf("RPC creds environment variable %s is not set", name)
+		}
+		return strings.TrimSpace(v), nil
+	case strings.HasPrefix(spec, keyringPrefix):
+		name := spec[len(keyringPrefix):]
+		v, err := readKeyring(name)
+		if err != nil {
+			return "", errors.Annotatef(err, "reading RPC creds %q from keyring", name)
 		}
+		return strings.TrimSpace(v), nil
+	case spec == "":
+		return "", errors.Errorf("RPC credentials are required, please specify --rpc-creds")
+	default:
+		return spec, nil
+	}
+}
 
-		return getRPCCredsFromString(strings.TrimSpace(string(data)))
-	} else {
-		return getRPCCredsFromString(*rpcCreds)
+func GetRPCCreds() (username, passwd string, err error) {
+	return creds(*rpcCreds).userPass()
+}
+
+func (c creds) userPass() (username, passwd string, err error) {
+	s, err := c.secret()
+	if err != nil {
+		return "", "", errors.Trace(err)
 	}
+	return getRPCCredsFromString(s)
 }
 
 func getRPCCredsFromString(s string) (username, passwd string, err error) {
@@ -53,3 +131,29 @@ func getRPCCredsFromString(s string) (username, passwd string, err error) {
 		return "", "", errors.Errorf("Failed to get username and password: wrong RPC creds spec")
 	}
 }
+
+// privateKey parses PEM-encoded private key specified by the creds.
+func (c creds) privateKey() (crypto.Signer, error) {
+	s, err := c.secret()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	block, _ := pem.Decode([]byte(s))
+	if block == nil {
+		return nil, errors.Errorf("RPC creds do not contain a PEM-encoded private key")
+	}
+	if k, err := x509.ParsePKCS8PrivateKey(block.Bytes); err == nil {
+		if signer, ok := k.(crypto.Signer); ok {
+			return signer, nil
+		}
+		return nil, errors.Errorf("unsupported private key type %T", k)
+	}
+	if k, err := x509.ParseECPrivateKey(block.Bytes); err == nil {
+		return k, nil
+	}
+	k, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, errors.Annotatef(err, "failed to parse private key")
+	}
+	return k, nil
+}
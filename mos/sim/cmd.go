@@ -0,0 +1,83 @@
+//
+// Copyright (c) 2014-2019 Cesanta Software Limited
+// All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package sim
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/cesanta/errors"
+	flag "github.com/spf13/pflag"
+
+	"github.com/mongoose-os/mos/mos/dev"
+	"github.com/mongoose-os/mos/mos/ourutil"
+)
+
+var (
+	listenFlag       = flag.StringSlice("sim-listen", []string{"tcp://127.0.0.1:8910"}, "Addresses for the simulated device to listen on: tcp://, ws://, http:// or pty://. Can be used multiple times.")
+	stateDirFlag     = flag.String("sim-state-dir", "", "Directory to keep the state of the simulated device in. If not set, the state is kept in memory.")
+	appFlag          = flag.String("sim-app", "", "App name reported by the simulated device")
+	archFlag         = flag.String("sim-arch", "", "Architecture reported by the simulated device")
+	fwVersionFlag    = flag.String("sim-fw-version", "", "Firmware version reported by the simulated device")
+	dropRateFlag     = flag.Float64("sim-drop-rate", 0, "Fraction of requests the simulated device ignores")
+	slowRateFlag     = flag.Float64("sim-slow-rate", 0, "Fraction of requests the simulated device responds to with a delay")
+	slowDelayFlag    = flag.Duration("sim-slow-delay", 2*time.Second, "Response delay for --sim-slow-rate")
+	oomRateFlag      = flag.Float64("sim-oom-rate", 0, "Fraction of requests that fail with an out of memory error")
+	oomThresholdFlag = flag.Int("sim-oom-threshold", 0, "If set, requests with arguments larger than this fail with an out of memory error")
+)
+
+// Sim runs a simulated device until interrupted.
+func Sim(ctx context.Context, devConn dev.DevConn) error {
+	d, err := New(Options{
+		Info: Info{
+			App:       *appFlag,
+			Arch:      *archFlag,
+			FwVersion: *fwVersionFlag,
+		},
+		StateDir: *stateDirFlag,
+		Faults: Faults{
+			DropRate:     *dropRateFlag,
+			SlowRate:     *slowRateFlag,
+			SlowDelay:    *slowDelayFlag,
+			OOMRate:      *oomRateFlag,
+			OOMThreshold: *oomThresholdFlag,
+		},
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+	info := d.Info()
+	ourutil.Reportf("Simulated device: %s %s %s (%s)", info.App, info.Arch, info.FwVersion, info.FwID)
+	for _, addr := range *listenFlag {
+		ep, err := d.Listen(ctx, addr)
+		if err != nil {
+			return errors.Annotatef(err, "failed to listen on %s", addr)
+		}
+		defer ep.Close()
+		ourutil.Reportf("Listening on %s, use --port %s", addr, ep.ConnectAddr)
+	}
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	select {
+	case <-sigs:
+	case <-ctx.Done():
+	}
+	return nil
+}
@@ -0,0 +1,258 @@
+//
+// Copyright (c) 2014-2019 Cesanta Software Limited
+// All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package sim
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/cesanta/errors"
+
+	"github.com/mongoose-os/mos/common/mgrpc"
+)
+
+const (
+	// Level 0 holds the defaults, level 9 is the user level.
+	numConfigLevels  = 10
+	userConfigLevel  = numConfigLevels - 1
+	configFileFormat = "conf%d.json"
+)
+
+// configState holds the configuration of the device.
+type configState struct {
+	meta store
+
+	// Saved levels. Level 0 holds the defaults.
+	levels [numConfigLevels]map[string]interface{}
+	// Levels changed by Config.Set but not saved yet.
+	unsaved map[int]map[string]interface{}
+	// Levels saved with try_once, to be used during the next boot only.
+	tryOnce map[int]map[string]interface{}
+	// Levels saved with try_once that are in effect during the current boot.
+	tryOnceActive map[int]map[string]interface{}
+	// Configuration in effect.
+	runtime map[string]interface{}
+}
+
+// defaultConfig returns a minimal default configuration of a device.
+func defaultConfig(info *Info) map[string]interface{} {
+	suffix := info.MAC
+	if len(suffix) > 6 {
+		suffix = suffix[len(suffix)-6:]
+	}
+	conf := map[string]interface{}{}
+	json.Unmarshal([]byte(fmt.Sprintf(`{
+  "device": {"id": %q, "password": ""},
+  "debug": {"level": 2, "stdout_uart": 0, "stderr_uart": 0},
+  "sys": {"tz_spec": ""},
+  "rpc": {"enable": true, "max_frame_size": 4096},
+  "wifi": {
+    "ap": {"enable": true, "ssid": %q, "pass": "Mongoose"},
+    "sta": {"enable": false, "ssid": "", "pass": ""}
+  }
+}`, strings.ToLower(info.App+"_"+suffix), "Mongoose_"+suffix)), &conf)
+	return conf
+}
+
+// copyConfig returns a deep copy of the config.
+func copyConfig(conf map[string]interface{}) map[string]interface{} {
+	res := map[string]interface{}{}
+	if conf != nil {
+		data, _ := json.Marshal(conf)
+		json.Unmarshal(data, &res)
+	}
+	return res
+}
+
+// mergeConfig merges src into dst. Objects are merged recursively, all other
+// values (including arrays) are replaced.
+func mergeConfig(dst, src map[string]interface{}) {
+	for k, v := range src {
+		if vm, ok := v.(map[string]interface{}); ok {
+			if dm, ok := dst[k].(map[string]interface{}); ok {
+				mergeConfig(dm, vm)
+				continue
+			}
+		}
+		dst[k] = v
+	}
+}
+
+func (cs *configState) load(meta store, defaults map[string]interface{}) error {
+	cs.meta = meta
+	cs.levels[0] = copyConfig(defaults)
+	for l := 1; l < numConfigLevels; l++ {
+		data, err := meta.Get(fmt.Sprintf(configFileFormat, l))
+		if err != nil {
+			if os.IsNotExist(errors.Cause(err)) {
+				continue
+			}
+			return errors.Trace(err)
+		}
+		if err := json.Unmarshal(data, &cs.levels[l]); err != nil {
+			return errors.Annotatef(err, "invalid config level %d", l)
+		}
+	}
+	cs.tryOnce = map[int]map[string]interface{}{}
+	return nil
+}
+
+// level returns contents of the level in effect during the current boot.
+func (cs *configState) level(l int) map[string]interface{} {
+	if conf, ok := cs.tryOnceActive[l]; ok {
+		return conf
+	}
+	return cs.levels[l]
+}
+
+// merged returns configuration composed of levels up to and including maxLevel.
+func (cs *configState) merged(maxLevel int) map[string]interface{} {
+	res := map[string]interface{}{}
+	for l := 0; l <= maxLevel; l++ {
+		mergeConfig(res, copyConfig(cs.level(l)))
+	}
+	return res
+}
+
+func (cs *configState) boot() {
+	cs.tryOnceActive = cs.tryOnce
+	cs.tryOnce = map[int]map[string]interface{}{}
+	cs.unsaved = map[int]map[string]interface{}{}
+	cs.runtime = cs.merged(userConfigLevel)
+}
+
+func (cs *configState) set(l int, conf map[string]interface{}) {
+	levelConf, ok := cs.unsaved[l]
+	if !ok {
+		levelConf = copyConfig(cs.level(l))
+		cs.unsaved[l] = levelConf
+	}
+	mergeConfig(levelConf, copyConfig(conf))
+	mergeConfig(cs.runtime, copyConfig(conf))
+}
+
+func (cs *configState) save(tryOnce bool) error {
+	for l, conf := range cs.unsaved {
+		if tryOnce {
+			cs.tryOnce[l] = conf
+			continue
+		}
+		data, err := json.MarshalIndent(conf, "", "  ")
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if err := cs.meta.Put(fmt.Sprintf(configFileFormat, l), data); err != nil {
+			return errors.Annotatef(err, "failed to save config level %d", l)
+		}
+		cs.levels[l] = conf
+		delete(cs.tryOnce, l)
+	}
+	cs.unsaved = map[int]map[string]interface{}{}
+	return nil
+}
+
+func (d *Device) addConfigHandlers() {
+	d.addMethod("Config.Get", d.configGet)
+	d.addMethod("Config.Set", d.configSet)
+	d.addMethod("Config.Save", d.configSave)
+}
+
+func (d *Device) configGet(ctx context.Context, r mgrpc.MgRPC, args json.RawMessage) (interface{}, error) {
+	var a struct {
+		Key   string `json:"key"`
+		Level *int   `json:"level"`
+	}
+	if err := parseArgs(args, &a); err != nil {
+		return nil, err
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	var res interface{} = copyConfig(d.conf.runtime)
+	if d.opts.NoConfigLevels {
+		res = d.conf.merged(userConfigLevel)
+	} else if a.Level != nil && *a.Level >= 0 {
+		if *a.Level >= numConfigLevels {
+			return nil, errorf(400, "invalid level %d", *a.Level)
+		}
+		res = d.conf.merged(*a.Level)
+	}
+	if a.Key != "" {
+		for _, k := range strings.Split(a.Key, ".") {
+			m, ok := res.(map[string]interface{})
+			if ok {
+				res, ok = m[k]
+			}
+			if !ok {
+				return nil, errorf(404, "invalid config key %q", a.Key)
+			}
+		}
+	}
+	return res, nil
+}
+
+func (d *Device) configSet(ctx context.Context, r mgrpc.MgRPC, args json.RawMessage) (interface{}, error) {
+	var a struct {
+		Config  map[string]interface{} `json:"config"`
+		Level   int                    `json:"level"`
+		Save    bool                   `json:"save"`
+		Reboot  bool                   `json:"reboot"`
+		TryOnce bool                   `json:"try_once"`
+	}
+	if err := parseArgs(args, &a); err != nil {
+		return nil, err
+	}
+	if a.Level == 0 || d.opts.NoConfigLevels {
+		a.Level = userConfigLevel
+	}
+	if a.Level < 1 || a.Level >= numConfigLevels {
+		return nil, errorf(400, "invalid level %d", a.Level)
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.conf.set(a.Level, a.Config)
+	if a.Save {
+		if err := d.conf.save(a.TryOnce); err != nil {
+			return nil, err
+		}
+	}
+	if a.Reboot {
+		d.scheduleReboot(defaultRebootDelay)
+	}
+	return map[string]bool{"saved": a.Save}, nil
+}
+
+func (d *Device) configSave(ctx context.Context, r mgrpc.MgRPC, args json.RawMessage) (interface{}, error) {
+	var a struct {
+		Reboot  bool `json:"reboot"`
+		TryOnce bool `json:"try_once"`
+	}
+	if err := parseArgs(args, &a); err != nil {
+		return nil, err
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if err := d.conf.save(a.TryOnce); err != nil {
+		return nil, err
+	}
+	if a.Reboot {
+		d.scheduleReboot(defaultRebootDelay)
+	}
+	return nil, nil
+}
@@ -0,0 +1,76 @@
+//
+// Copyright (c) 2014-2019 Cesanta Software Limited
+// All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package sim
+
+import (
+	"context"
+	"math/rand"
+	"time"
+
+	"github.com/golang/glog"
+
+	"github.com/mongoose-os/mos/common/mgrpc"
+	"github.com/mongoose-os/mos/common/mgrpc/frame"
+)
+
+const (
+	statusOOM  = 500
+	messageOOM = "Out of memory"
+)
+
+// Faults configures the faults injected by the device.
+// Rates are probabilities, from 0 (never) to 1 (always).
+type Faults struct {
+	// DropRate is the rate of requests that are ignored, as if the frame was lost.
+	DropRate float64
+
+	// SlowRate is the rate of requests responses to which are delayed by SlowDelay.
+	SlowRate  float64
+	SlowDelay time.Duration
+
+	// OOMRate is the rate of requests that fail with an out of memory error.
+	OOMRate float64
+	// OOMThreshold, if positive, is the size of the largest request arguments
+	// the device has memory for. Larger requests fail with an out of memory error.
+	OOMThreshold int
+}
+
+func chance(rate float64) bool {
+	return rate > 0 && rand.Float64() < rate
+}
+
+func (fs Faults) middleware(next mgrpc.Handler) mgrpc.Handler {
+	return func(ctx context.Context, r mgrpc.MgRPC, f *frame.Frame) *frame.Frame {
+		if chance(fs.DropRate) {
+			glog.Infof("dropping request %d (%s)", f.ID, f.Method)
+			return nil
+		}
+		if chance(fs.OOMRate) || (fs.OOMThreshold > 0 && len(f.Params)+len(f.DeprecatedArgs) > fs.OOMThreshold) {
+			glog.Infof("failing request %d (%s) with OOM", f.ID, f.Method)
+			return &frame.Frame{ID: f.ID, Error: &frame.Error{Code: statusOOM, Message: messageOOM}}
+		}
+		if chance(fs.SlowRate) {
+			glog.Infof("delaying request %d (%s) by %s", f.ID, f.Method, fs.SlowDelay)
+			select {
+			case <-time.After(fs.SlowDelay):
+			case <-ctx.Done():
+				return nil
+			}
+		}
+		return next(ctx, r, f)
+	}
+}
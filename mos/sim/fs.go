@@ -0,0 +1,241 @@
+//
+// Copyright (c) 2014-2019 Cesanta Software Limited
+// All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package sim
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"strings"
+
+	"github.com/cesanta/errors"
+
+	"github.com/mongoose-os/mos/common/mgrpc"
+	"github.com/mongoose-os/mos/mos/fs"
+)
+
+// fsName validates and normalizes the file name: the filesystem is flat and
+// names are relative to its root. With Options.FSDirs, names that contain
+// slashes are listed as being in directories.
+func fsName(name string) (string, error) {
+	n := strings.TrimPrefix(name, "/")
+	if n == "" || n == "." || n == ".." {
+		return "", errorf(400, "invalid file name %q", name)
+	}
+	return n, nil
+}
+
+// fsUsed returns the total size of the files. Must be called with the lock held.
+func (d *Device) fsUsed() int64 {
+	var used int64
+	names, _ := d.files.List()
+	for _, name := range names {
+		data, _ := d.files.Get(name)
+		used += int64(len(data))
+	}
+	return used
+}
+
+// fsList returns names and sizes of the files in the directory.
+func (d *Device) fsList(args json.RawMessage) ([]fs.ListExtResult, error) {
+	var a fs.ListArgs
+	if err := parseArgs(args, &a); err != nil {
+		return nil, err
+	}
+	prefix := ""
+	if a.Path != nil {
+		prefix = strings.Trim(*a.Path, "/")
+	}
+	if prefix != "" {
+		prefix += "/"
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	names, err := d.files.List()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	var res []fs.ListExtResult
+	dirs := map[string]bool{}
+	for _, name := range names {
+		if prefix != "" && name+"/" == prefix {
+			return nil, errorf(400, "%q is not a directory", *a.Path)
+		}
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		n := strings.TrimPrefix(name, prefix)
+		if i := strings.Index(n, "/"); i > 0 && d.opts.FSDirs {
+			if dn := n[:i]; !dirs[dn] {
+				dirs[dn] = true
+				res = append(res, fs.ListExtResult{Name: &dn, Size: new(int64)})
+			}
+			continue
+		}
+		data, err := d.files.Get(name)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		size := int64(len(data))
+		res = append(res, fs.ListExtResult{Name: &n, Size: &size})
+	}
+	return res, nil
+}
+
+func (d *Device) addFSHandlers() {
+	d.addMethod("FS.List", d.fsListNames)
+	d.addMethod("FS.ListExt", d.fsListExt)
+	d.addMethod("FS.Get", d.fsGet)
+	d.addMethod("FS.Put", d.fsPut)
+	d.addMethod("FS.Remove", d.fsRemove)
+	d.addMethod("FS.Checksum", d.fsChecksum)
+}
+
+func (d *Device) fsListNames(ctx context.Context, r mgrpc.MgRPC, args json.RawMessage) (interface{}, error) {
+	files, err := d.fsList(args)
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for _, f := range files {
+		names = append(names, *f.Name)
+	}
+	return names, nil
+}
+
+func (d *Device) fsListExt(ctx context.Context, r mgrpc.MgRPC, args json.RawMessage) (interface{}, error) {
+	files, err := d.fsList(args)
+	if err != nil {
+		return nil, err
+	}
+	if files == nil {
+		files = []fs.ListExtResult{}
+	}
+	return files, nil
+}
+
+func (d *Device) fsGet(ctx context.Context, r mgrpc.MgRPC, args json.RawMessage) (interface{}, error) {
+	var a fs.GetArgs
+	if err := parseArgs(args, &a); err != nil {
+		return nil, err
+	}
+	if a.Filename == nil {
+		return nil, errorf(400, "filename is required")
+	}
+	name, err := fsName(*a.Filename)
+	if err != nil {
+		return nil, err
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	data, err := d.files.Get(name)
+	if err != nil {
+		return nil, errorf(400, "failed to open file %q", *a.Filename)
+	}
+	size := int64(len(data))
+	if a.Offset < 0 || a.Offset > size {
+		return nil, errorf(400, "invalid offset %d", a.Offset)
+	}
+	n := size - a.Offset
+	if a.Len > 0 && a.Len < n {
+		n = a.Len
+	}
+	chunk := base64.StdEncoding.EncodeToString(data[a.Offset : a.Offset+n])
+	left := size - a.Offset - n
+	return &fs.GetResult{Data: &chunk, Left: &left}, nil
+}
+
+func (d *Device) fsPut(ctx context.Context, r mgrpc.MgRPC, args json.RawMessage) (interface{}, error) {
+	var a struct {
+		Filename string `json:"filename"`
+		Data     string `json:"data"`
+		Append   bool   `json:"append"`
+	}
+	if err := parseArgs(args, &a); err != nil {
+		return nil, err
+	}
+	name, err := fsName(a.Filename)
+	if err != nil {
+		return nil, err
+	}
+	chunk, err := base64.StdEncoding.DecodeString(a.Data)
+	if err != nil {
+		return nil, errorf(400, "invalid data: %s", err)
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	var data []byte
+	if a.Append {
+		data, err = d.files.Get(name)
+		if err != nil && !os.IsNotExist(errors.Cause(err)) {
+			return nil, errors.Trace(err)
+		}
+	}
+	old, _ := d.files.Get(name)
+	if d.fsUsed()-int64(len(old))+int64(len(data)+len(chunk)) > d.info.FSSize {
+		return nil, errorf(500, "failed to write %q: no space left", a.Filename)
+	}
+	if err := d.files.Put(name, append(data, chunk...)); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return nil, nil
+}
+
+func (d *Device) fsChecksum(ctx context.Context, r mgrpc.MgRPC, args json.RawMessage) (interface{}, error) {
+	var a fs.ChecksumArgs
+	if err := parseArgs(args, &a); err != nil {
+		return nil, err
+	}
+	name, err := fsName(a.Filename)
+	if err != nil {
+		return nil, err
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	data, err := d.files.Get(name)
+	if err != nil {
+		return nil, errorf(400, "failed to open file %q", a.Filename)
+	}
+	if a.Len > 0 && a.Len < int64(len(data)) {
+		data = data[:a.Len]
+	}
+	sum := sha256.Sum256(data)
+	return &fs.ChecksumResult{Size: int64(len(data)), SHA256: hex.EncodeToString(sum[:])}, nil
+}
+
+func (d *Device) fsRemove(ctx context.Context, r mgrpc.MgRPC, args json.RawMessage) (interface{}, error) {
+	var a fs.RemoveArgs
+	if err := parseArgs(args, &a); err != nil {
+		return nil, err
+	}
+	if a.Filename == nil {
+		return nil, errorf(400, "filename is required")
+	}
+	name, err := fsName(*a.Filename)
+	if err != nil {
+		return nil, err
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if err := d.files.Remove(name); err != nil {
+		return nil, errorf(400, "failed to remove %q", *a.Filename)
+	}
+	return nil, nil
+}
@@ -0,0 +1,318 @@
+//
+// Copyright (c) 2014-2019 Cesanta Software Limited
+// All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package sim
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"path"
+	"time"
+
+	"github.com/cesanta/errors"
+	"github.com/golang/glog"
+
+	"github.com/mongoose-os/mos/common/fwbundle"
+	"github.com/mongoose-os/mos/common/mgrpc"
+	zip "github.com/mongoose-os/mos/common/ourzip"
+)
+
+// OTA states, as reported by OTA.Status.
+const (
+	otaStateIdle     = 0
+	otaStateProgress = 1
+	otaStateError    = 2
+	otaStateSuccess  = 3
+
+	// Delay between successful completion of an update and reboot.
+	otaRebootDelay = 500 * time.Millisecond
+)
+
+type otaState struct {
+	state int
+	msg   string
+
+	// Update in progress.
+	size          int64
+	data          []byte
+	deadline      time.Time
+	commitTimeout time.Duration
+
+	// Firmware installed by the last update, activated on reboot.
+	pending *Info
+	// Firmware that was running before the update that has not been committed yet.
+	// If the update is not committed, the device rolls back to it on reboot.
+	prev        *Info
+	commitTimer *time.Timer
+}
+
+// OTAStatus is the result of OTA.Status.
+type OTAStatus struct {
+	State           int    `json:"state"`
+	Msg             string `json:"msg,omitempty"`
+	Size            int64  `json:"size,omitempty"`
+	Offset          int64  `json:"offset"`
+	ProgressPercent int    `json:"progress_percent"`
+	IsCommitted     bool   `json:"is_committed"`
+	CommitTimeout   int64  `json:"commit_timeout,omitempty"`
+}
+
+// readManifest returns the manifest of a firmware bundle.
+func readManifest(data []byte) (*fwbundle.FirmwareManifest, error) {
+	r, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	for _, f := range r.File {
+		if path.Base(f.Name) != fwbundle.ManifestFileName {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		manifestData, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		var fm fwbundle.FirmwareManifest
+		if err := json.Unmarshal(manifestData, &fm); err != nil {
+			return nil, errors.Trace(err)
+		}
+		return &fm, nil
+	}
+	return nil, errors.Errorf("no %s in the archive", fwbundle.ManifestFileName)
+}
+
+// otaFail aborts the update in progress. Must be called with the lock held.
+func (d *Device) otaFail(msg string) error {
+	d.ota.state, d.ota.msg, d.ota.data = otaStateError, msg, nil
+	return errorf(400, "%s", msg)
+}
+
+// otaCheckProgress returns an error if there is no update in progress.
+// Must be called with the lock held.
+func (d *Device) otaCheckProgress() error {
+	if d.ota.state != otaStateProgress {
+		return errorf(400, "no update in progress")
+	}
+	if !d.ota.deadline.IsZero() && time.Now().After(d.ota.deadline) {
+		return d.otaFail("update timed out")
+	}
+	return nil
+}
+
+// otaReboot activates the newly installed firmware or rolls back
+// the uncommitted one. Must be called with the lock held.
+func (d *Device) otaReboot() {
+	o := &d.ota
+	if o.state == otaStateProgress {
+		o.state, o.msg = otaStateIdle, ""
+	}
+	o.data = nil
+	if o.commitTimer != nil {
+		o.commitTimer.Stop()
+		o.commitTimer = nil
+	}
+	switch {
+	case o.pending != nil:
+		if o.prev == nil {
+			prev := d.info
+			o.prev = &prev
+		}
+		d.info = *o.pending
+		o.pending = nil
+		o.state, o.msg = otaStateIdle, ""
+		if o.commitTimeout == 0 {
+			d.otaCommit()
+			break
+		}
+		glog.Infof("running uncommitted firmware %s, commit timeout %s", d.info.FwVersion, o.commitTimeout)
+		o.commitTimer = time.AfterFunc(o.commitTimeout, d.otaCommitTimeout)
+	case o.prev != nil:
+		glog.Infof("firmware %s was not committed, rolling back to %s", d.info.FwVersion, o.prev.FwVersion)
+		d.info = *o.prev
+		o.prev = nil
+	}
+}
+
+// otaCommit makes the running firmware permanent. Must be called with the lock held.
+func (d *Device) otaCommit() error {
+	if d.ota.prev == nil {
+		return nil
+	}
+	d.ota.prev = nil
+	if d.ota.commitTimer != nil {
+		d.ota.commitTimer.Stop()
+		d.ota.commitTimer = nil
+	}
+	return errors.Trace(d.saveInfo())
+}
+
+func (d *Device) otaCommitTimeout() {
+	d.lock.Lock()
+	uncommitted := d.ota.prev != nil
+	d.lock.Unlock()
+	if uncommitted {
+		d.Reboot()
+	}
+}
+
+func (d *Device) addOTAHandlers() {
+	d.addMethod("OTA.Status", d.otaStatus)
+	d.addMethod("OTA.Begin", d.otaBegin)
+	d.addMethod("OTA.Write", d.otaWrite)
+	d.addMethod("OTA.End", d.otaEnd)
+	d.addMethod("OTA.Commit", d.otaCommitHandler)
+	d.addMethod("OTA.Revert", d.otaRevert)
+}
+
+func (d *Device) otaStatus(ctx context.Context, r mgrpc.MgRPC, args json.RawMessage) (interface{}, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.ota.state == otaStateProgress {
+		d.otaCheckProgress()
+	}
+	o := &d.ota
+	st := &OTAStatus{
+		State:       o.state,
+		Msg:         o.msg,
+		Size:        o.size,
+		Offset:      int64(len(o.data)),
+		IsCommitted: o.prev == nil,
+	}
+	if o.state == otaStateProgress && o.size > 0 {
+		st.ProgressPercent = int(st.Offset * 100 / o.size)
+	}
+	if !st.IsCommitted {
+		st.CommitTimeout = int64(o.commitTimeout / time.Second)
+	}
+	if d.opts.NoOTAOffset {
+		return struct {
+			*OTAStatus
+			Offset *int64 `json:"offset,omitempty"`
+		}{OTAStatus: st}, nil
+	}
+	return st, nil
+}
+
+func (d *Device) otaBegin(ctx context.Context, r mgrpc.MgRPC, args json.RawMessage) (interface{}, error) {
+	var a struct {
+		Size          int64 `json:"size"`
+		Timeout       int64 `json:"timeout"`
+		CommitTimeout int64 `json:"commit_timeout"`
+	}
+	if err := parseArgs(args, &a); err != nil {
+		return nil, err
+	}
+	if a.Size <= 0 {
+		return nil, errorf(400, "size is required")
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.otaCheckProgress() == nil {
+		return nil, errorf(400, "update is already in progress")
+	}
+	d.ota.state, d.ota.msg = otaStateProgress, ""
+	d.ota.size, d.ota.data = a.Size, make([]byte, 0, a.Size)
+	d.ota.commitTimeout = time.Duration(a.CommitTimeout) * time.Second
+	d.ota.deadline = time.Time{}
+	if a.Timeout > 0 {
+		d.ota.deadline = time.Now().Add(time.Duration(a.Timeout) * time.Second)
+	}
+	return nil, nil
+}
+
+func (d *Device) otaWrite(ctx context.Context, r mgrpc.MgRPC, args json.RawMessage) (interface{}, error) {
+	var a struct {
+		Offset *int64 `json:"offset"`
+		Data   string `json:"data"`
+	}
+	if err := parseArgs(args, &a); err != nil {
+		return nil, err
+	}
+	data, err := base64.StdEncoding.DecodeString(a.Data)
+	if err != nil {
+		return nil, errorf(400, "invalid data: %s", err)
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if err := d.otaCheckProgress(); err != nil {
+		return nil, err
+	}
+	written := int64(len(d.ota.data))
+	offset := written
+	if a.Offset != nil {
+		offset = *a.Offset
+	}
+	// Chunks that have already been written may be resent when retrying.
+	if offset < 0 || offset > written {
+		return nil, errorf(400, "invalid offset %d, %d bytes written", offset, written)
+	}
+	if offset+int64(len(data)) > d.ota.size {
+		return nil, d.otaFail("data exceeds the size of the update")
+	}
+	d.ota.data = append(d.ota.data[:offset], data...)
+	return nil, nil
+}
+
+func (d *Device) otaEnd(ctx context.Context, r mgrpc.MgRPC, args json.RawMessage) (interface{}, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if err := d.otaCheckProgress(); err != nil {
+		return nil, err
+	}
+	if int64(len(d.ota.data)) != d.ota.size {
+		return nil, d.otaFail("incomplete update")
+	}
+	fm, err := readManifest(d.ota.data)
+	if err != nil {
+		return nil, d.otaFail("invalid firmware bundle: " + err.Error())
+	}
+	info := d.info
+	if fm.Name != "" {
+		info.App = fm.Name
+	}
+	if fm.Platform != "" {
+		info.Arch = fm.Platform
+	}
+	info.FwVersion, info.FwID = fm.Version, fm.BuildID
+	d.ota.pending = &info
+	d.ota.state, d.ota.data = otaStateSuccess, nil
+	glog.Infof("firmware %s (%s) installed, rebooting", info.FwVersion, info.FwID)
+	d.scheduleReboot(otaRebootDelay)
+	return nil, nil
+}
+
+func (d *Device) otaCommitHandler(ctx context.Context, r mgrpc.MgRPC, args json.RawMessage) (interface{}, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return nil, d.otaCommit()
+}
+
+func (d *Device) otaRevert(ctx context.Context, r mgrpc.MgRPC, args json.RawMessage) (interface{}, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.ota.prev == nil {
+		return nil, errorf(400, "firmware is committed")
+	}
+	d.scheduleReboot(defaultRebootDelay)
+	return nil, nil
+}
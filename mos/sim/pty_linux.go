@@ -0,0 +1,101 @@
+//
+// Copyright (c) 2014-2019 Cesanta Software Limited
+// All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package sim
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+
+	"github.com/cesanta/errors"
+)
+
+func ioctl(fd int, req uintptr, arg unsafe.Pointer) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), req, uintptr(arg)); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// openPTY creates a pseudo-terminal and returns its master side and
+// the name and descriptor of the slave side, which is put in raw mode.
+func openPTY() (*os.File, string, int, error) {
+	mfd, err := syscall.Open("/dev/ptmx", syscall.O_RDWR|syscall.O_NOCTTY|syscall.O_NONBLOCK|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, "", -1, errors.Annotatef(err, "failed to open /dev/ptmx")
+	}
+	var ptn uint32
+	var unlock int32
+	if err := ioctl(mfd, syscall.TIOCGPTN, unsafe.Pointer(&ptn)); err != nil {
+		syscall.Close(mfd)
+		return nil, "", -1, errors.Annotatef(err, "TIOCGPTN")
+	}
+	if err := ioctl(mfd, syscall.TIOCSPTLCK, unsafe.Pointer(&unlock)); err != nil {
+		syscall.Close(mfd)
+		return nil, "", -1, errors.Annotatef(err, "TIOCSPTLCK")
+	}
+	slaveName := fmt.Sprintf("/dev/pts/%d", ptn)
+	// Slave is kept open so the master does not get hung up on when the
+	// client closes the port.
+	sfd, err := syscall.Open(slaveName, syscall.O_RDWR|syscall.O_NOCTTY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		syscall.Close(mfd)
+		return nil, "", -1, errors.Annotatef(err, "failed to open %s", slaveName)
+	}
+	var t syscall.Termios
+	err = ioctl(sfd, syscall.TCGETS, unsafe.Pointer(&t))
+	if err == nil {
+		t.Iflag &^= syscall.IGNBRK | syscall.BRKINT | syscall.PARMRK | syscall.ISTRIP |
+			syscall.INLCR | syscall.IGNCR | syscall.ICRNL | syscall.IXON
+		t.Oflag &^= syscall.OPOST
+		t.Lflag &^= syscall.ECHO | syscall.ECHONL | syscall.ICANON | syscall.ISIG | syscall.IEXTEN
+		t.Cflag &^= syscall.CSIZE | syscall.PARENB
+		t.Cflag |= syscall.CS8
+		t.Cc[syscall.VMIN], t.Cc[syscall.VTIME] = 1, 0
+		err = ioctl(sfd, syscall.TCSETS, unsafe.Pointer(&t))
+	}
+	if err != nil {
+		syscall.Close(mfd)
+		syscall.Close(sfd)
+		return nil, "", -1, errors.Annotatef(err, "failed to set raw mode")
+	}
+	return os.NewFile(uintptr(mfd), "/dev/ptmx"), slaveName, sfd, nil
+}
+
+type ptyCloser struct {
+	master *os.File
+	sfd    int
+}
+
+func (pc *ptyCloser) Close() error {
+	syscall.Close(pc.sfd)
+	return pc.master.Close()
+}
+
+func (d *Device) listenPTY(ctx context.Context) (*Endpoint, error) {
+	master, slaveName, sfd, err := openPTY()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	d.serveStream(ctx, slaveName, master)
+	return &Endpoint{
+		ConnectAddr: "serial://" + slaveName,
+		closer:      &ptyCloser{master: master, sfd: sfd},
+	}, nil
+}
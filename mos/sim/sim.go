@@ -0,0 +1,448 @@
+//
+// Copyright (c) 2014-2019 Cesanta Software Limited
+// All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Package sim implements a simulated device that serves the standard
+// Mongoose OS RPC services: Sys, Config, FS, OTA and RPC.List.
+// It allows to exercise mos and tools built on top of it without hardware.
+package sim
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cesanta/errors"
+	"github.com/golang/glog"
+
+	"github.com/mongoose-os/mos/common/mgrpc"
+	"github.com/mongoose-os/mos/common/mgrpc/codec"
+	"github.com/mongoose-os/mos/common/mgrpc/frame"
+	"github.com/mongoose-os/mos/mos/dev"
+)
+
+const (
+	// PTYScheme is the scheme of the listen address that makes the device
+	// available as a pseudo-terminal, as if it was attached to a serial port.
+	PTYScheme = "pty"
+
+	deviceFileName = "device.json"
+	fsDirName      = "fs"
+
+	defaultRebootDelay = 100 * time.Millisecond
+)
+
+// Info describes the simulated hardware and the firmware it runs.
+type Info struct {
+	App       string `json:"app"`
+	Arch      string `json:"arch"`
+	FwVersion string `json:"fw_version"`
+	FwID      string `json:"fw_id"`
+	MAC       string `json:"mac"`
+	RAMSize   int64  `json:"ram_size"`
+	FSSize    int64  `json:"fs_size"`
+}
+
+// setDefaults fills the fields that are not set.
+func (info *Info) setDefaults() {
+	if info.App == "" {
+		info.App = "sim"
+	}
+	if info.Arch == "" {
+		info.Arch = "sim"
+	}
+	if info.FwVersion == "" {
+		info.FwVersion = "1.0"
+	}
+	if info.FwID == "" {
+		info.FwID = "20190101-000000"
+	}
+	if info.MAC == "" {
+		info.MAC = "02DEADBEEF01"
+	}
+	if info.RAMSize == 0 {
+		info.RAMSize = 320 * 1024
+	}
+	if info.FSSize == 0 {
+		info.FSSize = 256 * 1024
+	}
+}
+
+// Options configure a simulated device.
+type Options struct {
+	// Info of a fresh device. When the device is loaded from StateDir,
+	// information saved there takes precedence.
+	Info Info
+
+	// StateDir is the directory where device info, config and files are kept.
+	// If empty, the state is kept in memory only.
+	StateDir string
+
+	// Defaults is the default (level 0) configuration.
+	// If nil, a minimal configuration is generated.
+	Defaults map[string]interface{}
+
+	Faults Faults
+
+	// Disabled are the methods the device does not implement, e.g. to
+	// simulate stock firmware that lacks FS.Checksum.
+	Disabled []string
+
+	// NoOTAOffset makes OTA.Status omit the offset, like older firmware does.
+	NoOTAOffset bool
+
+	// FSDirs makes FS.List and FS.ListExt report subdirectories as entries
+	// of zero size instead of the files in them, like LFS does.
+	FSDirs bool
+
+	// NoConfigLevels makes Config.Get and Config.Set ignore the level, like
+	// older firmware does.
+	NoConfigLevels bool
+}
+
+// Registrar is something handlers can be added to, e.g. mgrpc.Server or mgrpc.MgRPC.
+type Registrar interface {
+	AddHandler(method string, handler mgrpc.Handler, opts ...mgrpc.HandlerOption)
+	AddMiddleware(mw mgrpc.Middleware)
+}
+
+// Device is a simulated device.
+type Device struct {
+	opts     Options
+	meta     store
+	files    store
+	handlers map[string]mgrpc.Handler
+
+	lock     sync.Mutex
+	info     Info
+	bootTime time.Time
+	conf     configState
+	ota      otaState
+	// Connections that are dropped when the device reboots.
+	conns map[mgrpc.MgRPC]bool
+	// Connections that survive reboots, e.g. the pseudo-terminal.
+	persistentConns map[mgrpc.MgRPC]bool
+}
+
+// New creates a simulated device. If opts.StateDir is set, the state saved
+// there is loaded.
+func New(opts Options) (*Device, error) {
+	d := &Device{
+		opts:            opts,
+		handlers:        make(map[string]mgrpc.Handler),
+		conns:           make(map[mgrpc.MgRPC]bool),
+		persistentConns: make(map[mgrpc.MgRPC]bool),
+	}
+	if opts.StateDir != "" {
+		meta, err := newDirStore(opts.StateDir)
+		if err != nil {
+			return nil, errors.Annotatef(err, "failed to create state dir")
+		}
+		files, err := newDirStore(filepath.Join(opts.StateDir, fsDirName))
+		if err != nil {
+			return nil, errors.Annotatef(err, "failed to create state dir")
+		}
+		d.meta, d.files = meta, files
+	} else {
+		d.meta, d.files = memStore{}, memStore{}
+	}
+
+	if data, err := d.meta.Get(deviceFileName); err == nil {
+		if err := json.Unmarshal(data, &d.info); err != nil {
+			return nil, errors.Annotatef(err, "invalid %s", deviceFileName)
+		}
+	} else if os.IsNotExist(errors.Cause(err)) {
+		d.info = opts.Info
+	} else {
+		return nil, errors.Trace(err)
+	}
+	d.info.setDefaults()
+	if err := d.saveInfo(); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	defaults := opts.Defaults
+	if defaults == nil {
+		defaults = defaultConfig(&d.info)
+	}
+	if err := d.conf.load(d.meta, defaults); err != nil {
+		return nil, errors.Trace(err)
+	}
+	d.boot()
+
+	d.addSysHandlers()
+	d.addConfigHandlers()
+	d.addFSHandlers()
+	d.addOTAHandlers()
+	d.addMethod("RPC.List", d.rpcList)
+	d.addMethod("RPC.EnableBinary", d.rpcEnableBinary)
+	return d, nil
+}
+
+// Info returns information about the device and the firmware it runs.
+func (d *Device) Info() Info {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.info
+}
+
+// Register installs the handlers of the device and the fault injection
+// middleware on s.
+func (d *Device) Register(s Registrar) {
+	s.AddMiddleware(d.trackConns)
+	s.AddMiddleware(d.opts.Faults.middleware)
+	for method, handler := range d.handlers {
+		s.AddHandler(method, handler)
+	}
+}
+
+// Endpoint is an address the device is reachable at.
+type Endpoint struct {
+	// ConnectAddr is the address to connect to, suitable for the --port flag.
+	ConnectAddr string
+
+	closer io.Closer
+}
+
+// Close stops serving the endpoint.
+func (ep *Endpoint) Close() error {
+	return ep.closer.Close()
+}
+
+// Listen makes the device reachable at the given address, which is either
+// a listener URL accepted by mgrpc.Listen (e.g. tcp://127.0.0.1:8910 or
+// ws://127.0.0.1:8910) or pty:// for a pseudo-terminal.
+func (d *Device) Listen(ctx context.Context, addr string) (*Endpoint, error) {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, errors.Annotatef(err, "invalid address %q", addr)
+	}
+	if u.Scheme == PTYScheme {
+		return d.listenPTY(ctx)
+	}
+	lc, err := mgrpc.ListenerConfigFromURL(addr)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	s, err := mgrpc.Listen(ctx, lc)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	d.Register(s)
+	return &Endpoint{
+		ConnectAddr: fmt.Sprintf("%s://%s", u.Scheme, s.Addr()),
+		closer:      s,
+	}, nil
+}
+
+// serveStream serves RPC over a stream that works like a serial port.
+func (d *Device) serveStream(ctx context.Context, name string, rwc io.ReadWriteCloser) mgrpc.MgRPC {
+	r := mgrpc.Serve(ctx, codec.SerialDevice(name, rwc))
+	d.lock.Lock()
+	d.persistentConns[r] = true
+	d.lock.Unlock()
+	d.Register(r)
+	return r
+}
+
+type rpcError struct {
+	code int
+	msg  string
+}
+
+func (e *rpcError) Error() string {
+	return e.msg
+}
+
+// errorf returns an error that is sent to the caller with the given status code.
+func errorf(code int, format string, args ...interface{}) error {
+	return &rpcError{code: code, msg: fmt.Sprintf(format, args...)}
+}
+
+// parseArgs unmarshals request arguments, if any, into v.
+func parseArgs(args json.RawMessage, v interface{}) error {
+	if len(args) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(args, v); err != nil {
+		return errorf(400, "invalid arguments: %s", err)
+	}
+	return nil
+}
+
+type method func(ctx context.Context, r mgrpc.MgRPC, args json.RawMessage) (interface{}, error)
+
+func (d *Device) addMethod(name string, m method) {
+	for _, dm := range d.opts.Disabled {
+		if dm == name {
+			return
+		}
+	}
+	d.handlers[name] = func(ctx context.Context, r mgrpc.MgRPC, f *frame.Frame) *frame.Frame {
+		args := f.Params
+		if args == nil {
+			args = f.DeprecatedArgs
+		}
+		resp := &frame.Frame{ID: f.ID}
+		res, err := m(ctx, r, args)
+		if err == nil && res != nil {
+			resp.Result, err = json.Marshal(res)
+		}
+		if err != nil {
+			code := 500
+			if re, ok := errors.Cause(err).(*rpcError); ok {
+				code = re.code
+			}
+			glog.V(1).Infof("%s: %d %s", f.Method, code, err)
+			resp.Result = nil
+			resp.Error = &frame.Error{Code: code, Message: err.Error()}
+		}
+		return resp
+	}
+}
+
+func (d *Device) trackConns(next mgrpc.Handler) mgrpc.Handler {
+	return func(ctx context.Context, r mgrpc.MgRPC, f *frame.Frame) *frame.Frame {
+		d.lock.Lock()
+		if !d.persistentConns[r] && !d.conns[r] {
+			for c := range d.conns {
+				if !c.IsConnected() {
+					delete(d.conns, c)
+				}
+			}
+			d.conns[r] = true
+		}
+		d.lock.Unlock()
+		return next(ctx, r, f)
+	}
+}
+
+func (d *Device) saveInfo() error {
+	data, err := json.MarshalIndent(&d.info, "", "  ")
+	if err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(d.meta.Put(deviceFileName, data))
+}
+
+// boot resets the runtime state, as if the device has just been powered up.
+// Must be called with the lock held.
+func (d *Device) boot() {
+	d.bootTime = time.Now()
+	d.conf.boot()
+}
+
+// Reboot simulates device reboot: connections are dropped, unsaved
+// configuration is lost, updated firmware is activated or rolled back.
+func (d *Device) Reboot() {
+	d.lock.Lock()
+	glog.Infof("rebooting")
+	d.otaReboot()
+	d.boot()
+	d.lock.Unlock()
+	d.DropConnections()
+}
+
+// DropConnections simulates loss of connectivity: all the connections are
+// closed, the state of the device is not affected.
+func (d *Device) DropConnections() {
+	d.lock.Lock()
+	conns := d.conns
+	d.conns = make(map[mgrpc.MgRPC]bool)
+	d.lock.Unlock()
+	for c := range conns {
+		c.Disconnect(context.Background())
+	}
+}
+
+func (d *Device) scheduleReboot(delay time.Duration) {
+	time.AfterFunc(delay, d.Reboot)
+}
+
+func (d *Device) addSysHandlers() {
+	d.addMethod("Sys.GetInfo", d.sysGetInfo)
+	d.addMethod("Sys.GetUID", d.sysGetUID)
+	d.addMethod("Sys.Reboot", d.sysReboot)
+}
+
+func (d *Device) sysGetInfo(ctx context.Context, r mgrpc.MgRPC, args json.RawMessage) (interface{}, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	info := d.info
+	fsFree := info.FSSize - d.fsUsed()
+	ramFree := info.RAMSize * 3 / 4
+	ramMinFree := info.RAMSize / 2
+	uptime := int64(time.Since(d.bootTime) / time.Second)
+	return &dev.GetInfoResult{
+		App:        &info.App,
+		Arch:       &info.Arch,
+		Fs_free:    &fsFree,
+		Fs_size:    &info.FSSize,
+		Fw_id:      &info.FwID,
+		Fw_version: &info.FwVersion,
+		Mac:        &info.MAC,
+		RAMFree:    &ramFree,
+		RAMMinFree: &ramMinFree,
+		RAMSize:    &info.RAMSize,
+		Uptime:     &uptime,
+	}, nil
+}
+
+func (d *Device) sysGetUID(ctx context.Context, r mgrpc.MgRPC, args json.RawMessage) (interface{}, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return map[string]string{"uid": strings.ToLower(d.info.MAC)}, nil
+}
+
+func (d *Device) sysReboot(ctx context.Context, r mgrpc.MgRPC, args json.RawMessage) (interface{}, error) {
+	var a struct {
+		DelayMs int64 `json:"delay_ms"`
+	}
+	if err := parseArgs(args, &a); err != nil {
+		return nil, err
+	}
+	delay := defaultRebootDelay
+	if a.DelayMs > 0 {
+		delay = time.Duration(a.DelayMs) * time.Millisecond
+	}
+	d.scheduleReboot(delay)
+	return nil, nil
+}
+
+// rpcEnableBinary makes the connection the request came over send data in
+// binary frames. Like real devices, only serial connections support it.
+func (d *Device) rpcEnableBinary(ctx context.Context, r mgrpc.MgRPC, args json.RawMessage) (interface{}, error) {
+	if err := r.SetCodecOptions(&codec.Options{Serial: codec.SerialCodecOptions{BinaryFrames: true}}); err != nil {
+		return nil, errorf(501, "binary frames are not supported on this connection")
+	}
+	return nil, nil
+}
+
+func (d *Device) rpcList(ctx context.Context, r mgrpc.MgRPC, args json.RawMessage) (interface{}, error) {
+	var methods []string
+	for method := range d.handlers {
+		methods = append(methods, method)
+	}
+	sort.Strings(methods)
+	return methods, nil
+}
@@ -0,0 +1,190 @@
+//
+// Copyright (c) 2014-2019 Cesanta Software Limited
+// All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package sim
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mongoose-os/mos/common/fwbundle"
+	"github.com/mongoose-os/mos/mos/dev"
+	"github.com/mongoose-os/mos/mos/fs"
+)
+
+func TestSimConfig(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	dir, err := ioutil.TempDir("", "sim")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	d, devConn, closeDev := NewTestConn(t, ctx, Options{StateDir: dir})
+	defer closeDev()
+
+	var saved dev.ConfigSetResp
+	if err := devConn.Call(ctx, "Config.Set", &dev.ConfigSetArg{
+		Config: map[string]interface{}{"wifi": map[string]interface{}{"sta": map[string]interface{}{"ssid": "test"}}},
+		Save:   true,
+	}, &saved); err != nil || !saved.Saved {
+		t.Fatalf("%v %+v", err, saved)
+	}
+	if err := devConn.Call(ctx, "Config.Set", &dev.ConfigSetArg{
+		Config:  map[string]interface{}{"debug": map[string]interface{}{"level": 3}},
+		Save:    true,
+		TryOnce: true,
+	}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	getConf := func(level int, key string) string {
+		devConf, err := dev.GetConfigLevel(ctx, devConn, level)
+		if err != nil {
+			t.Fatal(err)
+		}
+		v, err := devConf.Get(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+	for i, want := range []string{"3", "3", "2"} {
+		if i > 0 {
+			d.Reboot()
+			devConn.Disconnect(ctx)
+			if err := devConn.Connect(ctx, false); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if got := getConf(-1, "debug.level"); got != want {
+			t.Errorf("boot %d: got debug.level %s, want %s", i, got, want)
+		}
+		if got := getConf(-1, "wifi.sta.ssid"); got != "test" {
+			t.Errorf("boot %d: got wifi.sta.ssid %q", i, got)
+		}
+		if got := getConf(0, "wifi.sta.ssid"); got != "" {
+			t.Errorf("boot %d: got default wifi.sta.ssid %q", i, got)
+		}
+	}
+
+	// Saved state is loaded by a new instance.
+	d2, err := New(Options{StateDir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := d2.conf.runtime["wifi"].(map[string]interface{})["sta"].(map[string]interface{})["ssid"]; got != "test" {
+		t.Errorf("reloaded wifi.sta.ssid: %v", got)
+	}
+}
+
+func TestSimFS(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	_, devConn, closeDev := NewTestConn(t, ctx, Options{})
+	defer closeDev()
+
+	data := strings.Repeat("0123456789", 200)
+	if err := fs.PutData(ctx, devConn, bytes.NewBufferString(data), "/test.txt"); err != nil {
+		t.Fatal(err)
+	}
+	got, err := fs.GetFile(ctx, devConn, "test.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != data {
+		t.Errorf("got %d bytes, want %d", len(got), len(data))
+	}
+	var files []fs.ListExtResult
+	if err := devConn.Call(ctx, "FS.ListExt", nil, &files); err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || *files[0].Name != "test.txt" || *files[0].Size != int64(len(data)) {
+		t.Errorf("got %+v", files)
+	}
+	name := "test.txt"
+	if err := devConn.Call(ctx, "FS.Remove", &fs.RemoveArgs{Filename: &name}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.GetFile(ctx, devConn, name); err == nil {
+		t.Errorf("expected an error getting a removed file")
+	}
+}
+
+func TestSimOTA(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	d, devConn, closeDev := NewTestConn(t, ctx, Options{})
+	defer closeDev()
+
+	fwb := fwbundle.NewBundle()
+	fwb.Name, fwb.Platform, fwb.Version, fwb.BuildID = "app", "sim", "2.0", "20190202-000000"
+	buf := bytes.NewBuffer(nil)
+	if err := fwbundle.WriteZipFirmwareBytes(fwb, buf, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := devConn.Call(ctx, "OTA.Begin", map[string]int{"size": buf.Len(), "commit_timeout": 60}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := devConn.Call(ctx, "OTA.Write", map[string]interface{}{"offset": 0, "data": buf.Bytes()}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := devConn.Call(ctx, "OTA.End", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(2 * otaRebootDelay)
+	devConn.Disconnect(ctx)
+	if err := devConn.Connect(ctx, false); err != nil {
+		t.Fatal(err)
+	}
+	info, err := dev.GetInfo(ctx, devConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *info.Fw_version != "2.0" || *info.App != "app" {
+		t.Errorf("got %s %s", *info.App, *info.Fw_version)
+	}
+	var st OTAStatus
+	if err := devConn.Call(ctx, "OTA.Status", nil, &st); err != nil || st.IsCommitted {
+		t.Fatalf("%v %+v", err, st)
+	}
+
+	// Reboot without commit rolls back.
+	d.Reboot()
+	if got := d.Info().FwVersion; got != "1.0" {
+		t.Errorf("got version %s after rollback", got)
+	}
+}
+
+func TestSimFaults(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	_, devConn, closeDev := NewTestConn(t, ctx, Options{Faults: Faults{OOMThreshold: 100}})
+	defer closeDev()
+
+	if _, err := dev.GetInfo(ctx, devConn); err != nil {
+		t.Fatal(err)
+	}
+	err := devConn.Call(ctx, "FS.Put", map[string]interface{}{"filename": "a", "data": make([]byte, 100)}, nil)
+	if err == nil || !strings.Contains(err.Error(), messageOOM) {
+		t.Errorf("expected OOM error, got %v", err)
+	}
+}
@@ -0,0 +1,116 @@
+//
+// Copyright (c) 2014-2019 Cesanta Software Limited
+// All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package sim
+
+import (
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/cesanta/errors"
+)
+
+// store keeps named blobs, either in memory or in a directory.
+type store interface {
+	Get(name string) ([]byte, error)
+	Put(name string, data []byte) error
+	Remove(name string) error
+	// List returns names of all the blobs, sorted.
+	List() ([]string, error)
+}
+
+type memStore map[string][]byte
+
+func (ms memStore) Get(name string) ([]byte, error) {
+	data, ok := ms[name]
+	if !ok {
+		return nil, errors.Trace(os.ErrNotExist)
+	}
+	return data, nil
+}
+
+func (ms memStore) Put(name string, data []byte) error {
+	ms[name] = append([]byte(nil), data...)
+	return nil
+}
+
+func (ms memStore) Remove(name string) error {
+	if _, ok := ms[name]; !ok {
+		return errors.Trace(os.ErrNotExist)
+	}
+	delete(ms, name)
+	return nil
+}
+
+func (ms memStore) List() ([]string, error) {
+	var names []string
+	for name := range ms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// dirStore keeps each blob in a file. Names are escaped, so blobs with
+// slashes in their names do not require subdirectories.
+type dirStore string
+
+func newDirStore(dir string) (dirStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", errors.Trace(err)
+	}
+	return dirStore(dir), nil
+}
+
+func (ds dirStore) path(name string) string {
+	return filepath.Join(string(ds), url.PathEscape(name))
+}
+
+func (ds dirStore) Get(name string) ([]byte, error) {
+	data, err := ioutil.ReadFile(ds.path(name))
+	return data, errors.Trace(err)
+}
+
+func (ds dirStore) Put(name string, data []byte) error {
+	return errors.Trace(ioutil.WriteFile(ds.path(name), data, 0644))
+}
+
+func (ds dirStore) Remove(name string) error {
+	return errors.Trace(os.Remove(ds.path(name)))
+}
+
+func (ds dirStore) List() ([]string, error) {
+	infos, err := ioutil.ReadDir(string(ds))
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	var names []string
+	for _, info := range infos {
+		if info.IsDir() {
+			continue
+		}
+		name, err := url.PathUnescape(info.Name())
+		if err != nil {
+			continue
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
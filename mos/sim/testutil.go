@@ -0,0 +1,60 @@
+//
+// Copyright (c) 2014-2019 Cesanta Software Limited
+// All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package sim
+
+import (
+	"context"
+	"time"
+
+	"github.com/mongoose-os/mos/mos/dev"
+)
+
+// TB is the part of testing.TB used by the test helpers below, so that
+// the package does not have to depend on testing.
+type TB interface {
+	Fatal(args ...interface{})
+}
+
+// NewTestEndpoint creates a device and makes it reachable on a random local
+// TCP port. The test fails if that is not possible.
+func NewTestEndpoint(t TB, ctx context.Context, opts Options) (*Device, *Endpoint) {
+	d, err := New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ep, err := d.Listen(ctx, "tcp://127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d, ep
+}
+
+// NewTestConn creates a device like NewTestEndpoint and connects to it.
+// The function returned disconnects and stops the device.
+func NewTestConn(t TB, ctx context.Context, opts Options) (*Device, *dev.MosDevConn, func()) {
+	d, ep := NewTestEndpoint(t, ctx, opts)
+	c := &dev.Client{Timeout: 2 * time.Second}
+	devConn, err := c.CreateDevConn(ctx, ep.ConnectAddr, false)
+	if err != nil {
+		ep.Close()
+		t.Fatal(err)
+	}
+	return d, devConn, func() {
+		devConn.Disconnect(ctx)
+		ep.Close()
+	}
+}
@@ -0,0 +1,484 @@
+//
+// Copyright (c) 2014-2019 Cesanta Software Limited
+// All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Package transfer implements chunked transfers of data to and from the
+// device, used for files and firmware updates.
+//
+// The chunk size adapts to the device: it starts from an estimate based on
+// the amount of free RAM, grows while calls succeed and backs off on
+// timeouts and out of memory errors. After a timeout, it grows back once
+// calls succeed again. Where the transport allows, several requests are kept
+// in flight.
+package transfer
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cesanta/errors"
+	"github.com/golang/glog"
+	flag "github.com/spf13/pflag"
+
+	"github.com/mongoose-os/mos/common/mgrpc"
+	"github.com/mongoose-os/mos/mos/dev"
+	"github.com/mongoose-os/mos/mos/flags"
+)
+
+const (
+	minChunkSize        = 128
+	maxSerialChunkSize  = 512
+	maxNetworkChunkSize = 8192
+	networkWindow       = 4
+
+	// Chunk size is doubled after this many successful calls in a row.
+	growAfter = 4
+	// After a timeout lowers the chunk size cap, it is raised back after this
+	// many successful calls at the cap. The number doubles every time the cap
+	// is lowered, so a size that keeps failing is retried less and less often.
+	raiseCapAfter = 4 * growAfter
+)
+
+// Options of a transfer.
+type Options struct {
+	// ChunkSize is the initial chunk size. If 0, it is estimated from the
+	// amount of free RAM reported by the device.
+	ChunkSize int
+	// MinChunkSize and MaxChunkSize limit the chunk size adjustments.
+	MinChunkSize int
+	MaxChunkSize int
+	// Window is the maximum number of requests in flight.
+	Window int
+	// Retry controls how many times a chunk is tried before giving up and
+	// how long to wait between attempts. Calls made by the transfer are not
+	// retried by the connection.
+	Retry dev.RetryPolicy
+	// Progress, if set, is invoked with the number of bytes transferred so far
+	// every time a chunk is done.
+	Progress func(done int64)
+}
+
+// OptionsFromFlags returns transfer options suitable for devConn.
+// If --chunk-size is given explicitly, the chunk size is not adjusted.
+func OptionsFromFlags(devConn dev.DevConn) Options {
+	opts := Options{
+		MinChunkSize: minChunkSize,
+		MaxChunkSize: maxNetworkChunkSize,
+		Window:       networkWindow,
+		Retry:        dev.RetryPolicyFromFlags(),
+	}
+	if dc, ok := dev.AsMosDevConn(devConn); !ok || dc.IsSerial() {
+		opts.MaxChunkSize = maxSerialChunkSize
+		opts.Window = 1
+	}
+	if flag.CommandLine.Changed("chunk-size") {
+		opts.ChunkSize = *flags.ChunkSize
+		opts.MinChunkSize = *flags.ChunkSize
+		opts.MaxChunkSize = *flags.ChunkSize
+	}
+	return opts
+}
+
+// Stats describe a finished transfer.
+type Stats struct {
+	Bytes     int64
+	Elapsed   time.Duration
+	ChunkSize int
+}
+
+func (s Stats) String() string {
+	rate := 0.0
+	if s.Elapsed > 0 {
+		rate = float64(s.Bytes) / 1024 / s.Elapsed.Seconds()
+	}
+	return fmt.Sprintf("%d bytes in %.2fs (%.2f KB/s, chunk size %d)", s.Bytes, s.Elapsed.Seconds(), rate, s.ChunkSize)
+}
+
+// WriteFunc sends a chunk of data to be stored at the given offset.
+type WriteFunc func(ctx context.Context, offset int64, data []byte) error
+
+// ReadFunc retrieves up to n bytes at the given offset. It returns the data
+// and the number of bytes left after it.
+type ReadFunc func(ctx context.Context, offset int64, n int) (data []byte, left int64, err error)
+
+// ResyncFunc returns the amount of data the device has actually stored.
+// It is used to resume writes after a failure when several chunks were in
+// flight and it is not known which of them made it.
+type ResyncFunc func(ctx context.Context) (int64, error)
+
+// Transfer moves data in chunks of adaptive size. A Transfer can be used for
+// several operations with the same device, the chunk size learned is kept.
+type Transfer struct {
+	devConn dev.DevConn
+	opts    Options
+
+	chunkSize    int
+	maxChunkSize int
+	successes    int
+	// Chunk size the cap can be raised back to. Sizes that ran out of memory
+	// on the device are not tried again.
+	ceiling    int
+	raiseAfter int
+	stats      Stats
+}
+
+// New creates a transfer. If opts.ChunkSize is not set, the device is asked
+// about its free RAM.
+func New(ctx context.Context, devConn dev.DevConn, opts Options) *Transfer {
+	if opts.MinChunkSize <= 0 {
+		opts.MinChunkSize = minChunkSize
+	}
+	if opts.MaxChunkSize < opts.MinChunkSize {
+		opts.MaxChunkSize = opts.MinChunkSize
+	}
+	if opts.Window <= 0 {
+		opts.Window = 1
+	}
+	if opts.Retry.Attempts <= 0 {
+		opts.Retry.Attempts = 1
+	}
+	t := &Transfer{devConn: devConn, opts: opts, maxChunkSize: opts.MaxChunkSize, ceiling: opts.MaxChunkSize}
+	t.chunkSize = opts.ChunkSize
+	if t.chunkSize <= 0 {
+		t.chunkSize = t.probe(ctx)
+	}
+	t.chunkSize = t.clamp(t.chunkSize)
+	glog.V(1).Infof("initial chunk size %d, window %d", t.chunkSize, opts.Window)
+	return t
+}
+
+// NewFromFlags creates a transfer with options from OptionsFromFlags.
+func NewFromFlags(ctx context.Context, devConn dev.DevConn) *Transfer {
+	return New(ctx, devConn, OptionsFromFlags(devConn))
+}
+
+// probe estimates the chunk size from the amount of free RAM: there should be
+// enough to hold the request, which is larger than the chunk itself, and
+// leave plenty for the rest of the firmware.
+func (t *Transfer) probe(ctx context.Context) int {
+	ctx2, cancel := context.WithTimeout(ctx, t.devConn.GetTimeout())
+	defer cancel()
+	var info dev.GetInfoResult
+	if err := t.devConn.Call(ctx2, "Sys.GetInfo", nil, &info); err != nil {
+		glog.Warningf("failed to get device info: %s", err)
+		return *flags.ChunkSize
+	}
+	var free int64
+	switch {
+	case info.RAMFree != nil:
+		free = *info.RAMFree
+	case info.RAMSize != nil:
+		free = *info.RAMSize / 4
+	default:
+		return *flags.ChunkSize
+	}
+	cs := minChunkSize
+	for int64(cs*2) <= free/8 {
+		cs *= 2
+	}
+	glog.V(1).Infof("%d bytes of RAM free, chunk size %d", free, cs)
+	return cs
+}
+
+func (t *Transfer) clamp(cs int) int {
+	if cs > t.maxChunkSize {
+		cs = t.maxChunkSize
+	}
+	if cs < t.opts.MinChunkSize {
+		cs = t.opts.MinChunkSize
+	}
+	return cs
+}
+
+// ChunkSize returns the current chunk size.
+func (t *Transfer) ChunkSize() int {
+	return t.chunkSize
+}
+
+// Stats returns the statistics of the last operation.
+func (t *Transfer) Stats() Stats {
+	return t.stats
+}
+
+func (t *Transfer) succeeded() {
+	t.successes++
+	switch {
+	case t.successes >= growAfter && t.chunkSize < t.maxChunkSize:
+		t.chunkSize = t.clamp(t.chunkSize * 2)
+		t.successes = 0
+		glog.V(1).Infof("chunk size increased to %d", t.chunkSize)
+	case t.successes >= t.raiseAfter && t.maxChunkSize < t.ceiling:
+		// The timeout may have been a temporary condition, try a larger size again.
+		t.maxChunkSize *= 2
+		if t.maxChunkSize > t.ceiling {
+			t.maxChunkSize = t.ceiling
+		}
+		t.chunkSize = t.maxChunkSize
+		t.successes = 0
+		glog.V(1).Infof("chunk size increased to %d", t.chunkSize)
+	}
+}
+
+func (t *Transfer) failed(err error) {
+	t.successes = 0
+	if !isTimeout(err) && !isOOM(err) {
+		return
+	}
+	// Do not try the size that failed again for a while or, if the device
+	// ran out of memory, at all.
+	t.maxChunkSize = t.clamp(t.chunkSize / 2)
+	t.chunkSize = t.maxChunkSize
+	if isOOM(err) {
+		t.ceiling = t.maxChunkSize
+	} else if t.raiseAfter == 0 {
+		t.raiseAfter = raiseCapAfter
+	} else {
+		t.raiseAfter *= 2
+	}
+	glog.Infof("chunk size decreased to %d", t.chunkSize)
+}
+
+func isTimeout(err error) bool {
+	return errors.Cause(err) == context.DeadlineExceeded || dev.RemoteStatus(err) == 408
+}
+
+func isOOM(err error) bool {
+	msg := strings.ToLower(err.Error())
+	return strings.Contains(msg, "out of memory") || dev.RemoteStatus(err) == 413
+}
+
+// request is a call in flight.
+type request struct {
+	offset int64
+	data   []byte
+	n      int
+	left   int64
+	err    error
+
+	sent     chan struct{}
+	sentOnce sync.Once
+	done     chan struct{}
+}
+
+func (req *request) markSent() {
+	req.sentOnce.Do(func() { close(req.sent) })
+}
+
+// start invokes f once prev has been sent, so that requests reach the device
+// in order.
+func (t *Transfer) start(ctx context.Context, prev, req *request, f func(ctx context.Context) error) {
+	req.sent = make(chan struct{})
+	req.done = make(chan struct{})
+	go func() {
+		if prev != nil {
+			select {
+			case <-prev.sent:
+			case <-prev.done:
+			case <-ctx.Done():
+			}
+		}
+		ctx2, cancel := context.WithTimeout(mgrpc.ContextWithSentNotifier(dev.WithoutRetries(ctx), req.markSent), t.devConn.GetTimeout())
+		req.err = f(ctx2)
+		cancel()
+		req.markSent()
+		close(req.done)
+	}()
+}
+
+func wait(queue []*request) {
+	for _, req := range queue {
+		<-req.done
+	}
+}
+
+func (t *Transfer) begin() time.Time {
+	t.stats = Stats{}
+	return time.Now()
+}
+
+func (t *Transfer) end(startTime time.Time, n int64) {
+	t.stats = Stats{Bytes: n, Elapsed: time.Since(startTime), ChunkSize: t.chunkSize}
+	glog.Infof("transferred %s", t.stats)
+}
+
+func (t *Transfer) progress(n int64) {
+	if t.opts.Progress != nil {
+		t.opts.Progress(n)
+	}
+}
+
+// Write sends all the data from r using write, starting at the given offset.
+// If resync is nil, only one chunk is sent at a time.
+func (t *Transfer) Write(ctx context.Context, offset int64, r io.Reader, write WriteFunc, resync ResyncFunc) error {
+	startTime := t.begin()
+	window := t.opts.Window
+	if resync == nil {
+		window = 1
+	}
+	// Data that has been read but has not been acknowledged yet, starting at base.
+	// Of it, numSent bytes have been sent.
+	var buf []byte
+	base := offset
+	numSent, eof := 0, false
+	var queue []*request
+	var prev *request
+	attempt := 1
+	for {
+		for !eof && len(buf)-numSent < t.chunkSize {
+			data := make([]byte, t.chunkSize)
+			n, err := r.Read(data)
+			buf = append(buf, data[:n]...)
+			if err != nil {
+				if errors.Cause(err) != io.EOF {
+					wait(queue)
+					return errors.Trace(err)
+				}
+				eof = true
+			}
+		}
+		if len(queue) < window && numSent < len(buf) {
+			n := t.chunkSize
+			if n > len(buf)-numSent {
+				n = len(buf) - numSent
+			}
+			req := &request{offset: base + int64(numSent), data: buf[numSent : numSent+n]}
+			glog.V(1).Infof("Sending %d @ %d", len(req.data), req.offset)
+			t.start(ctx, prev, req, func(ctx context.Context) error {
+				return write(ctx, req.offset, req.data)
+			})
+			queue = append(queue, req)
+			prev = req
+			numSent += n
+			continue
+		}
+		if len(queue) == 0 {
+			break
+		}
+		req := queue[0]
+		queue = queue[1:]
+		<-req.done
+		if req.err == nil {
+			n := len(req.data)
+			buf, base, numSent = buf[n:], base+int64(n), numSent-n
+			attempt = 1
+			t.succeeded()
+			t.progress(base)
+			continue
+		}
+		// It is not known what happened to the rest of the requests.
+		wait(queue)
+		queue, prev, numSent = nil, nil, 0
+		if attempt >= t.opts.Retry.Attempts || ctx.Err() != nil {
+			return errors.Annotatef(req.err, "write failed at offset %d", req.offset)
+		}
+		glog.Warningf("Error: %s", req.err)
+		t.failed(req.err)
+		if err := t.opts.Retry.Sleep(ctx, attempt); err != nil {
+			return errors.Annotatef(req.err, "write failed at offset %d", req.offset)
+		}
+		attempt++
+		if resync != nil {
+			ctx2, cancel := context.WithTimeout(ctx, t.devConn.GetTimeout())
+			stored, err := resync(ctx2)
+			cancel()
+			if err != nil {
+				return errors.Annotatef(err, "failed to resume after %s", req.err)
+			}
+			if stored < base || stored > base+int64(len(buf)) {
+				return errors.Errorf("cannot resume at offset %d, expected %d..%d", stored, base, base+int64(len(buf)))
+			}
+			buf, base = buf[stored-base:], stored
+		}
+	}
+	t.end(startTime, base-offset)
+	return nil
+}
+
+// Read retrieves data using read, starting at the given offset, until there
+// is none left and writes it to w.
+func (t *Transfer) Read(ctx context.Context, offset int64, w io.Writer, read ReadFunc) error {
+	startTime := t.begin()
+	// Offset of the next request and of the end of the data received.
+	start, done := offset, offset
+	// Size is not known until the first response.
+	size := int64(-1)
+	var queue []*request
+	var prev *request
+	attempt := 1
+	for {
+		canSend := len(queue) == 0 && size < 0 ||
+			len(queue) < t.opts.Window && size >= 0 && offset < size
+		if canSend {
+			req := &request{offset: offset, n: t.chunkSize}
+			if size >= 0 && int64(req.n) > size-offset {
+				req.n = int(size - offset)
+			}
+			glog.V(1).Infof("Getting %d @ %d", req.n, req.offset)
+			t.start(ctx, prev, req, func(ctx context.Context) error {
+				var err error
+				req.data, req.left, err = read(ctx, req.offset, req.n)
+				return err
+			})
+			queue = append(queue, req)
+			prev = req
+			offset += int64(req.n)
+			continue
+		}
+		if len(queue) == 0 {
+			break
+		}
+		req := queue[0]
+		queue = queue[1:]
+		<-req.done
+		if req.err != nil {
+			wait(queue)
+			queue, prev, offset = nil, nil, done
+			if attempt >= t.opts.Retry.Attempts || ctx.Err() != nil {
+				return errors.Annotatef(req.err, "read failed at offset %d", req.offset)
+			}
+			glog.Warningf("Error: %s", req.err)
+			t.failed(req.err)
+			if err := t.opts.Retry.Sleep(ctx, attempt); err != nil {
+				return errors.Annotatef(req.err, "read failed at offset %d", req.offset)
+			}
+			attempt++
+			continue
+		}
+		if len(req.data) == 0 && req.left > 0 {
+			wait(queue)
+			return errors.Errorf("no data at offset %d, %d bytes left", req.offset, req.left)
+		}
+		if _, err := w.Write(req.data); err != nil {
+			wait(queue)
+			return errors.Trace(err)
+		}
+		done += int64(len(req.data))
+		size = done + req.left
+		attempt = 1
+		t.succeeded()
+		t.progress(done)
+		if len(req.data) < req.n || req.left == 0 {
+			// Short read, or the end: requests that follow are of no use.
+			wait(queue)
+			queue, prev, offset = nil, nil, done
+		}
+	}
+	t.end(startTime, done-start)
+	return nil
+}
@@ -0,0 +1,109 @@
+//
+// Copyright (c) 2014-2019 Cesanta Software Limited
+// All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package transfer_test
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cesanta/errors"
+
+	"github.com/mongoose-os/mos/mos/dev"
+	"github.com/mongoose-os/mos/mos/fs"
+	"github.com/mongoose-os/mos/mos/sim"
+	"github.com/mongoose-os/mos/mos/transfer"
+)
+
+func TestTransferAdaptsToDevice(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	_, devConn, closeDev := sim.NewTestConn(t, ctx, sim.Options{Faults: sim.Faults{OOMThreshold: 6000}})
+	defer closeDev()
+
+	opts := transfer.OptionsFromFlags(devConn)
+	xfer := transfer.New(ctx, devConn, opts)
+	if got, want := xfer.ChunkSize(), opts.MaxChunkSize; got != want {
+		t.Errorf("initial chunk size: got %d, want %d", got, want)
+	}
+
+	data := strings.Repeat("0123456789abcdef", 4000)
+	if err := xfer.Write(ctx, 0, strings.NewReader(data), func(ctx context.Context, offset int64, chunk []byte) error {
+		return devConn.Call(ctx, "FS.Put", map[string]interface{}{
+			"filename": "test.txt", "append": offset > 0, "data": chunk,
+		}, nil)
+	}, func(ctx context.Context) (int64, error) {
+		var files []fs.ListExtResult
+		err := devConn.Call(ctx, "FS.ListExt", nil, &files)
+		if err != nil || len(files) == 0 {
+			return 0, err
+		}
+		return *files[0].Size, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if cs := xfer.ChunkSize(); cs >= opts.MaxChunkSize || cs < opts.MinChunkSize {
+		t.Errorf("chunk size was not adjusted: %d", cs)
+	}
+	if st := xfer.Stats(); st.Bytes != int64(len(data)) || st.Elapsed <= 0 {
+		t.Errorf("unexpected stats: %+v", st)
+	}
+
+	var got bytes.Buffer
+	if err := fs.GetData(ctx, devConn, "test.txt", &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.String() != data {
+		t.Errorf("got %d bytes, want %d", got.Len(), len(data))
+	}
+}
+
+func TestTransferChunkSizeRecovers(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	_, devConn, closeDev := sim.NewTestConn(t, ctx, sim.Options{})
+	defer closeDev()
+
+	data := strings.Repeat("0123456789abcdef", 2000)
+	for _, c := range []struct {
+		err  error
+		want int
+	}{
+		// A timeout may be temporary, the chunk size grows back.
+		{context.DeadlineExceeded, 1024},
+		// The device does not have memory for chunks of this size.
+		{errors.Errorf("out of memory"), 512},
+	} {
+		opts := transfer.Options{ChunkSize: 1024, MinChunkSize: 128, MaxChunkSize: 1024, Retry: dev.RetryPolicy{Attempts: 2}}
+		xfer := transfer.New(ctx, devConn, opts)
+		failed := false
+		if err := xfer.Write(ctx, 0, strings.NewReader(data), func(ctx context.Context, offset int64, chunk []byte) error {
+			if !failed {
+				failed = true
+				return c.err
+			}
+			return nil
+		}, nil); err != nil {
+			t.Fatal(err)
+		}
+		if got := xfer.ChunkSize(); got != c.want {
+			t.Errorf("%s: got chunk size %d, want %d", c.err, got, c.want)
+		}
+	}
+}